@@ -0,0 +1,64 @@
+package crammd5
+
+import (
+	"testing"
+
+	"github.com/mesos/mesos-go/auth/callback"
+	"github.com/mesos/mesos-go/auth/sasl/mech"
+	"github.com/stretchr/testify/assert"
+)
+
+func credentials(name, secret string) callback.Handler {
+	return callback.HandlerFunc(func(cb ...callback.Interface) error {
+		for _, c := range cb {
+			switch c := c.(type) {
+			case *callback.Name:
+				c.Set(name)
+			case *callback.Password:
+				c.Set([]byte(secret))
+			default:
+				return &callback.Unsupported{Callback: c}
+			}
+		}
+		return nil
+	})
+}
+
+func TestChallengeResponse(t *testing.T) {
+	// test vector of RFC 2195
+	m, step, err := newInstance(credentials("tim", "tanstaaftanstaaf"))
+	assert.NoError(t, err)
+	step, data, err := step(m, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	step, data, err = step(m, []byte("<1896.697170952@postoffice.reston.mci.net>"))
+	assert.NoError(t, err)
+	assert.Nil(t, step)
+	assert.Equal(t, "tim b913a602c7eda7a495b4e6e7334d3890", string(data))
+}
+
+func TestChallengeResponseErrors(t *testing.T) {
+	m, _, err := newInstance(credentials("tim", "tanstaaftanstaaf"))
+	assert.NoError(t, err)
+	_, data, err := challengeResponse(m, nil)
+	assert.Equal(t, challengeDataRequired, err)
+	assert.Nil(t, data)
+
+	// the credentials could not be obtained.
+	m, _, err = newInstance(callback.HandlerFunc(func(cb ...callback.Interface) error {
+		return &callback.Unsupported{Callback: cb[0]}
+	}))
+	assert.NoError(t, err)
+	next, data, err := challengeResponse(m, []byte("<1896.697170952@postoffice.reston.mci.net>"))
+	assert.IsType(t, &callback.Unsupported{}, err)
+	assert.Nil(t, data)
+	_, _, err = next(m, nil)
+	assert.Equal(t, mech.IllegalStateErr, err)
+}
+
+func TestRegistered(t *testing.T) {
+	name, factory := mech.SelectSupported([]string{"PLAIN", Name})
+	assert.Equal(t, Name, name)
+	assert.NotNil(t, factory)
+}
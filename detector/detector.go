@@ -19,14 +19,86 @@
 package detector
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 )
 
+// MasterChanged is notified every time a new leading master is
+// elected, and with nil when the leading master is gone before another
+// one is elected.
+type MasterChanged interface {
+	OnMasterChanged(*mesos.MasterInfo)
+}
+
+// OnMasterChanged adapter function type to facade the MasterChanged
+// interface.
+type OnMasterChanged func(*mesos.MasterInfo)
+
+func (fn OnMasterChanged) OnMasterChanged(m *mesos.MasterInfo) {
+	fn(m)
+}
+
 // An abstraction of a Master detector which can be used to
 // detect the leading master from a group.
-type MasterDetector interface {
+type Detector interface {
 	// Detect new master election. Every time a new master is
-	// elected, the detector will call the passed function.
+	// elected, the detector will notify the passed MasterChanged.
 	// If it fails to start detection, then an error is returned.
-	Detect(func(*mesos.MasterInfo)) error
+	Detect(MasterChanged) error
+
+	// Stop detection and release the resources held by the detector,
+	// the observer is not notified anymore. Stop may be called more
+	// than once.
+	Stop() error
+}
+
+// New returns the Detector implementation matching the given spec:
+// zk://host1:port1,host2:port2/path uses ZooKeeper to detect the
+// leading master, while host:port designates a single, static master.
+// file:///path reads either from the file, once, see FileMasterDetector.
+func New(spec string) (Detector, error) {
+	if strings.HasPrefix(spec, "zk://") {
+		return NewZkMasterDetector(spec)
+	}
+	if strings.HasPrefix(spec, "file://") {
+		return NewFileMasterDetector(strings.TrimPrefix(spec, "file://"), 0)
+	}
+	info, err := CreateMasterInfo(spec)
+	if err != nil {
+		return nil, err
+	}
+	detector := NewStandaloneMasterDetector()
+	detector.Appoint(info)
+	return detector, nil
+}
+
+// CreateMasterInfo builds a MasterInfo for a master listening at the
+// given host:port address.
+func CreateMasterInfo(hostport string) (*mesos.MasterInfo, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid master address %q: %v", hostport, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid master port %q: %v", portStr, err)
+	}
+
+	// MasterInfo.ip is packed in network byte order, see libprocess.
+	var ip uint32
+	if addr := net.ParseIP(host).To4(); addr != nil {
+		ip = uint32(addr[0]) | uint32(addr[1])<<8 | uint32(addr[2])<<16 | uint32(addr[3])<<24
+	}
+	return &mesos.MasterInfo{
+		Id:       proto.String(""),
+		Ip:       proto.Uint32(ip),
+		Port:     proto.Uint32(uint32(port)),
+		Pid:      proto.String("master@" + hostport),
+		Hostname: proto.String(host),
+	}, nil
 }
@@ -20,5 +20,11 @@
 The detector package houses implementation of master detectors.
 The default implementation is the zookeeper master detector.
 It uses zookeeper to detect the lead Mesos master during startup/failover.
+
+A process running several scheduler drivers against the same masters can
+share one detector, hence one zookeeper session, between them with Shared.
+Every driver gets its own handle: its observer only receives the masters
+detected while it is registered, and stopping it leaves the other handles
+running. The underlying detector is stopped with the last handle.
 */
 package detector
@@ -0,0 +1,140 @@
+package detector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// FileMasterDetector detects the leading master from the spec written in
+// a file, host:port or zk://host1:port1,host2:port2/path, like the
+// --master=file:///path of the mesos slave. The file may be read again
+// periodically to pick up a new spec.
+type FileMasterDetector struct {
+	path     string
+	poll     time.Duration // 0 reads the file once
+	lock     sync.Mutex
+	spec     string   // last read from the file
+	detector Detector // of spec
+	observer MasterChanged
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFileMasterDetector creates a detector of the spec written in the
+// file at path. It fails if the file cannot be read or the spec is
+// invalid. The file is read again every poll once detection starts,
+// unless poll is 0.
+func NewFileMasterDetector(path string, poll time.Duration) (*FileMasterDetector, error) {
+	spec, err := readMasterFile(path)
+	if err != nil {
+		return nil, err
+	}
+	detector, err := newFileDetector(path, spec)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMasterDetector{
+		path:     path,
+		poll:     poll,
+		spec:     spec,
+		detector: detector,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func readMasterFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the master from %s: %v", path, err)
+	}
+	spec := strings.TrimSpace(string(b))
+	if spec == "" {
+		return "", fmt.Errorf("No master in %s", path)
+	}
+	return spec, nil
+}
+
+// newFileDetector creates the detector of the spec read from the file at
+// path.
+func newFileDetector(path, spec string) (Detector, error) {
+	if strings.HasPrefix(spec, "file://") {
+		return nil, fmt.Errorf("Invalid master %q in %s: a file cannot point to another file", spec, path)
+	}
+	detector, err := New(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid master %q in %s: %v", spec, path, err)
+	}
+	return detector, nil
+}
+
+// Detect starts the detection of the spec of the file, and of the new
+// spec every time the file changes if it is polled.
+func (d *FileMasterDetector) Detect(obs MasterChanged) error {
+	d.lock.Lock()
+	d.observer = obs
+	detector := d.detector
+	d.lock.Unlock()
+	if err := detector.Detect(obs); err != nil {
+		return err
+	}
+	if d.poll > 0 {
+		go d.pollLoop()
+	}
+	return nil
+}
+
+func (d *FileMasterDetector) pollLoop() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-time.After(d.poll):
+		}
+		spec, err := readMasterFile(d.path)
+		if err != nil {
+			log.Warningf("Keeping master %q: %v\n", d.spec, err)
+			continue
+		}
+		if spec != d.spec {
+			d.changed(spec)
+		}
+	}
+}
+
+// changed replaces the detector of the previous spec with one of spec.
+func (d *FileMasterDetector) changed(spec string) {
+	detector, err := newFileDetector(d.path, spec)
+	if err != nil {
+		log.Warningf("Keeping master %q: %v\n", d.spec, err)
+		return
+	}
+	log.Infof("Master changed from %q to %q in %s\n", d.spec, spec, d.path)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	if err := d.detector.Stop(); err != nil {
+		log.Warningf("Failed to stop the detector of master %q: %v\n", d.spec, err)
+	}
+	d.spec, d.detector = spec, detector
+	if err := detector.Detect(d.observer); err != nil {
+		log.Errorf("Failed to detect master %q: %v\n", spec, err)
+	}
+}
+
+// Stop stops polling the file and the detection of its spec.
+func (d *FileMasterDetector) Stop() error {
+	d.stopOnce.Do(func() { close(d.done) })
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.detector.Stop()
+}
@@ -0,0 +1,96 @@
+package detector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// masterFile writes contents to a temporary file, removed by the
+// returned func.
+func masterFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "mesos-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "master")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func expectMasterPid(t *testing.T, detected chan *mesos.MasterInfo, pid string) {
+	select {
+	case m := <-detected:
+		assert.Equal(t, pid, m.GetPid())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master %s.", pid)
+	}
+}
+
+func TestFileDetectorNew(t *testing.T) {
+	path, remove := masterFile(t, "127.0.0.1:5050\n")
+	defer remove()
+
+	d, err := New("file://" + path)
+	assert.NoError(t, err)
+	_, ok := d.(*FileMasterDetector)
+	assert.True(t, ok)
+	obs, detected := masterObserver()
+	assert.NoError(t, d.Detect(obs))
+	expectMasterPid(t, detected, "master@127.0.0.1:5050")
+	assert.NoError(t, d.Stop())
+
+	path, remove = masterFile(t, zkurl)
+	defer remove()
+	fd, err := NewFileMasterDetector(path, 0)
+	assert.NoError(t, err)
+	_, ok = fd.detector.(*ZkMasterDetector)
+	assert.True(t, ok)
+}
+
+func TestFileDetectorInvalid(t *testing.T) {
+	_, err := NewFileMasterDetector("/nonexistent/master", 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to read the master from /nonexistent/master")
+
+	for _, contents := range []string{"", "127.0.0.1", "zk:///mesos", "file:///etc/master"} {
+		path, remove := masterFile(t, contents)
+		_, err = NewFileMasterDetector(path, 0)
+		if assert.Error(t, err, contents) {
+			assert.Contains(t, err.Error(), path)
+		}
+		remove()
+	}
+}
+
+func TestFileDetectorPoll(t *testing.T) {
+	path, remove := masterFile(t, "127.0.0.1:5050")
+	defer remove()
+
+	d, err := NewFileMasterDetector(path, 10*time.Millisecond)
+	assert.NoError(t, err)
+	obs, detected := masterObserver()
+	assert.NoError(t, d.Detect(obs))
+	expectMasterPid(t, detected, "master@127.0.0.1:5050")
+
+	// the new master is detected once the file changes, an invalid one
+	// is ignored.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("127.0.0.1"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, detected)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("127.0.0.2:5051"), 0644))
+	expectMasterPid(t, detected, "master@127.0.0.2:5051")
+
+	// no more changes once stopped.
+	assert.NoError(t, d.Stop())
+	assert.NoError(t, ioutil.WriteFile(path, []byte("127.0.0.3:5052"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, detected)
+}
@@ -1,74 +1,454 @@
 package detector
 
-// import (
-// 	mesos "github.com/mesos/mesos-go/mesosproto"
-// 	"github.com/mesos/mesos-go/zookeeper"
-// 	"github.com/stretchr/testify/assert"
-// 	"net/url"
-// 	"testing"
-// )
-
-// var zkurl = "zk://127.0.0.1:2181/mesos"
-// var zkurl_bad = "zk://127.0.0.1:2181"
-
-// func TestMasterDetectorNew(t *testing.T) {
-// 	md, err := NewZkMasterDetector(zkurl)
-// 	assert.NoError(t, err)
-// 	assert.Equal(t, 1, len(md.zkHosts))
-// 	u, _ := url.Parse(zkurl)
-// 	assert.True(t, u.String() == md.url.String())
-// 	assert.Equal(t, "/mesos", md.zkPath)
-// }
-
-// func TestMasterDetectorDetect(t *testing.T) {
-// 	md, err := NewZkMasterDetector(zkurl)
-// 	assert.NoError(t, err)
-// 	mockClient := createClient(newMasterWatcher(md))
-// 	md.zkClient = zookeeper.ZkClient(mockClient)
-
-// 	md.Detect(func(master *mesos.MasterInfo) {
-// 		println("Hello!")
-// 	})
-
-// }
-
-// type testDataNode string
-
-// func (n testDataNode) Data() ([]byte, error) {
-// 	return []byte("Hello"), nil
-// }
-
-// func (n testDataNode) List() ([]zookeeper.ZkNode, error) {
-// 	return []zookeeper.ZkNode{
-// 		testDataNode("info_001"),
-// 		testDataNode("info_002"),
-// 		testDataNode("info_003"),
-// 	}, nil
-// }
-
-// func (n testDataNode) String() string {
-// 	return string(n)
-// }
-
-// func createClient(watcher zookeeper.ZkWatcher) *zookeeper.ZkClientConnector {
-// 	c := zookeeper.NewZkClientConnector()
-// 	conn := NewMockZkConnector()
-// 	conn.On("Close").Return(nil)
-// 	conn.On("ChildrenW", path).Return([]string{path}, &zk.Stat{}, chEvent, nil)
-// 	conn.On("Children").Return([]string{"x", "a", "d"}, &zk.Stat{}, nil)
-// 	conn.On("Get", path).Return([]byte("Hello"), &zk.Stat{}, nil)
-// 	c.Conn = conn
-// 	c.connected = true
-// 	c.rootNode = NewZkPath(c, path)
-// 	return c
-
-// 	// c := zookeeper.New()
-// 	// c.Connected = true
-// 	// c.Watcher = watcher
-// 	// c.WatchChildren("/mesos")
-// 	// c.On("Connect").Return(nil)
-// 	// c.On("WatchChildren").Return(nil)
-// 	// c.On("Disconnect").Return()
-
-// 	// return c
-// }
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+var zkurl = "zk://127.0.0.1:2181,127.0.0.2:2181/mesos"
+
+func TestMasterDetectorNew(t *testing.T) {
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:2181", "127.0.0.2:2181"}, md.client.hosts)
+	assert.Equal(t, "/mesos", md.client.rootPath)
+
+	_, err = NewZkMasterDetector("http://127.0.0.1:2181/mesos")
+	assert.Error(t, err)
+	_, err = NewZkMasterDetector("zk:///mesos")
+	assert.Error(t, err)
+	_, err = NewZkMasterDetector("zk://127.0.0.1:zk/mesos")
+	assert.Error(t, err)
+}
+
+func TestMasterDetectorChroot(t *testing.T) {
+	md, err := NewZkMasterDetector("zk://127.0.0.1:2181/chroot/mesos/")
+	assert.NoError(t, err)
+	assert.Equal(t, "/chroot/mesos", md.client.rootPath)
+
+	ch := make(chan zk.Event, 1)
+	data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("ChildrenW", "/chroot/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil)
+	conn.On("Get", "/chroot/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+	conn.On("GetW", "/chroot/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	md.client.conn = conn
+	md.client.setConnected(true)
+
+	detected := make(chan *mesos.MasterInfo, 1)
+	err = md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+
+	select {
+	case m := <-detected:
+		assert.Equal(t, "master(1)", m.GetId())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master detection.")
+	}
+}
+
+func TestMasterDetectorNewWithCredentials(t *testing.T) {
+	md, err := NewZkMasterDetector("zk://mesos:s%40cret@127.0.0.1:2181/mesos")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:2181"}, md.client.hosts)
+	assert.Equal(t, []zkAuth{{"digest", []byte("mesos:s@cret")}}, md.client.auth)
+
+	md, err = NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+	assert.Empty(t, md.client.auth)
+}
+
+func TestMasterDetectorNewURLs(t *testing.T) {
+	for _, tc := range []struct {
+		url   string
+		hosts []string
+		path  string
+		auth  []zkAuth
+	}{
+		{"zk://h1:2181,h2/mesos", []string{"h1:2181", "h2:2181"}, "/mesos", nil},
+		{"zk://h1:2182,h2:2183", []string{"h1:2182", "h2:2183"}, "/", nil},
+		{"zk://[::1]:2181,[::2]:2181/mesos", []string{"[::1]:2181", "[::2]:2181"}, "/mesos", nil},
+		{"zk://[::1],h2:2182/chroot/mesos", []string{"[::1]:2181", "h2:2182"}, "/chroot/mesos", nil},
+		{"zk://mesos:secret@h1,[::2]:2182/mesos", []string{"h1:2181", "[::2]:2182"}, "/mesos",
+			[]zkAuth{{"digest", []byte("mesos:secret")}}},
+		{"zk://mesos:s@cret@h1/mesos", []string{"h1:2181"}, "/mesos", []zkAuth{{"digest", []byte("mesos:s@cret")}}},
+		{"zk://mesos@h1/mesos", []string{"h1:2181"}, "/mesos", []zkAuth{{"digest", []byte("mesos:")}}},
+	} {
+		md, err := NewZkMasterDetector(tc.url)
+		if !assert.NoError(t, err, tc.url) {
+			continue
+		}
+		assert.Equal(t, tc.hosts, md.client.hosts, tc.url)
+		assert.Equal(t, tc.path, md.client.rootPath, tc.url)
+		assert.Equal(t, tc.auth, md.client.auth, tc.url)
+	}
+
+	for _, url := range []string{
+		"127.0.0.1:2181/mesos",
+		"zk://",
+		"zk://h1,,h2/mesos",
+		"zk://h1:2181,h2:0/mesos",
+		"zk://[::1]:zk/mesos",
+		"zk://[::1]:2181],h2/mesos",
+		"zk://mesos:secret@/mesos",
+		"zk://mesos:s%zzcret@h1/mesos",
+	} {
+		_, err := NewZkMasterDetector(url)
+		assert.Error(t, err, url)
+	}
+}
+
+func TestMasterDetectorDetect(t *testing.T) {
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+
+	ch := make(chan zk.Event, 1)
+	data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"log_replicas", "info_0000000002", "info_0000000001"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	md.client.conn = conn
+	md.client.setConnected(true)
+
+	detected := make(chan *mesos.MasterInfo, 1)
+	err = md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+
+	select {
+	case m := <-detected:
+		assert.Equal(t, "master(1)", m.GetId())
+		assert.Equal(t, uint32(5050), m.GetPort())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master detection.")
+	}
+
+	// unchanged leader is not reported twice.
+	ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: "/mesos"}
+	select {
+	case m := <-detected:
+		t.Fatalf("Unexpected master detected: %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestMasterDetectorLeaderLost(t *testing.T) {
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+
+	ch := make(chan zk.Event, 1)
+	data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil).Once()
+	conn.On("Children").Return([]string{"log_replicas"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	md.client.conn = conn
+	md.client.setConnected(true)
+
+	detected := make(chan *mesos.MasterInfo, 2)
+	err = md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+
+	select {
+	case m := <-detected:
+		assert.Equal(t, "master(1)", m.GetId())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master detection.")
+	}
+
+	// the leader node is deleted, no master is leading.
+	ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: "/mesos"}
+	select {
+	case m := <-detected:
+		assert.Nil(t, m)
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for the lost leader.")
+	}
+
+	// the loss is reported once.
+	ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: "/mesos"}
+	select {
+	case m := <-detected:
+		t.Fatalf("Unexpected master detected: %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestMasterDetectorLeaderDataChanged(t *testing.T) {
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+
+	ch := make(chan zk.Event, 1)
+	dataCh := make(chan zk.Event, 1)
+	before, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	after, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5051))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000001").Return(before, &zk.Stat{}, nil).Once()
+	conn.On("Get", "/mesos/info_0000000001").Return(after, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000001").Return(before, &zk.Stat{}, (<-chan zk.Event)(dataCh), nil)
+	md.client.conn = conn
+	md.client.setConnected(true)
+
+	detected := make(chan *mesos.MasterInfo, 2)
+	err = md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+
+	for _, port := range []uint32{5050, 5051} {
+		select {
+		case m := <-detected:
+			assert.Equal(t, "master(1)", m.GetId())
+			assert.Equal(t, port, m.GetPort())
+		case <-time.After(time.Millisecond * 700):
+			t.Fatalf("Waited too long for master detection.")
+		}
+		if port == 5050 {
+			// the leader updates its MasterInfo in place.
+			dataCh <- zk.Event{Type: zk.EventNodeDataChanged, Path: "/mesos/info_0000000001"}
+		}
+	}
+}
+
+func TestDetectorNew(t *testing.T) {
+	d, err := New(zkurl)
+	assert.NoError(t, err)
+	_, ok := d.(*ZkMasterDetector)
+	assert.True(t, ok)
+
+	d, err = New("127.0.0.1:5050")
+	assert.NoError(t, err)
+	_, ok = d.(*StandaloneMasterDetector)
+	assert.True(t, ok)
+
+	var detected *mesos.MasterInfo
+	err = d.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected = m
+	}))
+	assert.NoError(t, err)
+	assert.NotNil(t, detected)
+	assert.Equal(t, "master@127.0.0.1:5050", detected.GetPid())
+	assert.Equal(t, uint32(5050), detected.GetPort())
+	assert.Equal(t, uint32(0x0100007f), detected.GetIp())
+
+	_, err = New("127.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestStandaloneDetectorAppoint(t *testing.T) {
+	d := NewStandaloneMasterDetector()
+	detected := make(chan *mesos.MasterInfo, 1)
+	err := d.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(detected))
+
+	d.Appoint(util.NewMasterInfo("master(2)", 123456, 5051))
+	m := <-detected
+	assert.Equal(t, "master(2)", m.GetId())
+}
+
+func TestSelectTopNode(t *testing.T) {
+	assert.Equal(t, "", selectTopNode(nil))
+	assert.Equal(t, "", selectTopNode([]string{"log_replicas", "info_abc"}))
+	assert.Equal(t, "info_0000000003", selectTopNode([]string{"json.info_0000000004", "info_0000000003", "log_replicas"}))
+	assert.Equal(t, "json.info_0000000002", selectTopNode([]string{"info_0000000003", "json.info_0000000002", "info_0000000005"}))
+}
+
+func TestSelectTopNodeNumericOrder(t *testing.T) {
+	// lexically info_10 < info_9 and 10000000000 < 9999999999.
+	assert.Equal(t, "info_9", selectTopNode([]string{"info_10", "info_9", "info_11"}))
+	assert.Equal(t, "json.info_9999999999", selectTopNode([]string{"json.info_10000000000", "json.info_9999999999"}))
+}
+
+func TestNodeSequence(t *testing.T) {
+	seq, ok := nodeSequence("info_0000000042")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), seq)
+	seq, ok = nodeSequence("json.info_10000000000")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10000000000), seq)
+	seq, ok = nodeSequence("lock-7")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), seq)
+	_, ok = nodeSequence("log_replicas")
+	assert.False(t, ok)
+	_, ok = nodeSequence("")
+	assert.False(t, ok)
+}
+
+func TestParseMasterInfo(t *testing.T) {
+	data := []byte(`{"address":{"hostname":"master-1","ip":"10.0.0.1","port":5050},` +
+		`"hostname":"master-1","id":"20150101-000000-16777226-5050-1","ip":16777226,` +
+		`"pid":"master@10.0.0.1:5050","port":5050,"version":"0.25.0"}`)
+	m, err := parseMasterInfo("json.info_0000000002", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "20150101-000000-16777226-5050-1", m.GetId())
+	assert.Equal(t, uint32(16777226), m.GetIp())
+	assert.Equal(t, uint32(5050), m.GetPort())
+	assert.Equal(t, "master@10.0.0.1:5050", m.GetPid())
+	assert.Equal(t, "master-1", m.GetHostname())
+
+	data, err = proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5051))
+	assert.NoError(t, err)
+	m, err = parseMasterInfo("info_0000000001", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "master(1)", m.GetId())
+	assert.Equal(t, uint32(5051), m.GetPort())
+
+	_, err = parseMasterInfo("json.info_0000000002", []byte("not-json"))
+	assert.Error(t, err)
+}
+
+func TestMasterDetectorDetectJSON(t *testing.T) {
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+
+	ch := make(chan zk.Event, 1)
+	legacy, err := proto.Marshal(util.NewMasterInfo("legacy", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000009", "json.info_0000000007", "log_replicas"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000009").Return(legacy, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/json.info_0000000007").Return([]byte(`{"id":"modern","ip":123456,"port":5050}`), &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/json.info_0000000007").Return([]byte{}, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	md.client.conn = conn
+	md.client.setConnected(true)
+
+	detected := make(chan *mesos.MasterInfo, 1)
+	err = md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	}))
+	assert.NoError(t, err)
+
+	select {
+	case m := <-detected:
+		assert.Equal(t, "modern", m.GetId())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master detection.")
+	}
+}
+
+func TestStandaloneDetectorStop(t *testing.T) {
+	d := NewStandaloneMasterDetector()
+	detected := make(chan *mesos.MasterInfo, 1)
+	assert.NoError(t, d.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	})))
+	assert.NoError(t, d.Stop())
+	assert.NoError(t, d.Stop())
+
+	d.Appoint(util.NewMasterInfo("master(2)", 123456, 5051))
+	assert.Equal(t, 0, len(detected))
+}
+
+func TestMasterDetectorStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 2; i++ { // a new detector works after Stop
+		md, err := NewZkMasterDetector(zkurl)
+		assert.NoError(t, err)
+
+		ch := make(chan zk.Event, 1)
+		data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+		assert.NoError(t, err)
+		conn := NewMockZkConnector()
+		conn.On("Close").Return()
+		conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+		conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil)
+		conn.On("Get", "/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+		conn.On("GetW", "/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+		md.client.conn = conn
+		md.client.setConnected(true)
+
+		detected := make(chan *mesos.MasterInfo, 1)
+		assert.NoError(t, md.Detect(OnMasterChanged(func(m *mesos.MasterInfo) {
+			detected <- m
+		})))
+		<-detected
+
+		assert.NoError(t, md.Stop())
+		assert.NoError(t, md.Stop())
+		conn.AssertNumberOfCalls(t, "Close", 1)
+		assert.False(t, md.client.isConnected())
+	}
+	assertNoGoroutineLeak(t, before)
+}
+
+// assertNoGoroutineLeak waits for the number of goroutines to drop back
+// to the given count.
+func TestMasterDetectorDetectContextCancelled(t *testing.T) {
+	before := runtime.NumGoroutine()
+	md, err := NewZkMasterDetector(zkurl)
+	assert.NoError(t, err)
+
+	ch := make(chan zk.Event, 1)
+	data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("Close").Return()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	md.client.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		sessionCh := make(chan zk.Event, 1)
+		sessionCh <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		return conn, sessionCh, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	detected := make(chan *mesos.MasterInfo, 1)
+	assert.NoError(t, md.DetectContext(ctx, OnMasterChanged(func(m *mesos.MasterInfo) {
+		detected <- m
+	})))
+	<-detected
+
+	// cancel while the children and leader data are watched.
+	cancel()
+	assertNoGoroutineLeak(t, before)
+	conn.AssertNumberOfCalls(t, "Close", 1)
+
+	_, err = md.client.list("/mesos")
+	assert.Equal(t, errZkClientStopped, err)
+	_, err = md.client.data("/mesos/info_0000000001")
+	assert.Equal(t, errZkClientStopped, err)
+	assert.Equal(t, errZkClientStopped, md.client.watchChildren("."))
+	assert.Equal(t, errZkClientStopped, md.client.connect())
+}
+
+func assertNoGoroutineLeak(t *testing.T, count int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leaked %d goroutines", runtime.NumGoroutine()-count)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
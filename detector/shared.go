@@ -0,0 +1,170 @@
+package detector
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// newDetector creates the detectors shared by Shared, replaced by tests.
+var newDetector = New
+
+// the shared detectors of the process, key:normalized spec.
+var sharedDetectors = struct {
+	sync.Mutex
+	detectors map[string]*sharedDetector
+}{detectors: make(map[string]*sharedDetector)}
+
+// SharedDetector is a handle on a Detector shared by the users of the
+// same spec in a process, see Shared. A single detector, hence a single
+// ZooKeeper session, serves all the handles.
+//
+// Each handle has its own observer: the observer passed to Detect is
+// notified of the leading masters detected from then on, starting with
+// the current one if it is already known, until the handle is stopped.
+// Stopping a handle does not affect the others, the shared detector is
+// stopped with the last handle. A handle must not be used after Stop.
+type SharedDetector struct {
+	shared   *sharedDetector
+	stopOnce sync.Once
+}
+
+// sharedDetector fans out the notifications of a detector to the
+// observers of its handles.
+type sharedDetector struct {
+	spec       string
+	detector   Detector
+	refs       int        // open handles, guarded by sharedDetectors
+	startLock  sync.Mutex // serializes the start of the detector
+	started    bool       // guarded by startLock
+	notifyLock sync.Mutex // serializes the notifications, keeping their order
+	leader     *mesos.MasterInfo
+	lock       sync.Mutex                        // guards observers
+	observers  map[*SharedDetector]MasterChanged // key:handle
+}
+
+// Shared returns a new handle on the detector of spec shared by the
+// process, see SharedDetector. The detector is created, as by New, for
+// the first handle. Specs naming the same ZooKeeper hosts in any order,
+// or the same path with a trailing slash, share the same detector.
+func Shared(spec string) (*SharedDetector, error) {
+	key := normalizeSpec(spec)
+
+	sharedDetectors.Lock()
+	defer sharedDetectors.Unlock()
+	sd, ok := sharedDetectors.detectors[key]
+	if !ok {
+		d, err := newDetector(spec)
+		if err != nil {
+			return nil, err
+		}
+		sd = &sharedDetector{
+			spec:      key,
+			detector:  d,
+			observers: make(map[*SharedDetector]MasterChanged),
+		}
+		sharedDetectors.detectors[key] = sd
+		log.V(2).Infoln("Created shared detector for", key)
+	}
+	sd.refs++
+	return &SharedDetector{shared: sd}, nil
+}
+
+// normalizeSpec returns the key of the detector of spec, the hosts of a
+// zk:// URL are sorted, with their port, and its path cleaned.
+func normalizeSpec(spec string) string {
+	spec = strings.TrimSpace(spec)
+	if !strings.HasPrefix(spec, "zk://") {
+		return spec
+	}
+	hosts, path, auth, err := parseZkURL(spec)
+	if err != nil {
+		return spec // New reports the error.
+	}
+	for i, host := range hosts {
+		if h, err := validateZkHost(host); err == nil {
+			hosts[i] = h
+		}
+	}
+	sort.Strings(hosts)
+	key := "zk://"
+	for _, a := range auth {
+		key += string(a.credential) + "@"
+	}
+	return key + strings.Join(hosts, ",") + zkPath(path)
+}
+
+// Detect registers the observer of the handle, the shared detector is
+// started by the first handle to call Detect.
+func (h *SharedDetector) Detect(obs MasterChanged) error {
+	sd := h.shared
+	sd.notifyLock.Lock()
+	sd.lock.Lock()
+	sd.observers[h] = obs
+	sd.lock.Unlock()
+	if obs != nil && sd.leader != nil {
+		obs.OnMasterChanged(sd.leader)
+	}
+	sd.notifyLock.Unlock()
+	return sd.start()
+}
+
+func (sd *sharedDetector) start() error {
+	sd.startLock.Lock()
+	defer sd.startLock.Unlock()
+	if sd.started {
+		return nil
+	}
+	// the detector may notify the leader before returning.
+	if err := sd.detector.Detect(OnMasterChanged(sd.masterChanged)); err != nil {
+		return err
+	}
+	sd.started = true
+	return nil
+}
+
+// Stop unregisters the observer of the handle, the shared detector is
+// stopped once all its handles are. Stop may be called more than once.
+func (h *SharedDetector) Stop() (err error) {
+	h.stopOnce.Do(func() {
+		sd := h.shared
+		sd.lock.Lock()
+		delete(sd.observers, h)
+		sd.lock.Unlock()
+
+		sharedDetectors.Lock()
+		sd.refs--
+		last := sd.refs == 0
+		if last {
+			delete(sharedDetectors.detectors, sd.spec)
+		}
+		sharedDetectors.Unlock()
+
+		if last {
+			log.V(2).Infoln("Stopping shared detector for", sd.spec)
+			err = sd.detector.Stop()
+		}
+	})
+	return err
+}
+
+func (sd *sharedDetector) masterChanged(m *mesos.MasterInfo) {
+	sd.notifyLock.Lock()
+	defer sd.notifyLock.Unlock()
+	sd.leader = m
+	sd.lock.Lock()
+	observers := make([]MasterChanged, 0, len(sd.observers))
+	for _, obs := range sd.observers {
+		if obs != nil {
+			observers = append(observers, obs)
+		}
+	}
+	sd.lock.Unlock()
+
+	for _, obs := range observers {
+		obs.OnMasterChanged(m)
+	}
+}
@@ -0,0 +1,131 @@
+package detector
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSpec(t *testing.T) {
+	assert.Equal(t, "zk://127.0.0.1:2181,127.0.0.2:2181/mesos", normalizeSpec("zk://127.0.0.2:2181,127.0.0.1:2181/mesos/"))
+	assert.Equal(t, "zk://127.0.0.1:2181,127.0.0.2:2181/mesos", normalizeSpec(" "+zkurl))
+	assert.Equal(t, "zk://[::1]:2181,h2:2181/mesos", normalizeSpec("zk://h2,[::1]:2181/mesos"))
+	assert.Equal(t, "127.0.0.1:5050", normalizeSpec("127.0.0.1:5050 "))
+}
+
+// masterObserver records the masters notified to a driver.
+func masterObserver() (MasterChanged, chan *mesos.MasterInfo) {
+	detected := make(chan *mesos.MasterInfo, 4)
+	return OnMasterChanged(func(m *mesos.MasterInfo) { detected <- m }), detected
+}
+
+func expectMaster(t *testing.T, detected chan *mesos.MasterInfo, id string) {
+	select {
+	case m := <-detected:
+		assert.Equal(t, id, m.GetId())
+	case <-time.After(time.Millisecond * 700):
+		t.Fatalf("Waited too long for master %s.", id)
+	}
+}
+
+func TestSharedDetector(t *testing.T) {
+	ch := make(chan zk.Event, 1)
+	data, err := proto.Marshal(util.NewMasterInfo("master(1)", 123456, 5050))
+	assert.NoError(t, err)
+	data2, err := proto.Marshal(util.NewMasterInfo("master(2)", 123456, 5050))
+	assert.NoError(t, err)
+	conn := NewMockZkConnector()
+	conn.On("Close").Return()
+	conn.On("ChildrenW", "/mesos").Return([]string{}, &zk.Stat{}, (<-chan zk.Event)(ch), nil)
+	conn.On("Children").Return([]string{"info_0000000001"}, &zk.Stat{}, nil).Once()
+	conn.On("Children").Return([]string{"info_0000000002"}, &zk.Stat{}, nil)
+	conn.On("Get", "/mesos/info_0000000001").Return(data, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000001").Return(data, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+	conn.On("Get", "/mesos/info_0000000002").Return(data2, &zk.Stat{}, nil)
+	conn.On("GetW", "/mesos/info_0000000002").Return(data2, &zk.Stat{}, (<-chan zk.Event)(make(chan zk.Event)), nil)
+
+	var created, connected int32
+	defer func(fn func(string) (Detector, error)) { newDetector = fn }(newDetector)
+	newDetector = func(spec string) (Detector, error) {
+		atomic.AddInt32(&created, 1)
+		md, err := NewZkMasterDetector(spec)
+		if err != nil {
+			return nil, err
+		}
+		md.client.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+			atomic.AddInt32(&connected, 1)
+			sessionCh := make(chan zk.Event, 1)
+			sessionCh <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+			return conn, sessionCh, nil
+		})
+		return md, nil
+	}
+
+	// two drivers of the process detect the master of the same ensemble.
+	d1, err := Shared(zkurl)
+	assert.NoError(t, err)
+	d2, err := Shared("zk://127.0.0.2:2181,127.0.0.1:2181/mesos/")
+	assert.NoError(t, err)
+	assert.True(t, d1.shared == d2.shared)
+
+	obs1, detected1 := masterObserver()
+	assert.NoError(t, d1.Detect(obs1))
+	expectMaster(t, detected1, "master(1)")
+	obs2, detected2 := masterObserver()
+	assert.NoError(t, d2.Detect(obs2))
+	expectMaster(t, detected2, "master(1)")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&created))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connected))
+
+	// each driver is notified of a new leader.
+	ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: "/mesos"}
+	expectMaster(t, detected1, "master(2)")
+	expectMaster(t, detected2, "master(2)")
+
+	// the first driver stops, the session stays open for the second.
+	assert.NoError(t, d1.Stop())
+	assert.NoError(t, d1.Stop())
+	conn.AssertNotCalled(t, "Close")
+	assert.Equal(t, 0, len(detected1))
+
+	// the last driver stops, the session is closed.
+	assert.NoError(t, d2.Stop())
+	conn.AssertNumberOfCalls(t, "Close", 1)
+	sharedDetectors.Lock()
+	assert.Empty(t, sharedDetectors.detectors)
+	sharedDetectors.Unlock()
+
+	// a new handle gets a new detector.
+	d3, err := Shared(zkurl)
+	assert.NoError(t, err)
+	assert.False(t, d3.shared == d1.shared)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&created))
+	assert.NoError(t, d3.Stop())
+}
+
+func TestSharedStandaloneDetector(t *testing.T) {
+	d1, err := Shared("127.0.0.1:5050")
+	assert.NoError(t, err)
+	d2, err := Shared("127.0.0.1:5050")
+	assert.NoError(t, err)
+	defer d2.Stop()
+
+	obs1, detected1 := masterObserver()
+	assert.NoError(t, d1.Detect(obs1))
+	expectMaster(t, detected1, "")
+	assert.NoError(t, d1.Stop())
+
+	// the detector was not stopped by the first handle.
+	obs2, detected2 := masterObserver()
+	assert.NoError(t, d2.Detect(obs2))
+	expectMaster(t, detected2, "")
+
+	_, err = Shared("127.0.0.1")
+	assert.Error(t, err)
+}
@@ -1,37 +1,56 @@
 package detector
 
 import (
+	"sync"
+
 	log "github.com/golang/glog"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 )
 
+// StandaloneMasterDetector is a Detector for a single, well known
+// master. The leading master is appointed explicitly.
 type StandaloneMasterDetector struct {
-	ch chan *mesos.MasterInfo
+	lock     sync.Mutex
+	leader   *mesos.MasterInfo
+	observer MasterChanged
 }
 
 // Create a new stand alone master detector.
 func NewStandaloneMasterDetector() *StandaloneMasterDetector {
-	return &StandaloneMasterDetector{make(chan *mesos.MasterInfo)}
+	return &StandaloneMasterDetector{}
 }
 
 // Trigger a master detected event.
 func (s *StandaloneMasterDetector) Appoint(m *mesos.MasterInfo) {
-	log.V(2).Infoln("Appoint")
-	s.ch <- m
+	log.V(2).Infoln("Appoint", m.GetPid())
+	s.lock.Lock()
+	s.leader = m
+	obs := s.observer
+	s.lock.Unlock()
+
+	if obs != nil {
+		obs.OnMasterChanged(m)
+	}
 }
 
-// Detecting the new master.
-func (s *StandaloneMasterDetector) Detect(receiver chan *mesos.MasterInfo) error {
-	// go func() {
-	// 	for {
-	// 		receiver <- s.ch
-	// 		log.V(2).Infoln("Master detected")
-	// 	}
-	// }()
+// Detecting the new master. The observer is notified right away if
+// a master has already been appointed.
+func (s *StandaloneMasterDetector) Detect(obs MasterChanged) error {
+	s.lock.Lock()
+	s.observer = obs
+	leader := s.leader
+	s.lock.Unlock()
+
+	if obs != nil && leader != nil {
+		obs.OnMasterChanged(leader)
+	}
 	return nil
 }
 
-// Stop the detection.
-func (s *StandaloneMasterDetector) Stop() {
-	close(s.ch)
+// Stop forgets the observer, subsequent appointments are not reported.
+func (s *StandaloneMasterDetector) Stop() error {
+	s.lock.Lock()
+	s.observer = nil
+	s.lock.Unlock()
+	return nil
 }
@@ -18,109 +18,260 @@
 
 package detector
 
-// import (
-// 	"code.google.com/p/gogoprotobuf/proto"
-// 	log "github.com/golang/glog"
-// 	mesos "github.com/mesos/mesos-go/mesosproto"
-// 	"github.com/mesos/mesos-go/zookeeper"
-
-// 	"net/url"
-// )
-
-// // ------------------ MasterWatcher ------------------- //
-// type masterWatcher struct {
-// 	detector *ZkMasterDetector
-// }
-
-// func newMasterWatcher(md *ZkMasterDetector) *masterWatcher {
-// 	return &masterWatcher{detector: md}
-// }
-
-// func (w *masterWatcher) Connected(zkClient zookeeper.ZkClient) {
-
-// }
-
-// func (w *masterWatcher) ChildrenChanged(c zookeeper.ZkClient, node zookeeper.ZkNode) {
-// 	list, err := node.List()
-// 	if err != nil {
-// 		log.Errorf("Unable to retrieve children list for %s\n", node.String())
-// 		return
-// 	}
-// 	if len(list) == 0 {
-// 		log.Errorf("Node %s has no children\n", node.String())
-// 		return
-// 	}
-
-// 	// list is sorted (ascending).  So, first element is leader.
-// 	leaderNode := list[0]
-// 	if w.detector.leaderNode != nil && w.detector.leaderNode.String() == leaderNode.String() {
-// 		log.V(2).Infof("Ignoring ChildrenChanged event for node %s, leader has not changed.", node.String())
-// 		return
-// 	}
-
-// 	w.detector.leaderNode = leaderNode
-// 	data, err := leaderNode.Data()
-// 	if err != nil {
-// 		log.Errorln("Unable to retrieve leader data:", err.Error())
-// 		return
-// 	}
-// 	masterInfo := new(mesos.MasterInfo)
-// 	err = proto.Unmarshal(data, masterInfo)
-// 	if err != nil {
-// 		log.Errorln("Unable to unmarshall MasterInfo data from zookeeper.")
-// 		return
-// 	}
-
-// 	if w.detector.detectedFunc != nil {
-// 		w.detector.detectedFunc(masterInfo)
-// 	}
-// }
-
-// func (w *masterWatcher) Error(err error) {
-
-// }
-
-// // ZkMasterDetector uses ZooKeeper to detect new leading master.
-// type ZkMasterDetector struct {
-// 	zkPath       string
-// 	zkHosts      []string
-// 	zkClient     *zookeeper.ZkClientConnector
-// 	leaderNode   zookeeper.ZkNode
-// 	url          *url.URL
-// 	nodePrefix   string
-// 	detectedFunc func(*mesos.MasterInfo)
-// }
-
-// // Internal constructor function
-// func NewZkMasterDetector(zkurls string) (*ZkMasterDetector, error) {
-// 	u, err := url.Parse(zkurls)
-// 	if err != nil {
-// 		log.Fatalln("Failed to parse url", err)
-// 		return nil, err
-// 	}
-
-// 	detector := new(ZkMasterDetector)
-// 	detector.url = u
-// 	detector.zkHosts = append(detector.zkHosts, u.Host)
-// 	detector.zkPath = u.Path
-// 	detector.nodePrefix = "info_"
-// 	detector.zkClient = zookeeper.NewZkClientConnector()
-
-// 	log.V(2).Infoln("Created new detector, watching ", detector.zkHosts, detector.zkPath)
-// 	return detector, nil
-// }
-
-// func (md *ZkMasterDetector) Detect(f func(*mesos.MasterInfo)) error {
-// 	md.detectedFunc = f
-
-// 	err := md.zkClient.Connect(md.zkHosts, md.zkPath, newMasterWatcher(md))
-// 	if err != nil {
-// 		return err
-// 	}
-// 	err = md.zkClient.WatchChildren(".") // watch the current path (speci)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	return nil
-// }
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"golang.org/x/net/context"
+)
+
+const (
+	// prefixes of the znodes created by mesos masters for leader election.
+	// Legacy masters store a protobuf MasterInfo, modern ones store JSON.
+	nodePrefix     = "info_"
+	nodeJSONPrefix = "json.info_"
+)
+
+// ZkMasterDetector uses ZooKeeper to detect new leading master.
+type ZkMasterDetector struct {
+	client     *zkClient
+	lock       sync.Mutex
+	leaderNode string
+	observer   MasterChanged
+}
+
+// Create a new ZooKeeper master detector from a zk://host1,host2/path URL.
+// Credentials in the URL, zk://user:pass@host1,host2/path, are added to the
+// session with the digest scheme.
+func NewZkMasterDetector(zkurls string) (*ZkMasterDetector, error) {
+	hosts, path, auth, err := parseZkURL(zkurls)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newZkClient(hosts, path, auth...)
+	if err != nil {
+		return nil, err
+	}
+
+	detector := &ZkMasterDetector{client: client}
+	client.childrenWatcher = zkChildrenWatcherFunc(detector.childrenChanged)
+	client.dataWatcher = zkDataWatcherFunc(detector.dataChanged)
+	log.V(2).Infoln("Created new detector, watching", client.hosts, client.rootPath)
+	return detector, nil
+}
+
+// parseZkURL splits a zk://[user:pass@]host1[:port],host2[:port]/path URL
+// into its hosts, path and credentials. It is not parsed as a URL: the
+// hosts may be IPv6 literals and only some of them have a port, e.g.
+// zk://[::1]:2181,[::2]/mesos. The hosts are validated by newZkClient.
+func parseZkURL(zkurls string) (hosts []string, path string, auth []zkAuth, err error) {
+	rest := strings.TrimPrefix(zkurls, "zk://")
+	if rest == zkurls {
+		scheme := zkurls
+		if i := strings.Index(zkurls, "://"); i >= 0 {
+			scheme = zkurls[:i]
+		}
+		return nil, "", nil, fmt.Errorf("Unsupported url scheme %q, expected zk://", scheme)
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, path = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		// zk://user:pass@host/path, used for digest ACLs.
+		user, password := rest[:i], ""
+		if j := strings.Index(user, ":"); j >= 0 {
+			user, password = user[:j], user[j+1:]
+		}
+		if user, err = url.PathUnescape(user); err == nil {
+			password, err = url.PathUnescape(password)
+		}
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("Failed to parse the credentials of url %q: %v", zkurls, err)
+		}
+		auth = append(auth, zkAuth{scheme: "digest", credential: []byte(user + ":" + password)})
+		rest = rest[i+1:]
+	}
+	if rest == "" {
+		return nil, "", nil, fmt.Errorf("Failed to parse url %q: no zookeeper hosts", zkurls)
+	}
+	return strings.Split(rest, ","), path, auth, nil
+}
+
+// SetConnectTimeout sets the timeout for connecting to ZooKeeper and
+// confirming the connection, 5s by default. Ensembles reached over a WAN
+// may need a longer timeout. Call it before Detect.
+func (md *ZkMasterDetector) SetConnectTimeout(timeout time.Duration) {
+	md.client.setConnectTimeout(timeout)
+}
+
+// Detect connects to ZooKeeper and watches the master group, the
+// observer is notified of the current leader and every subsequent
+// leader change.
+func (md *ZkMasterDetector) Detect(obs MasterChanged) error {
+	return md.DetectContext(context.Background(), obs)
+}
+
+// DetectContext is like Detect, cancelling ctx stops the detector as if
+// Stop were called.
+func (md *ZkMasterDetector) DetectContext(ctx context.Context, obs MasterChanged) error {
+	md.client.stopOnDone(ctx)
+
+	md.lock.Lock()
+	md.observer = obs
+	md.lock.Unlock()
+
+	if err := md.client.connect(); err != nil {
+		return err
+	}
+	if err := md.client.watchChildren("."); err != nil {
+		return err
+	}
+	md.childrenChanged(md.client, md.client.rootPath)
+	return nil
+}
+
+// Stop closes the ZooKeeper session and terminates the watches.
+func (md *ZkMasterDetector) Stop() error {
+	md.lock.Lock()
+	md.observer = nil
+	md.leaderNode = ""
+	md.lock.Unlock()
+	return md.client.stop()
+}
+
+func (md *ZkMasterDetector) childrenChanged(zkc *zkClient, path string) {
+	list, err := zkc.list(path)
+	if err != nil {
+		log.Errorf("Unable to retrieve children list for %s: %v\n", path, err)
+		return
+	}
+
+	leaderNode := selectTopNode(list)
+	if leaderNode == "" {
+		log.Errorf("Node %s has no master children\n", path)
+		md.lock.Lock()
+		lost := md.leaderNode != ""
+		md.leaderNode = ""
+		obs := md.observer
+		md.lock.Unlock()
+		// the leader is gone and no master took over yet.
+		if lost && obs != nil {
+			obs.OnMasterChanged(nil)
+		}
+		return
+	}
+
+	md.lock.Lock()
+	if md.leaderNode == leaderNode {
+		md.lock.Unlock()
+		log.V(2).Infof("Ignoring children changed event for node %s, leader has not changed.", path)
+		return
+	}
+	md.leaderNode = leaderNode
+	obs := md.observer
+	md.lock.Unlock()
+
+	// the leader may update its MasterInfo in place.
+	if !zkc.watchingData(leaderNode) {
+		if err := zkc.watchData(leaderNode); err != nil {
+			log.Errorf("Unable to watch leader data for %s: %v\n", leaderNode, err)
+		}
+	}
+	md.notify(zkc, zkPath(path, leaderNode), leaderNode, obs)
+}
+
+func (md *ZkMasterDetector) dataChanged(zkc *zkClient, path string) {
+	md.lock.Lock()
+	leaderNode := md.leaderNode
+	obs := md.observer
+	md.lock.Unlock()
+
+	if leaderNode == "" || path != zkc.watchPath(leaderNode) {
+		log.V(2).Infof("Ignoring data changed event for node %s, it is not the leader.", path)
+		return
+	}
+	md.notify(zkc, path, leaderNode, obs)
+}
+
+// notify reads the MasterInfo of the leader at path and passes it to obs.
+func (md *ZkMasterDetector) notify(zkc *zkClient, path, leaderNode string, obs MasterChanged) {
+	data, err := zkc.data(path)
+	if err != nil {
+		log.Errorln("Unable to retrieve leader data:", err.Error())
+		return
+	}
+	masterInfo, err := parseMasterInfo(leaderNode, data)
+	if err != nil {
+		log.Errorln("Unable to unmarshall MasterInfo data from zookeeper:", err)
+		return
+	}
+
+	if obs != nil {
+		obs.OnMasterChanged(masterInfo)
+	}
+}
+
+// nodeSequence extracts the trailing sequence number that zookeeper
+// appends to an ephemeral sequential node, regardless of the node prefix.
+// The number is not zero padded beyond 10 digits so it must be compared
+// numerically, not lexically.
+func nodeSequence(node string) (uint64, bool) {
+	i := len(node)
+	for i > 0 && node[i-1] >= '0' && node[i-1] <= '9' {
+		i--
+	}
+	if i == len(node) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(node[i:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// masterSequence returns the sequence number of a master group znode,
+// ok is false if the node was not created by a mesos master.
+func masterSequence(node string) (seq uint64, ok bool) {
+	if !strings.HasPrefix(node, nodeJSONPrefix) && !strings.HasPrefix(node, nodePrefix) {
+		return 0, false
+	}
+	return nodeSequence(node)
+}
+
+// selectTopNode returns the name of the master node with the lowest
+// sequence number, which is the leader, or "" if there is none. The
+// children list is sorted lexically by zkClient.list, which can't be
+// relied upon once sequence numbers differ in width.
+func selectTopNode(list []string) (node string) {
+	var min uint64
+	for _, n := range list {
+		seq, ok := masterSequence(n)
+		if ok && (node == "" || seq < min) {
+			node, min = n, seq
+		}
+	}
+	return node
+}
+
+// parseMasterInfo decodes the data of a master node, JSON for
+// json.info_ nodes and protobuf for legacy info_ nodes.
+func parseMasterInfo(node string, data []byte) (*mesos.MasterInfo, error) {
+	masterInfo := new(mesos.MasterInfo)
+	if strings.HasPrefix(node, nodeJSONPrefix) {
+		if err := json.Unmarshal(data, masterInfo); err != nil {
+			return nil, err
+		}
+	} else if err := proto.Unmarshal(data, masterInfo); err != nil {
+		return nil, err
+	}
+	return masterInfo, nil
+}
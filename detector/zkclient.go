@@ -5,10 +5,19 @@ import (
 	"fmt"
 	log "github.com/golang/glog"
 	"github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+	"net"
+	pathpkg "path"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// errZkClientStopped is returned by the operations of a stopped client.
+var errZkClientStopped = errors.New("Zookeeper client is stopped.")
+
 // zkChildrenWatcher interface for handling watcher event
 // when zk.EventNodeChildrenChanged.
 type zkChildrenWatcher interface {
@@ -22,6 +31,19 @@ func (fn zkChildrenWatcherFunc) childrenChanged(zkc *zkClient, path string) {
 	fn(zkc, path)
 }
 
+// zkDataWatcher interface for handling watcher event
+// when zk.EventNodeDataChanged.
+type zkDataWatcher interface {
+	dataChanged(*zkClient, string)
+}
+
+// zkDataWatcherFunc adapter function type to facade the interface.
+type zkDataWatcherFunc func(*zkClient, string)
+
+func (fn zkDataWatcherFunc) dataChanged(zkc *zkClient, path string) {
+	fn(zkc, path)
+}
+
 // zkErrorWatcher interface for handling errors.
 type zkErrorWatcher interface {
 	errorOccured(*zkClient, error)
@@ -34,44 +56,164 @@ func (fn zkErrorWatcherFunc) errorOccured(zkc *zkClient, err error) {
 	fn(zkc, err)
 }
 
+// zkConnFactory creates the connection to the zookeeper ensemble.
+type zkConnFactory interface {
+	create(hosts []string, timeout time.Duration) (zkConnector, <-chan zk.Event, error)
+}
+
+// zkConnFactoryFunc adapter function to facade zkConnFactory.
+type zkConnFactoryFunc func([]string, time.Duration) (zkConnector, <-chan zk.Event, error)
+
+func (fn zkConnFactoryFunc) create(hosts []string, timeout time.Duration) (zkConnector, <-chan zk.Event, error) {
+	return fn(hosts, timeout)
+}
+
+var defaultConnFactory = zkConnFactoryFunc(func(hosts []string, timeout time.Duration) (zkConnector, <-chan zk.Event, error) {
+	conn, ch, err := zk.Connect(hosts, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, ch, nil
+})
+
+// default timeout for connecting to the ensemble and confirming the
+// connection.
+const defaultZkConnTimeout = 5 * time.Second
+
+// port of the ensemble hosts that do not specify one.
+const defaultZkPort = "2181"
+
+// initial delay between reconnection attempts after a session expired,
+// doubled on every failed attempt up to the connection timeout.
+const zkReconnectBackoff = 100 * time.Millisecond
+
+// zkAuth is the authentication info added to a zookeeper session, e.g.
+// scheme "digest" with credential "user:password".
+type zkAuth struct {
+	scheme     string
+	credential []byte
+}
+
 type zkClient struct {
+	lock            sync.Mutex // guards stopCh, conn, connected, closed and watches
 	conn            zkConnector
+	connFactory     zkConnFactory
 	hosts           []string
 	connTimeout     time.Duration
 	connected       bool
+	closed          bool          // stopped for good, don't reconnect
+	done            chan struct{} // closed once stopped for good
 	stopCh          chan bool
 	rootPath        string
+	watches         map[string]struct{} // paths passed to watchChildren
+	dataWatches     map[string]struct{} // paths passed to watchData
+	auth            []zkAuth            // added to every session before watching
 	childrenWatcher zkChildrenWatcher
+	dataWatcher     zkDataWatcher
 	errorWatcher    zkErrorWatcher
 }
 
-func newZkClient(hosts []string, path string) (*zkClient, error) {
-	zkc := new(zkClient)
-	zkc.hosts = hosts
-	zkc.connTimeout = time.Second * 5
-	zkc.rootPath = path
+func newZkClient(hosts []string, path string, auth ...zkAuth) (*zkClient, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("No zookeeper hosts given.")
+	}
+	validHosts := make([]string, len(hosts))
+	for i, host := range hosts {
+		h, err := validateZkHost(host)
+		if err != nil {
+			return nil, err
+		}
+		validHosts[i] = h
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("Invalid zookeeper path %q, expected an absolute path.", path)
+	}
 
-	// TODO: validate  URIs
+	zkc := new(zkClient)
+	zkc.hosts = validHosts
+	zkc.auth = auth
+	zkc.connTimeout = defaultZkConnTimeout
+	zkc.rootPath = zkPath(path) // may include a chroot, e.g. /chroot/mesos
+	zkc.stopCh = make(chan bool)
+	zkc.done = make(chan struct{})
+	zkc.watches = make(map[string]struct{})
+	zkc.dataWatches = make(map[string]struct{})
+	zkc.connFactory = defaultConnFactory
 	return zkc, nil
 }
 
+// validateZkHost returns host as host:port, the port defaults to 2181.
+func validateZkHost(host string) (string, error) {
+	if host == "" {
+		return "", errors.New("Invalid zookeeper host, the host is empty.")
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// no port, e.g. zk1, [::1] or ::1.
+		name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), defaultZkPort
+		if strings.Contains(name, ":") && net.ParseIP(name) == nil {
+			return "", fmt.Errorf("Invalid zookeeper host %q: %v", host, err)
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("Invalid zookeeper host %q, the host name is empty.", host)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("Invalid zookeeper host %q, the port must be a number between 1 and 65535.", host)
+	}
+	return net.JoinHostPort(name, port), nil
+}
+
+// setConnectTimeout sets the timeout for connecting to the ensemble and
+// confirming the connection, a timeout <= 0 restores the default. It
+// applies from the next connection attempt on.
+func (zkc *zkClient) setConnectTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultZkConnTimeout
+	}
+	zkc.lock.Lock()
+	zkc.connTimeout = timeout
+	zkc.lock.Unlock()
+}
+
+func (zkc *zkClient) connectTimeout() time.Duration {
+	zkc.lock.Lock()
+	defer zkc.lock.Unlock()
+	return zkc.connTimeout
+}
+
 func (zkc *zkClient) connect() error {
-	if zkc.connected {
+	if zkc.stopped() {
+		return errZkClientStopped
+	}
+	if zkc.isConnected() {
 		return nil
 	}
 
-	conn, ch, err := zk.Connect(zkc.hosts, zkc.connTimeout)
+	timeout := zkc.connectTimeout()
+	conn, ch, err := zkc.connFactory.create(zkc.hosts, timeout)
 	if err != nil {
 		return err
 	}
 
+	zkc.lock.Lock()
 	zkc.conn = conn
+	select {
+	case <-zkc.stopCh:
+		// reconnecting after a disconnect.
+		zkc.stopCh = make(chan bool)
+	default:
+	}
+	stopCh := zkc.stopCh
+	zkc.lock.Unlock()
 
 	// make sure connection succeeds: wait for conn notification.
 	waitConnCh := make(chan struct{})
 	go func() {
 		for {
 			select {
+			case <-stopCh:
+				return
 			case e := <-ch:
 				if e.Err != nil {
 					log.Errorf("Received state error: %s", e.Err.Error())
@@ -84,19 +226,26 @@ func (zkc *zkClient) connect() error {
 					log.Infoln("Connecting to zookeeper...")
 
 				case zk.StateConnected:
-					zkc.connected = true
+					zkc.setConnected(true)
 					log.Infoln("Connected to zookeeper at", zkc.hosts)
-					close(waitConnCh)
+					select {
+					case <-waitConnCh: // reconnected within the session
+					default:
+						close(waitConnCh)
+					}
 
 				case zk.StateSyncConnected:
-					zkc.connected = true
+					zkc.setConnected(true)
 					log.Infoln("SyncConnected to zookper server")
 				case zk.StateDisconnected:
+					// the connection is lost, zk reconnects within the
+					// session or reports it expired.
 					log.Infoln("Disconnected from zookeeper server")
-					zkc.disconnect()
+					zkc.setConnected(false)
 				case zk.StateExpired:
-					log.Infoln("Zookeeper client session expired, disconnecting.")
-					//zkc.disconnect()
+					log.Infoln("Zookeeper client session expired, reconnecting.")
+					go zkc.reconnect()
+					return
 				}
 			}
 		}
@@ -105,30 +254,192 @@ func (zkc *zkClient) connect() error {
 	// wait for connected confirmation
 	select {
 	case <-waitConnCh:
-		if !zkc.connected {
+		if !zkc.isConnected() {
 			err := errors.New("Unabe to confirm connected state.")
 			log.Errorf(err.Error())
 			return err
 		}
-	case <-time.After(zkc.connTimeout):
-		return fmt.Errorf("Unable to confirm connection after %v.", time.Second*5)
+	case <-time.After(timeout):
+		zkc.teardown()
+		return fmt.Errorf("Unable to confirm connection after %v.", timeout)
 	}
 
+	return zkc.authenticate(conn)
+}
+
+// authenticate adds the auth info of the client to the session, errors
+// are reported to the errorWatcher too.
+func (zkc *zkClient) authenticate(conn zkConnector) error {
+	for _, auth := range zkc.auth {
+		if err := conn.AddAuth(auth.scheme, auth.credential); err != nil {
+			err = fmt.Errorf("Unable to add %s auth to zookeeper session: %v", auth.scheme, err)
+			log.Errorln(err)
+			if zkc.errorWatcher != nil {
+				zkc.errorWatcher.errorOccured(zkc, err)
+			}
+			zkc.teardown()
+			return err
+		}
+	}
 	return nil
 }
 
-func (zkc *zkClient) disconnect() error {
+// reconnect replaces an expired session with a new one, retrying with
+// exponential backoff, and re-establishes the children watches.
+func (zkc *zkClient) reconnect() {
+	zkc.teardown()
+
+	backoff := zkReconnectBackoff
+	for {
+		zkc.lock.Lock()
+		closed := zkc.closed
+		zkc.lock.Unlock()
+		if closed {
+			log.V(2).Infoln("Not reconnecting to zookeeper, client is stopped.")
+			return
+		}
+
+		err := zkc.connect()
+		if err == nil {
+			break
+		}
+		log.Errorf("Unable to reconnect to zookeeper, retrying in %v: %v\n", backoff, err)
+		select {
+		case <-zkc.done:
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if max := zkc.connectTimeout(); backoff > max {
+			backoff = max
+		}
+	}
+
+	zkc.lock.Lock()
+	paths := make([]string, 0, len(zkc.watches))
+	for path := range zkc.watches {
+		paths = append(paths, path)
+	}
+	zkc.lock.Unlock()
+
+	for _, path := range paths {
+		if err := zkc.watchChildren(path); err != nil {
+			log.Errorf("Unable to watch children for path %s: %s", path, err.Error())
+			if zkc.errorWatcher != nil {
+				zkc.errorWatcher.errorOccured(zkc, err)
+			}
+			continue
+		}
+		// the children may have changed while the session was down.
+		if zkc.childrenWatcher != nil {
+			zkc.childrenWatcher.childrenChanged(zkc, zkc.watchPath(path))
+		}
+	}
+
+	zkc.lock.Lock()
+	paths = paths[:0]
+	for path := range zkc.dataWatches {
+		paths = append(paths, path)
+	}
+	zkc.lock.Unlock()
+
+	for _, path := range paths {
+		if err := zkc.rewatchData(path); err != nil {
+			continue
+		}
+		if zkc.dataWatcher != nil {
+			zkc.dataWatcher.dataChanged(zkc, zkc.watchPath(path))
+		}
+	}
+}
+
+// stop closes the zk connection and stops the watch goroutines for
+// good, the client does not reconnect afterwards. It is only called on
+// behalf of the user, see ZkMasterDetector.Stop and stopOnDone; a lost
+// connection or an expired session only tears the connection down. It
+// may be called more than once, subsequent calls are no-ops.
+func (zkc *zkClient) stop() error {
+	zkc.lock.Lock()
+	if !zkc.closed {
+		zkc.closed = true
+		close(zkc.done)
+	}
+	zkc.lock.Unlock()
+	zkc.teardown()
 	return nil
 }
 
+// stopped returns true once the client is stopped for good.
+func (zkc *zkClient) stopped() bool {
+	zkc.lock.Lock()
+	defer zkc.lock.Unlock()
+	return zkc.closed
+}
+
+// stopOnDone stops the client once ctx is done.
+func (zkc *zkClient) stopOnDone(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.V(2).Infoln("Disconnecting from zookeeper:", ctx.Err())
+			zkc.stop()
+		case <-zkc.done:
+		}
+	}()
+}
+
+// isConnected tells whether the session is connected, as last reported
+// by zk.
+func (zkc *zkClient) isConnected() bool {
+	zkc.lock.Lock()
+	defer zkc.lock.Unlock()
+	return zkc.connected
+}
+
+func (zkc *zkClient) setConnected(connected bool) {
+	zkc.lock.Lock()
+	zkc.connected = connected
+	zkc.lock.Unlock()
+}
+
+// teardown closes the current zk connection, if any, and stops the
+// goroutines watching it.
+func (zkc *zkClient) teardown() {
+	zkc.lock.Lock()
+	defer zkc.lock.Unlock()
+
+	select {
+	case <-zkc.stopCh:
+		return // already torn down
+	default:
+	}
+	close(zkc.stopCh)
+	zkc.connected = false
+	if zkc.conn != nil {
+		zkc.conn.Close()
+	}
+	log.V(2).Infoln("Disconnected from zookeeper at", zkc.hosts)
+}
+
+// watchPath returns the absolute path of a path passed to watchChildren,
+// relative to the root path of the client.
+func (zkc *zkClient) watchPath(path string) string {
+	return zkPath(zkc.rootPath, path)
+}
+
+// zkPath joins elems into an absolute znode path, removing empty and "."
+// elements as well as duplicate slashes.
+func zkPath(elems ...string) string {
+	return pathpkg.Join(append([]string{"/"}, elems...)...)
+}
+
 func (zkc *zkClient) watchChildren(path string) error {
-	if !zkc.connected {
-		return errors.New("Not connected to server.")
+	if zkc.stopped() {
+		return errZkClientStopped
 	}
-	watchPath := zkc.rootPath
-	if path != "" && path != "." {
-		watchPath = watchPath + path
+	if !zkc.isConnected() {
+		return errors.New("Not connected to server.")
 	}
+	watchPath := zkc.watchPath(path)
 
 	log.V(2).Infoln("Watching children for path", watchPath)
 	children, _, ch, err := zkc.conn.ChildrenW(watchPath)
@@ -136,8 +447,15 @@ func (zkc *zkClient) watchChildren(path string) error {
 		return err
 	}
 
+	zkc.lock.Lock()
+	zkc.watches[path] = struct{}{}
+	stopCh := zkc.stopCh
+	zkc.lock.Unlock()
+
 	go func(chList []string) {
 		select {
+		case <-stopCh:
+			return
 		case e := <-ch:
 			if e.Err != nil {
 				log.Errorf("Received error while watching path %s: %s", watchPath, e.Err.Error())
@@ -164,8 +482,84 @@ func (zkc *zkClient) watchChildren(path string) error {
 	return nil
 }
 
+// watchData watches the data of the node at path, relative to the root
+// path, notifying the dataWatcher every time it changes.
+func (zkc *zkClient) watchData(path string) error {
+	if zkc.stopped() {
+		return errZkClientStopped
+	}
+	if !zkc.isConnected() {
+		return errors.New("Not connected to server.")
+	}
+	watchPath := zkc.watchPath(path)
+
+	log.V(2).Infoln("Watching data for path", watchPath)
+	_, _, ch, err := zkc.conn.GetW(watchPath)
+	if err != nil {
+		return err
+	}
+
+	zkc.lock.Lock()
+	zkc.dataWatches[path] = struct{}{}
+	stopCh := zkc.stopCh
+	zkc.lock.Unlock()
+
+	go func() {
+		select {
+		case <-stopCh:
+			return
+		case e := <-ch:
+			if e.Err != nil {
+				log.Errorf("Received error while watching data of path %s: %s", watchPath, e.Err.Error())
+				if zkc.errorWatcher != nil {
+					zkc.errorWatcher.errorOccured(zkc, e.Err)
+				}
+			}
+
+			switch e.Type {
+			case zk.EventNodeDataChanged:
+				if zkc.dataWatcher != nil {
+					zkc.dataWatcher.dataChanged(zkc, e.Path)
+				}
+			}
+		}
+		zkc.rewatchData(path)
+	}()
+	return nil
+}
+
+// watchingData returns true if the data of path is being watched.
+func (zkc *zkClient) watchingData(path string) bool {
+	zkc.lock.Lock()
+	defer zkc.lock.Unlock()
+	_, ok := zkc.dataWatches[path]
+	return ok
+}
+
+// rewatchData arms the data watch of path again, reporting errors to the
+// errorWatcher. The watch is dropped once the node is gone.
+func (zkc *zkClient) rewatchData(path string) error {
+	err := zkc.watchData(path)
+	switch {
+	case err == zk.ErrNoNode:
+		log.V(2).Infof("Node %s is gone, no longer watching its data", path)
+		zkc.lock.Lock()
+		delete(zkc.dataWatches, path)
+		zkc.lock.Unlock()
+	case err != nil:
+		log.Errorf("Unable to watch data for path %s: %s", path, err.Error())
+		if zkc.errorWatcher != nil {
+			zkc.errorWatcher.errorOccured(zkc, err)
+		}
+	}
+	return err
+}
+
 func (zkc *zkClient) list(path string) ([]string, error) {
-	if !zkc.connected {
+	if zkc.stopped() {
+		return nil, errZkClientStopped
+	}
+	if !zkc.isConnected() {
 		return nil, errors.New("Unable to list children, client not connected.")
 	}
 
@@ -180,7 +574,10 @@ func (zkc *zkClient) list(path string) ([]string, error) {
 }
 
 func (zkc *zkClient) data(path string) ([]byte, error) {
-	if !zkc.connected {
+	if zkc.stopped() {
+		return nil, errZkClientStopped
+	}
+	if !zkc.isConnected() {
 		return nil, errors.New("Unable to retrieve node data, client not connected.")
 	}
 
@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +22,7 @@ func TestZkClientNew(t *testing.T) {
 	c, err := newZkClient(test_zk_hosts, path)
 	assert.NoError(t, err)
 	assert.NotNil(t, c)
-	assert.False(t, c.connected)
+	assert.False(t, c.isConnected())
 	c.conn = connector
 
 }
@@ -29,6 +30,46 @@ func TestZkClientNew(t *testing.T) {
 // This test requires zookeeper to be running.
 // You must also set env variable ZK_HOSTS to point to zk hosts.
 // The zk package does not offer a way to mock its connection function.
+func TestZkClientNewValidation(t *testing.T) {
+	for _, tc := range []struct {
+		hosts    []string
+		expected []string // nil if invalid
+	}{
+		{[]string{"zk1:2181", "zk2:2182"}, []string{"zk1:2181", "zk2:2182"}},
+		{[]string{"zk1", "10.0.0.1"}, []string{"zk1:2181", "10.0.0.1:2181"}},
+		{[]string{"[::1]:2181", "[::1]", "::1"}, []string{"[::1]:2181", "[::1]:2181", "[::1]:2181"}},
+		{nil, nil},
+		{[]string{}, nil},
+		{[]string{""}, nil},
+		{[]string{"zk1:2181", ""}, nil},
+		{[]string{":2181"}, nil},
+		{[]string{"zk1:"}, nil},
+		{[]string{"zk1:port"}, nil},
+		{[]string{"zk1:0"}, nil},
+		{[]string{"zk1:65536"}, nil},
+		{[]string{"zk1:2181:2181"}, nil},
+	} {
+		c, err := newZkClient(tc.hosts, "/mesos")
+		if tc.expected == nil {
+			assert.Error(t, err, "%q", tc.hosts)
+			assert.Nil(t, c, "%q", tc.hosts)
+			continue
+		}
+		if assert.NoError(t, err, "%q", tc.hosts) {
+			assert.Equal(t, tc.expected, c.hosts)
+		}
+	}
+
+	for _, path := range []string{"mesos", "./mesos", "mesos/"} {
+		_, err := newZkClient(test_zk_hosts, path)
+		assert.Error(t, err, path)
+	}
+	for _, path := range []string{"", "/", "/mesos", "/chroot/mesos/"} {
+		_, err := newZkClient(test_zk_hosts, path)
+		assert.NoError(t, err, path)
+	}
+}
+
 func TestZkClientConnect(t *testing.T) {
 	if os.Getenv("ZK_HOSTS") == "" {
 		t.Skip("Skipping test: requires env ZK_HOSTS for zookeeper addresses.")
@@ -41,7 +82,7 @@ func TestZkClientConnect(t *testing.T) {
 
 	err = c.connect()
 	assert.NoError(t, err)
-	assert.True(t, c.connected)
+	assert.True(t, c.isConnected())
 }
 
 func TestWatchChildren(t *testing.T) {
@@ -106,10 +147,236 @@ func TestWatchErrors(t *testing.T) {
 
 }
 
+func TestWatchData(t *testing.T) {
+	path := "/test"
+	ch := make(chan zk.Event, 1)
+
+	c := makeZkClient(t, test_zk_hosts, path)
+	conn := makeMockConnector(path, (<-chan zk.Event)(ch))
+	c.conn = conn
+	wCh := make(chan string, 1)
+	c.dataWatcher = zkDataWatcherFunc(func(zkc *zkClient, path string) {
+		wCh <- path
+	})
+
+	assert.NoError(t, c.watchData("."))
+	for i := 0; i < 2; i++ {
+		ch <- zk.Event{Type: zk.EventNodeDataChanged, Path: path}
+		select {
+		case changed := <-wCh:
+			assert.Equal(t, path, changed)
+		case <-time.After(time.Millisecond * 700):
+			t.Fatalf("Waited too long for data change %d.", i)
+		}
+	}
+	// the watch is armed again after each event.
+	time.Sleep(time.Millisecond * 50)
+	conn.AssertNumberOfCalls(t, "GetW", 3)
+}
+
+func TestWatchDataNodeDeleted(t *testing.T) {
+	path := "/test"
+	ch := make(chan zk.Event, 1)
+
+	c := makeZkClient(t, test_zk_hosts, path)
+	conn := NewMockZkConnector()
+	conn.On("GetW", path).Return([]byte("Hello"), &zk.Stat{}, (<-chan zk.Event)(ch), nil).Once()
+	conn.On("GetW", path).Return([]byte{}, &zk.Stat{}, (<-chan zk.Event)(nil), zk.ErrNoNode)
+	c.conn = conn
+	c.dataWatcher = zkDataWatcherFunc(func(zkc *zkClient, path string) {
+		t.Errorf("Unexpected data change of %s", path)
+	})
+	c.errorWatcher = zkErrorWatcherFunc(func(zkc *zkClient, err error) {
+		t.Errorf("Unexpected error %v", err)
+	})
+
+	assert.NoError(t, c.watchData("."))
+	ch <- zk.Event{Type: zk.EventNodeDeleted, Path: path}
+
+	// a deleted node is no longer watched.
+	for i := 0; i < 10 && c.watchingData("."); i++ {
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.False(t, c.watchingData("."))
+	conn.AssertNumberOfCalls(t, "GetW", 2)
+}
+
+func TestZkClientStop(t *testing.T) {
+	path := "/test"
+	ch := make(chan zk.Event, 1)
+	c := makeZkClient(t, test_zk_hosts, path)
+	conn := makeMockConnector(path, (<-chan zk.Event)(ch))
+	c.conn = conn
+	c.childrenWatcher = zkChildrenWatcherFunc(func(zkc *zkClient, path string) {
+		t.Errorf("Unexpected children changed event after stop")
+	})
+	assert.NoError(t, c.watchChildren("."))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.stop())
+		}()
+	}
+	wg.Wait()
+
+	assert.False(t, c.isConnected())
+	conn.AssertNumberOfCalls(t, "Close", 1)
+	assert.NoError(t, c.stop())
+	conn.AssertNumberOfCalls(t, "Close", 1)
+
+	// the watch goroutine is gone, the event is not delivered.
+	ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: path}
+	time.Sleep(time.Millisecond * 100)
+	conn.AssertNumberOfCalls(t, "ChildrenW", 1)
+}
+
+func TestZkClientDoneOnlyOnStop(t *testing.T) {
+	c := makeZkClient(t, test_zk_hosts, "/test")
+	c.conn = makeMockConnector("/test", make(chan zk.Event))
+
+	// tearing the connection down, e.g. on session expiry, is not a stop.
+	c.teardown()
+	assert.False(t, c.stopped())
+	select {
+	case <-c.done:
+		t.Fatalf("Client stopped on teardown.")
+	default:
+	}
+
+	assert.NoError(t, c.stop())
+	assert.True(t, c.stopped())
+	select {
+	case <-c.done:
+	default:
+		t.Fatalf("Client not stopped.")
+	}
+}
+
+func TestZkClientReconnectOnSessionExpired(t *testing.T) {
+	path := "/test"
+	c, err := newZkClient(test_zk_hosts, path)
+	assert.NoError(t, err)
+
+	// every connection reports connected right away.
+	conns := make(chan *MockZkConnector, 2)
+	sessions := make(chan chan zk.Event, 2)
+	c.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		ch := make(chan zk.Event, 2)
+		ch <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		conn := makeMockConnector(path, make(chan zk.Event))
+		conns <- conn
+		sessions <- ch
+		return conn, ch, nil
+	})
+	rewatched := make(chan string, 1)
+	c.childrenWatcher = zkChildrenWatcherFunc(func(zkc *zkClient, path string) {
+		rewatched <- path
+	})
+
+	assert.NoError(t, c.connect())
+	assert.NoError(t, c.watchChildren("."))
+	first, session := <-conns, <-sessions
+
+	// zk reports the connection lost before the session expired.
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateDisconnected}
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+
+	select {
+	case p := <-rewatched:
+		assert.Equal(t, path, p)
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Waited too long for the new session.")
+	}
+	second := <-conns
+	assert.True(t, c.isConnected())
+	first.AssertNumberOfCalls(t, "Close", 1)
+	second.AssertNumberOfCalls(t, "ChildrenW", 1)
+
+	assert.NoError(t, c.stop())
+	second.AssertNumberOfCalls(t, "Close", 1)
+}
+
+func TestZkClientDisconnectedThenExpired(t *testing.T) {
+	path := "/test"
+	c, err := newZkClient(test_zk_hosts, path)
+	assert.NoError(t, err)
+
+	conns := make(chan *MockZkConnector, 2)
+	sessions := make(chan chan zk.Event, 2)
+	c.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		ch := make(chan zk.Event, 2)
+		ch <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		conn := makeMockConnector(path, make(chan zk.Event))
+		conns <- conn
+		sessions <- ch
+		return conn, ch, nil
+	})
+	assert.NoError(t, c.connect())
+	first, session := <-conns, <-sessions
+
+	// a lost connection neither closes the session nor stops the client.
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateDisconnected}
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, c.stopped())
+	first.AssertNumberOfCalls(t, "Close", 0)
+	select {
+	case <-c.done:
+		t.Fatalf("Client stopped on a lost connection.")
+	default:
+	}
+
+	// the session expires while disconnected, a new one is created.
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	select {
+	case second := <-conns:
+		assert.True(t, first != second)
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Waited too long for the new session.")
+	}
+	first.AssertNumberOfCalls(t, "Close", 1)
+	assert.NoError(t, c.stop())
+}
+
+func TestZkClientReconnectBackoff(t *testing.T) {
+	c, err := newZkClient(test_zk_hosts, "/test")
+	assert.NoError(t, err)
+	c.setConnectTimeout(time.Millisecond * 300)
+
+	var attempts []time.Time
+	c.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 4 {
+			return nil, nil, errors.New("ensemble unavailable")
+		}
+		ch := make(chan zk.Event, 1)
+		ch <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		return makeMockConnector("/test", make(chan zk.Event)), ch, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		c.reconnect()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Waited too long for reconnection.")
+	}
+	// 100ms, 200ms, then capped at the 300ms connection timeout.
+	for i, min := range []time.Duration{100, 200, 300} {
+		assert.True(t, attempts[i+1].Sub(attempts[i]) >= min*time.Millisecond)
+	}
+	c.stop()
+}
+
 func makeZkClient(t *testing.T, hosts []string, path string) *zkClient {
 	c, err := newZkClient(hosts, path)
 	assert.NoError(t, err)
-	c.connected = true
+	c.setConnected(true)
 	return c
 }
 
@@ -119,6 +386,90 @@ func makeMockConnector(path string, chEvent <-chan zk.Event) *MockZkConnector {
 	conn.On("ChildrenW", path).Return([]string{path}, &zk.Stat{}, chEvent, nil)
 	conn.On("Children").Return([]string{"x", "a", "d"}, &zk.Stat{}, nil)
 	conn.On("Get", path).Return([]byte("Hello"), &zk.Stat{}, nil)
+	conn.On("GetW", path).Return([]byte("Hello"), &zk.Stat{}, chEvent, nil)
 
 	return conn
 }
+
+func TestZkClientConnectTimeout(t *testing.T) {
+	c, err := newZkClient(test_zk_hosts, "/test")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultZkConnTimeout, c.connectTimeout())
+
+	var timeouts []time.Duration
+	c.connFactory = zkConnFactoryFunc(func(_ []string, timeout time.Duration) (zkConnector, <-chan zk.Event, error) {
+		timeouts = append(timeouts, timeout)
+		// the connection is never confirmed.
+		return makeMockConnector("/test", make(chan zk.Event)), make(chan zk.Event), nil
+	})
+
+	c.setConnectTimeout(time.Millisecond * 200)
+	start := time.Now()
+	err = c.connect()
+	assert.True(t, time.Since(start) >= time.Millisecond*200)
+	assert.EqualError(t, err, "Unable to confirm connection after 200ms.")
+	assert.Equal(t, []time.Duration{time.Millisecond * 200}, timeouts)
+
+	c.setConnectTimeout(0)
+	assert.Equal(t, defaultZkConnTimeout, c.connectTimeout())
+}
+
+func TestZkClientAuth(t *testing.T) {
+	c, err := newZkClient(test_zk_hosts, "/test", zkAuth{"digest", []byte("user:pass")})
+	assert.NoError(t, err)
+
+	conn := makeMockConnector("/test", make(chan zk.Event))
+	conn.On("AddAuth", "digest", []byte("user:pass")).Return(nil)
+	c.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		ch := make(chan zk.Event, 1)
+		ch <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		return conn, ch, nil
+	})
+
+	assert.NoError(t, c.connect())
+	conn.AssertNumberOfCalls(t, "AddAuth", 1)
+	c.stop()
+}
+
+func TestZkClientAuthFailure(t *testing.T) {
+	c, err := newZkClient(test_zk_hosts, "/test", zkAuth{"digest", []byte("user:wrong")})
+	assert.NoError(t, err)
+
+	conn := makeMockConnector("/test", make(chan zk.Event))
+	conn.On("AddAuth", "digest", []byte("user:wrong")).Return(zk.ErrAuthFailed)
+	c.connFactory = zkConnFactoryFunc(func([]string, time.Duration) (zkConnector, <-chan zk.Event, error) {
+		ch := make(chan zk.Event, 1)
+		ch <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+		return conn, ch, nil
+	})
+	var reported error
+	c.errorWatcher = zkErrorWatcherFunc(func(zkc *zkClient, err error) {
+		reported = err
+	})
+
+	err = c.connect()
+	assert.Error(t, err)
+	assert.Equal(t, err, reported)
+	conn.AssertNumberOfCalls(t, "Close", 1)
+	conn.AssertNotCalled(t, "ChildrenW", "/test")
+}
+
+func TestZkClientWatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		root, path, expected string
+	}{
+		{"/mesos", ".", "/mesos"},
+		{"/mesos", "", "/mesos"},
+		{"/mesos", "/child", "/mesos/child"},
+		{"/mesos", "child", "/mesos/child"},
+		{"/mesos/", "/child/", "/mesos/child"},
+		{"/chroot/mesos", "/child", "/chroot/mesos/child"},
+		{"//chroot//mesos", ".", "/chroot/mesos"},
+		{"", ".", "/"},
+		{"", "/child", "/child"},
+	} {
+		c, err := newZkClient(test_zk_hosts, tc.root)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, c.watchPath(tc.path), "root %q, path %q", tc.root, tc.path)
+	}
+}
@@ -57,3 +57,15 @@ func (conn *MockZkConnector) Get(path string) ([]byte, *zk.Stat, error) {
 		args.Get(1).(*zk.Stat),
 		args.Error(2)
 }
+
+func (conn *MockZkConnector) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	args := conn.Called(path)
+	return args.Get(0).([]byte),
+		args.Get(1).(*zk.Stat),
+		args.Get(2).(<-chan zk.Event),
+		args.Error(3)
+}
+
+func (conn *MockZkConnector) AddAuth(scheme string, auth []byte) error {
+	return conn.Called(scheme, auth).Error(0)
+}
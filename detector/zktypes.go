@@ -12,4 +12,6 @@ type zkConnector interface {
 	Children(string) ([]string, *zk.Stat, error)
 	ChildrenW(string) ([]string, *zk.Stat, <-chan zk.Event, error)
 	Get(string) ([]byte, *zk.Stat, error)
+	GetW(string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	AddAuth(scheme string, auth []byte) error
 }
@@ -1,6 +1,8 @@
 package executor
 
 import (
+	"time"
+
 	"github.com/mesos/mesos-go/mesosproto"
 )
 
@@ -133,6 +135,14 @@ type ExecutorDriver interface {
 	 */
 	SendStatusUpdate(*mesosproto.TaskStatus) (mesosproto.Status, error)
 
+	/**
+	 * Sends a status update like SendStatusUpdate, then blocks until
+	 * the acknowledgement of the update has been received, or returns
+	 * an error once the timeout expires. An update that is not
+	 * acknowledged in time is still retried.
+	 */
+	SendStatusUpdateAndWait(*mesosproto.TaskStatus, time.Duration) (mesosproto.Status, error)
+
 	/**
 	 * Sends a message to the framework scheduler. These messages are
 	 * best effort; do not expect a framework message to be
@@ -57,6 +57,7 @@ type MesosExecutorDriver struct {
 	recoveryTimeout time.Duration
 	updates         map[string]*mesosproto.StatusUpdate // Key is a UUID string. TODO(yifan): Not used yet.
 	tasks           map[string]*mesosproto.TaskInfo     // Key is a UUID string. TODO(yifan): Not used yet.
+	ackWaiters      map[string]chan struct{}            // closed on acknowledgement, key is a UUID string.
 }
 
 // NewMesosExecutorDriver creates a new mesos executor driver.
@@ -68,14 +69,15 @@ func NewMesosExecutorDriver(exec Executor) (*MesosExecutorDriver, error) {
 	}
 
 	driver := &MesosExecutorDriver{
-		exec:      exec,
-		status:    mesosproto.Status_DRIVER_NOT_STARTED,
-		stopCh:    make(chan struct{}),
-		destroyCh: make(chan struct{}),
-		stopped:   true,
-		updates:   make(map[string]*mesosproto.StatusUpdate),
-		tasks:     make(map[string]*mesosproto.TaskInfo),
-		workDir:   ".",
+		exec:       exec,
+		status:     mesosproto.Status_DRIVER_NOT_STARTED,
+		stopCh:     make(chan struct{}),
+		destroyCh:  make(chan struct{}),
+		stopped:    true,
+		updates:    make(map[string]*mesosproto.StatusUpdate),
+		ackWaiters: make(map[string]chan struct{}),
+		tasks:      make(map[string]*mesosproto.TaskInfo),
+		workDir:    ".",
 	}
 	// TODO(yifan): Set executor cnt.
 	driver.messenger = messenger.NewHttp(&upid.UPID{ID: "executor(1)"})
@@ -259,9 +261,11 @@ func (driver *MesosExecutorDriver) reconnect(from *upid.UPID, pbMsg proto.Messag
 		FrameworkId: driver.frameworkID,
 	}
 	// Send all unacknowledged updates.
+	driver.lock.RLock()
 	for _, u := range driver.updates {
 		message.Updates = append(message.Updates, u)
 	}
+	driver.lock.RUnlock()
 	// Send all unacknowledged tasks.
 	for _, t := range driver.tasks {
 		message.Tasks = append(message.Tasks, t)
@@ -322,8 +326,14 @@ func (driver *MesosExecutorDriver) statusUpdateAcknowledgement(from *upid.UPID,
 			uuid, taskID, frameworkID)
 	}
 
-	// Remove the corresponding update.
+	// Remove the corresponding update, and release whoever waits for it.
+	driver.lock.Lock()
 	delete(driver.updates, uuid.String())
+	if acked, ok := driver.ackWaiters[uuid.String()]; ok {
+		close(acked)
+		delete(driver.ackWaiters, uuid.String())
+	}
+	driver.lock.Unlock()
 	// Remove the corresponding task.
 	delete(driver.tasks, taskID.String())
 }
@@ -484,10 +494,47 @@ func (driver *MesosExecutorDriver) Run() (mesosproto.Status, error) {
 
 // SendStatusUpdate sends status updates to the slave.
 func (driver *MesosExecutorDriver) SendStatusUpdate(taskStatus *mesosproto.TaskStatus) (mesosproto.Status, error) {
+	_, stat, err := driver.sendStatusUpdate(taskStatus, nil)
+	return stat, err
+}
+
+// SendStatusUpdateAndWait sends a status update like SendStatusUpdate, then
+// blocks until the slave acknowledges it or timeout expires. An update that
+// times out stays unacknowledged: it is resent when the driver reconnects
+// to the slave, not by SendStatusUpdateAndWait.
+func (driver *MesosExecutorDriver) SendStatusUpdateAndWait(taskStatus *mesosproto.TaskStatus, timeout time.Duration) (mesosproto.Status, error) {
+	acked := make(chan struct{})
+	key, stat, err := driver.sendStatusUpdate(taskStatus, acked)
+	if err != nil {
+		return stat, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+		return driver.Status(), nil
+	case <-driver.stopCh:
+		err = fmt.Errorf("Driver stopped before status update %s for task %s was acknowledged.",
+			key, taskStatus.GetTaskId().GetValue())
+	case <-timer.C:
+		err = fmt.Errorf("Status update %s for task %s was not acknowledged within %v.",
+			key, taskStatus.GetTaskId().GetValue(), timeout)
+	}
+	driver.lock.Lock()
+	delete(driver.ackWaiters, key)
+	driver.lock.Unlock()
+	log.Errorln(err)
+	return driver.Status(), err
+}
+
+// sendStatusUpdate sends a status update to the slave and returns its UUID.
+// acked, unless nil, is closed when the slave acknowledges the update.
+func (driver *MesosExecutorDriver) sendStatusUpdate(taskStatus *mesosproto.TaskStatus, acked chan struct{}) (string, mesosproto.Status, error) {
 	log.V(3).Infoln("Sending task status update: ", taskStatus.String())
 
 	if stat := driver.Status(); stat != mesosproto.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to SendStatusUpdate, expecting driver.status %s, but got %s", mesosproto.Status_DRIVER_RUNNING, stat)
+		return "", stat, fmt.Errorf("Unable to SendStatusUpdate, expecting driver.status %s, but got %s", mesosproto.Status_DRIVER_RUNNING, stat)
 	}
 
 	if taskStatus.GetState() == mesosproto.TaskState_TASK_STAGING {
@@ -497,15 +544,22 @@ func (driver *MesosExecutorDriver) SendStatusUpdate(taskStatus *mesosproto.TaskS
 			log.Errorln("Error while stopping the driver", err0)
 		}
 
-		return driver.Status(), err
+		return "", driver.Status(), err
 	}
 
 	// Set up status update.
 	update := driver.makeStatusUpdate(taskStatus)
 	log.Infof("Executor sending status update %v\n", update.String())
 
-	// Capture the status update.
-	driver.updates[uuid.UUID(update.GetUuid()).String()] = update
+	// Capture the status update, the waiter is registered before sending so
+	// that an early acknowledgement is not missed.
+	key := uuid.UUID(update.GetUuid()).String()
+	driver.lock.Lock()
+	driver.updates[key] = update
+	if acked != nil {
+		driver.ackWaiters[key] = acked
+	}
+	driver.lock.Unlock()
 
 	// Put the status update in the message.
 	message := &mesosproto.StatusUpdateMessage{
@@ -515,10 +569,13 @@ func (driver *MesosExecutorDriver) SendStatusUpdate(taskStatus *mesosproto.TaskS
 	// Send the message.
 	if err := driver.send(driver.slaveUPID, message); err != nil {
 		log.Errorf("Failed to send %v: %v\n", message, err)
-		return driver.status, err
+		driver.lock.Lock()
+		delete(driver.ackWaiters, key)
+		driver.lock.Unlock()
+		return key, driver.Status(), err
 	}
 
-	return driver.Status(), nil
+	return key, driver.Status(), nil
 }
 
 func (driver *MesosExecutorDriver) makeStatusUpdate(taskStatus *mesosproto.TaskStatus) *mesosproto.StatusUpdate {
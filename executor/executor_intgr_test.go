@@ -25,6 +25,7 @@ import (
 	mesos "github.com/mesos/mesos-go/mesosproto"
 	util "github.com/mesos/mesos-go/mesosutil"
 	"github.com/mesos/mesos-go/testutil"
+	"github.com/mesos/mesos-go/upid"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
@@ -527,3 +528,91 @@ func TestExecutorDriverError(t *testing.T) {
 		log.Errorf("Tired of waiting...")
 	}
 }
+
+// newAckingSlave starts a mock slave that acknowledges each status update
+// after delay, or never if delay is negative.
+func newAckingSlave(t *testing.T, delay time.Duration) *testutil.MockMesosHttpServer {
+	var server *testutil.MockMesosHttpServer
+	server = testutil.NewMockSlaveHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		rsp.WriteHeader(http.StatusAccepted)
+		if !strings.HasSuffix(req.URL.Path, "StatusUpdateMessage") || delay < 0 {
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		message := new(mesos.StatusUpdateMessage)
+		assert.NoError(t, proto.Unmarshal(data, message))
+		pid, err := upid.Parse(message.GetPid())
+		assert.NoError(t, err)
+
+		update := message.GetUpdate()
+		ack := &mesos.StatusUpdateAcknowledgementMessage{
+			SlaveId:     util.NewSlaveID(slaveID),
+			FrameworkId: update.GetFrameworkId(),
+			TaskId:      update.GetStatus().GetTaskId(),
+			Uuid:        update.GetUuid(),
+		}
+		time.AfterFunc(delay, func() {
+			testutil.NewMockMesosClient(t, server.PID).SendMessage(pid, ack)
+		})
+	})
+	return server
+}
+
+func TestExecutorDriverSendStatusUpdateAndWait(t *testing.T) {
+	setTestEnv(t)
+	server := newAckingSlave(t, 50*time.Millisecond)
+	defer server.Close()
+
+	driver, err := NewMesosExecutorDriver(newTestExecutor(t))
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Stop()
+
+	for _, state := range []mesos.TaskState{mesos.TaskState_TASK_RUNNING, mesos.TaskState_TASK_FINISHED} {
+		start := time.Now()
+		stat, err = driver.SendStatusUpdateAndWait(&mesos.TaskStatus{
+			TaskId: util.NewTaskID("test-task-001"),
+			State:  state.Enum(),
+		}, 5*time.Second)
+		assert.NoError(t, err, state.String())
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+		assert.True(t, time.Since(start) >= 50*time.Millisecond, state.String())
+	}
+
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	assert.Equal(t, 0, len(driver.updates))
+	assert.Equal(t, 0, len(driver.ackWaiters))
+}
+
+func TestExecutorDriverSendStatusUpdateAndWaitTimeout(t *testing.T) {
+	setTestEnv(t)
+	server := newAckingSlave(t, -1)
+	defer server.Close()
+
+	driver, err := NewMesosExecutorDriver(newTestExecutor(t))
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Stop()
+
+	start := time.Now()
+	stat, err = driver.SendStatusUpdateAndWait(&mesos.TaskStatus{
+		TaskId: util.NewTaskID("test-task-001"),
+		State:  mesos.TaskState_TASK_RUNNING.Enum(),
+	}, 50*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// the update is kept for the reregistration with the slave.
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	assert.Equal(t, 1, len(driver.updates))
+	assert.Equal(t, 0, len(driver.ackWaiters))
+}
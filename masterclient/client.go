@@ -0,0 +1,132 @@
+package masterclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mesos/mesos-go/detector"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	statePath      = "/master/state.json"
+)
+
+// Client queries the leading mesos master over HTTP. Non-leading
+// masters redirect to the leader, those redirects are followed.
+type Client struct {
+	lock   sync.RWMutex
+	leader *mesos.MasterInfo
+	tr     *http.Transport
+	client *http.Client
+}
+
+// NewClient creates a client that tracks the leading master reported
+// by the detector. Use a detector.StandaloneMasterDetector to query
+// a known master.
+func NewClient(d detector.Detector) (*Client, error) {
+	tr := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: defaultTimeout,
+		}).Dial,
+		ResponseHeaderTimeout: defaultTimeout,
+	}
+	c := &Client{
+		tr:     tr,
+		client: &http.Client{Transport: tr},
+	}
+	if err := d.Detect(detector.OnMasterChanged(c.setLeader)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) setLeader(m *mesos.MasterInfo) {
+	log.V(2).Infoln("Master client detected leading master", m.GetPid())
+	c.lock.Lock()
+	c.leader = m
+	c.lock.Unlock()
+}
+
+// Leader returns the last detected leading master, or nil.
+func (c *Client) Leader() *mesos.MasterInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.leader
+}
+
+// State fetches and decodes /master/state.json from the leading master.
+func (c *Client) State(ctx context.Context) (*State, error) {
+	state := new(State)
+	if err := c.get(ctx, statePath, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	leader := c.Leader()
+	if leader == nil {
+		return fmt.Errorf("No leading master detected")
+	}
+	hostport, err := masterAddr(leader)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", "http://"+hostport+path, nil)
+	if err != nil {
+		return err
+	}
+	return c.httpDo(ctx, req, func(resp *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Master %s returned status %s for %s", hostport, resp.Status, path)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
+
+func (c *Client) httpDo(ctx context.Context, req *http.Request, f func(*http.Response, error) error) error {
+	ch := make(chan error, 1)
+	go func() { ch <- f(c.client.Do(req)) }()
+	select {
+	case <-ctx.Done():
+		c.tr.CancelRequest(req)
+		<-ch // Wait for f to return.
+		return ctx.Err()
+	case err := <-ch:
+		return err
+	}
+}
+
+// masterAddr returns the host:port of the master's HTTP endpoints.
+func masterAddr(m *mesos.MasterInfo) (string, error) {
+	if m.GetPid() != "" {
+		pid, err := upid.Parse(m.GetPid())
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(pid.Host, pid.Port), nil
+	}
+	port := strconv.Itoa(int(m.GetPort()))
+	if m.GetHostname() != "" {
+		return net.JoinHostPort(m.GetHostname(), port), nil
+	}
+	// MasterInfo.ip is packed in network byte order.
+	ip := m.GetIp()
+	addr := net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24))
+	return net.JoinHostPort(addr.String(), port), nil
+}
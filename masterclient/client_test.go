@@ -0,0 +1,159 @@
+package masterclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/detector"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newStateServer(t *testing.T, fixture string) *httptest.Server {
+	data, err := ioutil.ReadFile("testdata/" + fixture)
+	assert.NoError(t, err)
+	return httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/master/state.json" {
+			rsp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Write(data)
+	}))
+}
+
+func newTestClient(t *testing.T, addr string) (*Client, *detector.StandaloneMasterDetector) {
+	d := detector.NewStandaloneMasterDetector()
+	d.Appoint(masterInfoFor(addr))
+	c, err := NewClient(d)
+	assert.NoError(t, err)
+	return c, d
+}
+
+func masterInfoFor(addr string) *mesos.MasterInfo {
+	info := util.NewMasterInfo("master", 0, 0)
+	info.Pid = proto.String("master@" + addr)
+	return info
+}
+
+func TestClientState_0_20(t *testing.T) {
+	server := newStateServer(t, "state-0.20.1.json")
+	defer server.Close()
+
+	c, _ := newTestClient(t, server.Listener.Addr().String())
+	state, err := c.State(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0.20.1", state.Version)
+	assert.Equal(t, "master@10.0.0.1:5050", state.Leader)
+
+	fw := state.Framework("20141015-164000-16842762-5050-1234-0000")
+	assert.NotNil(t, fw)
+	assert.Equal(t, 2, len(fw.Tasks))
+	assert.Equal(t, "task-1", fw.Tasks[0].Id)
+	assert.Equal(t, "TASK_RUNNING", fw.Tasks[0].State)
+	assert.Equal(t, float64(128), fw.Tasks[0].Resources.Mem)
+	assert.Equal(t, 1, len(fw.CompletedTasks))
+
+	assert.Equal(t, 1, len(state.Slaves))
+	slave := state.Slave("20141015-164000-16842762-5050-1234-0")
+	assert.NotNil(t, slave)
+	assert.Equal(t, "slave-1", slave.Hostname)
+	assert.Equal(t, "[31000-32000]", slave.Resources.Ports)
+	assert.Equal(t, "r1", slave.Attributes["rack"])
+}
+
+func TestClientState_0_22(t *testing.T) {
+	server := newStateServer(t, "state-0.22.1.json")
+	defer server.Close()
+
+	c, _ := newTestClient(t, server.Listener.Addr().String())
+	state, err := c.State(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0.22.1", state.Version)
+
+	fw := state.Framework("20150507-120000-16842762-5050-777-0001")
+	assert.NotNil(t, fw)
+	assert.Equal(t, 1, len(fw.Tasks))
+	assert.Equal(t, "20150507-120000-16842762-5050-777-S1", fw.Tasks[0].SlaveId)
+	assert.Equal(t, 2, len(state.Slaves))
+	assert.Nil(t, state.Framework("unknown"))
+	assert.Nil(t, state.Slave("unknown"))
+}
+
+func TestClientFollowsRedirect(t *testing.T) {
+	leader := newStateServer(t, "state-0.22.1.json")
+	defer leader.Close()
+	standby := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		http.Redirect(rsp, req, "//"+leader.Listener.Addr().String()+req.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer standby.Close()
+
+	c, _ := newTestClient(t, standby.Listener.Addr().String())
+	state, err := c.State(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "master@10.0.0.2:5050", state.Leader)
+}
+
+func TestClientLeaderChange(t *testing.T) {
+	old := newStateServer(t, "state-0.20.1.json")
+	defer old.Close()
+	current := newStateServer(t, "state-0.22.1.json")
+	defer current.Close()
+
+	c, d := newTestClient(t, old.Listener.Addr().String())
+	state, err := c.State(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0.20.1", state.Version)
+
+	d.Appoint(masterInfoFor(current.Listener.Addr().String()))
+	state, err = c.State(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0.22.1", state.Version)
+}
+
+func TestClientNoLeader(t *testing.T) {
+	c, err := NewClient(detector.NewStandaloneMasterDetector())
+	assert.NoError(t, err)
+	_, err = c.State(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClientStateCancelled(t *testing.T) {
+	blockCh := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		<-blockCh
+	}))
+	defer server.Close()
+	defer close(blockCh)
+
+	c, _ := newTestClient(t, server.Listener.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.State(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestMasterAddr(t *testing.T) {
+	addr, err := masterAddr(util.NewMasterInfo("master", 0x0100007f, 5050))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5050", addr)
+
+	info := util.NewMasterInfo("master", 0, 5050)
+	info.Hostname = proto.String("master-1")
+	addr, err = masterAddr(info)
+	assert.NoError(t, err)
+	assert.Equal(t, "master-1:5050", addr)
+
+	info.Pid = proto.String("master@10.0.0.1:5051")
+	addr, err = masterAddr(info)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(addr, ":5051"))
+}
@@ -0,0 +1,6 @@
+/*
+Package masterclient includes a minimal, read-only client for the HTTP
+endpoints of the mesos master, such as /master/state.json. The leading
+master is discovered with a detector.Detector.
+*/
+package masterclient
@@ -0,0 +1,69 @@
+package masterclient
+
+// State is the subset of /master/state.json used by frameworks.
+type State struct {
+	Version             string      `json:"version"`
+	Id                  string      `json:"id"`
+	Pid                 string      `json:"pid"`
+	Hostname            string      `json:"hostname"`
+	Leader              string      `json:"leader"`
+	Frameworks          []Framework `json:"frameworks"`
+	CompletedFrameworks []Framework `json:"completed_frameworks"`
+	Slaves              []Slave     `json:"slaves"`
+}
+
+type Framework struct {
+	Id             string    `json:"id"`
+	Name           string    `json:"name"`
+	User           string    `json:"user"`
+	Hostname       string    `json:"hostname"`
+	Active         bool      `json:"active"`
+	Resources      Resources `json:"resources"`
+	Tasks          []Task    `json:"tasks"`
+	CompletedTasks []Task    `json:"completed_tasks"`
+}
+
+type Task struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	FrameworkId string    `json:"framework_id"`
+	ExecutorId  string    `json:"executor_id"`
+	SlaveId     string    `json:"slave_id"`
+	State       string    `json:"state"`
+	Resources   Resources `json:"resources"`
+}
+
+type Slave struct {
+	Id         string                 `json:"id"`
+	Pid        string                 `json:"pid"`
+	Hostname   string                 `json:"hostname"`
+	Resources  Resources              `json:"resources"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type Resources struct {
+	Cpus  float64 `json:"cpus"`
+	Mem   float64 `json:"mem"`
+	Disk  float64 `json:"disk"`
+	Ports string  `json:"ports"`
+}
+
+// Framework returns the registered framework with the given ID, or nil.
+func (s *State) Framework(frameworkId string) *Framework {
+	for i := range s.Frameworks {
+		if s.Frameworks[i].Id == frameworkId {
+			return &s.Frameworks[i]
+		}
+	}
+	return nil
+}
+
+// Slave returns the registered slave with the given ID, or nil.
+func (s *State) Slave(slaveId string) *Slave {
+	for i := range s.Slaves {
+		if s.Slaves[i].Id == slaveId {
+			return &s.Slaves[i]
+		}
+	}
+	return nil
+}
@@ -19,6 +19,9 @@
 package mesosutil
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/gogo/protobuf/proto"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 )
@@ -73,6 +76,32 @@ func NewFrameworkInfo(user, name string, frameworkId *mesos.FrameworkID) *mesos.
 	}
 }
 
+// NewFrameworkInfoWithRole is like NewFrameworkInfo, the framework is
+// allocated the resources of role instead of the default "*" role. It
+// fails if role is not valid, see ValidateRole.
+func NewFrameworkInfoWithRole(user, name string, frameworkId *mesos.FrameworkID, role string) (*mesos.FrameworkInfo, error) {
+	if err := ValidateRole(role); err != nil {
+		return nil, err
+	}
+	info := NewFrameworkInfo(user, name, frameworkId)
+	info.Role = proto.String(role)
+	return info, nil
+}
+
+// ValidateRole returns an error if role is not a valid name for a role:
+// it must not be empty, "." or "..", nor contain a path separator.
+func ValidateRole(role string) error {
+	switch {
+	case role == "":
+		return fmt.Errorf("Role must not be empty")
+	case role == "." || role == "..":
+		return fmt.Errorf("Role must not be %q", role)
+	case strings.ContainsAny(role, "/\\"):
+		return fmt.Errorf("Role %q must not contain a path separator", role)
+	}
+	return nil
+}
+
 func NewMasterInfo(id string, ip, port uint32) *mesos.MasterInfo {
 	return &mesos.MasterInfo{
 		Id:   proto.String(id),
@@ -139,6 +168,32 @@ func NewStatusUpdate(frameworkId *mesos.FrameworkID, taskStatus *mesos.TaskStatu
 	}
 }
 
+// SandboxPath returns, on a best-effort basis, the URL of the sandbox of
+// the task the status is about, laid out by the slave as
+//
+//	<agentURL>/executors/<executor id>/runs/latest
+//
+// where agentURL locates the directory of the framework in the work
+// directory of the slave, e.g.
+// "http://10.0.0.1:5051/files/browse.json?path=/tmp/mesos/slaves/<slave id>/frameworks/<framework id>".
+// The TaskStatus of this version of mesos carries neither the framework
+// ID nor a container status, hence the framework directory. A task run
+// without an executor of its own uses the command executor, whose ID is
+// the task ID. It returns false if the status lacks the slave or task ID,
+// or is about a task of another slave than the one agentURL locates.
+func SandboxPath(status *mesos.TaskStatus, agentURL string) (string, bool) {
+	slaveId := status.GetSlaveId().GetValue()
+	executorId := status.GetExecutorId().GetValue()
+	if executorId == "" {
+		executorId = status.GetTaskId().GetValue()
+	}
+	agentURL = strings.TrimSuffix(agentURL, "/")
+	if slaveId == "" || executorId == "" || !strings.Contains(agentURL, "/slaves/"+slaveId+"/frameworks/") {
+		return "", false
+	}
+	return agentURL + "/executors/" + executorId + "/runs/latest", true
+}
+
 func NewCommandInfo(command string) *mesos.CommandInfo {
 	return &mesos.CommandInfo{Value: proto.String(command)}
 }
@@ -153,3 +208,43 @@ func NewExecutorInfo(execId *mesos.ExecutorID, command *mesos.CommandInfo) *meso
 		Command:    command,
 	}
 }
+
+// SetTaskUser makes the task run as user instead of the framework user.
+// The user is set on the command of the task's executor if it has one,
+// otherwise on the command of the task, which is created if missing.
+func SetTaskUser(task *mesos.TaskInfo, user string) {
+	if task.Executor != nil && task.Executor.Command != nil {
+		task.Executor.Command.User = proto.String(user)
+		return
+	}
+	if task.Command == nil {
+		task.Command = &mesos.CommandInfo{}
+	}
+	task.Command.User = proto.String(user)
+}
+
+// SetTaskEnv sets an environment variable of the command that runs the
+// task: the command of the task's executor if it has one, otherwise the
+// command of the task. A task without a command is left as is.
+func SetTaskEnv(task *mesos.TaskInfo, name, value string) {
+	cmd := task.Command
+	if task.Executor != nil {
+		cmd = task.Executor.Command
+	}
+	if cmd == nil {
+		return
+	}
+	if cmd.Environment == nil {
+		cmd.Environment = &mesos.Environment{}
+	}
+	for _, v := range cmd.Environment.Variables {
+		if v.GetName() == name {
+			v.Value = proto.String(value)
+			return
+		}
+	}
+	cmd.Environment.Variables = append(cmd.Environment.Variables, &mesos.Environment_Variable{
+		Name:  proto.String(name),
+		Value: proto.String(value),
+	})
+}
@@ -126,6 +126,20 @@ func TestNewFrameworkInfo(t *testing.T) {
 	}
 }
 
+func TestNewFrameworkInfoWithRole(t *testing.T) {
+	info, err := NewFrameworkInfoWithRole("test-user", "test-name", nil, "analytics")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-user", info.GetUser())
+	assert.Equal(t, "analytics", info.GetRole())
+	assert.Equal(t, "*", NewFrameworkInfo("test-user", "test-name", nil).GetRole())
+
+	for _, role := range []string{"", ".", "..", "a/b", "/", `a\b`} {
+		info, err = NewFrameworkInfoWithRole("test-user", "test-name", nil, role)
+		assert.Nil(t, info, role)
+		assert.Error(t, err, role)
+	}
+}
+
 func TestNewMasterInfo(t *testing.T) {
 	master := NewMasterInfo("master-1", 1234, 5678)
 	if master == nil {
@@ -238,6 +252,35 @@ func TestNewCommandInfo(t *testing.T) {
 	}
 }
 
+func TestSandboxPath(t *testing.T) {
+	status := NewTaskStatus(NewTaskID("task-1"), mesos.TaskState_TASK_RUNNING)
+	status.SlaveId = NewSlaveID("slave-1")
+	status.ExecutorId = NewExecutorID("exec-1")
+
+	path, ok := SandboxPath(status, "http://10.0.0.1:5051/files/browse.json?path=/tmp/mesos/slaves/slave-1/frameworks/framework-1/")
+	if !ok {
+		t.Fatal("Sandbox path not derived from a complete status")
+	}
+	if path != "http://10.0.0.1:5051/files/browse.json?path=/tmp/mesos/slaves/slave-1/frameworks/framework-1/executors/exec-1/runs/latest" {
+		t.Fatalf("Unexpected sandbox path %q", path)
+	}
+
+	// the command executor is named after the task.
+	status.ExecutorId = nil
+	path, ok = SandboxPath(status, "/tmp/mesos/slaves/slave-1/frameworks/framework-1")
+	if !ok || path != "/tmp/mesos/slaves/slave-1/frameworks/framework-1/executors/task-1/runs/latest" {
+		t.Fatalf("Unexpected sandbox path %q", path)
+	}
+
+	if _, ok = SandboxPath(status, "/tmp/mesos/slaves/slave-2/frameworks/framework-1"); ok {
+		t.Fatal("Sandbox path derived on another slave")
+	}
+	status.SlaveId = nil
+	if _, ok = SandboxPath(status, "/tmp/mesos/slaves/slave-1/frameworks/framework-1"); ok {
+		t.Fatal("Sandbox path derived without a slave ID")
+	}
+}
+
 func TestNewExecutorInfo(t *testing.T) {
 	info := NewExecutorInfo(NewExecutorID("exec-1"), NewCommandInfo("ls -l"))
 	if info == nil {
@@ -250,3 +293,45 @@ func TestNewExecutorInfo(t *testing.T) {
 		t.Fatal("Protobuf object ExecutorInfo.Command missing")
 	}
 }
+
+func TestSetTaskUser(t *testing.T) {
+	task := NewTaskInfo("task-1", NewTaskID("task-1"), NewSlaveID("slave-1"), nil)
+	task.Command = NewCommandInfo("ls -l")
+	SetTaskUser(task, "nobody")
+	if task.GetCommand().GetUser() != "nobody" {
+		t.Fatal("Protobuf object TaskInfo.Command.User missing")
+	}
+
+	task = NewTaskInfo("task-2", NewTaskID("task-2"), NewSlaveID("slave-1"), nil)
+	task.Executor = NewExecutorInfo(NewExecutorID("exec-1"), NewCommandInfo("ls -l"))
+	SetTaskUser(task, "nobody")
+	if task.GetExecutor().GetCommand().GetUser() != "nobody" {
+		t.Fatal("Protobuf object TaskInfo.Executor.Command.User missing")
+	}
+	if task.Command != nil {
+		t.Fatal("Protobuf object TaskInfo.Command unexpectedly set")
+	}
+}
+
+func TestSetTaskEnv(t *testing.T) {
+	task := NewTaskInfo("task-1", NewTaskID("task-1"), NewSlaveID("slave-1"), nil)
+	SetTaskEnv(task, "FOO", "bar")
+	if task.Command != nil {
+		t.Fatal("Protobuf object TaskInfo.Command unexpectedly set")
+	}
+
+	task.Command = NewCommandInfo("ls -l")
+	SetTaskEnv(task, "FOO", "bar")
+	SetTaskEnv(task, "FOO", "baz")
+	vars := task.GetCommand().GetEnvironment().GetVariables()
+	if len(vars) != 1 || vars[0].GetName() != "FOO" || vars[0].GetValue() != "baz" {
+		t.Fatalf("Unexpected environment %v", vars)
+	}
+
+	task.Executor = NewExecutorInfo(NewExecutorID("exec-1"), NewCommandInfo("ls -l"))
+	SetTaskEnv(task, "FOO", "qux")
+	vars = task.GetExecutor().GetCommand().GetEnvironment().GetVariables()
+	if len(vars) != 1 || vars[0].GetValue() != "qux" {
+		t.Fatalf("Unexpected executor environment %v", vars)
+	}
+}
@@ -0,0 +1,143 @@
+package messenger
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// trackedConn is a connection dialed by an HTTPTransporter, it records
+// its activity so that the transporter is able to tell how long it has
+// been idle in the pool.
+type trackedConn struct {
+	net.Conn
+	t         *HTTPTransporter
+	lastRead  int64 // unix nanos of the last bytes received
+	lastWrite int64 // unix nanos of the last bytes sent
+	reused    int32 // 1 once a response was received on the connection
+	closeOnce sync.Once
+}
+
+func newTrackedConn(t *HTTPTransporter, conn net.Conn) *trackedConn {
+	now := time.Now().UnixNano()
+	return &trackedConn{Conn: conn, t: t, lastRead: now, lastWrite: now}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		atomic.StoreInt32(&c.reused, 1)
+	}
+	return n, c.wrapError(err)
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	}
+	return n, c.wrapError(err)
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.t.connLock.Lock()
+		delete(c.t.conns, c)
+		c.t.connLock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// wrapError marks the failure of a connection that was reused from the
+// pool, so that the request it carried is retried on a new connection.
+func (c *trackedConn) wrapError(err error) error {
+	if err != nil && atomic.LoadInt32(&c.reused) == 1 && isResetError(err) {
+		return &staleConnError{err}
+	}
+	return err
+}
+
+// idleFor returns the time since the last response was received on the
+// connection, zero while a request is waiting for its response.
+func (c *trackedConn) idleFor(now time.Time) time.Duration {
+	lastRead, lastWrite := atomic.LoadInt64(&c.lastRead), atomic.LoadInt64(&c.lastWrite)
+	if lastWrite > lastRead {
+		return 0
+	}
+	return now.Sub(time.Unix(0, lastRead))
+}
+
+// staleConnError is the failure of a pooled connection that was silently
+// dropped while idle, typically by a firewall.
+type staleConnError struct {
+	Err error
+}
+
+func (e *staleConnError) Error() string { return e.Err.Error() }
+func (e *staleConnError) Unwrap() error { return e.Err }
+
+// isResetError tells whether err reports a connection closed by the
+// other end or by a middlebox.
+func isResetError(err error) bool {
+	operr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	return operr.Op == "read" || operr.Op == "write"
+}
+
+// isStaleConnError tells whether err is the failure of a request sent on
+// a pooled connection that turned out to be dead, see staleConnError.
+func isStaleConnError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *staleConnError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case interface {
+			Unwrap() error
+		}:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// track registers conn so that it is closed once idle for too long.
+func (t *HTTPTransporter) track(conn *trackedConn) {
+	t.connLock.Lock()
+	t.conns[conn] = struct{}{}
+	t.connLock.Unlock()
+}
+
+// closeStaleConns closes the pooled connections idle for longer than the
+// IdleConn timeout, so that the next message dials a new connection
+// instead of hitting one dropped while idle.
+func (t *HTTPTransporter) closeStaleConns() {
+	if t.timeouts.IdleConn <= 0 {
+		return
+	}
+	now := time.Now()
+	var stale []*trackedConn
+	t.connLock.Lock()
+	for conn := range t.conns {
+		if conn.idleFor(now) > t.timeouts.IdleConn {
+			stale = append(stale, conn)
+		}
+	}
+	t.connLock.Unlock()
+
+	for _, conn := range stale {
+		log.V(1).Infof("Closing connection to %v, idle for more than %v\n", conn.RemoteAddr(), t.timeouts.IdleConn)
+		conn.Close()
+		t.metrics.Increment(MetricStaleConnsAvoided)
+	}
+}
@@ -0,0 +1,142 @@
+package messenger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// connKillingServer accepts the messages of a transporter, the first
+// connection is reset on receipt of its second message, like a connection
+// dropped by a firewall while idle.
+type connKillingServer struct {
+	ln       net.Listener
+	conns    int32 // connections accepted
+	received int32 // messages accepted
+}
+
+func newConnKillingServer(t *testing.T) *connKillingServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &connKillingServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, atomic.AddInt32(&s.conns, 1))
+		}
+	}()
+	return s
+}
+
+func (s *connKillingServer) serve(conn net.Conn, n int32) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; ; i++ {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		if n == 1 && i == 1 {
+			conn.(*net.TCPConn).SetLinger(0) // reset the connection on close
+			return
+		}
+		atomic.AddInt32(&s.received, 1)
+		fmt.Fprint(conn, "HTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n")
+	}
+}
+
+func TestTransporterResendsOnStaleConnection(t *testing.T) {
+	srv := newConnKillingServer(t)
+	defer srv.ln.Close()
+
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+	toUpid, err := upid.Parse("testserver@" + srv.ln.Addr().String())
+	assert.NoError(t, err)
+	protoMsg := testmessage.GenerateSmallMessage()
+	msg := &Message{UPID: toUpid, Name: getMessageName(protoMsg), ProtoMessage: protoMsg}
+
+	transport := NewHTTPTransporter(fromUpid)
+	metrics := newCountingMetrics()
+	transport.SetMetrics(metrics)
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.Equal(t, 0, metrics.count(MetricStaleConnsAvoided))
+
+	// the pooled connection is reset, the message is resent on a new one.
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.conns))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.received))
+	assert.Equal(t, 1, metrics.count(MetricStaleConnsAvoided))
+}
+
+func TestTransporterClosesIdleConnections(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+	toUpid, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+	protoMsg := testmessage.GenerateSmallMessage()
+	msg := &Message{UPID: toUpid, Name: getMessageName(protoMsg), ProtoMessage: protoMsg}
+
+	transport := NewHTTPTransporter(fromUpid)
+	transport.SetTimeouts(HTTPTimeouts{IdleConn: 100 * time.Millisecond})
+	metrics := newCountingMetrics()
+	transport.SetMetrics(metrics)
+
+	// a connection used recently is reused.
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+
+	// an idle connection is replaced.
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conns))
+	assert.Equal(t, 1, metrics.count(MetricStaleConnsAvoided))
+	transport.connLock.Lock()
+	assert.Equal(t, 1, len(transport.conns))
+	transport.connLock.Unlock()
+
+	// so is an idle warm connection.
+	assert.NoError(t, transport.Warmup(context.TODO(), toUpid))
+	time.Sleep(150 * time.Millisecond)
+	transport.tr.CloseIdleConnections()
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&transport.warmHits))
+	assert.Equal(t, 2, metrics.count(MetricStaleConnsAvoided))
+}
+
+func TestTransporterKeepAlive(t *testing.T) {
+	transport := NewHTTPTransporter(&upid.UPID{ID: "mesos1", Host: "localhost"})
+	assert.True(t, transport.dialer().KeepAlive < 0)
+	transport.SetTimeouts(HTTPTimeouts{Dial: time.Second, KeepAlive: 30 * time.Second})
+	assert.Equal(t, time.Second, transport.dialer().Timeout)
+	assert.Equal(t, 30*time.Second, transport.dialer().KeepAlive)
+}
@@ -0,0 +1,101 @@
+package messenger
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+)
+
+const (
+	decodeErrorLogPeriod = time.Minute
+	maxDecodeErrorPeers  = 1024 // peers remembered by the decode error log
+)
+
+// DecodingTransporter is implemented by transporters that are able to
+// decode a message on receipt, so that a malformed one is rejected to its
+// sender instead of being accepted and dropped.
+type DecodingTransporter interface {
+	SetDecoder(decode func(*Message) error)
+}
+
+// decode unmarshals the bytes of a received message into the type
+// installed for its name. Failures are counted and logged at most once
+// per peer every decodeErrorLogPeriod.
+func (m *MesosMessenger) decode(msg *Message) error {
+	err := func() error {
+		mtype, ok := m.installedMessages[msg.Name]
+		if !ok {
+			return fmt.Errorf("Message %v is not installed", msg.Name)
+		}
+		pbMsg := reflect.New(mtype).Interface().(proto.Message)
+		if err := Unmarshal(msg.Bytes, pbMsg); err != nil {
+			return fmt.Errorf("Failed to decode message %v from %v: %v", msg.Name, msg.UPID, err)
+		}
+		msg.ProtoMessage = pbMsg
+		return nil
+	}()
+	if err == nil {
+		IncrementLabeled(m.metrics, MetricMessagesReceived, messageLabels(msg))
+	} else {
+		atomic.AddUint64(&m.decodeErrors, 1)
+		IncrementLabeled(m.metrics, MetricDecodeErrors, messageLabels(msg))
+		if m.decodeLog.allow(msg.UPID.String(), time.Now()) {
+			log.Errorln(err)
+		}
+	}
+	return err
+}
+
+// Unmarshal is proto.Unmarshal, except that a panic of the generated
+// decoders on malformed input is returned as an error.
+func Unmarshal(data []byte, msg proto.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed %T: %v", msg, r)
+		}
+	}()
+	return proto.Unmarshal(data, msg)
+}
+
+// DecodeErrors returns the number of received messages that could not be
+// decoded.
+func (m *MesosMessenger) DecodeErrors() uint64 {
+	return atomic.LoadUint64(&m.decodeErrors)
+}
+
+// peerLog limits logging to once per peer and period.
+type peerLog struct {
+	period time.Duration
+	lock   sync.Mutex
+	last   map[string]time.Time // key:peer
+}
+
+func newPeerLog(period time.Duration) *peerLog {
+	return &peerLog{period: period, last: make(map[string]time.Time)}
+}
+
+func (l *peerLog) allow(peer string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if last, ok := l.last[peer]; ok && now.Sub(last) < l.period {
+		return false
+	}
+	if len(l.last) >= maxDecodeErrorPeers {
+		// the sender's pid is not authenticated, don't let it grow the map.
+		for p, last := range l.last {
+			if now.Sub(last) >= l.period {
+				delete(l.last, p)
+			}
+		}
+		if len(l.last) >= maxDecodeErrorPeers {
+			return false
+		}
+	}
+	l.last[peer] = now
+	return true
+}
@@ -0,0 +1,82 @@
+package messenger
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessengerRejectsMalformedMessages(t *testing.T) {
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	rcvd := make(chan proto.Message, 1)
+	assert.NoError(t, m.Install(func(from *upid.UPID, msg proto.Message) {
+		rcvd <- msg
+	}, &testmessage.SmallMessage{}))
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	valid, err := proto.Marshal(&testmessage.SmallMessage{Values: []string{"hello"}})
+	assert.NoError(t, err)
+	tests := []struct {
+		name   string
+		path   string
+		body   []byte
+		status int
+	}{
+		{"truncated", "/mesos/mesos.internal.SmallMessage", valid[:len(valid)-1], http.StatusBadRequest},
+		{"length overflow", "/mesos/mesos.internal.SmallMessage", []byte("\x0a\xff\xff\xff\xff\xff\xff\xff\xff\x7f"), http.StatusBadRequest},
+		{"valid", "/mesos/mesos.internal.SmallMessage", valid, http.StatusAccepted},
+		{"query", "/mesos/mesos.internal.SmallMessage?x=/y", valid, http.StatusAccepted},
+	}
+	failed := uint64(0)
+	for _, test := range tests {
+		url := "http://" + m.UPID().Host + ":" + m.UPID().Port + test.path
+		req, err := http.NewRequest("POST", url, bytes.NewReader(test.body))
+		assert.NoError(t, err)
+		req.Header.Set("Libprocess-From", "peer(1)@127.0.0.1:5050")
+		rsp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, test.name) {
+			continue
+		}
+		rsp.Body.Close()
+		assert.Equal(t, test.status, rsp.StatusCode, test.name)
+
+		if test.status == http.StatusAccepted {
+			select {
+			case msg := <-rcvd:
+				assert.Equal(t, []string{"hello"}, msg.(*testmessage.SmallMessage).Values, test.name)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: message was not dispatched.", test.name)
+			}
+		} else {
+			failed++
+		}
+		assert.Equal(t, failed, m.DecodeErrors(), test.name)
+	}
+	assert.Equal(t, 0, len(rcvd))
+}
+
+func TestPeerLog(t *testing.T) {
+	l := newPeerLog(time.Minute)
+	now := time.Now()
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now.Add(30*time.Second)))
+	assert.True(t, l.allow("b", now.Add(30*time.Second)))
+	assert.True(t, l.allow("a", now.Add(time.Minute)))
+
+	// the peers remembered are bounded.
+	for i := 0; i < maxDecodeErrorPeers; i++ {
+		l.allow(strconv.Itoa(i), now.Add(time.Minute))
+	}
+	assert.Equal(t, maxDecodeErrorPeers, len(l.last))
+	assert.False(t, l.allow("c", now.Add(time.Minute)))
+	assert.True(t, l.allow("c", now.Add(2*time.Minute)))
+	assert.True(t, len(l.last) <= maxDecodeErrorPeers)
+}
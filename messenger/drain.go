@@ -0,0 +1,43 @@
+package messenger
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// how often Drain checks whether the outgoing messages were all sent.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drainer is implemented by messengers that are able to wait for their
+// outgoing messages to be sent, e.g. before stopping.
+type Drainer interface {
+	// Drain waits until the messages queued so far have been sent, or
+	// failed to be, or until ctx is done.
+	Drain(ctx context.Context) error
+}
+
+// Drain waits until the messages accepted by Send have been sent, or
+// failed to be. It fails when ctx is done or the messenger is stopped
+// first.
+func (m *MesosMessenger) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&m.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages are still queued: %v", atomic.LoadInt64(&m.pending), ctx.Err())
+		case <-m.stop:
+			return fmt.Errorf("Messenger stopped with %d messages queued", atomic.LoadInt64(&m.pending))
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// done accounts for a message accepted by Send that was sent, or dropped.
+func (m *MesosMessenger) done() {
+	atomic.AddInt64(&m.pending, -1)
+}
@@ -0,0 +1,75 @@
+package messenger
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMessengerDrain(t *testing.T) {
+	const count = 5
+	var rcvd int32
+	release := make(chan struct{})
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(rsp http.ResponseWriter, req *http.Request) {
+		<-release
+		atomic.AddInt32(&rcvd, 1)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer srv.Close()
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	failed := make(chan struct{}, 1)
+	m.OnSendFailure(func(*Message, error) { failed <- struct{}{} })
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	for i := 0; i < count; i++ {
+		assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{}))
+	}
+
+	// the receiver holds the messages, draining times out.
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, m.Drain(ctx))
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, m.Drain(ctx))
+	assert.Equal(t, int32(count), atomic.LoadInt32(&rcvd))
+
+	// failed messages are drained too.
+	srv.Close()
+	assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{}))
+	assert.NoError(t, m.Drain(ctx))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&m.pending))
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tired of waiting for the send failure.")
+	}
+}
+
+func TestMessengerDrainStopped(t *testing.T) {
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(http.ResponseWriter, *http.Request) {
+		time.Sleep(time.Second)
+	})
+	defer srv.Close()
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	assert.NoError(t, m.Start())
+	assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{}))
+	assert.NoError(t, m.Stop())
+	assert.Error(t, m.Drain(context.TODO()))
+}
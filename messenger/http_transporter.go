@@ -20,12 +20,16 @@ package messenger
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"github.com/mesos/mesos-go/upid"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -39,25 +43,184 @@ type HTTPTransporter struct {
 	listener     net.Listener // TODO(yifan): Change to TCPListener.
 	mux          *http.ServeMux
 	tr           *http.Transport
-	client       *http.Client // TODO(yifan): Set read/write deadline.
+	client       *http.Client
+	tlsConfig    *tls.Config // nil for plain HTTP
+	timeouts     HTTPTimeouts
 	messageQueue chan *Message
+	decode       func(*Message) error // nil to leave decoding to the receiver
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+	warmLock     sync.Mutex
+	warmConns    map[string]net.Conn // pre-connected, unused connections, key:host:port
+	dials        uint64              // connections dialed on demand
+	warmHits     uint64              // warm connections handed to requests
+	connLock     sync.Mutex
+	conns        map[*trackedConn]struct{} // open connections, guarded by connLock
+	metrics      Metrics
+}
+
+// HTTPTimeouts bounds the time an HTTPTransporter spends sending a
+// message, a zero duration means no limit.
+type HTTPTimeouts struct {
+	Dial           time.Duration // connecting to the receiver
+	ResponseHeader time.Duration // waiting for the receiver to accept the message
+	Request        time.Duration // the whole request, connecting included
+
+	// KeepAlive is the period of the TCP keepalive probes of the
+	// connections, zero disables them.
+	KeepAlive time.Duration
+	// IdleConn is the time after which an unused connection is closed
+	// instead of being reused, zero keeps the connections open. It should
+	// be lower than the idle timeout of the firewalls on the way.
+	IdleConn time.Duration
 }
 
 // NewHTTPTransporter creates a new http transporter.
 func NewHTTPTransporter(upid *upid.UPID) *HTTPTransporter {
-	tr := &http.Transport{}
-	return &HTTPTransporter{
+	t := &HTTPTransporter{
 		upid:         upid,
 		messageQueue: make(chan *Message, defaultQueueSize),
+		stopCh:       make(chan struct{}),
 		mux:          http.NewServeMux(),
-		client:       &http.Client{Transport: tr},
-		tr:           tr,
+		warmConns:    make(map[string]net.Conn),
+		conns:        make(map[*trackedConn]struct{}),
+		metrics:      NoopMetrics{},
+	}
+	t.tr = &http.Transport{Dial: t.dial}
+	t.client = &http.Client{Transport: t.tr, CheckRedirect: noRedirect}
+	return t
+}
+
+// NewHTTPSTransporter creates a new http transporter sending messages
+// over HTTPS with the given config. The transporter also serves HTTPS if
+// config has certificates, plain HTTP otherwise.
+func NewHTTPSTransporter(upid *upid.UPID, config *tls.Config) *HTTPTransporter {
+	t := NewHTTPTransporter(upid)
+	t.tlsConfig = config
+	t.tr.TLSClientConfig = config
+	return t
+}
+
+// SetTimeouts bounds the time spent sending messages, a send that times
+// out fails. It must be called before the transporter is started.
+func (t *HTTPTransporter) SetTimeouts(timeouts HTTPTimeouts) {
+	t.timeouts = timeouts
+	t.tr.ResponseHeaderTimeout = timeouts.ResponseHeader
+	t.client.Timeout = timeouts.Request
+}
+
+// SetMetrics installs the metrics the transporter reports to, they are
+// discarded by default. Call it before Start.
+func (t *HTTPTransporter) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	t.metrics = metrics
+}
+
+// dial hands out a warm connection to addr if there is one, otherwise
+// it connects on demand.
+func (t *HTTPTransporter) dial(network, addr string) (net.Conn, error) {
+	t.warmLock.Lock()
+	conn, ok := t.warmConns[addr]
+	delete(t.warmConns, addr)
+	t.warmLock.Unlock()
+
+	if ok {
+		tc := conn.(*trackedConn)
+		if t.timeouts.IdleConn <= 0 || tc.idleFor(time.Now()) <= t.timeouts.IdleConn {
+			atomic.AddUint64(&t.warmHits, 1)
+			log.V(2).Infof("Reusing warm connection to %s\n", addr)
+			t.track(tc)
+			return tc, nil
+		}
+		log.V(1).Infof("Closing warm connection to %s, idle for more than %v\n", addr, t.timeouts.IdleConn)
+		tc.Close()
+		t.metrics.Increment(MetricStaleConnsAvoided)
+	}
+	atomic.AddUint64(&t.dials, 1)
+	conn, err := t.dialer().Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := newTrackedConn(t, conn)
+	t.track(tc)
+	return tc, nil
+}
+
+func (t *HTTPTransporter) dialer() *net.Dialer {
+	keepAlive := t.timeouts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = -1 // disabled
+	}
+	return &net.Dialer{Timeout: t.timeouts.Dial, KeepAlive: keepAlive}
+}
+
+// Warmup resolves and connects to the process at upid ahead of time,
+// the next message sent to it reuses the connection.
+func (t *HTTPTransporter) Warmup(ctx context.Context, upid *upid.UPID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(upid.Host, upid.Port)
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		conn, err := t.dialer().Dial("tcp", addr)
+		if err != nil {
+			c <- result{nil, err}
+			return
+		}
+		c <- result{newTrackedConn(t, conn), nil}
+	}()
+
+	var r result
+	select {
+	case <-ctx.Done():
+		go func() {
+			// close the connection once the abandoned dial completes.
+			if r := <-c; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return ctx.Err()
+	case r = <-c:
+	}
+	if r.err != nil {
+		return r.err
 	}
+
+	t.warmLock.Lock()
+	if old, ok := t.warmConns[addr]; ok {
+		old.Close()
+	}
+	t.warmConns[addr] = r.conn
+	t.warmLock.Unlock()
+	log.V(2).Infof("Warmed up connection to %s\n", addr)
+	return nil
 }
 
-// Send sends the message to its specified upid.
+// Send sends the message to its specified upid. A message sent on a
+// pooled connection that turns out to have been dropped while idle is
+// sent again, once, on a new connection.
 func (t *HTTPTransporter) Send(ctx context.Context, msg *Message) error {
 	log.V(2).Infof("Sending message to %v via http\n", msg.UPID)
+	t.closeStaleConns()
+	err := t.send(ctx, msg)
+	if err != nil && isStaleConnError(err) && ctx.Err() == nil {
+		log.V(1).Infof("Resending message to %v on a new connection: %v\n", msg.UPID, err)
+		t.metrics.Increment(MetricStaleConnsAvoided)
+		// the other pooled connections may have been dropped as well.
+		t.tr.CloseIdleConnections()
+		err = t.send(ctx, msg)
+	}
+	return err
+}
+
+func (t *HTTPTransporter) send(ctx context.Context, msg *Message) error {
 	req, err := t.makeLibprocessRequest(msg)
 	if err != nil {
 		log.Errorf("Failed to make libprocess request: %v\n", err)
@@ -73,6 +236,14 @@ func (t *HTTPTransporter) Send(ctx context.Context, msg *Message) error {
 		// ensure master acknowledgement.
 		if (resp.StatusCode != http.StatusOK) &&
 			(resp.StatusCode != http.StatusAccepted) {
+			leader, ok, err := ParseLeaderHint(resp)
+			if err != nil {
+				log.Warningf("Ignoring the leader hint of master %s: %v\n", msg.UPID, err)
+			} else if ok {
+				err := &LeaderRedirectError{Master: msg.UPID, Leader: leader, Status: resp.Status}
+				log.Warning(err)
+				return err
+			}
 			msg := fmt.Sprintf("Master %s rejected %s.  Returned status %s.", msg.UPID, msg.RequestURI(), resp.Status)
 			log.Warning(msg)
 			return fmt.Errorf(msg)
@@ -81,6 +252,13 @@ func (t *HTTPTransporter) Send(ctx context.Context, msg *Message) error {
 	})
 }
 
+// noRedirect keeps the client from following the redirect of a standby
+// master to the leader, the receiver of a message is chosen by its sender,
+// see LeaderRedirectError.
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
 func (t *HTTPTransporter) httpDo(ctx context.Context, req *http.Request, f func(*http.Response, error) error) error {
 	c := make(chan error, 1)
 	go func() { c <- f(t.client.Do(req)) }()
@@ -94,9 +272,15 @@ func (t *HTTPTransporter) httpDo(ctx context.Context, req *http.Request, f func(
 	}
 }
 
-// Recv returns the message, one at a time.
+// Recv returns the message, one at a time. It returns nil once the
+// transporter is stopped.
 func (t *HTTPTransporter) Recv() *Message {
-	return <-t.messageQueue
+	select {
+	case <-t.stopCh:
+		return nil
+	case msg := <-t.messageQueue:
+		return msg
+	}
 }
 
 //Inject places a message into the incoming message queue.
@@ -115,6 +299,18 @@ func (t *HTTPTransporter) Install(msgName string) {
 	t.mux.HandleFunc(requestURI, t.messageHandler)
 }
 
+// Handle serves handler at pattern, along with the messages.
+func (t *HTTPTransporter) Handle(pattern string, handler http.Handler) (err error) {
+	defer func() {
+		// the mux panics on a conflicting pattern.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unable to serve %s: %v", pattern, r)
+		}
+	}()
+	t.mux.Handle(pattern, handler)
+	return nil
+}
+
 // Listen starts listen on UPID. If UPID is empty, the transporter
 // will listen on a random port, and then fill the UPID with the
 // host:port it is listening.
@@ -128,8 +324,13 @@ func (t *HTTPTransporter) Listen() error {
 		port = "0"
 	}
 	// NOTE: Explicitly specifis IPv4 because Libprocess
-	// only supports IPv4 for now.
-	ln, err := net.Listen("tcp4", net.JoinHostPort(host, port))
+	// only supports IPv4 for now, unless an IPv6 address is
+	// requested.
+	network := "tcp4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "tcp6"
+	}
+	ln, err := net.Listen(network, net.JoinHostPort(host, port))
 	if err != nil {
 		log.Errorf("HTTPTransporter failed to listen: %v\n", err)
 		return err
@@ -137,6 +338,9 @@ func (t *HTTPTransporter) Listen() error {
 	// Save the host:port in case they are not specified in upid.
 	host, port, _ = net.SplitHostPort(ln.Addr().String())
 	t.upid.Host, t.upid.Port = host, port
+	if t.tlsConfig != nil && len(t.tlsConfig.Certificates) > 0 {
+		ln = tls.NewListener(ln, t.tlsConfig)
+	}
 	t.listener = ln
 	return nil
 }
@@ -151,9 +355,24 @@ func (t *HTTPTransporter) Start() error {
 	return nil
 }
 
-// Stop stops the http transporter by closing the listener.
-func (t *HTTPTransporter) Stop() error {
-	return t.listener.Close()
+// Stop stops the http transporter by closing the listener and the
+// idle connections. It is safe to call Stop more than once, or before
+// Listen.
+func (t *HTTPTransporter) Stop() (err error) {
+	t.stopOnce.Do(func() {
+		close(t.stopCh)
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+		t.warmLock.Lock()
+		for addr, conn := range t.warmConns {
+			conn.Close()
+			delete(t.warmConns, addr)
+		}
+		t.warmLock.Unlock()
+		t.tr.CloseIdleConnections()
+	})
+	return err
 }
 
 // UPID returns the upid of the transporter.
@@ -176,17 +395,37 @@ func (t *HTTPTransporter) messageHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	log.V(2).Infof("Receiving message from %v, length %v\n", from, len(data))
-	w.WriteHeader(http.StatusAccepted)
-	t.messageQueue <- &Message{
+	msg := &Message{
 		UPID:  from,
-		Name:  extractNameFromRequestURI(r.RequestURI),
+		Name:  extractNameFromRequestURI(r.URL.Path),
 		Bytes: data,
 	}
+	if t.decode != nil && t.decode(msg) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	select {
+	case <-t.stopCh:
+		log.V(2).Infof("Dropping message from %v, transporter is stopped\n", from)
+	case t.messageQueue <- msg:
+	}
+}
+
+// SetDecoder installs the function decoding the messages on receipt, a
+// message it fails to decode is answered with 400 Bad Request. Call it
+// before Start.
+func (t *HTTPTransporter) SetDecoder(decode func(*Message) error) {
+	t.decode = decode
 }
 
 func (t *HTTPTransporter) makeLibprocessRequest(msg *Message) (*http.Request, error) {
 	hostport := net.JoinHostPort(msg.UPID.Host, msg.UPID.Port)
-	targetURL := fmt.Sprintf("http://%s%s", hostport, msg.RequestURI())
+	scheme := "http"
+	if t.tlsConfig != nil {
+		scheme = "https"
+	}
+	targetURL := fmt.Sprintf("%s://%s%s", scheme, hostport, msg.RequestURI())
 	log.V(2).Infof("libproc target URL %s", targetURL)
 	req, err := http.NewRequest("POST", targetURL, bytes.NewReader(msg.Bytes))
 	if err != nil {
@@ -1,11 +1,14 @@
 package messenger
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,6 +61,144 @@ func TestTransporterSend(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTransporterSendTimeout(t *testing.T) {
+	serverId := "testserver"
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+	protoMsg := testmessage.GenerateSmallMessage()
+	msgName := getMessageName(protoMsg)
+
+	// the server never responds.
+	release := make(chan struct{})
+	srv := makeMockServer(fmt.Sprintf("/%s/%s", serverId, msgName), func(rsp http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	defer srv.Close()
+	defer close(release)
+	toUpid, err := upid.Parse(fmt.Sprintf("%s@%s", serverId, srv.Listener.Addr().String()))
+	assert.NoError(t, err)
+
+	for _, timeouts := range []HTTPTimeouts{
+		{ResponseHeader: 100 * time.Millisecond},
+		{Request: 100 * time.Millisecond},
+	} {
+		transport := NewHTTPTransporter(fromUpid)
+		transport.SetTimeouts(timeouts)
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- transport.Send(context.TODO(), &Message{UPID: toUpid, Name: msgName, ProtoMessage: protoMsg})
+		}()
+		select {
+		case err := <-errCh:
+			assert.Error(t, err, "%+v", timeouts)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Send did not time out with %+v.", timeouts)
+		}
+	}
+}
+
+func TestTransporterSendTLS(t *testing.T) {
+	serverId := "testserver"
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+
+	protoMsg := testmessage.GenerateSmallMessage()
+	msgName := getMessageName(protoMsg)
+	requestURI := fmt.Sprintf("/%s/%s", serverId, msgName)
+
+	received := make(chan *http.Request, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(requestURI, func(rsp http.ResponseWriter, req *http.Request) {
+		received <- req
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+	toUpid, err := upid.Parse(fmt.Sprintf("%s@%s", serverId, srv.Listener.Addr().String()))
+	assert.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	transport := NewHTTPSTransporter(fromUpid, &tls.Config{RootCAs: roots})
+	msg := &Message{UPID: toUpid, Name: msgName, ProtoMessage: protoMsg}
+	req, err := transport.makeLibprocessRequest(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "https", req.URL.Scheme)
+	assert.NoError(t, transport.Send(context.TODO(), msg))
+
+	select {
+	case req := <-received:
+		assert.NotNil(t, req.TLS)
+		assert.Equal(t, fromUpid.String(), req.Header.Get("Libprocess-From"))
+		assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+	case <-time.After(time.Second):
+		t.Fatalf("Message was not received over TLS.")
+	}
+
+	// the server certificate is not trusted by default.
+	untrusted := NewHTTPSTransporter(fromUpid, &tls.Config{})
+	assert.Error(t, untrusted.Send(context.TODO(), msg))
+}
+
+func TestTransporterRequestURLIPv6(t *testing.T) {
+	transport := NewHTTPTransporter(&upid.UPID{ID: "mesos1", Host: "::1", Port: "5051"})
+	for _, tc := range []struct {
+		to   *upid.UPID
+		host string
+	}{
+		{&upid.UPID{ID: "master", Host: "::1", Port: "5050"}, "[::1]:5050"},
+		{&upid.UPID{ID: "master", Host: "2001:db8::10", Port: "5050"}, "[2001:db8::10]:5050"},
+		{&upid.UPID{ID: "master", Host: "127.0.0.1", Port: "5050"}, "127.0.0.1:5050"},
+	} {
+		msg := &Message{UPID: tc.to, Name: "mesos.internal.SmallMessage"}
+		req, err := transport.makeLibprocessRequest(msg)
+		if !assert.NoError(t, err, tc.host) {
+			continue
+		}
+		assert.Equal(t, tc.host, req.URL.Host)
+		assert.Equal(t, "http://"+tc.host+"/master/mesos.internal.SmallMessage", req.URL.String())
+		assert.Equal(t, "mesos1@[::1]:5051", req.Header.Get("Libprocess-From"))
+	}
+}
+
+func TestTransporterWarmupReusesConnection(t *testing.T) {
+	serverId := "testserver"
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+
+	protoMsg := testmessage.GenerateSmallMessage()
+	msgName := getMessageName(protoMsg)
+	srv := makeMockServer(fmt.Sprintf("/%s/%s", serverId, msgName), func(rsp http.ResponseWriter, req *http.Request) {})
+	defer srv.Close()
+	toUpid, err := upid.Parse(fmt.Sprintf("%s@%s", serverId, srv.Listener.Addr().String()))
+	assert.NoError(t, err)
+
+	transport := NewHTTPTransporter(fromUpid)
+	err = transport.Warmup(context.TODO(), toUpid)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(transport.warmConns))
+
+	err = transport.Send(context.TODO(), &Message{UPID: toUpid, Name: msgName, ProtoMessage: protoMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&transport.warmHits))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&transport.dials))
+	assert.Equal(t, 0, len(transport.warmConns))
+}
+
+func TestTransporterWarmupCancelled(t *testing.T) {
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+	toUpid, err := upid.Parse("testserver@127.0.0.1:5050")
+	assert.NoError(t, err)
+
+	transport := NewHTTPTransporter(fromUpid)
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err = transport.Warmup(ctx, toUpid)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(transport.warmConns))
+}
+
 func TestTransporterStartAndSend(t *testing.T) {
 	serverId := "testserver"
 	serverPort := getNewPort()
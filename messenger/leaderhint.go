@@ -0,0 +1,101 @@
+package messenger
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mesos/mesos-go/upid"
+)
+
+// maxHintBody bounds how much of the body of a response is searched for
+// a leader hint.
+const maxHintBody = 4096
+
+// leaderInBody matches the PID of the leader in the body of the response
+// of a standby master, e.g. "current leader is master@10.0.0.1:5050".
+var leaderInBody = regexp.MustCompile(`(?i)leader[^@]*?\s([^\s@]+@(?:\[[0-9A-Fa-f:.]+\]|[^\s:@]+):[0-9]+)`)
+
+// LeaderRedirectError is the failure of a message sent to a master that
+// is not the leader and pointed to the one that is, see ParseLeaderHint.
+type LeaderRedirectError struct {
+	Master *upid.UPID // the master the message was sent to
+	Leader *upid.UPID
+	Status string
+}
+
+func (e *LeaderRedirectError) Error() string {
+	return fmt.Sprintf("Master %v is not the leader, %v is.  Returned status %s.", e.Master, e.Leader, e.Status)
+}
+
+// ParseLeaderHint returns the leading master a standby master pointed to
+// in resp, if any. The masters either redirect to the leader with a
+// Location header, http://host:port, //host:port or a PID, or name the
+// leader in the body of the response. It returns false if resp holds no
+// hint, and an error if the hint is malformed. The body is read, up to
+// maxHintBody bytes, unless resp is a redirect.
+func ParseLeaderHint(resp *http.Response) (*upid.UPID, bool, error) {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil, false, nil
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if location := resp.Header.Get("Location"); location != "" {
+			leader, err := parseLocation(location)
+			if err != nil {
+				return nil, false, fmt.Errorf("Malformed leader hint %q: %v", location, err)
+			}
+			return leader, true, nil
+		}
+	}
+	if resp.Body == nil {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHintBody))
+	if err != nil {
+		return nil, false, err
+	}
+	m := leaderInBody.FindSubmatch(body)
+	if m == nil {
+		return nil, false, nil
+	}
+	leader, err := upid.Parse(string(m[1]))
+	if err != nil {
+		return nil, false, fmt.Errorf("Malformed leader hint %q: %v", m[1], err)
+	}
+	return leader, true, nil
+}
+
+// parseLocation parses the Location of a redirect to the leader, the id
+// of the PID is the first element of the path, "master" if there is none.
+func parseLocation(location string) (*upid.UPID, error) {
+	if strings.Contains(location, "@") && !strings.Contains(location, "/") {
+		return upid.Parse(location)
+	}
+	if !strings.Contains(location, "//") {
+		location = "//" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host")
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("no host or port")
+	}
+	id := "master"
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		id = strings.SplitN(path, "/", 2)[0]
+	}
+	return &upid.UPID{ID: id, Host: host, Port: port}, nil
+}
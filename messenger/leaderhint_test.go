@@ -0,0 +1,118 @@
+package messenger
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func readResponse(t *testing.T, name string) *http.Response {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "leaderhint", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestParseLeaderHint(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		leader  string // "" if there is no hint
+		fails   bool
+	}{
+		{fixture: "0.20_accepted.http"},
+		{fixture: "0.20_no_leader.http"},
+		{fixture: "0.20_redirect.http", leader: "master@10.0.0.2:5050"},
+		{fixture: "0.21_redirect.http", leader: "master@10.0.0.2:5050"},
+		{fixture: "0.21_redirect_ipv6.http", leader: "master@[fd00::2]:5050"},
+		{fixture: "0.21_leader_body.http", leader: "master@10.0.0.2:5050"},
+		{fixture: "garbage_location.http", fails: true},
+		{fixture: "garbage_location_port.http", fails: true},
+		{fixture: "garbage_body.http", fails: true},
+		{fixture: "garbage_no_port.http"},
+	} {
+		leader, ok, err := ParseLeaderHint(readResponse(t, tt.fixture))
+		if tt.fails {
+			assert.Error(t, err, tt.fixture)
+			assert.False(t, ok, tt.fixture)
+			continue
+		}
+		assert.NoError(t, err, tt.fixture)
+		assert.Equal(t, tt.leader != "", ok, tt.fixture)
+		assert.Equal(t, tt.leader, leader.String(), tt.fixture)
+	}
+}
+
+func TestParseLeaderHintLocation(t *testing.T) {
+	for location, leader := range map[string]string{
+		"10.0.0.2:5050":                    "master@10.0.0.2:5050",
+		"master@10.0.0.2:5050":             "master@10.0.0.2:5050",
+		"https://10.0.0.2:5050/master/":    "master@10.0.0.2:5050",
+		"//10.0.0.2:5050/scheduler(1)/foo": "scheduler(1)@10.0.0.2:5050",
+	} {
+		resp := &http.Response{StatusCode: http.StatusTemporaryRedirect, Header: http.Header{"Location": {location}}}
+		pid, ok, err := ParseLeaderHint(resp)
+		assert.NoError(t, err, location)
+		assert.True(t, ok, location)
+		assert.Equal(t, leader, pid.String(), location)
+	}
+}
+
+func TestParseLeaderHintGarbageBody(t *testing.T) {
+	// a long body is not read past maxHintBody.
+	body := strings.Repeat("x", maxHintBody) + " current leader is master@10.0.0.2:5050"
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Body: nopCloser{strings.NewReader(body)}}
+	pid, ok, err := ParseLeaderHint(resp)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, pid)
+
+	// a redirect without a Location may name the leader in its body.
+	resp = &http.Response{StatusCode: http.StatusTemporaryRedirect, Body: nopCloser{strings.NewReader("leader: master@10.0.0.3:5050")}}
+	pid, ok, err = ParseLeaderHint(resp)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "master@10.0.0.3:5050", pid.String())
+}
+
+type nopCloser struct {
+	*strings.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestTransporterSendLeaderRedirect(t *testing.T) {
+	fromUpid, err := upid.Parse(fmt.Sprintf("mesos1@localhost:%d", getNewPort()))
+	assert.NoError(t, err)
+
+	protoMsg := testmessage.GenerateSmallMessage()
+	msg := &Message{Name: getMessageName(protoMsg), ProtoMessage: protoMsg}
+	srv := makeMockServer("/master/"+msg.Name, func(rsp http.ResponseWriter, req *http.Request) {
+		http.Redirect(rsp, req, "//10.0.0.2:5050/master/redirect", http.StatusTemporaryRedirect)
+	})
+	defer srv.Close()
+	msg.UPID, err = upid.Parse("master@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	err = NewHTTPTransporter(fromUpid).Send(context.TODO(), msg)
+	redirect, ok := err.(*LeaderRedirectError)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	assert.Equal(t, msg.UPID, redirect.Master)
+	assert.Equal(t, "master@10.0.0.2:5050", redirect.Leader.String())
+}
@@ -19,9 +19,15 @@
 package messenger
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -37,15 +43,29 @@ const (
 )
 
 var (
-	sendRoutines   int
-	encodeRoutines int
-	decodeRoutines int
+	sendRoutines     int
+	encodeRoutines   int
+	decodeRoutines   int
+	sendQueueSize    int
+	sendQueueTimeout time.Duration
+	sendMaxAttempts  int
+	sendRetryBackoff time.Duration
+
+	// ErrQueueFull is returned by Send when the outgoing queue stayed full
+	// for send-queue-timeout.
+	ErrQueueFull = errors.New("outgoing message queue is full")
+
+	warnDeprecatedOnce sync.Once
 )
 
 func init() {
-	flag.IntVar(&sendRoutines, "send-routines", 1, "Number of network sending routines")
-	flag.IntVar(&encodeRoutines, "encode-routines", 1, "Number of encoding routines")
+	flag.IntVar(&sendRoutines, "send-routines", 1, "Deprecated, ignored: messages are sent by a single routine to keep their order")
+	flag.IntVar(&encodeRoutines, "encode-routines", 1, "Deprecated, ignored: messages are encoded by a single routine to keep their order")
 	flag.IntVar(&decodeRoutines, "decode-routines", 1, "Number of decoding routines")
+	flag.IntVar(&sendQueueSize, "send-queue-size", defaultQueueSize, "Number of outgoing messages queued before Send waits")
+	flag.DurationVar(&sendQueueTimeout, "send-queue-timeout", 5*time.Second, "Time Send waits for room in a full outgoing queue before failing")
+	flag.IntVar(&sendMaxAttempts, "send-max-attempts", 1, "Number of times a message is sent while the receiver cannot be connected to, 1 never retries")
+	flag.DurationVar(&sendRetryBackoff, "send-retry-backoff", 100*time.Millisecond, "Time before the first retry of a failed message, doubled on each retry")
 }
 
 // MessageHandler is the callback of the message. When the callback
@@ -62,15 +82,53 @@ type Messenger interface {
 	UPID() *upid.UPID
 }
 
+// Warmer is implemented by messengers that are able to connect to a
+// remote process ahead of the first message sent to it.
+type Warmer interface {
+	Warmup(ctx context.Context, upid *upid.UPID) error
+}
+
+// QueueReporter is implemented by messengers that queue outgoing
+// messages, so that their backlog can be monitored.
+type QueueReporter interface {
+	// QueueDepth returns the number of messages waiting to be sent.
+	QueueDepth() int
+}
+
+// SendFailureHandler is notified of a message that could not be delivered.
+type SendFailureHandler func(msg *Message, err error)
+
+// FailureNotifier is implemented by messengers that are able to report
+// undelivered messages to a handler, instead of reporting them as
+// framework errors.
+type FailureNotifier interface {
+	OnSendFailure(handler SendFailureHandler)
+}
+
 // MesosMessenger is an implementation of the Messenger interface.
+// Outgoing messages go through a bounded queue, a single routine sends
+// them in the order they were queued. The messages to a receiver that
+// cannot be connected to are retried, in order, by a routine of their own.
 type MesosMessenger struct {
 	upid              *upid.UPID
-	encodingQueue     chan *Message
-	sendingQueue      chan *Message
+	encodingQueue     chan *Message // the outgoing queue
+	sendingQueue      chan *Message // unbuffered, hands messages to the sender
 	installedMessages map[string]reflect.Type
 	installedHandlers map[string]MessageHandler
 	stop              chan struct{}
+	stopOnce          sync.Once
 	tr                Transporter
+	sendFailed        SendFailureHandler // nil to report failures as errors
+	queueTimeout      time.Duration
+	maxAttempts       int
+	retryBackoff      time.Duration
+	decodeRoutines    int
+	retryLock         sync.Mutex
+	retrying          map[string][]*Message // queued behind a retried message, key:UPID
+	decodeLog         *peerLog
+	metrics           Metrics
+	decodeErrors      uint64 // received messages that failed to decode
+	pending           int64  // messages accepted by Send, not yet sent or dropped
 }
 
 // NewMesosMessenger creates a new mesos messenger.
@@ -78,17 +136,76 @@ func NewHttp(upid *upid.UPID) *MesosMessenger {
 	return New(upid, NewHTTPTransporter(upid))
 }
 
+// NewHttps creates a new mesos messenger talking HTTPS with the given
+// config, see NewHTTPSTransporter.
+func NewHttps(upid *upid.UPID, config *tls.Config) *MesosMessenger {
+	return New(upid, NewHTTPSTransporter(upid, config))
+}
+
+// Options tune the queueing and the delivery of the messages of a
+// MesosMessenger, see the flags of the same name for their meaning.
+type Options struct {
+	SendQueueSize    int
+	SendQueueTimeout time.Duration
+	SendMaxAttempts  int
+	SendRetryBackoff time.Duration
+	DecodeRoutines   int
+}
+
+// DefaultOptions returns the options set by the command line flags.
+func DefaultOptions() Options {
+	return Options{
+		SendQueueSize:    sendQueueSize,
+		SendQueueTimeout: sendQueueTimeout,
+		SendMaxAttempts:  sendMaxAttempts,
+		SendRetryBackoff: sendRetryBackoff,
+		DecodeRoutines:   decodeRoutines,
+	}
+}
+
 func New(upid *upid.UPID, t Transporter) *MesosMessenger {
+	return NewWithOptions(upid, t, DefaultOptions())
+}
+
+// NewWithOptions is like New, but the messenger is tuned by opts instead
+// of the command line flags.
+func NewWithOptions(upid *upid.UPID, t Transporter, opts Options) *MesosMessenger {
+	warnDeprecatedOnce.Do(func() {
+		for _, name := range deprecatedFlags() {
+			log.Warningf("Flag %s is deprecated and ignored, messages are sent in order by a single routine\n", name)
+		}
+	})
 	return &MesosMessenger{
 		upid:              upid,
-		encodingQueue:     make(chan *Message, defaultQueueSize),
-		sendingQueue:      make(chan *Message, defaultQueueSize),
+		encodingQueue:     make(chan *Message, opts.SendQueueSize),
+		sendingQueue:      make(chan *Message),
 		installedMessages: make(map[string]reflect.Type),
 		installedHandlers: make(map[string]MessageHandler),
+		stop:              make(chan struct{}),
 		tr:                t,
+		queueTimeout:      opts.SendQueueTimeout,
+		maxAttempts:       opts.SendMaxAttempts,
+		retryBackoff:      opts.SendRetryBackoff,
+		decodeRoutines:    opts.DecodeRoutines,
+		retrying:          make(map[string][]*Message),
+		decodeLog:         newPeerLog(decodeErrorLogPeriod),
+		metrics:           NoopMetrics{},
 	}
 }
 
+// deprecatedFlags returns the names of the deprecated flags that are
+// set, to no effect.
+func deprecatedFlags() []string {
+	var names []string
+	if sendRoutines != 1 {
+		names = append(names, "send-routines")
+	}
+	if encodeRoutines != 1 {
+		names = append(names, "encode-routines")
+	}
+	return names
+}
+
 /// Install installs the handler with the given message.
 func (m *MesosMessenger) Install(handler MessageHandler, msg proto.Message) error {
 	// Check if the message is a pointer.
@@ -109,7 +226,8 @@ func (m *MesosMessenger) Install(handler MessageHandler, msg proto.Message) erro
 }
 
 // Send puts a message into the outgoing queue, waiting to be sent.
-// With buffered channels, this will not block under moderate throughput.
+// If the queue is full, Send waits up to send-queue-timeout for room
+// and then fails with ErrQueueFull.
 // When an error is generated, the error can be communicated by placing
 // a message on the incoming queue to be handled upstream.
 func (m *MesosMessenger) Send(ctx context.Context, upid *upid.UPID, msg proto.Message) error {
@@ -118,14 +236,41 @@ func (m *MesosMessenger) Send(ctx context.Context, upid *upid.UPID, msg proto.Me
 	}
 	name := getMessageName(msg)
 	log.V(2).Infof("Sending message %v to %v\n", name, upid)
+	message := &Message{upid, name, msg, nil}
+	atomic.AddInt64(&m.pending, 1)
+	select {
+	case m.encodingQueue <- message:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(m.queueTimeout)
+	defer timer.Stop()
 	select {
 	case <-ctx.Done():
+		m.done()
 		return ctx.Err()
-	case m.encodingQueue <- &Message{upid, name, msg, nil}:
+	case m.encodingQueue <- message:
 		return nil
+	case <-timer.C:
+		m.done()
+		log.Warningf("Dropping message %v to %v, %d messages are queued\n", name, upid, len(m.encodingQueue))
+		return ErrQueueFull
 	}
 }
 
+// QueueDepth returns the number of messages waiting to be sent.
+func (m *MesosMessenger) QueueDepth() int {
+	return len(m.encodingQueue)
+}
+
+// OnSendFailure installs the handler notified of the messages that could
+// not be delivered, by default they are reported as FrameworkErrorMessage.
+// Call it before Start.
+func (m *MesosMessenger) OnSendFailure(handler SendFailureHandler) {
+	m.sendFailed = handler
+}
+
 // Route puts a message either in the incoming or outgoing queue.
 // This method is useful for:
 // 1) routing internal error to callback handlers
@@ -151,9 +296,11 @@ func (m *MesosMessenger) Start() error {
 		return err
 	}
 	m.upid = m.tr.UPID()
+	if d, ok := m.tr.(DecodingTransporter); ok {
+		d.SetDecoder(m.decode)
+	}
 
-	m.stop = make(chan struct{})
-	errChan := make(chan error)
+	errChan := make(chan error, 1) // Start returns on Stop, after we stopped listening
 	go func() {
 		if err := m.tr.Start(); err != nil {
 			errChan <- err
@@ -165,25 +312,45 @@ func (m *MesosMessenger) Start() error {
 		return err
 	case <-time.After(preparePeriod):
 	}
-	for i := 0; i < sendRoutines; i++ {
-		go m.sendLoop()
-	}
-	for i := 0; i < encodeRoutines; i++ {
-		go m.encodeLoop()
-	}
-	for i := 0; i < decodeRoutines; i++ {
+	go func() {
+		// the transporter should only stop serving on Stop, report it
+		// upstream otherwise, no more messages will be received.
+		select {
+		case <-m.stop:
+		case err := <-errChan:
+			select {
+			case <-m.stop:
+			default:
+				m.reportError(fmt.Errorf("Messenger died, the transporter stopped serving: %v", err))
+			}
+		}
+	}()
+	go m.sendLoop()
+	go m.encodeLoop()
+	for i := 0; i < m.decodeRoutines; i++ {
 		go m.decodeLoop()
 	}
 	return nil
 }
 
-// Stop stops the messenger and clean up all the goroutines.
-func (m *MesosMessenger) Stop() error {
-	if err := m.tr.Stop(); err != nil {
-		log.Errorf("Failed to stop the transporter: %v\n", err)
-		return err
+// Stop stops the messenger and clean up all the goroutines. It is safe
+// to call Stop more than once, or on a messenger that was never started.
+func (m *MesosMessenger) Stop() (err error) {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		if err = m.tr.Stop(); err != nil {
+			log.Errorf("Failed to stop the transporter: %v\n", err)
+		}
+	})
+	return err
+}
+
+// Warmup pre-connects to the remote process if the transporter
+// supports it, otherwise it is a no-op.
+func (m *MesosMessenger) Warmup(ctx context.Context, upid *upid.UPID) error {
+	if w, ok := m.tr.(Warmer); ok {
+		return w.Warmup(ctx, upid)
 	}
-	close(m.stop)
 	return nil
 }
 
@@ -211,11 +378,14 @@ func (m *MesosMessenger) encodeLoop() {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
+				case <-m.stop:
+					return nil
 				case m.sendingQueue <- msg:
 					return nil
 				}
 			}()
 			if e != nil {
+				m.done()
 				m.reportError(fmt.Errorf("Failed to enqueue message %v: %v", msg, e))
 			}
 		}
@@ -244,30 +414,134 @@ func (m *MesosMessenger) sendLoop() {
 		case <-m.stop:
 			return
 		case msg := <-m.sendingQueue:
-			e := func() error {
-				//TODO(jdef) implement timeout for context
-				ctx, cancel := context.WithCancel(context.TODO())
-				defer cancel()
+			if m.queueRetry(msg) {
+				continue
+			}
+			start := time.Now()
+			e := m.send(msg)
+			if e != nil && m.maxAttempts > 1 && isConnectionError(e) {
+				m.startRetry(msg, e, start)
+				continue
+			}
+			m.finish(msg, e, time.Since(start))
+		}
+	}
+}
 
-				c := make(chan error, 1)
-				go func() { c <- m.tr.Send(ctx, msg) }()
+// finish accounts for a message that was sent, or failed to be.
+func (m *MesosMessenger) finish(msg *Message, err error, elapsed time.Duration) {
+	m.sent(msg, err, elapsed)
+	m.done()
+	if err != nil {
+		if m.sendFailed != nil {
+			m.sendFailed(msg, err)
+		} else {
+			m.reportError(fmt.Errorf("Failed to send message %v: %v", msg.Name, err))
+		}
+	}
+}
 
-				select {
-				case <-ctx.Done():
-					// Transport layer must use the context to detect cancelled requests.
-					<-c // wait for Send to return
-					return ctx.Err()
-				case err := <-c:
-					return err
-				}
-			}()
-			if e != nil {
-				m.reportError(fmt.Errorf("Failed to send message %v: %v", msg.Name, e))
-			}
+// queueRetry queues msg behind the messages being retried to the same
+// receiver, if any, so that they are sent in order. It returns false if
+// the receiver is reachable as far as we know.
+func (m *MesosMessenger) queueRetry(msg *Message) bool {
+	key := msg.UPID.String()
+	m.retryLock.Lock()
+	defer m.retryLock.Unlock()
+	queued, ok := m.retrying[key]
+	if ok {
+		m.retrying[key] = append(queued, msg)
+	}
+	return ok
+}
+
+// startRetry hands msg, whose first attempt failed with err, over to a
+// routine of its own so that the receivers that can be reached are not
+// held back.
+func (m *MesosMessenger) startRetry(msg *Message, err error, start time.Time) {
+	key := msg.UPID.String()
+	m.retryLock.Lock()
+	m.retrying[key] = nil
+	m.retryLock.Unlock()
+	go m.retryLoop(key, msg, err, start)
+}
+
+// retryLoop retries msg, then sends the messages queued behind it to the
+// same receiver, until none is left or the messenger stops.
+func (m *MesosMessenger) retryLoop(key string, msg *Message, err error, start time.Time) {
+	for {
+		err = m.retry(msg, err)
+		m.finish(msg, err, time.Since(start))
+
+		m.retryLock.Lock()
+		queued := m.retrying[key]
+		if len(queued) == 0 {
+			delete(m.retrying, key)
+			m.retryLock.Unlock()
+			return
 		}
+		msg, m.retrying[key] = queued[0], queued[1:]
+		m.retryLock.Unlock()
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		start = time.Now()
+		err = m.send(msg)
 	}
 }
 
+// retry resends a message whose last attempt failed with err, up to
+// maxAttempts attempts in all with an exponential backoff, while the
+// receiver cannot be connected to. A message the receiver may have
+// received, e.g. when its response timed out, is not retried.
+func (m *MesosMessenger) retry(msg *Message, err error) error {
+	backoff := m.retryBackoff
+	for attempt := 1; err != nil && attempt < m.maxAttempts && isConnectionError(err); attempt++ {
+		log.V(1).Infof("Retrying message %v to %v in %v, attempt %d failed: %v\n", msg.Name, msg.UPID, backoff, attempt, err)
+		m.metrics.Increment(MetricSendRetries)
+		select {
+		case <-m.stop:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = m.send(msg)
+	}
+	return err
+}
+
+func (m *MesosMessenger) send(msg *Message) error {
+	//TODO(jdef) implement timeout for context
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	c := make(chan error, 1)
+	go func() { c <- m.tr.Send(ctx, msg) }()
+
+	select {
+	case <-ctx.Done():
+		// Transport layer must use the context to detect cancelled requests.
+		<-c // wait for Send to return
+		return ctx.Err()
+	case err := <-c:
+		return err
+	}
+}
+
+// isConnectionError tells whether err is a failure to connect to the
+// receiver, e.g. a refused connection, so that the message was not
+// delivered for sure.
+func isConnectionError(err error) bool {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	operr, ok := err.(*net.OpError)
+	return ok && operr.Op == "dial"
+}
+
 // Since HTTPTransporter.Recv() is already buffered, so we don't need a 'recvLoop' here.
 func (m *MesosMessenger) decodeLoop() {
 	for {
@@ -277,10 +551,12 @@ func (m *MesosMessenger) decodeLoop() {
 		default:
 		}
 		msg := m.tr.Recv()
+		if msg == nil {
+			return // transporter stopped
+		}
 		log.V(2).Infof("Receiving message %v from %v\n", msg.Name, msg.UPID)
-		msg.ProtoMessage = reflect.New(m.installedMessages[msg.Name]).Interface().(proto.Message)
-		if err := proto.Unmarshal(msg.Bytes, msg.ProtoMessage); err != nil {
-			log.Errorf("Failed to unmarshal message %v: %v\n", msg, err)
+		// injected messages and those decoded by the transporter are ready.
+		if msg.ProtoMessage == nil && m.decode(msg) != nil {
 			continue
 		}
 		// TODO(yifan): Catch panic.
@@ -2,15 +2,21 @@ package messenger
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"runtime"
 	"strconv"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
 	"github.com/mesos/mesos-go/messenger/testmessage"
 	"github.com/mesos/mesos-go/upid"
 	"github.com/stretchr/testify/assert"
@@ -158,6 +164,320 @@ func TestMessengerFailToSend(t *testing.T) {
 	assert.Error(t, m.Send(context.TODO(), upid, &testmessage.SmallMessage{}))
 }
 
+func TestMessengerStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	port := strconv.Itoa(getNewPort())
+	for i := 0; i < 2; i++ { // the port is released by Stop
+		m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: port})
+		assert.NoError(t, m.Start())
+		assert.NoError(t, m.Stop())
+		assert.NoError(t, m.Stop())
+	}
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestMessengerReportsDeadTransporter(t *testing.T) {
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	reported := make(chan string, 1)
+	assert.NoError(t, m.Install(func(from *upid.UPID, msg proto.Message) {
+		reported <- msg.(*mesos.FrameworkErrorMessage).GetMessage()
+	}, &mesos.FrameworkErrorMessage{}))
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// the transporter stops serving behind the messenger's back.
+	m.tr.(*HTTPTransporter).listener.Close()
+	select {
+	case msg := <-reported:
+		assert.Contains(t, msg, "Messenger died")
+	case <-time.After(time.Second):
+		t.Fatalf("Dead transporter was not reported.")
+	}
+}
+
+func TestMessengerSendFailureHandler(t *testing.T) {
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	reported := make(chan proto.Message, 1)
+	assert.NoError(t, m.Install(func(from *upid.UPID, msg proto.Message) {
+		reported <- msg
+	}, &mesos.FrameworkErrorMessage{}))
+	failed := make(chan *Message, 1)
+	m.OnSendFailure(func(msg *Message, err error) {
+		assert.Error(t, err)
+		failed <- msg
+	})
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// nothing listens on the port.
+	to := &upid.UPID{ID: "mesos2", Host: "localhost", Port: strconv.Itoa(getNewPort())}
+	assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{}))
+	select {
+	case msg := <-failed:
+		assert.True(t, to.Equal(msg.UPID))
+		assert.Equal(t, "mesos.internal.SmallMessage", msg.Name)
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Send failure was not reported.")
+	}
+	assert.Equal(t, 0, len(reported))
+}
+
+func TestMessengerSendQueueFull(t *testing.T) {
+	defer func(size int, timeout time.Duration) {
+		sendQueueSize, sendQueueTimeout = size, timeout
+	}(sendQueueSize, sendQueueTimeout)
+	sendQueueSize, sendQueueTimeout = 2, 100*time.Millisecond
+
+	// the receiver never responds, the messages pile up.
+	release := make(chan struct{})
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(http.ResponseWriter, *http.Request) {
+		<-release
+	})
+	defer srv.Close()
+	defer close(release)
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// one message is being sent and one handed to the sender at most.
+	sent := 0
+	for ; sent < sendQueueSize+3; sent++ {
+		if err = m.Send(context.TODO(), to, &testmessage.SmallMessage{}); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrQueueFull, err)
+	assert.True(t, sent >= sendQueueSize && sent <= sendQueueSize+2, "sent %d", sent)
+	assert.Equal(t, sendQueueSize, m.QueueDepth())
+}
+
+func TestMessengerNewWithOptions(t *testing.T) {
+	opts := DefaultOptions()
+	assert.Equal(t, sendQueueSize, opts.SendQueueSize)
+	assert.Equal(t, sendQueueTimeout, opts.SendQueueTimeout)
+	assert.Equal(t, sendMaxAttempts, opts.SendMaxAttempts)
+
+	// the options, not the flags, tune the messenger.
+	opts.SendQueueSize, opts.SendQueueTimeout = 1, 10*time.Millisecond
+	release := make(chan struct{})
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(http.ResponseWriter, *http.Request) {
+		<-release
+	})
+	defer srv.Close()
+	defer close(release)
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	self := &upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())}
+	m := NewWithOptions(self, NewHTTPTransporter(self), opts)
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	sent := 0
+	for ; sent < sendQueueSize; sent++ {
+		if err = m.Send(context.TODO(), to, &testmessage.SmallMessage{}); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrQueueFull, err)
+	assert.True(t, sent <= 3, "sent %d", sent)
+	assert.Equal(t, 1, m.QueueDepth())
+}
+
+func TestMessengerSendOrder(t *testing.T) {
+	const count = 100
+	rcvd := make(chan string, count)
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(rsp http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		msg := &testmessage.SmallMessage{}
+		assert.NoError(t, proto.Unmarshal(body, msg))
+		rcvd <- msg.Values[0]
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer srv.Close()
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	for i := 0; i < count; i++ {
+		assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{Values: []string{strconv.Itoa(i)}}))
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case v := <-rcvd:
+			assert.Equal(t, strconv.Itoa(i), v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %d of %d messages.", i, count)
+		}
+	}
+}
+
+// scriptedTransporter fails the messages sent as told by fail, which is
+// given the receiver and the number of messages sent to it so far.
+type scriptedTransporter struct {
+	*HTTPTransporter
+	lock  sync.Mutex
+	sends map[string]int
+	rcvd  chan string // the messages delivered, "receiver/value"
+	fail  func(to string, n int) error
+}
+
+func newScriptedTransporter(fail func(to string, n int) error) *scriptedTransporter {
+	return &scriptedTransporter{
+		HTTPTransporter: NewHTTPTransporter(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())}),
+		sends:           make(map[string]int),
+		rcvd:            make(chan string, 16),
+		fail:            fail,
+	}
+}
+
+func (t *scriptedTransporter) Send(ctx context.Context, msg *Message) error {
+	t.lock.Lock()
+	t.sends[msg.UPID.ID]++
+	n := t.sends[msg.UPID.ID]
+	t.lock.Unlock()
+	if err := t.fail(msg.UPID.ID, n); err != nil {
+		return err
+	}
+	t.rcvd <- msg.UPID.ID + "/" + msg.ProtoMessage.(*testmessage.SmallMessage).Values[0]
+	return nil
+}
+
+func (t *scriptedTransporter) attempts(to string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sends[to]
+}
+
+func refused() error {
+	return &url.Error{Op: "Post", URL: "http://127.0.0.1:5050", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+}
+
+func TestMessengerSendRetry(t *testing.T) {
+	defer func(attempts int, backoff time.Duration) {
+		sendMaxAttempts, sendRetryBackoff = attempts, backoff
+	}(sendMaxAttempts, sendRetryBackoff)
+	sendMaxAttempts, sendRetryBackoff = 3, 10*time.Millisecond
+
+	timeout := &url.Error{Op: "Post", URL: "http://127.0.0.1:5050", Err: &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("i/o timeout")}}
+	tests := []struct {
+		name     string
+		failures int // attempts failed before the message is delivered
+		err      error
+		attempts int
+		failed   bool
+	}{
+		{"refused twice then succeeds", 2, refused(), 3, false},
+		{"retries exhausted", 5, refused(), 3, true},
+		{"rejected", 1, fmt.Errorf("Master rejected the message"), 1, true},
+		{"response timed out", 1, timeout, 1, true},
+	}
+	for _, test := range tests {
+		test := test
+		tr := newScriptedTransporter(func(_ string, n int) error {
+			if n <= test.failures {
+				return test.err
+			}
+			return nil
+		})
+		m := New(&upid.UPID{ID: "mesos"}, tr)
+		failed := make(chan error, 1)
+		m.OnSendFailure(func(msg *Message, err error) { failed <- err })
+		assert.NoError(t, m.Start())
+
+		assert.NoError(t, m.Send(context.TODO(), &upid.UPID{ID: "testserver", Host: "127.0.0.1", Port: "5050"}, &testmessage.SmallMessage{Values: []string{"1"}}))
+		select {
+		case err := <-failed:
+			assert.True(t, test.failed, "%s: %v", test.name, err)
+		case <-tr.rcvd:
+			assert.False(t, test.failed, test.name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: message was neither delivered nor reported.", test.name)
+		}
+		assert.Equal(t, test.attempts, tr.attempts("testserver"), test.name)
+		m.Stop()
+	}
+}
+
+func TestMessengerSendRetryKeepsOthersMoving(t *testing.T) {
+	defer func(attempts int, backoff time.Duration) {
+		sendMaxAttempts, sendRetryBackoff = attempts, backoff
+	}(sendMaxAttempts, sendRetryBackoff)
+	sendMaxAttempts, sendRetryBackoff = 3, 100*time.Millisecond
+
+	// the slave cannot be connected to twice, the master is fine.
+	tr := newScriptedTransporter(func(to string, n int) error {
+		if to == "slave" && n <= 2 {
+			return refused()
+		}
+		return nil
+	})
+	m := New(&upid.UPID{ID: "mesos"}, tr)
+	m.OnSendFailure(func(msg *Message, err error) { t.Errorf("Failed to send %v: %v", msg.Name, err) })
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	slave := &upid.UPID{ID: "slave", Host: "127.0.0.1", Port: "5051"}
+	master := &upid.UPID{ID: "master", Host: "127.0.0.1", Port: "5050"}
+	for _, send := range []struct {
+		to    *upid.UPID
+		value string
+	}{{slave, "1"}, {master, "1"}, {slave, "2"}, {master, "2"}} {
+		assert.NoError(t, m.Send(context.TODO(), send.to, &testmessage.SmallMessage{Values: []string{send.value}}))
+	}
+
+	var rcvd []string
+	for len(rcvd) < 4 {
+		select {
+		case v := <-tr.rcvd:
+			rcvd = append(rcvd, v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %v.", rcvd)
+		}
+	}
+	// the master does not wait for the slave, whose messages keep their order.
+	assert.Equal(t, []string{"master/1", "master/2", "slave/1", "slave/2"}, rcvd)
+	assert.Equal(t, 4, tr.attempts("slave"))
+	assert.NoError(t, m.Drain(context.TODO()))
+}
+
+func TestIsConnectionError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = http.Post("http://"+addr+"/", "application/x-protobuf", nil)
+	assert.True(t, isConnectionError(err), "%v", err)
+	assert.False(t, isConnectionError(fmt.Errorf("Master rejected the message")))
+	assert.False(t, isConnectionError(&url.Error{Op: "Post", URL: "http://" + addr, Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ETIMEDOUT}}))
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+	defer func(send, encode int) {
+		sendRoutines, encodeRoutines = send, encode
+	}(sendRoutines, encodeRoutines)
+
+	assert.Empty(t, deprecatedFlags())
+	sendRoutines = 4
+	assert.Equal(t, []string{"send-routines"}, deprecatedFlags())
+	encodeRoutines = 2
+	assert.Equal(t, []string{"send-routines", "encode-routines"}, deprecatedFlags())
+}
+
+func TestMessengerStopUnstarted(t *testing.T) {
+	m := NewHttp(&upid.UPID{ID: "mesos"})
+	assert.NoError(t, m.Stop())
+	assert.NoError(t, m.Stop())
+}
+
 func TestMessenger(t *testing.T) {
 	messages := generateMixedMessages(1000)
 
@@ -431,3 +751,15 @@ func BenchmarkMessengerSendRecvMixedMessage(b *testing.B) {
 	}
 	globalWG.Wait()
 }
+
+// assertNoGoroutineLeak waits for the number of goroutines to drop back
+// to the given count.
+func assertNoGoroutineLeak(t *testing.T, count int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leaked %d goroutines", runtime.NumGoroutine()-count)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
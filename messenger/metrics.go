@@ -0,0 +1,148 @@
+package messenger
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mesos/mesos-go/upid"
+)
+
+// Names of the metrics reported by MesosMessenger.
+const (
+	MetricMessagesSent     = "messages_sent"
+	MetricMessagesReceived = "messages_received"
+	MetricSendFailures     = "send_failures"
+	MetricSendRetries      = "send_retries"
+	MetricDecodeErrors     = "decode_errors"
+	MetricSendLatency      = "send_latency_seconds" // observed for each message delivered
+	MetricSendQueueDepth   = "send_queue_depth"     // gauge, see MesosMessenger.QueueDepth
+
+	// MetricStaleConnsAvoided counts the pooled connections closed because
+	// they were idle for too long, and the messages resent because their
+	// pooled connection had been dropped while idle.
+	MetricStaleConnsAvoided = "stale_connections_avoided"
+)
+
+// Metrics receives the activity of a messenger or a driver, so that it
+// can be exported to a monitoring system such as Prometheus or expvar.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Increment adds one to the named counter.
+	Increment(name string)
+	// Observe records a value of the named distribution.
+	Observe(name string, value float64)
+}
+
+// NoopMetrics discards all metrics.
+type NoopMetrics struct{}
+
+func (NoopMetrics) Increment(string)        {}
+func (NoopMetrics) Observe(string, float64) {}
+
+// Labels break a metric down, e.g. by message name, key:label name.
+type Labels map[string]string
+
+// LabeledMetrics is implemented by the Metrics that break metrics down by
+// labels, see IncrementLabeled.
+type LabeledMetrics interface {
+	Metrics
+	IncrementLabeled(name string, labels Labels)
+	ObserveLabeled(name string, value float64, labels Labels)
+}
+
+// GaugeRegistry is implemented by the Metrics that export gauges, the
+// value of a gauge is sampled each time the metrics are exported.
+type GaugeRegistry interface {
+	Gauge(name string, sample func() float64)
+}
+
+// IncrementLabeled adds one to the named counter of metrics, broken down
+// by labels if metrics supports it.
+func IncrementLabeled(metrics Metrics, name string, labels Labels) {
+	if m, ok := metrics.(LabeledMetrics); ok {
+		m.IncrementLabeled(name, labels)
+	} else {
+		metrics.Increment(name)
+	}
+}
+
+// ObserveLabeled records a value of the named distribution of metrics,
+// broken down by labels if metrics supports it.
+func ObserveLabeled(metrics Metrics, name string, value float64, labels Labels) {
+	if m, ok := metrics.(LabeledMetrics); ok {
+		m.ObserveLabeled(name, value, labels)
+	} else {
+		metrics.Observe(name, value)
+	}
+}
+
+// PeerClass returns the kind of libprocess process pid is, e.g. "master"
+// or "slave", for the peer_class label. Unknown processes are "other".
+func PeerClass(pid *upid.UPID) string {
+	if pid == nil {
+		return "other"
+	}
+	id := pid.ID
+	if i := strings.IndexByte(id, '('); i >= 0 {
+		id = id[:i]
+	}
+	switch id {
+	case "master", "slave", "scheduler", "executor":
+		return id
+	}
+	return "other"
+}
+
+// MetricsReporter is implemented by messengers that report their activity
+// to a Metrics.
+type MetricsReporter interface {
+	SetMetrics(metrics Metrics)
+}
+
+// SetMetrics installs the metrics the messenger reports to, they are
+// discarded by default. Call it before Start.
+func (m *MesosMessenger) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	m.metrics = metrics
+	if r, ok := m.tr.(MetricsReporter); ok {
+		r.SetMetrics(metrics)
+	}
+	if g, ok := metrics.(GaugeRegistry); ok {
+		g.Gauge(MetricSendQueueDepth, func() float64 { return float64(m.QueueDepth()) })
+	}
+}
+
+// messageLabels are the labels of the metrics of msg.
+func messageLabels(msg *Message) Labels {
+	return Labels{"message_name": msg.Name, "peer_class": PeerClass(msg.UPID)}
+}
+
+// sent reports the outcome of sending msg, which took d.
+func (m *MesosMessenger) sent(msg *Message, err error, d time.Duration) {
+	labels := messageLabels(msg)
+	if err != nil {
+		IncrementLabeled(m.metrics, MetricSendFailures, labels)
+		return
+	}
+	IncrementLabeled(m.metrics, MetricMessagesSent, labels)
+	ObserveLabeled(m.metrics, MetricSendLatency, d.Seconds(), labels)
+}
+
+// HandlerServer is implemented by the messengers that serve HTTP, so that
+// they serve other endpoints along with the messages, e.g. the metrics.
+type HandlerServer interface {
+	Handle(pattern string, handler http.Handler) error
+}
+
+// Handle serves handler at pattern, along with the messages, if the
+// transporter of the messenger serves HTTP. Call it before Start.
+func (m *MesosMessenger) Handle(pattern string, handler http.Handler) error {
+	if s, ok := m.tr.(HandlerServer); ok {
+		return s.Handle(pattern, handler)
+	}
+	return fmt.Errorf("Transporter %T does not serve HTTP", m.tr)
+}
@@ -0,0 +1,85 @@
+package messenger
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// countingMetrics counts increments and observations by name.
+type countingMetrics struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{counts: make(map[string]int)}
+}
+
+func (c *countingMetrics) Increment(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[name]++
+}
+
+func (c *countingMetrics) Observe(name string, value float64) {
+	c.Increment(name)
+}
+
+func (c *countingMetrics) count(name string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.counts[name]
+}
+
+func TestMessengerMetrics(t *testing.T) {
+	srv := makeMockServer("/testserver/mesos.internal.SmallMessage", func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer srv.Close()
+	to, err := upid.Parse("testserver@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	metrics := newCountingMetrics()
+	m := NewHttp(&upid.UPID{ID: "mesos", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	m.SetMetrics(metrics)
+	rcvd := make(chan struct{}, 1)
+	assert.NoError(t, m.Install(func(*upid.UPID, proto.Message) { rcvd <- struct{}{} }, &testmessage.SmallMessage{}))
+	failed := make(chan struct{}, 1)
+	m.OnSendFailure(func(*Message, error) { failed <- struct{}{} })
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// one message is delivered, the next one fails.
+	assert.NoError(t, m.Send(context.TODO(), to, &testmessage.SmallMessage{}))
+	unreachable := &upid.UPID{ID: "testserver", Host: "localhost", Port: strconv.Itoa(getNewPort())}
+	assert.NoError(t, m.Send(context.TODO(), unreachable, &testmessage.SmallMessage{}))
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send failure was not reported.")
+	}
+	assert.Equal(t, 1, metrics.count(MetricMessagesSent))
+	assert.Equal(t, 1, metrics.count(MetricSendLatency))
+	assert.Equal(t, 1, metrics.count(MetricSendFailures))
+
+	// a peer sends a message to m.
+	peer := NewHttp(&upid.UPID{ID: "peer", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	assert.NoError(t, peer.Start())
+	defer peer.Stop()
+	assert.NoError(t, peer.Send(context.TODO(), m.UPID(), &testmessage.SmallMessage{}))
+	select {
+	case <-rcvd:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message was not received.")
+	}
+	assert.Equal(t, 1, metrics.count(MetricMessagesReceived))
+}
@@ -64,6 +64,11 @@ func (m *MockedMessenger) Route(ctx context.Context, upid *upid.UPID, msg proto.
 	return m.Called().Error(0)
 }
 
+// Warmup is a mocked implementation.
+func (m *MockedMessenger) Warmup(ctx context.Context, upid *upid.UPID) error {
+	return m.Called().Error(0)
+}
+
 // Start is a mocked implementation.
 func (m *MockedMessenger) Start() error {
 	go m.recvLoop()
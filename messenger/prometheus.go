@@ -0,0 +1,310 @@
+package messenger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets of the
+// distributions observed by PrometheusMetrics, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics keeps the metrics reported to it and exports them in
+// the Prometheus text exposition format, as an http.Handler. Counters are
+// exported as <namespace>_<name>_total, distributions as histograms and
+// gauges as is. The names of the metrics are those reported, e.g.
+// MetricMessagesSent, they do not change across releases.
+type PrometheusMetrics struct {
+	namespace string
+	lock      sync.Mutex
+	help      map[string]string
+	buckets   map[string][]float64
+	counters  map[string]map[string]float64    // key:name, then labels
+	histos    map[string]map[string]*histogram // key:name, then labels
+	gauges    map[string]func() float64
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics returns metrics exported with names prefixed by
+// namespace, e.g. "mesos".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace: namespace,
+		help:      make(map[string]string),
+		buckets:   make(map[string][]float64),
+		counters:  make(map[string]map[string]float64),
+		histos:    make(map[string]map[string]*histogram),
+		gauges:    make(map[string]func() float64),
+	}
+}
+
+// Describe sets the help text of the named metric.
+func (p *PrometheusMetrics) Describe(name, help string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.help[name] = help
+}
+
+// SetBuckets sets the upper bounds of the histogram buckets of the named
+// distribution, DefaultBuckets otherwise. It does nothing once a value of
+// the distribution was observed.
+func (p *PrometheusMetrics) SetBuckets(name string, buckets []float64) {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.histos[name]; !ok {
+		p.buckets[name] = sorted
+	}
+}
+
+func (p *PrometheusMetrics) Increment(name string) {
+	p.IncrementLabeled(name, nil)
+}
+
+func (p *PrometheusMetrics) Observe(name string, value float64) {
+	p.ObserveLabeled(name, value, nil)
+}
+
+func (p *PrometheusMetrics) IncrementLabeled(name string, labels Labels) {
+	key := formatLabels(labels)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	series, ok := p.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		p.counters[name] = series
+	}
+	series[key]++
+}
+
+func (p *PrometheusMetrics) ObserveLabeled(name string, value float64, labels Labels) {
+	key := formatLabels(labels)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	buckets, ok := p.buckets[name]
+	if !ok {
+		buckets = DefaultBuckets
+		p.buckets[name] = buckets
+	}
+	series, ok := p.histos[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		p.histos[name] = series
+	}
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		series[key] = h
+	}
+	if i := sort.SearchFloat64s(buckets, value); i < len(buckets) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// Gauge exports the value sample returns as the named gauge.
+func (p *PrometheusMetrics) Gauge(name string, sample func() float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gauges[name] = sample
+}
+
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, the
+// metrics sorted by name and their series by labels.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	// the gauges are sampled without the lock, they may take others.
+	p.lock.Lock()
+	gauges := make(map[string]func() float64, len(p.gauges))
+	for name, sample := range p.gauges {
+		gauges[name] = sample
+	}
+	p.lock.Unlock()
+	values := make(map[string]float64, len(gauges))
+	for name, sample := range gauges {
+		values[name] = sample()
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, name := range sortedKeys(p.counters, p.histos, values) {
+		if series, ok := p.counters[name]; ok {
+			family := p.metricName(name) + "_total"
+			p.writeHeader(cw, name, family, "counter")
+			for _, labels := range counterLabels(series) {
+				cw.printf("%s%s %s\n", family, labels, formatValue(series[labels]))
+			}
+		}
+		if series, ok := p.histos[name]; ok {
+			family := p.metricName(name)
+			p.writeHeader(cw, name, family, "histogram")
+			buckets := p.buckets[name]
+			for _, labels := range histogramLabels(series) {
+				h := series[labels]
+				var cumulative uint64
+				for i, bound := range buckets {
+					cumulative += h.counts[i]
+					cw.printf("%s_bucket%s %d\n", family, withLe(labels, formatValue(bound)), cumulative)
+				}
+				cw.printf("%s_bucket%s %d\n", family, withLe(labels, "+Inf"), h.count)
+				cw.printf("%s_sum%s %s\n", family, labels, formatValue(h.sum))
+				cw.printf("%s_count%s %d\n", family, labels, h.count)
+			}
+		}
+		if value, ok := values[name]; ok {
+			family := p.metricName(name)
+			p.writeHeader(cw, name, family, "gauge")
+			cw.printf("%s %s\n", family, formatValue(value))
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (p *PrometheusMetrics) writeHeader(cw *countingWriter, name, family, kind string) {
+	if help, ok := p.help[name]; ok {
+		cw.printf("# HELP %s %s\n", family, escapeHelp(help))
+	}
+	cw.printf("# TYPE %s %s\n", family, kind)
+}
+
+func (p *PrometheusMetrics) metricName(name string) string {
+	if p.namespace != "" {
+		name = p.namespace + "_" + name
+	}
+	return sanitizeName(name, true)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	var n int
+	n, cw.err = fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+}
+
+// sortedKeys returns the names of the metrics of maps, sorted.
+func sortedKeys(counters map[string]map[string]float64, histos map[string]map[string]*histogram, gauges map[string]float64) []string {
+	seen := make(map[string]bool)
+	for name := range counters {
+		seen[name] = true
+	}
+	for name := range histos {
+		seen[name] = true
+	}
+	for name := range gauges {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func counterLabels(series map[string]float64) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func histogramLabels(series map[string]*histogram) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels returns labels as {name="value",...} sorted by name, the
+// empty string without labels.
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = sanitizeName(name, false) + `="` + escapeLabelValue(labels[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLe adds the le label of a histogram bucket to formatted labels.
+func withLe(labels, le string) string {
+	if labels == "" {
+		return `{le="` + le + `"}`
+	}
+	return labels[:len(labels)-1] + `,le="` + le + `"}`
+}
+
+// sanitizeName replaces the characters not allowed in a metric name, or
+// in a label name if metric is false, by underscores.
+func sanitizeName(name string, metric bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		ok := c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			i > 0 && '0' <= c && c <= '9' || metric && c == ':'
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string { return labelValueEscaper.Replace(v) }
+func escapeHelp(v string) string       { return helpEscaper.Replace(v) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
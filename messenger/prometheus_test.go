@@ -0,0 +1,215 @@
+package messenger
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/messenger/testmessage"
+	"github.com/mesos/mesos-go/upid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+var (
+	promSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(.*)\})? (\S+)$`)
+	promLabel  = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"(,|$)`)
+	promType   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|histogram)$`)
+)
+
+// promSeries is a sample of the Prometheus text format.
+type promSeries struct {
+	kind   string // of its family
+	labels map[string]string
+	value  float64
+}
+
+// parsePrometheus validates the Prometheus text format and returns its
+// samples, key:name.
+func parsePrometheus(t *testing.T, text string) map[string][]promSeries {
+	samples := make(map[string][]promSeries)
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			m := promType.FindStringSubmatch(line)
+			if !assert.NotNil(t, m, line) {
+				continue
+			}
+			assert.Empty(t, types[m[1]], "family declared twice: %s", m[1])
+			types[m[1]] = m[2]
+			continue
+		}
+		m := promSample.FindStringSubmatch(line)
+		if !assert.NotNil(t, m, line) {
+			continue
+		}
+		name, kind := m[1], types[m[1]]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if family := strings.TrimSuffix(name, suffix); family != name && types[family] == "histogram" {
+				kind = "histogram"
+			}
+		}
+		assert.NotEmpty(t, kind, "sample before its TYPE: %s", line)
+
+		labels := make(map[string]string)
+		for rest := m[3]; rest != ""; {
+			l := promLabel.FindStringSubmatch(rest)
+			if !assert.NotNil(t, l, line) {
+				break
+			}
+			labels[l[1]] = l[2]
+			rest = rest[len(l[0]):]
+		}
+		value, err := strconv.ParseFloat(m[4], 64)
+		assert.NoError(t, err, line)
+		samples[name] = append(samples[name], promSeries{kind, labels, value})
+	}
+	return samples
+}
+
+// find returns the sample of series with labels.
+func find(series []promSeries, labels map[string]string) (promSeries, bool) {
+	for _, s := range series {
+		if fmt.Sprint(s.labels) == fmt.Sprint(labels) {
+			return s, true
+		}
+	}
+	return promSeries{}, false
+}
+
+func TestPrometheusMetricsFormat(t *testing.T) {
+	p := NewPrometheusMetrics("test")
+	p.Describe("requests", "Requests\nserved, by \\ path.")
+	p.IncrementLabeled("requests", Labels{"path": `a"b\c` + "\n", "code": "200"})
+	p.IncrementLabeled("requests", Labels{"path": `a"b\c` + "\n", "code": "200"})
+	p.Increment("requests")
+	p.SetBuckets("latency", []float64{1, 0.1})
+	p.Observe("latency", 0.05)
+	p.Observe("latency", 0.5)
+	p.Observe("latency", 5)
+	p.SetBuckets("latency", []float64{10})
+	p.Gauge("depth", func() float64 { return math.Inf(1) })
+	p.Increment("bad-name.total")
+
+	var text bytes.Buffer
+	_, err := p.WriteTo(&text)
+	assert.NoError(t, err)
+	assert.Equal(t, `# TYPE test_bad_name_total_total counter
+test_bad_name_total_total 1
+# TYPE test_depth gauge
+test_depth +Inf
+# TYPE test_latency histogram
+test_latency_bucket{le="0.1"} 1
+test_latency_bucket{le="1"} 2
+test_latency_bucket{le="+Inf"} 3
+test_latency_sum 5.55
+test_latency_count 3
+# HELP test_requests_total Requests\nserved, by \\ path.
+# TYPE test_requests_total counter
+test_requests_total 1
+test_requests_total{code="200",path="a\"b\\c\n"} 2
+`, text.String())
+	samples := parsePrometheus(t, text.String())
+	assert.Len(t, samples, 6)
+}
+
+func TestMessengerPrometheusMetrics(t *testing.T) {
+	srv := makeMockServer("/master/mesos.internal.SmallMessage", func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer srv.Close()
+	master, err := upid.Parse("master@" + srv.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	metrics := NewPrometheusMetrics("mesos")
+	m := NewHttp(&upid.UPID{ID: "scheduler(1)", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	m.SetMetrics(metrics)
+	assert.NoError(t, m.Handle("/metrics", metrics))
+	rcvd := make(chan struct{}, 1)
+	assert.NoError(t, m.Install(func(*upid.UPID, proto.Message) { rcvd <- struct{}{} }, &testmessage.SmallMessage{}))
+	failed := make(chan struct{}, 1)
+	m.OnSendFailure(func(*Message, error) { failed <- struct{}{} })
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	// two messages are delivered to the master, one to a slave fails.
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, m.Send(context.TODO(), master, &testmessage.SmallMessage{}))
+	}
+	slave := &upid.UPID{ID: "slave(1)", Host: "localhost", Port: strconv.Itoa(getNewPort())}
+	assert.NoError(t, m.Send(context.TODO(), slave, &testmessage.SmallMessage{}))
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send failure was not reported.")
+	}
+	// and an executor sends one.
+	peer := NewHttp(&upid.UPID{ID: "executor(1)", Host: "localhost", Port: strconv.Itoa(getNewPort())})
+	assert.NoError(t, peer.Start())
+	defer peer.Stop()
+	assert.NoError(t, peer.Send(context.TODO(), m.UPID(), &testmessage.SmallMessage{}))
+	select {
+	case <-rcvd:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message was not received.")
+	}
+
+	rsp, err := http.Get("http://" + m.UPID().Host + ":" + m.UPID().Port + "/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Contains(t, rsp.Header.Get("Content-Type"), "version=0.0.4")
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	samples := parsePrometheus(t, string(body))
+
+	name := "mesos.internal.SmallMessage"
+	for _, tc := range []struct {
+		series string
+		labels map[string]string
+		kind   string
+		value  float64
+	}{
+		{"mesos_messages_sent_total", map[string]string{"message_name": name, "peer_class": "master"}, "counter", 2},
+		{"mesos_send_failures_total", map[string]string{"message_name": name, "peer_class": "slave"}, "counter", 1},
+		{"mesos_messages_received_total", map[string]string{"message_name": name, "peer_class": "executor"}, "counter", 1},
+		{"mesos_send_latency_seconds_count", map[string]string{"message_name": name, "peer_class": "master"}, "histogram", 2},
+		{"mesos_send_latency_seconds_bucket", map[string]string{"message_name": name, "peer_class": "master", "le": "+Inf"}, "histogram", 2},
+		{"mesos_send_queue_depth", map[string]string{}, "gauge", 0},
+	} {
+		s, ok := find(samples[tc.series], tc.labels)
+		if assert.True(t, ok, "missing %s%v", tc.series, tc.labels) {
+			assert.Equal(t, tc.kind, s.kind, tc.series)
+			assert.Equal(t, tc.value, s.value, tc.series)
+		}
+	}
+}
+
+func TestPeerClass(t *testing.T) {
+	for id, class := range map[string]string{
+		"master":        "master",
+		"slave(1)":      "slave",
+		"scheduler(12)": "scheduler",
+		"executor(3)":   "executor",
+		"mesos":         "other",
+	} {
+		assert.Equal(t, class, PeerClass(&upid.UPID{ID: id}), id)
+	}
+	assert.Equal(t, "other", PeerClass(nil))
+}
@@ -33,6 +33,7 @@ type Transporter interface {
 	Listen() error
 
 	//Rcvd receives and delegate message handling to installed handlers.
+	//Returns nil once the transporter is stopped.
 	Recv() *Message
 
 	//Inject injects a message to the incoming queue. Must use context to
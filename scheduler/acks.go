@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var explicitAcks = flag.Bool("mesos_explicit_acknowledgements", false,
+	"Leave the acknowledgement of the status updates to the framework, see AcknowledgeStatusUpdate, instead of acknowledging them once StatusUpdate returns")
+
+// pendingAck is the acknowledgement of a status update delivered to the
+// framework, sent once the framework acknowledges the update.
+type pendingAck struct {
+	status  *mesos.TaskStatus
+	target  *upid.UPID // the slave that sent the update, or the master
+	message *mesos.StatusUpdateAcknowledgementMessage
+}
+
+// matches tells whether status is the update awaiting acknowledgement.
+func (ack *pendingAck) matches(status *mesos.TaskStatus) bool {
+	return ack.status.GetState() == status.GetState() && ack.status.GetTimestamp() == status.GetTimestamp()
+}
+
+// awaitAck keeps the acknowledgement of the last update of the task of
+// status until the framework acknowledges it. The slave does not send
+// the next update of the task before that, except to resend this one.
+func (driver *MesosSchedulerDriver) awaitAck(status *mesos.TaskStatus, target *upid.UPID, message *mesos.StatusUpdateAcknowledgementMessage) {
+	driver.ackLock.Lock()
+	defer driver.ackLock.Unlock()
+	driver.pendingAcks[status.GetTaskId().GetValue()] = &pendingAck{status, target, message}
+}
+
+// AcknowledgeStatusUpdate sends the acknowledgement of the last update of
+// the task of status delivered to StatusUpdate, if status is that update.
+// Acknowledging an update generated by the driver, or one already
+// acknowledged, does nothing. An acknowledgement that failed to be sent
+// may be retried.
+func (driver *MesosSchedulerDriver) AcknowledgeStatusUpdate(status *mesos.TaskStatus) (mesos.Status, error) {
+	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
+		return stat, driver.misused(fmt.Errorf("Unable to AcknowledgeStatusUpdate, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	if !driver.explicitAcks {
+		return driver.Status(), fmt.Errorf("Status updates are acknowledged by the driver, see mesos_explicit_acknowledgements")
+	}
+	if !driver.Connected() {
+		log.Infof("Not acknowledging the update of task %v, disconnected from master.\n", status.GetTaskId().GetValue())
+		return driver.Status(), ErrNotConnected
+	}
+
+	taskId := status.GetTaskId().GetValue()
+	driver.ackLock.Lock()
+	ack, ok := driver.pendingAcks[taskId]
+	driver.ackLock.Unlock()
+	if !ok || !ack.matches(status) {
+		driver.checkAcknowledged(status)
+		log.V(1).Infof("No %v update of task %v awaiting acknowledgement\n", status.GetState(), taskId)
+		return driver.Status(), nil
+	}
+
+	log.V(2).Infoln("Sending status update ACK to ", ack.target.String())
+	if err := driver.send(ack.target, ack.message); err != nil {
+		log.Errorf("Failed to send StatusUpdate ACK message: %v\n", err)
+		return driver.Status(), err
+	}
+
+	driver.ackLock.Lock()
+	if driver.pendingAcks[taskId] == ack {
+		delete(driver.pendingAcks, taskId)
+	}
+	driver.ackLock.Unlock()
+	driver.acknowledged(status)
+	return driver.Status(), nil
+}
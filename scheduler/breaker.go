@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // the path is used
+	breakerOpen                         // the path failed repeatedly, it is avoided
+	breakerHalfOpen                     // the path is probed once again
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("breakerState(%d)", int(s))
+	}
+}
+
+// circuitBreaker stops using a path after threshold consecutive failures
+// and lets a single probe through once reprobe elapsed. Delivery is
+// asynchronous, so the probe is deemed successful unless its failure was
+// recorded by the time the path is used again. It is not safe for
+// concurrent use.
+type circuitBreaker struct {
+	threshold int
+	reprobe   time.Duration
+	state     breakerState
+	failures  int // consecutive failures
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, reprobe time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, reprobe: reprobe}
+}
+
+// allow returns true if the path may be used at now.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.reprobe {
+			return false
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		// the probe did not fail.
+		b.state = breakerClosed
+		b.failures = 0
+	}
+	return true
+}
+
+// failure records a failed use of the path at now.
+func (b *circuitBreaker) failure(now time.Time) {
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
@@ -0,0 +1,216 @@
+package scheduler
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+)
+
+// estimated memory held by a cache entry besides its payload, i.e. the
+// map slot, key and bookkeeping.
+const cacheEntryOverhead = 64
+
+var (
+	cacheMaxEntries = flag.Int("mesos_cache_max_entries", 100000,
+		"Maximum number of entries retained by each internal cache of the scheduler driver, 0 for no limit")
+	cacheMemoryTarget = flag.Int("mesos_cache_memory_target", 64*1024*1024,
+		"Soft limit in bytes for the estimated size of all internal caches of the scheduler driver, 0 for no limit")
+	cacheCompactInterval = flag.Duration("mesos_cache_compact_interval", time.Minute,
+		"Interval at which the scheduler driver compacts its internal caches, 0 to only compact on demand")
+)
+
+// budgetedCache is an internal cache of the driver whose retention is
+// enforced by a cacheBudget.
+type budgetedCache interface {
+	// usage returns the number of entries and their estimated size in bytes.
+	usage() (entries, bytes int)
+	// evict drops up to n evictable entries, oldest first, and returns the
+	// number of entries and bytes dropped. Entries needed for correctness
+	// must never be evicted.
+	evict(n int) (entries, bytes int)
+}
+
+// budgetedCacheFuncs adapts a pair of functions to a budgetedCache.
+type budgetedCacheFuncs struct {
+	usageFunc func() (int, int)
+	evictFunc func(int) (int, int)
+}
+
+func (f budgetedCacheFuncs) usage() (int, int)      { return f.usageFunc() }
+func (f budgetedCacheFuncs) evict(n int) (int, int) { return f.evictFunc(n) }
+
+// pinnedCache accounts a cache against the budget without ever evicting
+// from it.
+type pinnedCache struct {
+	budgetedCache
+}
+
+func (pinnedCache) evict(int) (int, int) { return 0, 0 }
+
+type budgetedEntry struct {
+	name       string
+	cache      budgetedCache
+	maxEntries int // 0 for no limit
+	evictions  uint64
+}
+
+// cacheBudget enforces the per-cache entry limits and a global soft
+// memory target across the caches registered with it.
+type cacheBudget struct {
+	lock         sync.Mutex
+	caches       []*budgetedEntry
+	memoryTarget int // bytes, 0 for no limit
+}
+
+func newCacheBudget(memoryTarget int) *cacheBudget {
+	return &cacheBudget{memoryTarget: memoryTarget}
+}
+
+// register places cache under the budget, maxEntries <= 0 means the
+// cache is only subject to the global memory target.
+func (b *cacheBudget) register(name string, cache budgetedCache, maxEntries int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.caches = append(b.caches, &budgetedEntry{name: name, cache: cache, maxEntries: maxEntries})
+}
+
+// compact trims the caches exceeding their entry limit, then evicts from
+// the largest caches until the estimated size of all caches is within the
+// memory target or nothing more can be evicted. It returns the number of
+// entries evicted.
+func (b *cacheBudget) compact() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	evicted := 0
+	for _, c := range b.caches {
+		if c.maxEntries <= 0 {
+			continue
+		}
+		if n, _ := c.cache.usage(); n > c.maxEntries {
+			evicted += b.evict(c, n-c.maxEntries)
+		}
+	}
+	if b.memoryTarget <= 0 {
+		return evicted
+	}
+
+	exhausted := make(map[*budgetedEntry]bool)
+	for {
+		total := 0
+		var largest *budgetedEntry
+		var largestEntries, largestBytes int
+		for _, c := range b.caches {
+			n, size := c.cache.usage()
+			total += size
+			if !exhausted[c] && size > largestBytes {
+				largest, largestEntries, largestBytes = c, n, size
+			}
+		}
+		if total <= b.memoryTarget || largest == nil {
+			break
+		}
+		// evict as many entries of average size as cover the excess.
+		excess := total - b.memoryTarget
+		n := (excess*largestEntries + largestBytes - 1) / largestBytes
+		dropped := b.evict(largest, n)
+		if dropped == 0 {
+			exhausted[largest] = true
+		}
+		evicted += dropped
+	}
+	return evicted
+}
+
+// evict drops up to n entries of the cache, the caller must hold the lock.
+func (b *cacheBudget) evict(c *budgetedEntry, n int) int {
+	entries, bytes := c.cache.evict(n)
+	if entries > 0 {
+		c.evictions += uint64(entries)
+		log.V(2).Infof("Evicted %d entries (%d bytes) from the %s cache\n", entries, bytes, c.name)
+	}
+	return entries
+}
+
+// evictions returns the number of entries evicted so far, key:cache name.
+func (b *cacheBudget) evictions() map[string]uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	counts := make(map[string]uint64, len(b.caches))
+	for _, c := range b.caches {
+		counts[c.name] = c.evictions
+	}
+	return counts
+}
+
+// estimateSize estimates the memory held by a cache entry for msg.
+func estimateSize(msg proto.Message) int {
+	return cacheEntryOverhead + proto.Size(msg)
+}
+
+type agedKey struct {
+	key string
+	at  time.Time
+}
+
+type byAge []agedKey
+
+func (a byAge) Len() int           { return len(a) }
+func (a byAge) Less(i, j int) bool { return a[i].at.Before(a[j].at) }
+func (a byAge) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// oldest returns the n oldest of keys.
+func oldest(keys []agedKey, n int) []agedKey {
+	sort.Sort(byAge(keys))
+	if n < len(keys) {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// initCacheBudget places the internal caches of the driver under budget.
+// Outstanding offers are accounted but never evicted, the scheduler may
+// still launch tasks on them.
+func (driver *MesosSchedulerDriver) initCacheBudget(memoryTarget, maxEntries int) {
+	b := newCacheBudget(memoryTarget)
+	b.register("offers", pinnedCache{driver.cache.savedOffers}, 0)
+	b.register("rescinded_offers", driver.cache.rescindedOffers, maxEntries)
+	b.register("slave_pids", budgetedCacheFuncs{driver.cache.slavePidUsage, driver.cache.evictSlavePids}, maxEntries)
+	b.register("executor_failures", driver.failures, maxEntries)
+	if driver.statusOrder != nil {
+		b.register("task_statuses", driver.statusOrder, maxEntries)
+	}
+	driver.budget = b
+}
+
+// compactLoop compacts the caches every interval until the driver stops.
+func (driver *MesosSchedulerDriver) compactLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-driver.stopCh:
+			return
+		case <-ticker.C:
+			driver.CompactCaches()
+		}
+	}
+}
+
+// CompactCaches evicts stale entries from the internal caches of the
+// driver that exceed their budget and returns the number of entries
+// evicted. The driver compacts its caches periodically, see
+// mesos_cache_compact_interval, calling CompactCaches triggers it at once.
+func (driver *MesosSchedulerDriver) CompactCaches() int {
+	return driver.budget.compact()
+}
+
+// CacheEvictions returns the number of entries evicted from each internal
+// cache of the driver, key:cache name.
+func (driver *MesosSchedulerDriver) CacheEvictions() map[string]uint64 {
+	return driver.budget.evictions()
+}
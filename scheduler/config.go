@@ -0,0 +1,606 @@
+package scheduler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/messenger"
+)
+
+// Duration is a time.Duration written as a string such as "1m30s" in a
+// configuration file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a duration such as \"5s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config holds all the options of a MesosSchedulerDriver, the fields
+// mirror the mesos_* and messenger flags of the same name. See LoadConfig
+// and NewMesosSchedulerDriverFromConfig.
+type Config struct {
+	Master string `json:"master"`
+	// MasterFilePoll is how often the file of a file:// master is read
+	// again, 0 reads it once.
+	MasterFilePoll Duration `json:"master_file_poll"`
+	// MasterList is how the masters of a comma separated master are
+	// registered with in turn.
+	MasterList MasterListConfig `json:"master_list"`
+	// Strict rejects the unknown fields of the file, they are only
+	// logged otherwise.
+	Strict bool `json:"strict"`
+
+	Bind           BindConfig        `json:"bind"`
+	TLS            *TLSConfig        `json:"tls,omitempty"` // nil to talk HTTP
+	Authentication AuthConfig        `json:"authentication"`
+	Timeouts       TimeoutConfig     `json:"timeouts"`
+	Send           SendConfig        `json:"send"`
+	MessageSize    MessageSizeConfig `json:"message_size"`
+
+	OrderedStatusUpdates bool     `json:"ordered_status_updates"`
+	MasterWarmup         bool     `json:"master_warmup"`
+	ExplicitAcks         bool     `json:"explicit_acknowledgements"`
+	PrometheusMetrics    bool     `json:"prometheus_metrics"`
+	OfferTimeout         Duration `json:"offer_timeout"`
+	MaxKeptOffers        int      `json:"max_kept_offers"`
+	AllowedTaskUsers     []string `json:"allowed_task_users,omitempty"` // nil allows any user
+	CheckOfferResources  bool     `json:"check_offer_resources"`
+	DevStrict            bool     `json:"dev_strict"`
+
+	Reconcile  ReconcileConfig  `json:"reconcile"`
+	Refusal    RefusalConfig    `json:"refusal"`
+	DirectSend DirectSendConfig `json:"direct_send"`
+	Cache      CacheConfig      `json:"cache"`
+	TaskCache  TaskCacheConfig  `json:"task_cache"`
+	TaskIDs    TaskIDConfig     `json:"task_ids"`
+	Quota      QuotaConfig      `json:"quota"`
+	AckRetry   AckRetryConfig   `json:"ack_retry"`
+	IDLimits   IDLimitConfig    `json:"id_limits"`
+	Dispatch   DispatchConfig   `json:"dispatch"`
+	Duplicates DuplicateConfig  `json:"duplicate_scheduler"`
+	Debug      DebugConfig      `json:"debug"`
+}
+
+// BindConfig is the address the driver receives messages on, any
+// address and port are picked when empty.
+type BindConfig struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// TLSConfig names the PEM files the driver talks HTTPS with, see
+// NewMesosSchedulerDriverTLS. The driver only serves HTTPS with a
+// certificate.
+type TLSConfig struct {
+	CAFile   string `json:"ca_file"` // empty to trust the system roots
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// AuthConfig are the credentials the driver authenticates with, none if
+// Principal is empty.
+type AuthConfig struct {
+	Principal  string `json:"principal"`
+	SecretFile string `json:"secret_file"`
+	Provider   string `json:"provider"`
+}
+
+type TimeoutConfig struct {
+	Dial           Duration `json:"dial"`
+	ResponseHeader Duration `json:"response_header"`
+	Request        Duration `json:"request"`
+	StopDrain      Duration `json:"stop_drain"`
+	KeepAlive      Duration `json:"keepalive"`
+	IdleConn       Duration `json:"idle_conn"`
+	Detect         Duration `json:"detect"` // of the leading master of a zk:// or file:// master
+}
+
+// SendConfig tunes the messenger, see messenger.Options.
+type SendConfig struct {
+	QueueSize      int      `json:"queue_size"`
+	QueueTimeout   Duration `json:"queue_timeout"`
+	MaxAttempts    int      `json:"max_attempts"`
+	RetryBackoff   Duration `json:"retry_backoff"`
+	DecodeRoutines int      `json:"decode_routines"`
+}
+
+type MessageSizeConfig struct {
+	Max    int  `json:"max"`
+	Strict bool `json:"strict"`
+}
+
+type ReconcileConfig struct {
+	BatchSize  int      `json:"batch_size"`
+	BatchDelay Duration `json:"batch_delay"`
+}
+
+// RefusalConfig is the RefusalPolicy of the driver.
+type RefusalConfig struct {
+	Default Duration            `json:"default"`
+	Roles   map[string]Duration `json:"roles,omitempty"`
+}
+
+type DirectSendConfig struct {
+	Failures int      `json:"failures"`
+	Reprobe  Duration `json:"reprobe"`
+}
+
+type CacheConfig struct {
+	MaxEntries      int      `json:"max_entries"`
+	MemoryTarget    int      `json:"memory_target"`
+	CompactInterval Duration `json:"compact_interval"`
+}
+
+// TaskCacheConfig persists the task cache to File, see
+// FileTaskCacheStore. Requires ordered status updates.
+type TaskCacheConfig struct {
+	File             string   `json:"file"`
+	SnapshotInterval Duration `json:"snapshot_interval"`
+}
+
+// TaskIDConfig sets how a task reusing the ID of a previous task is
+// handled, see mesos_task_id_reuse_cooldown and mesos_allow_task_id_reuse.
+type TaskIDConfig struct {
+	ReuseCooldown Duration `json:"reuse_cooldown"`
+	AllowReuse    bool     `json:"allow_reuse"`
+}
+
+// IDLimitConfig are the longest framework name, executor ID and task ID
+// the driver accepts, in bytes. Unless Strict is set the driver only
+// warns about longer ones, and about IDs that cannot be path names.
+type IDLimitConfig struct {
+	FrameworkName int  `json:"framework_name"`
+	ExecutorID    int  `json:"executor_id"`
+	TaskID        int  `json:"task_id"`
+	Strict        bool `json:"strict"`
+}
+
+// DispatchConfig bounds the queue of the events waiting for the Scheduler
+// callbacks, and how long Join waits for the callback in progress once
+// the driver stopped.
+type DispatchConfig struct {
+	QueueSize           int      `json:"queue_size"`
+	CallbackStopTimeout Duration `json:"callback_stop_timeout"`
+	AbortOnPanic        bool     `json:"abort_on_panic"` // of a callback, see mesos_abort_on_callback_panic
+}
+
+// DuplicateConfig tells when another scheduler is suspected of
+// running with the framework ID, and whether the driver aborts then.
+type DuplicateConfig struct {
+	Reregistrations int      `json:"reregistrations"` // within the window, 0 to never suspect
+	Window          Duration `json:"window"`
+	Abort           bool     `json:"abort"`
+}
+
+// MasterListConfig tells when the driver moves on to the next master of
+// a list of masters, see mesos_master_attempts.
+type MasterListConfig struct {
+	Attempts            int      `json:"attempts"` // with each master, in turn
+	RegistrationTimeout Duration `json:"registration_timeout"`
+	Backoff             Duration `json:"backoff"` // doubled after every pass over the list
+	MaxBackoff          Duration `json:"max_backoff"`
+}
+
+// DebugConfig is where /metrics and /health are served, see
+// mesos_debug_address, and when they stop once the driver stops.
+type DebugConfig struct {
+	Address     string   `json:"address"`      // "" to serve them at the address of the driver
+	HealthGrace Duration `json:"health_grace"` // /health is served once the driver stopped, requires an address
+	StopFirst   bool     `json:"stop_first"`   // /metrics ends before the messages are drained
+}
+
+// AckRetryConfig is the backoff of the status update acknowledgements
+// that could not be sent.
+type AckRetryConfig struct {
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+}
+
+// QuotaConfig is the quota of the role of the framework, see QuotaAccount.
+// A zero amount means no quota on the resource.
+type QuotaConfig struct {
+	Cpus    float64 `json:"cpus"`
+	Mem     float64 `json:"mem"`
+	Disk    float64 `json:"disk"`
+	Enforce bool    `json:"enforce"`
+}
+
+// DefaultConfig returns the options set by the command line flags.
+func DefaultConfig() *Config {
+	opts := messenger.DefaultOptions()
+	return &Config{
+		MasterFilePoll: Duration(*masterFilePoll),
+		MasterList: MasterListConfig{
+			Attempts:            *masterAttempts,
+			RegistrationTimeout: Duration(*registrationTimeout),
+			Backoff:             Duration(*masterBackoff),
+			MaxBackoff:          Duration(*masterMaxBackoff),
+		},
+		Authentication: AuthConfig{Provider: *authProvider},
+		Timeouts: TimeoutConfig{
+			Dial:           Duration(*dialTimeout),
+			ResponseHeader: Duration(*responseHeaderTimeout),
+			Request:        Duration(*requestTimeout),
+			StopDrain:      Duration(*stopDrainTimeout),
+			KeepAlive:      Duration(*tcpKeepAlive),
+			IdleConn:       Duration(*idleConnTimeout),
+			Detect:         Duration(*detectTimeout),
+		},
+		Send: SendConfig{
+			QueueSize:      opts.SendQueueSize,
+			QueueTimeout:   Duration(opts.SendQueueTimeout),
+			MaxAttempts:    opts.SendMaxAttempts,
+			RetryBackoff:   Duration(opts.SendRetryBackoff),
+			DecodeRoutines: opts.DecodeRoutines,
+		},
+		MessageSize:          MessageSizeConfig{Max: *maxMessageSize, Strict: *strictMessageSize},
+		OrderedStatusUpdates: *orderedUpdates,
+		MasterWarmup:         *masterWarmup,
+		ExplicitAcks:         *explicitAcks,
+		PrometheusMetrics:    *prometheusMetrics,
+		OfferTimeout:         Duration(*offerTimeout),
+		MaxKeptOffers:        *maxKeptOffers,
+		CheckOfferResources:  *checkOfferResources,
+		DevStrict:            *devStrict,
+		Reconcile:            ReconcileConfig{BatchSize: *reconcileBatchSize, BatchDelay: Duration(*reconcileBatchDelay)},
+		DirectSend:           DirectSendConfig{Failures: *directSendFailures, Reprobe: Duration(*directSendReprobe)},
+		Cache: CacheConfig{
+			MaxEntries:      *cacheMaxEntries,
+			MemoryTarget:    *cacheMemoryTarget,
+			CompactInterval: Duration(*cacheCompactInterval),
+		},
+		TaskCache: TaskCacheConfig{SnapshotInterval: Duration(*taskCacheSnapshotInterval)},
+		TaskIDs:   TaskIDConfig{ReuseCooldown: Duration(*taskIDReuseCooldown), AllowReuse: *allowTaskIDReuse},
+		Quota:     QuotaConfig{Cpus: *quotaCpus, Mem: *quotaMem, Disk: *quotaDisk, Enforce: *enforceQuota},
+		AckRetry:  AckRetryConfig{Backoff: Duration(*ackRetryBackoff), MaxBackoff: Duration(*ackRetryMaxBackoff)},
+		IDLimits: IDLimitConfig{
+			FrameworkName: *maxFrameworkNameLength,
+			ExecutorID:    *maxExecutorIDLength,
+			TaskID:        *maxTaskIDLength,
+			Strict:        *strictIDs,
+		},
+		Dispatch: DispatchConfig{
+			QueueSize:           *eventQueueSize,
+			CallbackStopTimeout: Duration(*callbackStopTimeout),
+			AbortOnPanic:        *abortOnCallbackPanic,
+		},
+		Duplicates: DuplicateConfig{
+			Reregistrations: *duplicateReregistrations,
+			Window:          Duration(*duplicateWindow),
+			Abort:           *abortOnDuplicate,
+		},
+		Debug: DebugConfig{
+			Address:     *debugAddress,
+			HealthGrace: Duration(*debugHealthGrace),
+			StopFirst:   *debugStopFirst,
+		},
+	}
+}
+
+// ConfigError lists all the problems of a configuration.
+type ConfigError struct {
+	Path     string // empty if the config was not loaded from a file
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	what := "invalid scheduler config"
+	if e.Path != "" {
+		what += " " + e.Path
+	}
+	return what + ":\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+// LoadConfig reads a JSON configuration file, the fields missing from the
+// file keep the values of DefaultConfig. All the problems of the file are
+// reported at once by a *ConfigError.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	var strict struct {
+		Strict bool `json:"strict"`
+	}
+	if err := json.Unmarshal(data, &strict); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return nil, &ConfigError{Path: path, Problems: []string{"config: " + describeJSONError(err)}}
+		}
+		// the other problems are reported by decodeConfig.
+	}
+
+	var problems []string
+	decodeConfig(data, reflect.ValueOf(cfg).Elem(), "", strict.Strict, &problems)
+	problems = append(problems, cfg.problems()...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Path: path, Problems: problems}
+	}
+	return cfg, nil
+}
+
+// decodeConfig decodes the JSON object data onto the struct v field by
+// field, so that a bad field does not hide the problems of the others.
+func decodeConfig(data []byte, v reflect.Value, path string, strict bool, problems *[]string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		if path == "" {
+			path = "config"
+		}
+		*problems = append(*problems, fmt.Sprintf("%s: %s", path, describeJSONError(err)))
+		return
+	}
+	known := make(map[string]bool)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		known[name] = true
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		name = joinConfigPath(path, name)
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			decodeConfig(raw, f, name, strict, problems)
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			if string(raw) == "null" {
+				f.Set(reflect.Zero(f.Type()))
+				continue
+			}
+			if f.IsNil() {
+				f.Set(reflect.New(f.Type().Elem()))
+			}
+			decodeConfig(raw, f.Elem(), name, strict, problems)
+		default:
+			if err := json.Unmarshal(raw, f.Addr().Interface()); err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s: %s", name, describeJSONError(err)))
+			}
+		}
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, joinConfigPath(path, name))
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		if strict {
+			*problems = append(*problems, name+": unknown field")
+		} else {
+			log.Warningf("Ignoring unknown scheduler config field %s\n", name)
+		}
+	}
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func describeJSONError(err error) string {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Sprintf("syntax error at offset %d: %v", err.Offset, err)
+	case *json.UnmarshalTypeError:
+		return fmt.Sprintf("cannot use a JSON %s as %v", err.Value, err.Type)
+	}
+	return err.Error()
+}
+
+// Validate reports all the problems of the configuration by a
+// *ConfigError, nil if there are none.
+func (cfg *Config) Validate() error {
+	if problems := cfg.problems(); len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+func (cfg *Config) problems() []string {
+	var problems []string
+	failf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	atLeast := func(name string, v, min int) {
+		if v < min {
+			failf("%s: must be at least %d, got %d", name, min, v)
+		}
+	}
+	notNegative := func(name string, d Duration) {
+		if d < 0 {
+			failf("%s: must not be negative, got %v", name, time.Duration(d))
+		}
+	}
+	notNegativeAmount := func(name string, v float64) {
+		if v < 0 {
+			failf("%s: must not be negative, got %g", name, v)
+		}
+	}
+
+	if cfg.Master == "" {
+		failf("master: required")
+	}
+	notNegative("master_file_poll", cfg.MasterFilePoll)
+	atLeast("master_list.attempts", cfg.MasterList.Attempts, 1)
+	if cfg.MasterList.RegistrationTimeout <= 0 {
+		failf("master_list.registration_timeout: must be positive, got %v", time.Duration(cfg.MasterList.RegistrationTimeout))
+	}
+	notNegative("master_list.backoff", cfg.MasterList.Backoff)
+	if cfg.MasterList.MaxBackoff < cfg.MasterList.Backoff {
+		failf("master_list.max_backoff: must be at least the backoff, got %v", time.Duration(cfg.MasterList.MaxBackoff))
+	}
+	if cfg.Bind.Port < 0 || cfg.Bind.Port > 65535 {
+		failf("bind.port: must be between 0 and 65535, got %d", cfg.Bind.Port)
+	}
+	if cfg.TLS != nil && (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		failf("tls: cert_file and key_file must be set together")
+	}
+	if cfg.Authentication.Principal != "" && cfg.Authentication.SecretFile == "" {
+		failf("authentication.secret_file: required with a principal")
+	}
+	if cfg.Authentication.Principal == "" && cfg.Authentication.SecretFile != "" {
+		failf("authentication.principal: required with a secret_file")
+	}
+	if cfg.Authentication.Provider == "" {
+		failf("authentication.provider: required")
+	}
+	notNegative("timeouts.dial", cfg.Timeouts.Dial)
+	notNegative("timeouts.response_header", cfg.Timeouts.ResponseHeader)
+	notNegative("timeouts.request", cfg.Timeouts.Request)
+	notNegative("timeouts.stop_drain", cfg.Timeouts.StopDrain)
+	notNegative("timeouts.keepalive", cfg.Timeouts.KeepAlive)
+	notNegative("timeouts.idle_conn", cfg.Timeouts.IdleConn)
+	if cfg.Timeouts.Detect <= 0 {
+		failf("timeouts.detect: must be positive, got %v", time.Duration(cfg.Timeouts.Detect))
+	}
+	atLeast("send.queue_size", cfg.Send.QueueSize, 1)
+	notNegative("send.queue_timeout", cfg.Send.QueueTimeout)
+	atLeast("send.max_attempts", cfg.Send.MaxAttempts, 1)
+	notNegative("send.retry_backoff", cfg.Send.RetryBackoff)
+	atLeast("send.decode_routines", cfg.Send.DecodeRoutines, 1)
+	atLeast("message_size.max", cfg.MessageSize.Max, 1)
+	notNegative("offer_timeout", cfg.OfferTimeout)
+	atLeast("max_kept_offers", cfg.MaxKeptOffers, 0)
+	atLeast("reconcile.batch_size", cfg.Reconcile.BatchSize, 1)
+	notNegative("reconcile.batch_delay", cfg.Reconcile.BatchDelay)
+	notNegative("refusal.default", cfg.Refusal.Default)
+	roles := make([]string, 0, len(cfg.Refusal.Roles))
+	for role := range cfg.Refusal.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		notNegative("refusal.roles."+role, cfg.Refusal.Roles[role])
+	}
+	atLeast("direct_send.failures", cfg.DirectSend.Failures, 1)
+	notNegative("direct_send.reprobe", cfg.DirectSend.Reprobe)
+	atLeast("cache.max_entries", cfg.Cache.MaxEntries, 0)
+	atLeast("cache.memory_target", cfg.Cache.MemoryTarget, 0)
+	notNegative("cache.compact_interval", cfg.Cache.CompactInterval)
+	if cfg.TaskCache.File != "" && !cfg.OrderedStatusUpdates {
+		failf("task_cache.file: requires ordered_status_updates")
+	}
+	notNegative("task_cache.snapshot_interval", cfg.TaskCache.SnapshotInterval)
+	notNegative("task_ids.reuse_cooldown", cfg.TaskIDs.ReuseCooldown)
+	notNegativeAmount("quota.cpus", cfg.Quota.Cpus)
+	notNegativeAmount("quota.mem", cfg.Quota.Mem)
+	notNegativeAmount("quota.disk", cfg.Quota.Disk)
+	notNegative("ack_retry.backoff", cfg.AckRetry.Backoff)
+	if cfg.AckRetry.MaxBackoff < cfg.AckRetry.Backoff {
+		failf("ack_retry.max_backoff: must be at least the backoff, got %v", time.Duration(cfg.AckRetry.MaxBackoff))
+	}
+	if q := cfg.Quota; q.Enforce && q.Cpus <= 0 && q.Mem <= 0 && q.Disk <= 0 {
+		failf("quota.enforce: requires a quota")
+	}
+	atLeast("id_limits.framework_name", cfg.IDLimits.FrameworkName, 1)
+	atLeast("id_limits.executor_id", cfg.IDLimits.ExecutorID, 1)
+	atLeast("id_limits.task_id", cfg.IDLimits.TaskID, 1)
+	atLeast("dispatch.queue_size", cfg.Dispatch.QueueSize, 1)
+	notNegative("dispatch.callback_stop_timeout", cfg.Dispatch.CallbackStopTimeout)
+	atLeast("duplicate_scheduler.reregistrations", cfg.Duplicates.Reregistrations, 0)
+	if cfg.Duplicates.Reregistrations > 0 && cfg.Duplicates.Window <= 0 {
+		failf("duplicate_scheduler.window: must be positive, got %v", time.Duration(cfg.Duplicates.Window))
+	}
+	notNegative("debug.health_grace", cfg.Debug.HealthGrace)
+	if cfg.Debug.HealthGrace > 0 && cfg.Debug.Address == "" {
+		failf("debug.health_grace: requires an address")
+	}
+	return problems
+}
+
+// credential reads the credential of the configuration, nil if the
+// driver does not authenticate.
+func (cfg *Config) credential() (*mesos.Credential, error) {
+	if cfg.Authentication.Principal == "" {
+		return nil, nil
+	}
+	secret, err := ioutil.ReadFile(cfg.Authentication.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return &mesos.Credential{
+		Principal: proto.String(cfg.Authentication.Principal),
+		Secret:    secret,
+	}, nil
+}
+
+// tlsConfig loads the TLS files of the configuration, nil if the driver
+// talks HTTP.
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	if cfg.TLS == nil {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if cfg.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", cfg.TLS.CAFile)
+		}
+	}
+	if cfg.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (cfg *Config) refusalPolicy() RefusalPolicy {
+	p := RefusalPolicy{Default: time.Duration(cfg.Refusal.Default)}
+	if cfg.Refusal.Roles != nil {
+		p.Roles = make(map[string]time.Duration, len(cfg.Refusal.Roles))
+		for role, d := range cfg.Refusal.Roles {
+			p.Roles[role] = time.Duration(d)
+		}
+	}
+	return p
+}
+
+// NewMesosSchedulerDriverFromConfig is like NewMesosSchedulerDriverTLS,
+// but all the options of the driver come from cfg instead of the command
+// line flags, see LoadConfig and NewDriverWithConfig.
+func NewMesosSchedulerDriverFromConfig(
+	sched Scheduler,
+	framework *mesos.FrameworkInfo,
+	cfg *Config,
+) (*MesosSchedulerDriver, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("Config required.")
+	}
+	return NewDriverWithConfig(DriverConfig{Scheduler: sched, Framework: framework, Options: cfg})
+}
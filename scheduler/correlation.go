@@ -0,0 +1,34 @@
+package scheduler
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/net/context"
+)
+
+// CorrelationEnv is the environment variable that carries, to the
+// executor of a task, the correlation ID of the call that launched it.
+const CorrelationEnv = "MESOS_CORRELATION_ID"
+
+type correlationKey struct{}
+
+// WithCorrelation returns a context carrying the correlation ID of the
+// driver calls made with it, see LaunchTasksContext. It lets a tracing
+// system follow a call through the driver and into the executors.
+func WithCorrelation(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// Correlation returns the correlation ID carried by ctx, if any.
+func Correlation(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationKey{}).(string)
+	return id, ok && id != ""
+}
+
+// correlationOf returns the correlation ID carried by ctx, or a new one
+// to log the call with.
+func correlationOf(ctx context.Context) string {
+	if id, ok := Correlation(ctx); ok {
+		return id
+	}
+	return uuid.NewUUID().String()
+}
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// DriverMetricsSnapshot is a copy of the counters the driver keeps of its
+// activity, whether Metrics is set or not, see MetricsSnapshot.
+type DriverMetricsSnapshot struct {
+	OffersReceived uint64
+	OffersDeclined uint64 // including the offers launched on without tasks
+	TasksLaunched  uint64 // sent to the master
+	MessagesSent   uint64
+	MessagesFailed uint64 // not sent, see SendError
+	Reconnects     uint64 // re-registrations with a master
+	// StatusUpdates counts the updates received, including those the
+	// driver generates, key:state.
+	StatusUpdates map[mesos.TaskState]uint64
+
+	LastRegistered      time.Time // zero until the framework registers
+	LastStatusUpdate    time.Time // zero until an update is received
+	LastMessageSent     time.Time // zero until a message is sent
+	LastMessageReceived time.Time // zero until a message is received
+}
+
+// driverCounters are updated atomically, the counters come first for the
+// alignment of the 64 bit values.
+type driverCounters struct {
+	offersReceived   uint64
+	offersDeclined   uint64
+	tasksLaunched    uint64
+	messagesSent     uint64
+	messagesFailed   uint64
+	reconnects       uint64
+	lastRegistered   int64 // UnixNano, 0 if never
+	lastStatusUpdate int64 // UnixNano, 0 if never
+	lastSent         int64 // UnixNano, 0 if never
+	lastReceived     int64 // UnixNano, 0 if never
+
+	statusUpdates map[mesos.TaskState]*uint64 // not modified once created
+}
+
+func newDriverCounters() *driverCounters {
+	c := &driverCounters{statusUpdates: make(map[mesos.TaskState]*uint64)}
+	for state := range mesos.TaskState_name {
+		c.statusUpdates[mesos.TaskState(state)] = new(uint64)
+	}
+	return c
+}
+
+// sent counts a message sent at at, or not if err is set. The tasks and
+// the offers of a LaunchTasksMessage are counted once the message is sent.
+func (c *driverCounters) sent(msg proto.Message, err error, at time.Time) {
+	if err != nil {
+		atomic.AddUint64(&c.messagesFailed, 1)
+		return
+	}
+	atomic.AddUint64(&c.messagesSent, 1)
+	atomic.StoreInt64(&c.lastSent, at.UnixNano())
+	if launch, ok := msg.(*mesos.LaunchTasksMessage); ok {
+		if len(launch.Tasks) == 0 {
+			atomic.AddUint64(&c.offersDeclined, uint64(len(launch.OfferIds)))
+		} else {
+			atomic.AddUint64(&c.tasksLaunched, uint64(len(launch.Tasks)))
+		}
+	}
+}
+
+func (c *driverCounters) received(at time.Time) {
+	atomic.StoreInt64(&c.lastReceived, at.UnixNano())
+}
+
+func (c *driverCounters) offered(n int) {
+	atomic.AddUint64(&c.offersReceived, uint64(n))
+}
+
+func (c *driverCounters) registered(at time.Time, reconnect bool) {
+	atomic.StoreInt64(&c.lastRegistered, at.UnixNano())
+	if reconnect {
+		atomic.AddUint64(&c.reconnects, 1)
+	}
+}
+
+func (c *driverCounters) statusUpdated(state mesos.TaskState, at time.Time) {
+	if n, ok := c.statusUpdates[state]; ok {
+		atomic.AddUint64(n, 1)
+	}
+	atomic.StoreInt64(&c.lastStatusUpdate, at.UnixNano())
+}
+
+func (c *driverCounters) snapshot() DriverMetricsSnapshot {
+	s := DriverMetricsSnapshot{
+		OffersReceived:      atomic.LoadUint64(&c.offersReceived),
+		OffersDeclined:      atomic.LoadUint64(&c.offersDeclined),
+		TasksLaunched:       atomic.LoadUint64(&c.tasksLaunched),
+		MessagesSent:        atomic.LoadUint64(&c.messagesSent),
+		MessagesFailed:      atomic.LoadUint64(&c.messagesFailed),
+		Reconnects:          atomic.LoadUint64(&c.reconnects),
+		StatusUpdates:       make(map[mesos.TaskState]uint64),
+		LastRegistered:      unixNano(atomic.LoadInt64(&c.lastRegistered)),
+		LastStatusUpdate:    unixNano(atomic.LoadInt64(&c.lastStatusUpdate)),
+		LastMessageSent:     unixNano(atomic.LoadInt64(&c.lastSent)),
+		LastMessageReceived: unixNano(atomic.LoadInt64(&c.lastReceived)),
+	}
+	for state, n := range c.statusUpdates {
+		if v := atomic.LoadUint64(n); v > 0 {
+			s.StatusUpdates[state] = v
+		}
+	}
+	return s
+}
+
+func unixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// MetricsSnapshot returns a copy of the counters of the driver. It is not
+// named Metrics, which is the field the driver reports to.
+func (driver *MesosSchedulerDriver) MetricsSnapshot() DriverMetricsSnapshot {
+	return driver.counters.snapshot()
+}
@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mesos/mesos-go/messenger"
+)
+
+var (
+	debugAddress = flag.String("mesos_debug_address", "",
+		"Address /metrics and /health are served at, apart from the messages, instead of the address of the driver")
+	debugHealthGrace = flag.Duration("mesos_debug_health_grace", 0,
+		"How long /health keeps serving the final state of the driver once it stopped, requires mesos_debug_address")
+	debugStopFirst = flag.Bool("mesos_debug_stop_first", false,
+		"Stop serving /metrics as soon as the driver stops, before the messages are drained, instead of once the messenger stopped")
+)
+
+// debugEndpoints are /metrics and /health, served along with the messages
+// by the messenger, or at an address of their own. They have a lifecycle
+// of their own: the scrapes of /metrics may end before the messages are
+// drained, and /health may keep reporting the final state of the driver
+// for a grace window once it stopped. Stopped endpoints answer 503.
+type debugEndpoints struct {
+	address     string        // "" to be served by the messenger
+	healthGrace time.Duration // /health is served once the driver stopped, with an address
+	stopFirst   bool          // /metrics ends before the messages are drained
+
+	mux      *http.ServeMux
+	lock     sync.Mutex
+	metrics  bool // /metrics is served
+	health   bool // /health is served
+	listener net.Listener
+	stopOnce sync.Once
+}
+
+func newDebugEndpoints(cfg DebugConfig) *debugEndpoints {
+	return &debugEndpoints{
+		address:     cfg.Address,
+		healthGrace: time.Duration(cfg.HealthGrace),
+		stopFirst:   cfg.StopFirst,
+		mux:         http.NewServeMux(),
+		metrics:     true,
+		health:      true,
+	}
+}
+
+// gate serves h while served tells it is.
+func (d *debugEndpoints) gate(served *bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.lock.Lock()
+		ok := *served
+		d.lock.Unlock()
+		if !ok {
+			http.Error(w, "Stopped", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startDebugEndpoints serves /health, and /metrics if the driver reports
+// to Prometheus, at mesos_debug_address, or by the messenger otherwise,
+// which must not be started yet. Nothing is served by default.
+func (driver *MesosSchedulerDriver) startDebugEndpoints(metrics http.Handler) error {
+	d := driver.debug
+	if d.address == "" && metrics == nil {
+		return nil
+	}
+	patterns := []string{"/health"}
+	d.mux.Handle("/health", d.gate(&d.health, http.HandlerFunc(driver.serveHealth)))
+	if metrics != nil {
+		patterns = append(patterns, "/metrics")
+		d.mux.Handle("/metrics", d.gate(&d.metrics, metrics))
+	}
+
+	if d.address == "" {
+		s, ok := driver.messenger.(messenger.HandlerServer)
+		if !ok {
+			log.Warningf("Not serving the debug endpoints, messenger %T does not serve HTTP\n", driver.messenger)
+			return nil
+		}
+		for _, pattern := range patterns {
+			if err := s.Handle(pattern, d.mux); err != nil {
+				log.Errorf("Not serving the debug endpoints: %v\n", err)
+				return nil
+			}
+		}
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", d.address)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.listener = ln
+	d.lock.Unlock()
+	log.Infoln("Serving the debug endpoints at", ln.Addr())
+	go http.Serve(ln, d.mux)
+	return nil
+}
+
+// healthStatus is the JSON served at /health.
+type healthStatus struct {
+	Time                time.Time `json:"time"`
+	State               string    `json:"state"`
+	Status              string    `json:"status"`
+	Connected           bool      `json:"connected"`
+	Master              string    `json:"master,omitempty"`
+	OutstandingOffers   int       `json:"outstanding_offers"`
+	PendingAcks         int       `json:"pending_acks"`
+	LastMessageSent     time.Time `json:"last_message_sent"`
+	LastMessageReceived time.Time `json:"last_message_received"`
+	ShutdownReason      string    `json:"shutdown_reason,omitempty"`
+}
+
+// serveHealth answers 200 while the driver runs, 503 otherwise, with the
+// health of the driver in either case.
+func (driver *MesosSchedulerDriver) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := driver.health()
+	status := healthStatus{
+		Time:                h.Time,
+		State:               h.State.String(),
+		Status:              h.Status.String(),
+		Connected:           h.Connected,
+		OutstandingOffers:   h.OutstandingOffers,
+		PendingAcks:         h.PendingAcks,
+		LastMessageSent:     h.LastMessageSent,
+		LastMessageReceived: h.LastMessageReceived,
+	}
+	if h.Master != nil {
+		status.Master = h.Master.String()
+	}
+	if h.State.terminal() {
+		status.ShutdownReason = driver.ShutdownReason().String()
+	}
+	code := http.StatusOK
+	if h.State == StateStopping || h.State.terminal() {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.V(1).Infof("Failed to serve /health: %v\n", err)
+	}
+}
+
+// stopDebugMetrics ends the scrapes of /metrics, /health is still served.
+func (driver *MesosSchedulerDriver) stopDebugMetrics() {
+	driver.debug.lock.Lock()
+	driver.debug.metrics = false
+	driver.debug.lock.Unlock()
+}
+
+// debugStopped ends the debug endpoints once the driver stopped, after
+// the grace window of /health if they have an address of their own.
+func (driver *MesosSchedulerDriver) debugStopped() {
+	driver.stopDebugMetrics()
+	d := driver.debug
+	if d.address == "" || d.healthGrace <= 0 {
+		driver.StopDebugEndpoints()
+		return
+	}
+	go func() {
+		<-driver.clock.After(d.healthGrace)
+		driver.StopDebugEndpoints()
+	}()
+}
+
+// StopDebugEndpoints stops serving /metrics and /health, whether the
+// driver runs or not. They are not served again.
+func (driver *MesosSchedulerDriver) StopDebugEndpoints() {
+	d := driver.debug
+	d.lock.Lock()
+	d.metrics, d.health = false, false
+	ln := d.listener
+	d.lock.Unlock()
+	if ln == nil {
+		return
+	}
+	d.stopOnce.Do(func() {
+		if err := ln.Close(); err != nil {
+			log.Warningf("Failed to stop the debug endpoints: %v\n", err)
+		}
+	})
+}
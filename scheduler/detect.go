@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mesos/mesos-go/detector"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var detectTimeout = flag.Duration("mesos_detect_timeout", 30*time.Second,
+	"Time Start waits for the leading master of a zk:// or file:// master to be detected")
+
+var masterFilePoll = flag.Duration("mesos_master_file_poll", 0,
+	"How often the file of a file:// master is read again to pick up a new master, 0 reads it once")
+
+// newDetector creates the detector of a zk:// master, replaced by tests.
+var newDetector = detector.New
+
+// isDetected tells whether the leading master is detected from master,
+// a zk://host1:port1,host2:port2/path URL or a file:///path holding
+// either that or host:port, rather than given as host:port.
+func isDetected(master string) bool {
+	return strings.HasPrefix(master, "zk://") || strings.HasPrefix(master, "file://")
+}
+
+// masterDetector creates the detector of master, the file of a file://
+// master is read again every poll unless 0.
+func masterDetector(master string, poll time.Duration) (detector.Detector, error) {
+	if path := strings.TrimPrefix(master, "file://"); path != master {
+		return detector.NewFileMasterDetector(path, poll)
+	}
+	return newDetector(master)
+}
+
+// detectMaster starts the detector and waits up to detectTimeout for it to
+// report a leading master, which becomes the master of the driver. The
+// later changes of leader are handed to OnMasterChanged on the event
+// goroutine.
+func (driver *MesosSchedulerDriver) detectMaster() error {
+	var (
+		lock     sync.Mutex
+		waiting  = true
+		leader   *mesos.MasterInfo // the latest, while waiting
+		detected = make(chan struct{})
+	)
+	err := driver.detector.Detect(detector.OnMasterChanged(func(info *mesos.MasterInfo) {
+		lock.Lock()
+		if waiting {
+			if info != nil && leader == nil {
+				close(detected)
+			}
+			if info != nil {
+				leader = info
+			}
+			lock.Unlock()
+			return
+		}
+		lock.Unlock()
+		driver.post(func() { driver.OnMasterChanged(info) })
+	}))
+	if err != nil {
+		return fmt.Errorf("Failed to detect the leading master: %v", err)
+	}
+
+	timer := time.NewTimer(driver.detectTimeout)
+	defer timer.Stop()
+	select {
+	case <-detected:
+	case <-timer.C:
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	waiting = false
+	if leader == nil {
+		return fmt.Errorf("No leading master detected within %v", driver.detectTimeout)
+	}
+	pid, err := masterUPID(leader)
+	if err != nil {
+		return fmt.Errorf("Invalid leading master: %v", err)
+	}
+	log.Infoln("Detected leading master", pid)
+	driver.setMasterPid(pid)
+	return nil
+}
+
+// stopDetector stops the detector of the master, if any.
+func (driver *MesosSchedulerDriver) stopDetector() {
+	if driver.detector == nil {
+		return
+	}
+	if err := driver.detector.Stop(); err != nil {
+		log.Warningf("Failed to stop the master detector: %v\n", err)
+	}
+}
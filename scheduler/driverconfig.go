@@ -0,0 +1,106 @@
+package scheduler
+
+import (
+	"crypto/tls"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// DriverConfig is everything a MesosSchedulerDriver is created with, see
+// NewDriverWithConfig. The fields other than Scheduler, Framework and
+// Options override the options of the same name when set.
+type DriverConfig struct {
+	Scheduler Scheduler
+	Framework *mesos.FrameworkInfo
+
+	Master     string
+	Credential *mesos.Credential // instead of Options.Authentication
+	TLS        *tls.Config       // instead of Options.TLS
+	// BindingAddress and BindingPort are the address the driver receives
+	// messages on, instead of Options.Bind.
+	BindingAddress string
+	BindingPort    int
+	// HostnameOverride is the hostname of the framework. The framework
+	// keeps its own, or gets that of the host, if empty.
+	HostnameOverride string
+
+	// Options holds all the other options, e.g. ExplicitAcks,
+	// DefaultConfig if nil. They are not modified.
+	Options *Config
+}
+
+// options returns a copy of the options with the overrides applied.
+func (dc *DriverConfig) options() *Config {
+	cfg := DefaultConfig()
+	if dc.Options != nil {
+		opts := *dc.Options
+		cfg = &opts
+	}
+	if dc.Master != "" {
+		cfg.Master = dc.Master
+	}
+	if dc.BindingAddress != "" {
+		cfg.Bind.Address = dc.BindingAddress
+	}
+	if dc.BindingPort != 0 {
+		cfg.Bind.Port = dc.BindingPort
+	}
+	return cfg
+}
+
+// problems lists the problems of the configuration, those of the options
+// included.
+func (dc *DriverConfig) problems(cfg *Config) []string {
+	var problems []string
+	if dc.Scheduler == nil {
+		problems = append(problems, "scheduler: required")
+	}
+	if dc.Framework == nil {
+		problems = append(problems, "framework: required")
+	}
+	return append(problems, cfg.problems()...)
+}
+
+// NewDriverWithConfig creates a driver as configured by dc. It fails
+// with a ConfigError listing all the problems of dc, e.g. a missing
+// Scheduler or master. The user and hostname of the framework default to
+// those of the process.
+func NewDriverWithConfig(dc DriverConfig) (*MesosSchedulerDriver, error) {
+	cfg := dc.options()
+	if problems := dc.problems(cfg); len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	credential := dc.Credential
+	if credential == nil {
+		var err error
+		if credential, err = cfg.credential(); err != nil {
+			return nil, err
+		}
+	}
+	if credential != nil && dc.Framework.GetPrincipal() == "" {
+		dc.Framework.Principal = credential.Principal
+	}
+	tlsConfig := dc.TLS
+	if tlsConfig == nil {
+		var err error
+		if tlsConfig, err = cfg.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if dc.HostnameOverride != "" {
+		dc.Framework.Hostname = proto.String(dc.HostnameOverride)
+	}
+
+	driver, err := newConfiguredDriver(dc.Scheduler, dc.Framework, cfg, credential, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	driver.AllowedTaskUsers = cfg.AllowedTaskUsers
+	driver.Refusal = cfg.refusalPolicy()
+	if cfg.TaskCache.File != "" {
+		driver.TaskCacheStore = NewFileTaskCacheStore(cfg.TaskCache.File)
+	}
+	return driver, nil
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var (
+	duplicateReregistrations = flag.Int("mesos_duplicate_scheduler_reregistrations", 5,
+		"Suspect another scheduler of running with the framework ID after this many re-registrations within mesos_duplicate_scheduler_window, 0 never does")
+	duplicateWindow = flag.Duration("mesos_duplicate_scheduler_window", 10*time.Minute,
+		"Window of mesos_duplicate_scheduler_reregistrations")
+	abortOnDuplicate = flag.Bool("mesos_abort_on_duplicate_scheduler", false,
+		"Abort the driver when another scheduler is suspected of running with the framework ID, otherwise the Scheduler is only told with an error")
+)
+
+// the message of the FrameworkErrorMessage sent by the master to the
+// scheduler another one took over from.
+const frameworkFailedOver = "Framework failed over"
+
+// duplicateDetector counts the re-registrations of the framework within
+// a window. Two schedulers running with the same framework ID take the
+// framework over from each other, each re-registering in turn.
+type duplicateDetector struct {
+	lock            sync.Mutex
+	reregistrations int // 0 to never suspect
+	window          time.Duration
+	abort           bool
+	recent          []time.Time // re-registrations within the window, in order
+}
+
+func newDuplicateDetector(cfg DuplicateConfig) *duplicateDetector {
+	return &duplicateDetector{
+		reregistrations: cfg.Reregistrations,
+		window:          time.Duration(cfg.Window),
+		abort:           cfg.Abort,
+	}
+}
+
+// reregistered records a re-registration at now and returns how many
+// happened within the window, 0 unless there are enough to suspect a
+// duplicate. The count starts over once a duplicate is suspected.
+func (d *duplicateDetector) reregistered(now time.Time) int {
+	if d.reregistrations <= 0 {
+		return 0
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.recent = append(d.recent, now)
+	for len(d.recent) > 0 && now.Sub(d.recent[0]) > d.window {
+		d.recent = d.recent[1:]
+	}
+	if n := len(d.recent); n >= d.reregistrations {
+		d.recent = nil
+		return n
+	}
+	return 0
+}
+
+// duplicateSuspected tells the Scheduler that another scheduler seems to
+// run with the framework ID, with ShutdownDuplicateScheduler as
+// the reason, and aborts the driver if mesos_abort_on_duplicate_scheduler.
+func (driver *MesosSchedulerDriver) duplicateSuspected(why string) {
+	err := fmt.Sprintf("Another scheduler is suspected of running as framework %s: %s",
+		driver.frameworkId().GetValue(), why)
+	log.Errorln(err)
+	driver.metrics().Increment(MetricDuplicateScheduler)
+	driver.error(err, driver.duplicates.abort, ShutdownDuplicateScheduler)
+}
+
+// registeredWhileConnected checks a (re)registration of the framework
+// received while the driver is connected. One from the master the driver
+// is connected to may answer a registration attempt sent before the
+// first answer, one from another master means that the framework is
+// registered from elsewhere.
+func (driver *MesosSchedulerDriver) registeredWhileConnected(from *upid.UPID, frameworkId *mesos.FrameworkID) {
+	master := driver.masterPid()
+	if master == nil || from.Equal(master) || !frameworkId.Equal(driver.frameworkId()) {
+		return
+	}
+	driver.duplicateSuspected(fmt.Sprintf("master %v registered the framework while the driver is connected to master %v", from, master))
+}
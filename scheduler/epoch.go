@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"fmt"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// Epoch returns the epoch of the connection of the driver to the master.
+// It is 0 until the framework registers and incremented every time the
+// framework registers or re-registers, e.g. after a master failover, so
+// that a framework can tell which connection a callback belongs to. The
+// epoch of the callbacks is that of the driver when they are called, the
+// state transitions and the contexts passed to StatusUpdateContext carry
+// it too. Offers made on an older epoch cannot be launched on, see
+// StaleOfferError.
+func (driver *MesosSchedulerDriver) Epoch() uint64 {
+	return driver.state.currentEpoch()
+}
+
+// StaleOfferError is returned by LaunchTasks for an offer made before the
+// driver reconnected to the master, the master no longer knows it. The
+// tasks are marked as lost.
+type StaleOfferError struct {
+	OfferId string
+	Epoch   uint64 // the offer was made on
+	Current uint64 // epoch of the driver
+}
+
+func (e *StaleOfferError) Error() string {
+	return fmt.Sprintf("Offer %s is from epoch %d, the driver is at epoch %d", e.OfferId, e.Epoch, e.Current)
+}
+
+// staleOffer returns a StaleOfferError if the cached offer was made on an
+// older epoch than the current one, nil otherwise.
+func (driver *MesosSchedulerDriver) staleOffer(offerId *mesos.OfferID) error {
+	entry := driver.cache.getOffer(offerId)
+	if entry == nil {
+		return nil
+	}
+	if current := driver.Epoch(); entry.epoch < current {
+		return &StaleOfferError{OfferId: offerId.GetValue(), Epoch: entry.epoch, Current: current}
+	}
+	return nil
+}
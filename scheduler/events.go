@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/messenger"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var (
+	eventQueueSize = flag.Int("mesos_event_queue_size", 1024,
+		"How many received messages and driver events may wait for the Scheduler callbacks before the messenger blocks")
+	callbackStopTimeout = flag.Duration("mesos_callback_stop_timeout", 5*time.Second,
+		"How long Join and Run wait for the Scheduler callback in progress to return once the driver stopped, 0 does not wait")
+	abortOnCallbackPanic = flag.Bool("mesos_abort_on_callback_panic", true,
+		"Abort the driver when a Scheduler callback panics, otherwise the panic is only logged and the driver carries on")
+)
+
+// post queues fn to run on the event goroutine of the driver, the only
+// goroutine the Scheduler callbacks triggered by the master, the slaves
+// or by the driver itself run on. Events are handled in the order they
+// are posted, a slow callback delays the following events but not the
+// receipt of messages, until the queue is full. Events posted once the
+// driver stopped are dropped.
+func (driver *MesosSchedulerDriver) post(fn func()) {
+	select {
+	case driver.events <- fn:
+		return
+	default:
+	}
+	log.Warningf("Driver event queue is full (%d events), a Scheduler callback is slow\n", cap(driver.events))
+	driver.metrics().Increment(MetricEventQueueFull)
+	select {
+	case driver.events <- fn:
+	case <-driver.stopCh:
+	}
+}
+
+// postAsync is post for the events the driver generates itself, which
+// may be posted by a Scheduler callback: the event goroutine cannot wait
+// for itself, fn is queued by another goroutine if the queue is full.
+func (driver *MesosSchedulerDriver) postAsync(fn func()) {
+	select {
+	case driver.events <- fn:
+	default:
+		go driver.post(fn)
+	}
+}
+
+// dispatch returns a handler posting the messages received to h, see post.
+func (driver *MesosSchedulerDriver) dispatch(h messenger.MessageHandler) messenger.MessageHandler {
+	return func(from *upid.UPID, msg proto.Message) {
+		driver.counters.received(driver.clock.Now())
+		driver.post(func() { h(from, msg) })
+	}
+}
+
+// eventLoop handles the posted events in order until the driver stops.
+func (driver *MesosSchedulerDriver) eventLoop(done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-driver.stopCh:
+			return
+		case fn := <-driver.events:
+			driver.handle(fn)
+		}
+	}
+}
+
+// handle runs an event, recovering from a panic of the Scheduler.
+func (driver *MesosSchedulerDriver) handle(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			driver.callbackPanicked(r, debug.Stack())
+		}
+	}()
+	fn()
+}
+
+// callbackPanicked reports a panic of a Scheduler callback to the
+// Error callback and aborts the driver, unless
+// mesos_abort_on_callback_panic is false.
+func (driver *MesosSchedulerDriver) callbackPanicked(r interface{}, stack []byte) {
+	log.Errorf("Scheduler callback panicked: %v\n%s", r, stack)
+	driver.metrics().Increment(MetricCallbackPanics)
+	if !driver.abortOnPanic {
+		return
+	}
+	defer func() {
+		// the Error callback may panic too.
+		if r := recover(); r != nil {
+			log.Errorf("Scheduler Error callback panicked: %v\n", r)
+			if driver.Status() == mesos.Status_DRIVER_RUNNING {
+				driver.Abort()
+			}
+		}
+	}()
+	driver.error(fmt.Sprintf("Scheduler callback panicked: %v", r), true, ShutdownCallbackPanic)
+}
+
+// startEvents starts the event goroutine.
+func (driver *MesosSchedulerDriver) startEvents() {
+	done := make(chan struct{})
+	driver.lock.Lock()
+	driver.eventsDone = done
+	driver.lock.Unlock()
+	go driver.eventLoop(done)
+}
+
+// awaitCallback waits up to mesos_callback_stop_timeout for the callback
+// in progress, if any, to return once the driver stopped. Join waits for
+// it rather than Stop and Abort, which may be called by the callback.
+func (driver *MesosSchedulerDriver) awaitCallback() {
+	driver.lock.RLock()
+	done := driver.eventsDone
+	driver.lock.RUnlock()
+	if done == nil || driver.callbackStopTimeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(driver.callbackStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warningf("Stopped while a Scheduler callback is still running after %v\n", driver.callbackStopTimeout)
+	}
+}
@@ -0,0 +1,207 @@
+package scheduler
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// window within which failed tasks of an executor are correlated with
+// the loss of that executor.
+const executorFailureWindow = 10 * time.Second
+
+// ExecutorLostCause is the inferred reason an executor was lost.
+type ExecutorLostCause int
+
+const (
+	ExecutorLostUnknown        ExecutorLostCause = iota
+	ExecutorLostOOM                              // killed for exceeding its memory limit
+	ExecutorLostLaunchFailed                     // never launched, e.g. a fetch or image failure
+	ExecutorLostSlaveRestarted                   // did not survive a slave restart
+	ExecutorLostExited                           // exited on its own with an exit code
+	ExecutorLostSignaled                         // terminated by a signal
+)
+
+func (c ExecutorLostCause) String() string {
+	switch c {
+	case ExecutorLostOOM:
+		return "OOM"
+	case ExecutorLostLaunchFailed:
+		return "LAUNCH_FAILED"
+	case ExecutorLostSlaveRestarted:
+		return "SLAVE_RESTARTED"
+	case ExecutorLostExited:
+		return "EXITED"
+	case ExecutorLostSignaled:
+		return "SIGNALED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ExecutorLostInfo describes the loss of an executor.
+type ExecutorLostInfo struct {
+	ExecutorId *mesos.ExecutorID
+	SlaveId    *mesos.SlaveID
+	Status     int // raw wait status reported by the slave
+	ExitCode   int // valid if Signal == 0
+	Signal     int // terminating signal, 0 if the executor exited
+	Cause      ExecutorLostCause
+	TaskIds    []*mesos.TaskID // tasks of the executor that failed shortly before
+}
+
+// ExecutorLostInfoHandler may be implemented by a Scheduler to receive
+// an ExecutorLostInfo instead of the ExecutorLost callback.
+type ExecutorLostInfoHandler interface {
+	ExecutorLostInfo(SchedulerDriver, *ExecutorLostInfo)
+}
+
+// decodeWaitStatus splits a wait(2) status into exit code and signal.
+func decodeWaitStatus(status int) (exitCode, signal int) {
+	if sig := status & 0x7f; sig != 0 {
+		return 0, sig
+	}
+	return (status >> 8) & 0xff, 0
+}
+
+type executorFailure struct {
+	taskId  *mesos.TaskID
+	message string
+	at      time.Time
+}
+
+// executorFailures remembers the recent task failures of executors, so
+// they can be correlated with the loss of the executor.
+type executorFailures struct {
+	lock     sync.Mutex
+	failures map[string][]*executorFailure // key:SlaveID/ExecutorID
+}
+
+func newExecutorFailures() *executorFailures {
+	return &executorFailures{failures: make(map[string][]*executorFailure)}
+}
+
+func executorKey(slaveId *mesos.SlaveID, execId *mesos.ExecutorID) string {
+	return slaveId.GetValue() + "/" + execId.GetValue()
+}
+
+// record remembers a failed or lost task of the executor.
+func (f *executorFailures) record(slaveId *mesos.SlaveID, execId *mesos.ExecutorID, status *mesos.TaskStatus, now time.Time) {
+	switch status.GetState() {
+	case mesos.TaskState_TASK_FAILED, mesos.TaskState_TASK_LOST:
+	default:
+		return
+	}
+	key := executorKey(slaveId, execId)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures[key] = append(f.prune(key, now), &executorFailure{
+		taskId:  status.GetTaskId(),
+		message: status.GetMessage(),
+		at:      now,
+	})
+}
+
+// take returns and forgets the failures of the executor recorded within
+// executorFailureWindow before now.
+func (f *executorFailures) take(slaveId *mesos.SlaveID, execId *mesos.ExecutorID, now time.Time) []*executorFailure {
+	key := executorKey(slaveId, execId)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	recent := f.prune(key, now)
+	delete(f.failures, key)
+	return recent
+}
+
+// prune drops the failures older than executorFailureWindow, the
+// caller must hold the lock.
+func (f *executorFailures) prune(key string, now time.Time) []*executorFailure {
+	var recent []*executorFailure
+	for _, failure := range f.failures[key] {
+		if now.Sub(failure.at) <= executorFailureWindow {
+			recent = append(recent, failure)
+		}
+	}
+	return recent
+}
+
+// inferExecutorLost builds the ExecutorLostInfo from the wait status and
+// the messages of the tasks that failed right before the executor.
+func inferExecutorLost(execId *mesos.ExecutorID, slaveId *mesos.SlaveID, status int, failures []*executorFailure) *ExecutorLostInfo {
+	info := &ExecutorLostInfo{
+		ExecutorId: execId,
+		SlaveId:    slaveId,
+		Status:     status,
+	}
+	info.ExitCode, info.Signal = decodeWaitStatus(status)
+
+	for _, failure := range failures {
+		info.TaskIds = append(info.TaskIds, failure.taskId)
+		if info.Cause != ExecutorLostUnknown {
+			continue
+		}
+		// messages as reported by the mesos slave and its isolators.
+		msg := strings.ToLower(failure.message)
+		switch {
+		case strings.Contains(msg, "memory limit exceeded"):
+			info.Cause = ExecutorLostOOM
+		case strings.Contains(msg, "failed to fetch"),
+			strings.Contains(msg, "failed to launch"),
+			strings.Contains(msg, "failed to create container"):
+			info.Cause = ExecutorLostLaunchFailed
+		case strings.Contains(msg, "slave restarted"),
+			strings.Contains(msg, "did not re-register"):
+			info.Cause = ExecutorLostSlaveRestarted
+		}
+	}
+
+	if info.Cause == ExecutorLostUnknown {
+		if info.Signal != 0 {
+			info.Cause = ExecutorLostSignaled
+		} else {
+			info.Cause = ExecutorLostExited
+		}
+	}
+	return info
+}
+
+// usage returns the number of executors with recorded failures and the
+// estimated size of those failures.
+func (f *executorFailures) usage() (entries, bytes int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for key, failures := range f.failures {
+		bytes += cacheEntryOverhead + len(key) + failuresSize(failures)
+	}
+	return len(f.failures), bytes
+}
+
+// evict forgets the failures of up to n executors, those that failed
+// least recently first.
+func (f *executorFailures) evict(n int) (entries, bytes int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	keys := make([]agedKey, 0, len(f.failures))
+	for key, failures := range f.failures {
+		var last time.Time
+		if len(failures) > 0 {
+			last = failures[len(failures)-1].at
+		}
+		keys = append(keys, agedKey{key, last})
+	}
+	for _, k := range oldest(keys, n) {
+		bytes += cacheEntryOverhead + len(k.key) + failuresSize(f.failures[k.key])
+		delete(f.failures, k.key)
+		entries++
+	}
+	return
+}
+
+func failuresSize(failures []*executorFailure) (size int) {
+	for _, failure := range failures {
+		size += estimateSize(failure.taskId) + len(failure.message)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FrameworkErrorKind tells what a FrameworkError sent by the master is
+// about, guessed from its message.
+type FrameworkErrorKind int
+
+const (
+	FrameworkErrorGeneric       FrameworkErrorKind = iota
+	FrameworkErrorAuthorization                    // the framework is not authorized, e.g. to use its role or principal
+	FrameworkErrorRegistration                     // the registration was refused, or the framework removed or taken over
+)
+
+func (k FrameworkErrorKind) String() string {
+	switch k {
+	case FrameworkErrorGeneric:
+		return "GENERIC"
+	case FrameworkErrorAuthorization:
+		return "AUTHORIZATION"
+	case FrameworkErrorRegistration:
+		return "REGISTRATION"
+	default:
+		return fmt.Sprintf("FrameworkErrorKind(%d)", int(k))
+	}
+}
+
+// FrameworkError is an error the master sent the framework, with a
+// FrameworkErrorMessage, before the driver aborts. It is the StopReason
+// of the driver, and is handed to a FrameworkErrorHandler.
+type FrameworkError struct {
+	Kind    FrameworkErrorKind
+	Message string // as sent by the master
+}
+
+func (e *FrameworkError) Error() string {
+	return e.Message
+}
+
+// FrameworkErrorHandler may be implemented by a Scheduler to receive the
+// errors sent by the master as a FrameworkError, instead of the Error
+// callback. The other errors are still passed to Error.
+type FrameworkErrorHandler interface {
+	FrameworkError(SchedulerDriver, *FrameworkError)
+}
+
+// newFrameworkError classifies the message of a FrameworkErrorMessage.
+// The master only sends text, e.g. "Not authorized to use role 'x'" or
+// "Framework has been removed".
+func newFrameworkError(message string) *FrameworkError {
+	kind := FrameworkErrorGeneric
+	switch m := strings.ToLower(message); {
+	case strings.Contains(m, "not authorized"), strings.Contains(m, "unauthorized"),
+		strings.Contains(m, "not authenticated"):
+		kind = FrameworkErrorAuthorization
+	case strings.Contains(m, "register"), strings.Contains(m, "failed over"),
+		strings.Contains(m, "removed"):
+		kind = FrameworkErrorRegistration
+	}
+	return &FrameworkError{Kind: kind, Message: message}
+}
@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+// HealthSnapshot is the state of the driver handed to the heartbeat of
+// JoinWithHeartbeat.
+type HealthSnapshot struct {
+	Time      time.Time // when the snapshot was taken
+	State     DriverState
+	Status    mesos.Status
+	Connected bool
+	Master    *upid.UPID // nil until a master is known
+
+	OutstandingOffers int // cached, neither used nor declined yet
+	PendingAcks       int // status updates awaiting an explicit acknowledgement
+
+	LastMessageSent     time.Time // zero until a message is sent
+	LastMessageReceived time.Time // zero until a message is received
+	LastRegistered      time.Time // zero until the framework registers
+	LastStatusUpdate    time.Time // zero until an update is received
+}
+
+func (driver *MesosSchedulerDriver) health() HealthSnapshot {
+	driver.ackLock.Lock()
+	pendingAcks := len(driver.pendingAcks)
+	driver.ackLock.Unlock()
+	counters := driver.counters.snapshot()
+	return HealthSnapshot{
+		Time:                driver.clock.Now(),
+		State:               driver.State(),
+		Status:              driver.Status(),
+		Connected:           driver.Connected(),
+		Master:              driver.masterPid(),
+		OutstandingOffers:   driver.cache.savedOffers.len(),
+		PendingAcks:         pendingAcks,
+		LastMessageSent:     counters.LastMessageSent,
+		LastMessageReceived: counters.LastMessageReceived,
+		LastRegistered:      counters.LastRegistered,
+		LastStatusUpdate:    counters.LastStatusUpdate,
+	}
+}
+
+// JoinWithHeartbeat blocks until the driver is stopped, like Join, and
+// calls fn with a snapshot of the health of the driver every interval
+// meanwhile, e.g. to report liveness to a supervisor. A panic of fn is
+// logged, the next heartbeats are still called.
+func (driver *MesosSchedulerDriver) JoinWithHeartbeat(interval time.Duration, fn func(HealthSnapshot)) (mesos.Status, error) {
+	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
+		return stat, driver.misused(fmt.Errorf("Unable to JoinWithHeartbeat, expecting driver status %s, but is %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	if interval <= 0 {
+		return driver.Status(), fmt.Errorf("Unable to JoinWithHeartbeat, the interval must be positive, got %v", interval)
+	}
+	for {
+		select {
+		case <-driver.stopCh:
+			return driver.Status(), nil
+		case <-driver.clock.After(interval):
+			driver.heartbeat(fn)
+		}
+	}
+}
+
+func (driver *MesosSchedulerDriver) heartbeat(fn func(HealthSnapshot)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Heartbeat panicked: %v\n", r)
+		}
+	}()
+	fn(driver.health())
+}
@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var (
+	maxFrameworkNameLength = flag.Int("mesos_max_framework_name_length", 1024,
+		"Longest FrameworkInfo.name, in bytes, the driver accepts")
+	maxExecutorIDLength = flag.Int("mesos_max_executor_id_length", 255,
+		"Longest executor ID, in bytes, the driver launches, it names a directory of the sandbox path of the slave")
+	maxTaskIDLength = flag.Int("mesos_max_task_id_length", 255,
+		"Longest task ID, in bytes, the driver launches, it names the executor directory of a command task")
+	strictIDs = flag.Bool("mesos_strict_ids", false,
+		"Refuse, instead of only warning about, a framework name or the IDs of a task that are too long or not usable in a path")
+)
+
+// checkIDLength fails if the value named what is longer than max bytes.
+func checkIDLength(what, value string, max int) error {
+	if len(value) > max {
+		return fmt.Errorf("%s is %d bytes long, longer than %d.", what, len(value), max)
+	}
+	return nil
+}
+
+// checkPathID fails if the ID named what is too long or cannot be the
+// name of a directory: the slave makes directories of the executor IDs,
+// and of the task IDs of command tasks, in the sandbox path.
+func checkPathID(what, id string, max int) error {
+	if err := checkIDLength(what, id, max); err != nil {
+		return err
+	}
+	switch {
+	case id == "":
+		return fmt.Errorf("%s is empty.", what)
+	case strings.ContainsAny(id, "/\x00"):
+		return fmt.Errorf("%s %q contains a slash or a NUL byte.", what, id)
+	case strings.HasPrefix(id, "."):
+		return fmt.Errorf("%s %q starts with a dot.", what, id)
+	}
+	return nil
+}
+
+// checkFrameworkName checks the name of the framework when the driver is
+// created. Unless limits are strict a name that is too long only warns.
+func checkFrameworkName(framework *mesos.FrameworkInfo, limits IDLimitConfig) error {
+	err := checkIDLength("Framework name", framework.GetName(), limits.FrameworkName)
+	if err != nil && !limits.Strict {
+		log.Warningf("%v The master may reject the framework.\n", err)
+		return nil
+	}
+	return err
+}
+
+// checkTaskIDs checks the IDs of a task and of its executor before the
+// task is launched. Unless the limits are strict a bad ID only warns.
+func (driver *MesosSchedulerDriver) checkTaskIDs(task *mesos.TaskInfo) error {
+	err := checkPathID("Task ID", task.GetTaskId().GetValue(), driver.idLimits.TaskID)
+	if err == nil && task.Executor != nil {
+		err = checkPathID("Executor ID", task.Executor.GetExecutorId().GetValue(), driver.idLimits.ExecutorID)
+	}
+	if err != nil && !driver.idLimits.Strict {
+		log.Warningf("Launching task anyway: %v\n", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package scheduler
+
+import (
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/messenger"
+)
+
+// maxLeaderRedirects bounds the redirects a registration follows from
+// master to master, the driver then waits for the detector to report the
+// leader.
+const maxLeaderRedirects = 3
+
+// followLeader registers with the leader a standby master pointed to on
+// receipt of a registration, see messenger.ParseLeaderHint. It returns
+// false if msg is not a registration, the driver no longer registers or
+// followed too many redirects since the last master was detected.
+func (driver *MesosSchedulerDriver) followLeader(msg *messenger.Message, redirect *messenger.LeaderRedirectError) bool {
+	switch msg.ProtoMessage.(type) {
+	case *mesos.RegisterFrameworkMessage, *mesos.ReregisterFrameworkMessage:
+	default:
+		return false
+	}
+	if driver.Connected() || driver.Stopped() || driver.leaderRedirects >= maxLeaderRedirects {
+		return false
+	}
+	driver.leaderRedirects++
+	log.Infof("Master %v is not the leader, registering with %v\n", redirect.Master, redirect.Leader)
+	driver.setMasterPid(redirect.Leader)
+	// not on the event goroutine, send may wait for room in the queue.
+	go func() {
+		if err := driver.send(redirect.Leader, msg.ProtoMessage); err != nil {
+			log.Errorf("Failed to register with master %v: %v\n", redirect.Leader, err)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,196 @@
+package scheduler
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/messenger"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var (
+	masterAttempts = flag.Int("mesos_master_attempts", 2,
+		"Registrations attempted with each master of a list of masters before moving on to the next one")
+	registrationTimeout = flag.Duration("mesos_registration_timeout", 10*time.Second,
+		"Time a master of a list of masters has to answer a registration before the attempt fails")
+	masterBackoff = flag.Duration("mesos_master_backoff", time.Second,
+		"Delay of the first registration retry with a list of masters, doubled after every pass over the list")
+	masterMaxBackoff = flag.Duration("mesos_master_max_backoff", 30*time.Second,
+		"Maximum delay of the registration retries with a list of masters")
+)
+
+var errRegistrationTimeout = errors.New("Registration timed out")
+
+// isMasterList tells whether master is a comma separated list of
+// host:port masters, tried in turn until one accepts the registration.
+func isMasterList(master string) bool {
+	return strings.Contains(master, ",") && !isDetected(master)
+}
+
+// masterList is the masters of a comma separated master, the driver
+// registers with each in turn, attempts times, until one accepts.
+type masterList struct {
+	lock       sync.Mutex
+	masters    []*upid.UPID
+	attempts   int
+	timeout    time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	current    int    // index of the master registered with
+	failures   int    // of the registrations with the current master
+	passes     uint   // over the whole list, since the driver last registered
+	attempt    uint64 // of the registration in progress
+	retrying   bool   // the attempt waits for its backoff, it cannot fail
+}
+
+func newMasterList(master string, cfg MasterListConfig) (*masterList, error) {
+	l := &masterList{
+		attempts:   cfg.Attempts,
+		timeout:    time.Duration(cfg.RegistrationTimeout),
+		backoff:    time.Duration(cfg.Backoff),
+		maxBackoff: time.Duration(cfg.MaxBackoff),
+	}
+	for _, addr := range strings.Split(master, ",") {
+		pid, err := upid.Parse("master@" + strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid master %q in %q: %v", addr, master, err)
+		}
+		l.masters = append(l.masters, pid)
+	}
+	return l, nil
+}
+
+// started returns the number of the registration attempt started.
+func (l *masterList) started() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.attempt++
+	l.retrying = false
+	return l.attempt
+}
+
+// failed records that the registration attempt failed, unless it is not
+// the one in progress anymore. It returns the master to register with
+// next, the delay before and the attempt that waits for it, ok is false
+// if the failure is stale.
+func (l *masterList) failed(attempt uint64) (next *upid.UPID, delay time.Duration, retry uint64, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if attempt != l.attempt || l.retrying {
+		return nil, 0, 0, false
+	}
+	l.attempt++
+	l.retrying = true
+	l.failures++
+	if l.failures >= l.attempts {
+		l.failures = 0
+		l.current = (l.current + 1) % len(l.masters)
+		if l.current == 0 {
+			l.passes++
+		}
+	}
+	delay = l.backoff << l.passes
+	if delay > l.maxBackoff || delay <= 0 {
+		delay = l.maxBackoff
+	}
+	return l.masters[l.current], delay, l.attempt, true
+}
+
+// inProgress returns the registration attempt in progress.
+func (l *masterList) inProgress() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.attempt
+}
+
+// masterRegistered resets the backoff of the list of masters once one
+// accepted the registration, the attempt does not fail anymore.
+func (driver *MesosSchedulerDriver) masterRegistered() {
+	if driver.masters == nil {
+		return
+	}
+	l := driver.masters
+	l.lock.Lock()
+	l.failures, l.passes = 0, 0
+	l.attempt++
+	l.retrying = false
+	l.lock.Unlock()
+}
+
+// Master returns the master the driver is connected to or registers
+// with, nil while a leading master is being detected. It moves through
+// the masters of a list of masters as they fail.
+func (driver *MesosSchedulerDriver) Master() *upid.UPID {
+	return driver.masterPid()
+}
+
+// watchRegistration fails the registration just sent if the master does
+// not answer it in time, with a list of masters.
+func (driver *MesosSchedulerDriver) watchRegistration() {
+	if driver.masters == nil {
+		return
+	}
+	attempt := driver.masters.started()
+	go func() {
+		select {
+		case <-driver.stopCh:
+		case <-driver.clock.After(driver.masters.timeout):
+			driver.post(func() { driver.registrationFailed(attempt, errRegistrationTimeout) })
+		}
+	}()
+}
+
+// registrationFailed registers again, with the next master of the list
+// once the current one failed too many times, after a backoff.
+func (driver *MesosSchedulerDriver) registrationFailed(attempt uint64, cause error) {
+	if driver.Connected() || driver.Stopped() {
+		return
+	}
+	next, delay, retry, ok := driver.masters.failed(attempt)
+	if !ok {
+		return
+	}
+	log.Warningf("Failed to register with master %v, registering with %v in %v: %v\n", driver.masterPid(), next, delay, cause)
+	info := &mesos.MasterInfo{Pid: proto.String(next.String())}
+	go func() {
+		select {
+		case <-driver.stopCh:
+		case <-driver.clock.After(delay):
+			driver.post(func() {
+				if driver.masters.inProgress() == retry && !driver.Connected() {
+					driver.OnMasterChanged(info)
+				}
+			})
+		}
+	}()
+}
+
+// masterFailed handles the failure of a message sent to the master of a
+// list of masters: a failed registration, or the loss of the master
+// registered with, is retried with the list. It returns false for the
+// other failures.
+func (driver *MesosSchedulerDriver) masterFailed(msg *messenger.Message, err error) bool {
+	if driver.masters == nil {
+		return false
+	}
+	switch msg.ProtoMessage.(type) {
+	case *mesos.RegisterFrameworkMessage, *mesos.ReregisterFrameworkMessage:
+		if driver.Connected() {
+			return false
+		}
+	default:
+		if !driver.Connected() {
+			return false
+		}
+		driver.masterLost(fmt.Errorf("Failed to send message %v: %v", msg.Name, err))
+	}
+	driver.registrationFailed(driver.masters.inProgress(), err)
+	return true
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/mesos/mesos-go/messenger"
+)
+
+var prometheusMetrics = flag.Bool("mesos_prometheus_metrics", false,
+	"Serve the metrics of the driver and of its messenger in the Prometheus text format at /metrics, see mesos_debug_address, unless Metrics is set")
+
+// Names of the metrics reported by MesosSchedulerDriver, in addition to
+// those of its messenger.
+const (
+	MetricRegistered              = "registered"
+	MetricReregistered            = "reregistered" // the driver reconnected to a master
+	MetricDisconnected            = "disconnected"
+	MetricRegistrationLatency     = "registration_latency_seconds"
+	MetricDeclineRefuseSeconds    = "decline_refuse_seconds"    // observed for each offer declined per RefusalPolicy
+	MetricStatusUpdatesSuppressed = "status_updates_suppressed" // stale updates not delivered, see mesos_ordered_status_updates
+	MetricTaskIDReused            = "task_id_reused"            // tasks launched with the ID of a recent or running task
+	MetricAcksResent              = "status_update_acks_resent" // acknowledgements that could not be sent at first
+	MetricStatusUpdates           = "status_updates"            // received, labeled by task_state
+	MetricEventQueueFull          = "event_queue_full"          // events that waited for room in the event queue
+	MetricCallbackPanics          = "callback_panics"           // Scheduler callbacks that panicked
+	MetricDuplicateScheduler      = "duplicate_scheduler_suspected"
+
+	// gauges, exported if Metrics is a messenger.GaugeRegistry.
+	MetricConnected    = "connected" // 1 while connected to a master
+	MetricCachedOffers = "cached_offers"
+	MetricUnsentAcks   = "unsent_acks" // status update acknowledgements to resend
+	MetricEventQueue   = "event_queue" // events waiting for the Scheduler callbacks
+)
+
+// metrics returns the Metrics the driver reports to.
+func (driver *MesosSchedulerDriver) metrics() messenger.Metrics {
+	if driver.Metrics == nil {
+		return messenger.NoopMetrics{}
+	}
+	return driver.Metrics
+}
+
+// startMetrics has the messenger report to the driver's Metrics, which
+// are served to Prometheus if none were set, see mesos_prometheus_metrics.
+// It returns the handler of the Prometheus metrics, nil if not served.
+func (driver *MesosSchedulerDriver) startMetrics() http.Handler {
+	var handler http.Handler
+	if driver.Metrics == nil && driver.prometheusMetrics {
+		metrics := newPrometheusMetrics()
+		driver.Metrics, handler = metrics, metrics
+	}
+	if driver.Metrics == nil {
+		return nil
+	}
+	if r, ok := driver.messenger.(messenger.MetricsReporter); ok {
+		r.SetMetrics(driver.Metrics)
+	}
+	if g, ok := driver.Metrics.(messenger.GaugeRegistry); ok {
+		g.Gauge(MetricConnected, func() float64 {
+			if driver.Connected() {
+				return 1
+			}
+			return 0
+		})
+		g.Gauge(MetricCachedOffers, func() float64 { return float64(len(driver.cache.offersSnapshot())) })
+		g.Gauge(MetricUnsentAcks, func() float64 { return float64(driver.updates.size()) })
+		g.Gauge(MetricEventQueue, func() float64 { return float64(len(driver.events)) })
+	}
+	return handler
+}
+
+// newPrometheusMetrics returns the metrics served at /metrics, see
+// startDebugEndpoints.
+func newPrometheusMetrics() *messenger.PrometheusMetrics {
+	metrics := messenger.NewPrometheusMetrics("mesos")
+	metrics.SetBuckets(MetricDeclineRefuseSeconds, []float64{1, 5, 30, 60, 300, 600, 3600})
+	return metrics
+}
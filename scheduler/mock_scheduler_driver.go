@@ -0,0 +1,94 @@
+package scheduler
+
+import (
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSchedulerDriver is a SchedulerDriver to unit test a Scheduler with,
+// e.g. to assert the tasks it launches:
+//
+//	driver := NewMockSchedulerDriver()
+//	driver.On("LaunchTasks", offerIds, mock.Anything, mock.Anything).Return(mesos.Status_DRIVER_RUNNING, nil)
+//	sched.ResourceOffers(driver, offers)
+//	driver.AssertExpectations(t)
+//
+// Each method passes its arguments to Called and returns the status and
+// the error of the matching expectation.
+type MockSchedulerDriver struct {
+	mock.Mock
+}
+
+var _ SchedulerDriver = (*MockSchedulerDriver)(nil)
+
+func NewMockSchedulerDriver() *MockSchedulerDriver {
+	return &MockSchedulerDriver{}
+}
+
+func (m *MockSchedulerDriver) status(args mock.Arguments) (mesos.Status, error) {
+	return args.Get(0).(mesos.Status), args.Error(1)
+}
+
+func (m *MockSchedulerDriver) Start() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) Stop(failover bool) (mesos.Status, error) {
+	return m.status(m.Called(failover))
+}
+
+func (m *MockSchedulerDriver) Abort() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) Join() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) Run() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) RequestResources(requests []*mesos.Request) (mesos.Status, error) {
+	return m.status(m.Called(requests))
+}
+
+func (m *MockSchedulerDriver) LaunchTasks(offerIDs []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
+	return m.status(m.Called(offerIDs, tasks, filters))
+}
+
+func (m *MockSchedulerDriver) LaunchTasksOnOffers(offerIDs []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
+	return m.status(m.Called(offerIDs, tasks, filters))
+}
+
+func (m *MockSchedulerDriver) KillTask(taskID *mesos.TaskID) (mesos.Status, error) {
+	return m.status(m.Called(taskID))
+}
+
+func (m *MockSchedulerDriver) KillTasks(taskIDs []*mesos.TaskID) (mesos.Status, error) {
+	return m.status(m.Called(taskIDs))
+}
+
+func (m *MockSchedulerDriver) DeclineOffer(offerID *mesos.OfferID, filters *mesos.Filters) (mesos.Status, error) {
+	return m.status(m.Called(offerID, filters))
+}
+
+func (m *MockSchedulerDriver) ReviveOffers() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) SuppressOffers() (mesos.Status, error) {
+	return m.status(m.Called())
+}
+
+func (m *MockSchedulerDriver) SendFrameworkMessage(executorID *mesos.ExecutorID, slaveID *mesos.SlaveID, data string) (mesos.Status, error) {
+	return m.status(m.Called(executorID, slaveID, data))
+}
+
+func (m *MockSchedulerDriver) ReconcileTasks(statuses []*mesos.TaskStatus) (mesos.Status, error) {
+	return m.status(m.Called(statuses))
+}
+
+func (m *MockSchedulerDriver) AcknowledgeStatusUpdate(status *mesos.TaskStatus) (mesos.Status, error) {
+	return m.status(m.Called(status))
+}
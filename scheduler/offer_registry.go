@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+// offerRegistry tracks the outstanding offers of the driver, along with
+// the PID of the slave that made each offer. An offer may carry a
+// deadline after which it is considered expired, e.g. when the master
+// times out offers or the framework declines them automatically.
+type offerRegistry struct {
+	lock   sync.RWMutex
+	offers map[string]*cachedOffer // key:OfferID
+}
+
+func newOfferRegistry() *offerRegistry {
+	return &offerRegistry{
+		offers: make(map[string]*cachedOffer),
+	}
+}
+
+// add registers an offer that expires ttl after now. A ttl <= 0 means the
+// offer never expires.
+func (r *offerRegistry) add(offer *mesos.Offer, pid *upid.UPID, now time.Time, ttl time.Duration) {
+	entry := newCachedOffer(offer, pid)
+	if ttl > 0 {
+		entry.deadline = now.Add(ttl)
+	}
+	r.put(entry)
+}
+
+// put registers an entry.
+func (r *offerRegistry) put(entry *cachedOffer) {
+	r.lock.Lock()
+	r.offers[entry.offer.Id.GetValue()] = entry
+	r.lock.Unlock()
+}
+
+// get returns the registered offer, or nil.
+func (r *offerRegistry) get(offerId string) *cachedOffer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.offers[offerId]
+}
+
+// remove unregisters an offer and returns it, or nil if it was unknown.
+func (r *offerRegistry) remove(offerId string) *cachedOffer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.offers[offerId]
+	if ok {
+		delete(r.offers, offerId)
+	}
+	return entry
+}
+
+// list returns a snapshot of the registered offers.
+func (r *offerRegistry) list() []*cachedOffer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	entries := make([]*cachedOffer, 0, len(r.offers))
+	for _, entry := range r.offers {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// expire unregisters and returns the offers whose deadline passed
+// before now.
+func (r *offerRegistry) expire(now time.Time) []*cachedOffer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var expired []*cachedOffer
+	for id, entry := range r.offers {
+		if !entry.deadline.IsZero() && entry.deadline.Before(now) {
+			expired = append(expired, entry)
+			delete(r.offers, id)
+		}
+	}
+	return expired
+}
+
+// len returns the number of registered offers.
+func (r *offerRegistry) len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.offers)
+}
+
+// usage returns the number of registered offers and their estimated size.
+func (r *offerRegistry) usage() (entries, bytes int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, entry := range r.offers {
+		bytes += entry.size()
+	}
+	return len(r.offers), bytes
+}
+
+// evict unregisters up to n offers that carry a deadline, those due
+// first. Offers without a deadline are never evicted.
+func (r *offerRegistry) evict(n int) (entries, bytes int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var keys []agedKey
+	for id, entry := range r.offers {
+		if !entry.deadline.IsZero() {
+			keys = append(keys, agedKey{id, entry.deadline})
+		}
+	}
+	for _, k := range oldest(keys, n) {
+		bytes += r.offers[k.key].size()
+		delete(r.offers, k.key)
+		entries++
+	}
+	return
+}
+
+// trim unregisters and returns the offers beyond the keep highest-scored
+// ones, ties are broken by offer ID.
+func (r *offerRegistry) trim(keep int) []*cachedOffer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.offers) <= keep {
+		return nil
+	}
+	entries := make(byScore, 0, len(r.offers))
+	for _, entry := range r.offers {
+		entries = append(entries, entry)
+	}
+	sort.Sort(entries)
+	trimmed := entries[keep:]
+	for _, entry := range trimmed {
+		delete(r.offers, entry.offer.Id.GetValue())
+	}
+	return trimmed
+}
+
+// byScore sorts offers by decreasing score.
+type byScore []*cachedOffer
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score > s[j].score
+	}
+	return s[i].offer.Id.GetValue() < s[j].offer.Id.GetValue()
+}
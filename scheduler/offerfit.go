@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"sort"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var checkOfferResources = flag.Bool("mesos_check_offer_resources", false,
+	"Refuse to launch tasks whose resources, with those of the executors launched with them, do not fit in the offers instead of sending them to the master")
+
+// OfferResourcesError is the error of a launch refused because its tasks
+// need more of a resource than the offers hold, see
+// mesos_check_offer_resources. Nothing is sent, the tasks are lost.
+type OfferResourcesError struct {
+	Resource string // name, followed by the role unless it is "*"
+	Needed   string
+	Offered  string
+}
+
+func (e *OfferResourcesError) Error() string {
+	return fmt.Sprintf("Tasks need %s %s, the offers hold %s.", e.Resource, e.Needed, e.Offered)
+}
+
+// resourceKey tells the resources of a task apart, those of a role can
+// only come from the resources of the same role.
+type resourceKey struct {
+	name, role string
+}
+
+func keyOf(r *mesos.Resource) resourceKey {
+	return resourceKey{r.GetName(), r.GetRole()}
+}
+
+func (k resourceKey) String() string {
+	if k.role == "" || k.role == "*" {
+		return k.name
+	}
+	return k.name + "(" + k.role + ")"
+}
+
+// fitOffers fails if the tasks, along with the executors they launch on
+// the slave, need more of a scalar resource or other ranges than the
+// cached offers hold. The other types of resources are not checked.
+func (driver *MesosSchedulerDriver) fitOffers(offerIds []*mesos.OfferID, slaveId *mesos.SlaveID, tasks []*mesos.TaskInfo) error {
+	var offered, needed []*mesos.Resource
+	for _, offerId := range offerIds {
+		if entry := driver.cache.getOffer(offerId); entry != nil {
+			offered = append(offered, entry.offer.GetResources()...)
+		}
+	}
+	executors := make(map[string]bool) // launched with the tasks, key:executorId
+	for _, task := range tasks {
+		needed = append(needed, task.GetResources()...)
+		executor := task.GetExecutor()
+		if executor == nil || executors[executor.GetExecutorId().GetValue()] {
+			continue
+		}
+		executors[executor.GetExecutorId().GetValue()] = true
+		if driver.cache.getExecutor(slaveId, executor.ExecutorId) == nil {
+			needed = append(needed, executor.GetResources()...)
+		}
+	}
+	return fitResources(needed, offered)
+}
+
+// fitResources fails on the first resource of needed that offered does
+// not hold enough of.
+func fitResources(needed, offered []*mesos.Resource) error {
+	scalars := make(map[resourceKey]float64)
+	ranges := make(map[resourceKey][]*mesos.Value_Range)
+	for _, r := range offered {
+		switch r.GetType() {
+		case mesos.Value_SCALAR:
+			scalars[keyOf(r)] += r.GetScalar().GetValue()
+		case mesos.Value_RANGES:
+			ranges[keyOf(r)] = append(ranges[keyOf(r)], r.GetRanges().GetRange()...)
+		}
+	}
+	for k, rs := range ranges {
+		ranges[k] = mergeRanges(rs)
+	}
+
+	// the amounts are compared once all the tasks are summed up.
+	sums := make(map[resourceKey]float64)
+	var keys []resourceKey // of sums, in order
+	for _, r := range needed {
+		k := keyOf(r)
+		switch r.GetType() {
+		case mesos.Value_SCALAR:
+			if _, ok := sums[k]; !ok {
+				keys = append(keys, k)
+			}
+			sums[k] += r.GetScalar().GetValue()
+		case mesos.Value_RANGES:
+			for _, want := range r.GetRanges().GetRange() {
+				left, ok := takeRange(ranges[k], want)
+				if !ok {
+					return &OfferResourcesError{
+						Resource: k.String(),
+						Needed:   formatRanges([]*mesos.Value_Range{want}),
+						Offered:  formatRanges(ranges[k]),
+					}
+				}
+				ranges[k] = left
+			}
+		}
+	}
+	// leave some room for the rounding of the sums.
+	const epsilon = 1e-6
+	for _, k := range keys {
+		if sums[k] > scalars[k]+epsilon {
+			return &OfferResourcesError{
+				Resource: k.String(),
+				Needed:   fmt.Sprintf("%g", sums[k]),
+				Offered:  fmt.Sprintf("%g", scalars[k]),
+			}
+		}
+	}
+	return nil
+}
+
+// mergeRanges returns rs sorted, the overlapping and adjacent ranges
+// merged.
+func mergeRanges(rs []*mesos.Value_Range) []*mesos.Value_Range {
+	sorted := make([]*mesos.Value_Range, len(rs))
+	copy(sorted, rs)
+	sort.Sort(rangesByBegin(sorted))
+	var merged []*mesos.Value_Range
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.GetBegin() <= merged[n-1].GetEnd()+1 {
+			if r.GetEnd() > merged[n-1].GetEnd() {
+				merged[n-1] = newRange(merged[n-1].GetBegin(), r.GetEnd())
+			}
+			continue
+		}
+		merged = append(merged, newRange(r.GetBegin(), r.GetEnd()))
+	}
+	return merged
+}
+
+// takeRange removes want from the merged ranges available, it returns
+// false if want is not all available.
+func takeRange(available []*mesos.Value_Range, want *mesos.Value_Range) ([]*mesos.Value_Range, bool) {
+	begin, end := want.GetBegin(), want.GetEnd()
+	for i, r := range available {
+		if begin < r.GetBegin() || end > r.GetEnd() {
+			continue
+		}
+		left := make([]*mesos.Value_Range, 0, len(available)+1)
+		left = append(left, available[:i]...)
+		if begin > r.GetBegin() {
+			left = append(left, newRange(r.GetBegin(), begin-1))
+		}
+		if end < r.GetEnd() {
+			left = append(left, newRange(end+1, r.GetEnd()))
+		}
+		return append(left, available[i+1:]...), true
+	}
+	return available, false
+}
+
+func newRange(begin, end uint64) *mesos.Value_Range {
+	return &mesos.Value_Range{Begin: &begin, End: &end}
+}
+
+func formatRanges(rs []*mesos.Value_Range) string {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, r := range rs {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%d-%d", r.GetBegin(), r.GetEnd())
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+type rangesByBegin []*mesos.Value_Range
+
+func (rs rangesByBegin) Len() int           { return len(rs) }
+func (rs rangesByBegin) Less(i, j int) bool { return rs[i].GetBegin() < rs[j].GetBegin() }
+func (rs rangesByBegin) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
@@ -0,0 +1,83 @@
+package scheduler
+
+import (
+	"flag"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var maxKeptOffers = flag.Int("mesos_max_kept_offers", 0,
+	"Outstanding offers kept for a scheduler implementing OfferScorer, the lowest-scored ones are declined. 0 keeps all offers")
+
+// OfferScorer may be implemented by a Scheduler to rank offers. The driver
+// then keeps at most mesos_max_kept_offers outstanding offers, those with
+// the highest scores, and declines the others. New offers that are
+// declined are not passed to ResourceOffers. A previously offered one that
+// is declined in favor of a better offer is reported through
+// OfferRescinded, launching tasks against it fails.
+type OfferScorer interface {
+	Score(*mesos.Offer) float64
+}
+
+// putScoredOffer stores an offer along with its score.
+func (cache *schedCache) putScoredOffer(offer *mesos.Offer, pid *upid.UPID, score float64) {
+	entry := newCachedOffer(offer, pid)
+	entry.score = score
+	if cache.offerTTL > 0 {
+		entry.deadline = cache.clock.Now().Add(cache.offerTTL)
+	}
+	entry.epoch = cache.currentEpoch()
+	cache.savedOffers.put(entry)
+}
+
+// keepTopOffers declines the outstanding offers beyond the
+// maxKeptOffers highest-scored ones and returns the new offers that are
+// kept.
+func (driver *MesosSchedulerDriver) keepTopOffers(offers []*mesos.Offer) []*mesos.Offer {
+	if driver.maxKeptOffers <= 0 {
+		return offers
+	}
+	trimmed := driver.cache.savedOffers.trim(driver.maxKeptOffers)
+	if len(trimmed) == 0 {
+		return offers
+	}
+
+	isNew := make(map[string]bool, len(offers))
+	for _, offer := range offers {
+		isNew[offer.Id.GetValue()] = true
+	}
+	declined := make(map[string]bool, len(trimmed))
+	for _, entry := range trimmed {
+		offerId := entry.offer.Id
+		declined[offerId.GetValue()] = true
+		log.V(1).Infof("Declining offer %s scored %v, keeping %d better offers\n", offerId.GetValue(), entry.score, driver.maxKeptOffers)
+		driver.declineOffer(entry.offer)
+		if !isNew[offerId.GetValue()] {
+			driver.cache.rescindOffer(offerId)
+			driver.Scheduler.OfferRescinded(driver, offerId)
+		}
+	}
+
+	kept := make([]*mesos.Offer, 0, len(offers))
+	for _, offer := range offers {
+		if !declined[offer.Id.GetValue()] {
+			kept = append(kept, offer)
+		}
+	}
+	return kept
+}
+
+// declineOffer declines an offer the scheduler did not get to use.
+func (driver *MesosSchedulerDriver) declineOffer(offer *mesos.Offer) {
+	message := &mesos.LaunchTasksMessage{
+		FrameworkId: driver.frameworkId(),
+		OfferIds:    []*mesos.OfferID{offer.Id},
+		Tasks:       []*mesos.TaskInfo{},
+		Filters:     driver.declineFilters(offer),
+	}
+	if err := driver.send(driver.masterPid(), message); err != nil {
+		log.Errorf("Failed to decline offer %s: %v\n", offer.Id.GetValue(), err)
+	}
+}
@@ -0,0 +1,41 @@
+package scheduler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// ProtocolError reports a message from the master or a slave that lacks
+// a field the driver needs to handle it.
+type ProtocolError struct {
+	Message string // name of the message
+	Field   string // path of the missing field, e.g. Update.Status
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s is missing required field %s.", e.Message, e.Field)
+}
+
+// requireFields checks that the nested message fields at the given dotted
+// paths are set, instead of letting a handler dereference a nil pointer.
+func requireFields(msg proto.Message, paths ...string) error {
+	for _, path := range paths {
+		v := reflect.ValueOf(msg)
+		for _, name := range strings.Split(path, ".") {
+			if v.IsNil() {
+				break
+			}
+			v = v.Elem().FieldByName(name)
+			if !v.IsValid() {
+				panic(fmt.Sprintf("%T has no field %s", msg, path))
+			}
+		}
+		if v.IsNil() {
+			return &ProtocolError{Message: reflect.TypeOf(msg).Elem().Name(), Field: path}
+		}
+	}
+	return nil
+}
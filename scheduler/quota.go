@@ -0,0 +1,231 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var (
+	quotaCpus = flag.Float64("mesos_quota_cpus", 0,
+		"Quota of cpus of the role of the framework, the driver accounts for the resources of its tasks against it, see QuotaAccount. 0 means no quota")
+	quotaMem = flag.Float64("mesos_quota_mem", 0,
+		"Quota of mem, in MB, of the role of the framework, see mesos_quota_cpus")
+	quotaDisk = flag.Float64("mesos_quota_disk", 0,
+		"Quota of disk, in MB, of the role of the framework, see mesos_quota_cpus")
+	enforceQuota = flag.Bool("mesos_enforce_quota", false,
+		"Refuse to launch the tasks exceeding the remaining quota instead of sending them to the master, they are lost with a QuotaExceededError")
+)
+
+// how long the resources of a lost task are remembered, in case the task
+// turns out to be running after all, e.g. once its slave is back.
+const lostTaskRetention = 15 * time.Minute
+
+// Resources are amounts of the resources accounted against a quota.
+type Resources struct {
+	Cpus float64
+	Mem  float64 // MB
+	Disk float64 // MB
+}
+
+func (r Resources) add(o Resources) Resources {
+	return Resources{r.Cpus + o.Cpus, r.Mem + o.Mem, r.Disk + o.Disk}
+}
+
+func (r Resources) sub(o Resources) Resources {
+	return Resources{r.Cpus - o.Cpus, r.Mem - o.Mem, r.Disk - o.Disk}
+}
+
+func (r Resources) String() string {
+	return fmt.Sprintf("cpus:%g mem:%g disk:%g", r.Cpus, r.Mem, r.Disk)
+}
+
+// resourcesOf returns the amounts of the scalar resources of rs.
+func resourcesOf(rs []*mesos.Resource) (r Resources) {
+	for _, res := range rs {
+		v := res.GetScalar().GetValue()
+		switch res.GetName() {
+		case "cpus":
+			r.Cpus += v
+		case "mem":
+			r.Mem += v
+		case "disk":
+			r.Disk += v
+		}
+	}
+	return
+}
+
+// QuotaExceededError is the error of a task the driver refused to launch
+// because its resources exceed the remaining quota, see
+// mesos_enforce_quota. The task is lost.
+type QuotaExceededError struct {
+	TaskId    string
+	Needed    Resources // by the task
+	Remaining Resources // before the task
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Task %s needs %v, exceeding the remaining quota %v.", e.TaskId, e.Needed, e.Remaining)
+}
+
+// QuotaAccount keeps track of the resources used by the tasks of the
+// framework that are not terminal, against the quota of its role. The
+// resources of a task are charged when it is launched, along with those
+// of its executor if the executor is launched with it, and released by
+// its terminal status update, including the TASK_LOST updates that
+// reconciliation yields for the tasks the master does not know. A lost
+// task that turns out to be running is charged again.
+//
+// The driver only knows the resources of the tasks it launched, those of
+// a previous instance of the framework can be charged with Charge.
+type QuotaAccount struct {
+	lock    sync.Mutex
+	quota   Resources
+	enforce bool
+	used    Resources
+	tasks   map[string]Resources  // charged, key:taskId
+	lost    map[string]lostCharge // released by TASK_LOST, key:taskId
+}
+
+type lostCharge struct {
+	resources Resources
+	at        time.Time
+}
+
+func newQuotaAccount(quota Resources, enforce bool) *QuotaAccount {
+	return &QuotaAccount{
+		quota:   quota,
+		enforce: enforce,
+		tasks:   make(map[string]Resources),
+		lost:    make(map[string]lostCharge),
+	}
+}
+
+// Quota returns the quota, a zero amount means no quota on the resource.
+func (a *QuotaAccount) Quota() Resources {
+	return a.quota
+}
+
+// Used returns the resources used by the tasks that are not terminal.
+func (a *QuotaAccount) Used() Resources {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.used
+}
+
+// Remaining returns the resources left of the quota, negative when the
+// quota is exceeded and +Inf for the resources without quota.
+func (a *QuotaAccount) Remaining() Resources {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.remaining()
+}
+
+func (a *QuotaAccount) remaining() Resources {
+	left := a.quota.sub(a.used)
+	if a.quota.Cpus == 0 {
+		left.Cpus = math.Inf(1)
+	}
+	if a.quota.Mem == 0 {
+		left.Mem = math.Inf(1)
+	}
+	if a.quota.Disk == 0 {
+		left.Disk = math.Inf(1)
+	}
+	return left
+}
+
+// Charge accounts for the resources of a task the driver did not launch,
+// e.g. one launched by a previous instance of the framework.
+func (a *QuotaAccount) Charge(taskId *mesos.TaskID, r Resources) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.charge(taskId.GetValue(), r)
+}
+
+func (a *QuotaAccount) charge(taskId string, r Resources) {
+	a.release(taskId)
+	delete(a.lost, taskId)
+	a.tasks[taskId] = r
+	a.used = a.used.add(r)
+}
+
+func (a *QuotaAccount) release(taskId string) (Resources, bool) {
+	r, ok := a.tasks[taskId]
+	if ok {
+		delete(a.tasks, taskId)
+		a.used = a.used.sub(r)
+	}
+	return r, ok
+}
+
+// launch charges the resources r of the task, unless they exceed the
+// remaining quota and the quota is enforced.
+func (a *QuotaAccount) launch(task *mesos.TaskInfo, r Resources) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.enforce {
+		left := a.remaining()
+		if r.Cpus > left.Cpus || r.Mem > left.Mem || r.Disk > left.Disk {
+			return &QuotaExceededError{TaskId: task.GetTaskId().GetValue(), Needed: r, Remaining: left}
+		}
+	}
+	a.charge(task.GetTaskId().GetValue(), r)
+	return nil
+}
+
+// update releases the resources of a terminal task, or charges those of
+// a lost task that is running after all. The resources of the tasks lost
+// by the driver itself are not remembered, these tasks were not launched.
+func (a *QuotaAccount) update(status *mesos.TaskStatus, local bool, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	taskId := status.GetTaskId().GetValue()
+	if !isTerminalState(status.GetState()) {
+		if lost, ok := a.lost[taskId]; ok {
+			log.Warningf("Lost task %s is %v, charging its resources again\n", taskId, status.GetState())
+			a.charge(taskId, lost.resources)
+		}
+		return
+	}
+
+	r, ok := a.release(taskId)
+	if ok && !local && status.GetState() == mesos.TaskState_TASK_LOST {
+		a.lost[taskId] = lostCharge{r, now}
+	}
+	for id, lost := range a.lost {
+		if now.Sub(lost.at) > lostTaskRetention {
+			delete(a.lost, id)
+		}
+	}
+}
+
+// Quota returns the account of the resources of the tasks against the
+// quota of the role of the framework, nil if the driver runs without
+// quota, see mesos_quota_cpus.
+func (driver *MesosSchedulerDriver) Quota() *QuotaAccount {
+	return driver.quota
+}
+
+// chargeQuota charges the resources of a task about to be launched, along
+// with those of its executor if it is launched with the task. executors
+// are those of the tasks already charged for the same launch.
+func (driver *MesosSchedulerDriver) chargeQuota(task *mesos.TaskInfo, executors map[string]*mesos.ExecutorInfo) error {
+	if driver.quota == nil {
+		return nil
+	}
+	r := resourcesOf(task.Resources)
+	if executor := task.Executor; executor != nil {
+		executorId := executor.GetExecutorId()
+		if _, ok := executors[executorId.GetValue()]; !ok && driver.cache.getExecutor(task.SlaveId, executorId) == nil {
+			r = r.add(resourcesOf(executor.Resources))
+		}
+	}
+	return driver.quota.launch(task, r)
+}
@@ -0,0 +1,180 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var (
+	reconcileBatchSize = flag.Int("mesos_reconcile_batch_size", 1000,
+		"Maximum number of task statuses sent per explicit reconciliation message, 0 for no limit")
+	reconcileBatchDelay = flag.Duration("mesos_reconcile_batch_delay", time.Second,
+		"Delay between the batches of an explicit reconciliation")
+)
+
+// clock lets tests control the passage of time.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Reconciliation is an explicit reconciliation in progress, see
+// ReconcileTasksAsync. Status updates caused by the reconciliation are
+// delivered as usual whether it is cancelled or not.
+type Reconciliation struct {
+	cancelOnce sync.Once
+	cancel     chan struct{}
+	done       chan struct{}
+	lock       sync.Mutex
+	sent       int   // number of batches sent
+	err        error // why the batches stopped, if not sent completely
+}
+
+func newReconciliation() *Reconciliation {
+	return &Reconciliation{
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Cancel stops sending further batches, batches already sent are not
+// affected.
+func (r *Reconciliation) Cancel() {
+	r.cancelOnce.Do(func() { close(r.cancel) })
+}
+
+// Done is closed once no further batches will be sent, i.e. all batches
+// were sent or the reconciliation was cancelled, failed or the driver
+// stopped. See Err.
+func (r *Reconciliation) Done() <-chan struct{} {
+	return r.done
+}
+
+// Sent returns the number of batches sent so far.
+func (r *Reconciliation) Sent() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sent
+}
+
+// Err returns why not all batches were sent, nil if they were or the
+// reconciliation is still in progress.
+func (r *Reconciliation) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Reconciliation) batchSent() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sent++
+}
+
+func (r *Reconciliation) finish(err error) {
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+	close(r.done)
+}
+
+// reconcileBatches splits statuses into batches of at most size statuses,
+// size <= 0 means a single batch. Implicit reconciliation, i.e. no
+// statuses, is a single empty batch.
+func reconcileBatches(statuses []*mesos.TaskStatus, size int) [][]*mesos.TaskStatus {
+	if size <= 0 || len(statuses) <= size {
+		return [][]*mesos.TaskStatus{statuses}
+	}
+	batches := make([][]*mesos.TaskStatus, 0, (len(statuses)+size-1)/size)
+	for len(statuses) > size {
+		batches = append(batches, statuses[:size])
+		statuses = statuses[size:]
+	}
+	return append(batches, statuses)
+}
+
+// ReconcileTasksAsync starts reconciling the given tasks. Large explicit
+// reconciliations are sent in batches of mesos_reconcile_batch_size
+// statuses, mesos_reconcile_batch_delay apart, so that the updates they
+// cause do not arrive all at once. The first batch is sent before
+// ReconcileTasksAsync returns, its failure is returned as error; the
+// returned Reconciliation tracks the remaining batches.
+func (driver *MesosSchedulerDriver) ReconcileTasksAsync(statuses []*mesos.TaskStatus) (*Reconciliation, mesos.Status, error) {
+	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
+		return nil, stat, driver.misused(fmt.Errorf("Unable to ReconcileTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	if !driver.Connected() {
+		log.Infoln("Ignoring send Reconcile Tasks message, disconnected from master.")
+		return nil, driver.Status(), fmt.Errorf("Not connected to master.")
+	}
+
+	batches := reconcileBatches(statuses, driver.reconcileBatchSize)
+	if err := driver.sendReconcile(batches[0]); err != nil {
+		return nil, driver.Status(), err
+	}
+	r := newReconciliation()
+	r.batchSent()
+	if len(batches) == 1 {
+		r.finish(nil)
+		return r, driver.Status(), nil
+	}
+
+	log.V(1).Infof("Reconciling %d tasks in %d batches\n", len(statuses), len(batches))
+	go driver.reconcileLoop(r, batches[1:])
+	return r, driver.Status(), nil
+}
+
+// reconcileLoop sends the remaining batches of r until they are all sent,
+// r is cancelled or the driver stops.
+func (driver *MesosSchedulerDriver) reconcileLoop(r *Reconciliation, batches [][]*mesos.TaskStatus) {
+	for _, batch := range batches {
+		select {
+		case <-r.cancel:
+		case <-driver.stopCh:
+		case <-driver.clock.After(driver.reconcileBatchDelay):
+		}
+		// cancellation wins over an expired delay.
+		select {
+		case <-r.cancel:
+			log.V(1).Infof("Reconciliation cancelled after %d batches\n", r.Sent())
+			r.finish(fmt.Errorf("Reconciliation cancelled."))
+			return
+		case <-driver.stopCh:
+			r.finish(fmt.Errorf("Reconciliation aborted, the driver stopped."))
+			return
+		default:
+		}
+
+		if err := driver.sendReconcile(batch); err != nil {
+			r.finish(err)
+			return
+		}
+		r.batchSent()
+	}
+	r.finish(nil)
+}
+
+func (driver *MesosSchedulerDriver) sendReconcile(statuses []*mesos.TaskStatus) error {
+	if !driver.Connected() {
+		return fmt.Errorf("Not connected to master.")
+	}
+	message := &mesos.ReconcileTasksMessage{
+		FrameworkId: driver.frameworkId(),
+		Statuses:    statuses,
+	}
+	if err := driver.send(driver.masterPid(), message); err != nil {
+		log.Errorf("Failed to send reconcile tasks message: %v\n", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// RefusalPolicy chooses how long the master should not offer again the
+// resources of a declined offer, depending on the dominant role of the
+// offer. A short refusal for the "*" role and a long one for reserved
+// roles keeps unreserved resources coming while not hoarding reserved
+// offers.
+type RefusalPolicy struct {
+	// Roles maps a role to its refusal duration.
+	Roles map[string]time.Duration
+	// Default applies to the roles missing from Roles, zero leaves the
+	// master's default.
+	Default time.Duration
+}
+
+// refusal returns the refusal duration for an offer, zero for the
+// master's default.
+func (p RefusalPolicy) refusal(offer *mesos.Offer) time.Duration {
+	if offer != nil {
+		if d, ok := p.Roles[dominantRole(offer)]; ok {
+			return d
+		}
+	}
+	return p.Default
+}
+
+// dominantRole returns the role holding the largest share of any scalar
+// resource of the offer, ties go to the first role in name order. It is
+// "*" for an offer without scalar resources.
+func dominantRole(offer *mesos.Offer) string {
+	totals := make(map[string]float64)             // key:resource name
+	amounts := make(map[string]map[string]float64) // key:role, resource name
+	for _, r := range offer.GetResources() {
+		if r.GetType() != mesos.Value_SCALAR || r.GetScalar().GetValue() <= 0 {
+			continue
+		}
+		role := r.GetRole()
+		if amounts[role] == nil {
+			amounts[role] = make(map[string]float64)
+		}
+		amounts[role][r.GetName()] += r.GetScalar().GetValue()
+		totals[r.GetName()] += r.GetScalar().GetValue()
+	}
+
+	roles := make([]string, 0, len(amounts))
+	for role := range amounts {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	dominant, dominantShare := "*", 0.0
+	for _, role := range roles {
+		for name, amount := range amounts[role] {
+			if share := amount / totals[name]; share > dominantShare {
+				dominant, dominantShare = role, share
+			}
+		}
+	}
+	return dominant
+}
+
+// declineFilters returns the filters declining offer according to the
+// driver's RefusalPolicy.
+func (driver *MesosSchedulerDriver) declineFilters(offer *mesos.Offer) *mesos.Filters {
+	d := driver.Refusal.refusal(offer)
+	if d <= 0 {
+		return &mesos.Filters{}
+	}
+	driver.metrics().Observe(MetricDeclineRefuseSeconds, d.Seconds())
+	return &mesos.Filters{RefuseSeconds: proto.Float64(d.Seconds())}
+}
@@ -1,33 +1,73 @@
 package scheduler
 
 import (
+	"fmt"
+	"github.com/gogo/protobuf/proto"
 	log "github.com/golang/glog"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 	"github.com/mesos/mesos-go/upid"
 	"sync"
+	"time"
 )
 
 type cachedOffer struct {
 	offer    *mesos.Offer
 	slavePid *upid.UPID
+	deadline time.Time // zero if the offer does not expire
+	score    float64   // see OfferScorer
+	epoch    uint64    // of the connection the offer was made on
 }
 
+// how long the ID of a rescinded offer is remembered, so that tasks
+// launched against it can be rejected without a round trip to the master.
+const rescindedOfferTTL = 5 * time.Minute
+
 func newCachedOffer(offer *mesos.Offer, slavePid *upid.UPID) *cachedOffer {
 	return &cachedOffer{offer: offer, slavePid: slavePid}
 }
 
+// size estimates the memory held by the cached offer.
+func (c *cachedOffer) size() int {
+	size := estimateSize(c.offer)
+	if c.slavePid != nil {
+		size += len(c.slavePid.String())
+	}
+	return size
+}
+
 // schedCache a managed cache with backing maps to store offeres
 // and tasked slaves.
 type schedCache struct {
-	lock           sync.RWMutex
-	savedOffers    map[string]*cachedOffer // current offers key:OfferID
-	savedSlavePids map[string]*upid.UPID   // Current saved slaves, key:slaveId
+	lock            sync.RWMutex
+	savedOffers     *offerRegistry         // current offers key:OfferID
+	rescindedOffers *offerRegistry         // recently rescinded offers key:OfferID
+	offerTTL        time.Duration          // after which an offer expires, 0 if never
+	savedSlavePids  map[string]*upid.UPID  // Current saved slaves, key:slaveId
+	slavePidSeen    map[string]time.Time   // when a slave was last saved, key:slaveId
+	slaveRoutes     map[string]*slaveRoute // how messages reach a slave, key:slaveId
+
+	directSendFailures int           // see mesos_direct_send_failures
+	directSendReprobe  time.Duration // see mesos_direct_send_reprobe
+
+	slaveExecutors map[string]map[string]*mesos.ExecutorInfo // launched executors, key:slaveId, executorId
+	slaveContexts  map[string]SlaveContext                   // as last offered, key:slaveId
+	epoch          uint64                                    // stamped on the offers cached, see setEpoch
+	clock          clock                                     // of the driver
 }
 
 func newSchedCache() *schedCache {
 	return &schedCache{
-		savedOffers:    make(map[string]*cachedOffer),
-		savedSlavePids: make(map[string]*upid.UPID),
+		savedOffers:     newOfferRegistry(),
+		rescindedOffers: newOfferRegistry(),
+		savedSlavePids:  make(map[string]*upid.UPID),
+		slavePidSeen:    make(map[string]time.Time),
+		slaveRoutes:     make(map[string]*slaveRoute),
+		slaveContexts:   make(map[string]SlaveContext),
+		slaveExecutors:  make(map[string]map[string]*mesos.ExecutorInfo),
+
+		directSendFailures: *directSendFailures,
+		directSendReprobe:  *directSendReprobe,
+		clock:              realClock{},
 	}
 }
 
@@ -38,39 +78,119 @@ func (cache *schedCache) putOffer(offer *mesos.Offer, pid *upid.UPID) {
 		return
 	}
 	log.V(3).Infoln("Caching offer ", offer.Id.GetValue(), " with slavePID ", pid.String())
+	entry := newCachedOffer(offer, pid)
+	if cache.offerTTL > 0 {
+		entry.deadline = cache.clock.Now().Add(cache.offerTTL)
+	}
+	entry.epoch = cache.currentEpoch()
+	cache.savedOffers.put(entry)
+}
+
+// setEpoch sets the epoch of the offers cached from now on, the driver
+// sets it once it connects.
+func (cache *schedCache) setEpoch(epoch uint64) {
 	cache.lock.Lock()
-	cache.savedOffers[offer.Id.GetValue()] = &cachedOffer{offer: offer, slavePid: pid}
+	cache.epoch = epoch
 	cache.lock.Unlock()
 }
 
+func (cache *schedCache) currentEpoch() uint64 {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.epoch
+}
+
 // getOffer returns cached offer
 func (cache *schedCache) getOffer(offerId *mesos.OfferID) *cachedOffer {
 	if offerId == nil {
 		log.V(3).Infoln("WARN: OfferId == nil, returning nil")
 		return nil
 	}
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
-	return cache.savedOffers[offerId.GetValue()]
+	return cache.savedOffers.get(offerId.GetValue())
 }
 
 // containsOff test cache for offer(offerId)
 func (cache *schedCache) containsOffer(offerId *mesos.OfferID) bool {
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
-	_, ok := cache.savedOffers[offerId.GetValue()]
-	return ok
+	return cache.savedOffers.get(offerId.GetValue()) != nil
 }
 
 func (cache *schedCache) removeOffer(offerId *mesos.OfferID) {
-	cache.lock.Lock()
-	delete(cache.savedOffers, offerId.GetValue())
-	cache.lock.Unlock()
+	cache.savedOffers.remove(offerId.GetValue())
+}
+
+// offersSnapshot returns copies of the cached offers, key:OfferID.
+func (cache *schedCache) offersSnapshot() map[string]*mesos.Offer {
+	entries := cache.savedOffers.list()
+	offers := make(map[string]*mesos.Offer, len(entries))
+	for _, entry := range entries {
+		offers[entry.offer.Id.GetValue()] = proto.Clone(entry.offer).(*mesos.Offer)
+	}
+	return offers
+}
+
+// rescindOffer removes the offer and remembers it as rescinded for
+// rescindedOfferTTL.
+func (cache *schedCache) rescindOffer(offerId *mesos.OfferID) {
+	cache.savedOffers.remove(offerId.GetValue())
+	now := cache.clock.Now()
+	cache.rescindedOffers.expire(now)
+	cache.rescindedOffers.add(&mesos.Offer{Id: offerId}, nil, now, rescindedOfferTTL)
+}
+
+// expireOffers rescinds the offers whose deadline passed before now and
+// returns their IDs.
+func (cache *schedCache) expireOffers(now time.Time) []*mesos.OfferID {
+	var offerIds []*mesos.OfferID
+	for _, entry := range cache.savedOffers.expire(now) {
+		cache.rescindOffer(entry.offer.Id)
+		offerIds = append(offerIds, entry.offer.Id)
+	}
+	return offerIds
+}
+
+// rescindSlaveOffers rescinds the offers made by the slave, e.g. once it
+// is lost, and returns their IDs.
+func (cache *schedCache) rescindSlaveOffers(slaveId *mesos.SlaveID) []*mesos.OfferID {
+	var offerIds []*mesos.OfferID
+	for _, entry := range cache.savedOffers.list() {
+		if entry.offer.GetSlaveId().GetValue() == slaveId.GetValue() {
+			cache.rescindOffer(entry.offer.Id)
+			offerIds = append(offerIds, entry.offer.Id)
+		}
+	}
+	return offerIds
+}
+
+// offersSlave returns the slave that made the cached offers among
+// offerIds, nil if none of them is cached. The offers must all be from
+// the same slave.
+func (cache *schedCache) offersSlave(offerIds []*mesos.OfferID) (*mesos.SlaveID, error) {
+	var slaveId *mesos.SlaveID
+	var first *mesos.OfferID
+	for _, offerId := range offerIds {
+		entry := cache.getOffer(offerId)
+		if entry == nil {
+			continue
+		}
+		if slaveId == nil {
+			slaveId, first = entry.offer.SlaveId, offerId
+		} else if !slaveId.Equal(entry.offer.SlaveId) {
+			return nil, fmt.Errorf("Offers %s and %s are from different slaves %s and %s.",
+				first.GetValue(), offerId.GetValue(), slaveId.GetValue(), entry.offer.SlaveId.GetValue())
+		}
+	}
+	return slaveId, nil
+}
+
+// isRescinded tests whether the offer was rescinded by the master.
+func (cache *schedCache) isRescinded(offerId *mesos.OfferID) bool {
+	return cache.rescindedOffers.get(offerId.GetValue()) != nil
 }
 
 func (cache *schedCache) putSlavePid(slaveId *mesos.SlaveID, pid *upid.UPID) {
 	cache.lock.Lock()
 	cache.savedSlavePids[slaveId.GetValue()] = pid
+	cache.slavePidSeen[slaveId.GetValue()] = cache.clock.Now()
 	cache.lock.Unlock()
 }
 
@@ -79,6 +199,8 @@ func (cache *schedCache) getSlavePid(slaveId *mesos.SlaveID) *upid.UPID {
 		log.V(3).Infoln("SlaveId == nil, returning empty UPID")
 		return nil
 	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
 	return cache.savedSlavePids[slaveId.GetValue()]
 }
 
@@ -92,5 +214,69 @@ func (cache *schedCache) containsSlavePid(slaveId *mesos.SlaveID) bool {
 func (cache *schedCache) removeSlavePid(slaveId *mesos.SlaveID) {
 	cache.lock.Lock()
 	delete(cache.savedSlavePids, slaveId.GetValue())
+	delete(cache.slavePidSeen, slaveId.GetValue())
+	delete(cache.slaveRoutes, slaveId.GetValue())
+	delete(cache.slaveContexts, slaveId.GetValue())
+	delete(cache.slaveExecutors, slaveId.GetValue())
 	cache.lock.Unlock()
 }
+
+// putExecutor remembers the executor launched on a slave, so that the
+// tasks reusing its ID can be checked against it.
+func (cache *schedCache) putExecutor(slaveId *mesos.SlaveID, executor *mesos.ExecutorInfo) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	executors := cache.slaveExecutors[slaveId.GetValue()]
+	if executors == nil {
+		executors = make(map[string]*mesos.ExecutorInfo)
+		cache.slaveExecutors[slaveId.GetValue()] = executors
+	}
+	executors[executor.ExecutorId.GetValue()] = executor
+}
+
+// getExecutor returns the executor launched on a slave, nil if unknown.
+func (cache *schedCache) getExecutor(slaveId *mesos.SlaveID, executorId *mesos.ExecutorID) *mesos.ExecutorInfo {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.slaveExecutors[slaveId.GetValue()][executorId.GetValue()]
+}
+
+func (cache *schedCache) removeExecutor(slaveId *mesos.SlaveID, executorId *mesos.ExecutorID) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if executors := cache.slaveExecutors[slaveId.GetValue()]; executors != nil {
+		delete(executors, executorId.GetValue())
+		if len(executors) == 0 {
+			delete(cache.slaveExecutors, slaveId.GetValue())
+		}
+	}
+}
+
+// slavePidUsage returns the number of saved slave pids and their
+// estimated size.
+func (cache *schedCache) slavePidUsage() (entries, bytes int) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	for slaveId, pid := range cache.savedSlavePids {
+		bytes += cacheEntryOverhead + len(slaveId) + len(pid.String())
+	}
+	return len(cache.savedSlavePids), bytes
+}
+
+// evictSlavePids forgets up to n slave pids, least recently saved first.
+// Framework messages to an evicted slave are routed through the master.
+func (cache *schedCache) evictSlavePids(n int) (entries, bytes int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	keys := make([]agedKey, 0, len(cache.slavePidSeen))
+	for slaveId, seen := range cache.slavePidSeen {
+		keys = append(keys, agedKey{slaveId, seen})
+	}
+	for _, k := range oldest(keys, n) {
+		bytes += cacheEntryOverhead + len(k.key) + len(cache.savedSlavePids[k.key].String())
+		delete(cache.savedSlavePids, k.key)
+		delete(cache.slavePidSeen, k.key)
+		entries++
+	}
+	return
+}
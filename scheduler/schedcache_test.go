@@ -19,12 +19,14 @@
 package scheduler
 
 import (
+	"fmt"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 	util "github.com/mesos/mesos-go/mesosutil"
+	"github.com/mesos/mesos-go/upid"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
-
-	"github.com/mesos/mesos-go/upid"
+	"time"
 )
 
 func TestSchedCacheNew(t *testing.T) {
@@ -47,11 +49,11 @@ func TestSchedCachePutOffer(t *testing.T) {
 	assert.NoError(t, err)
 	cache.putOffer(offer02, pid02)
 
-	assert.Equal(t, len(cache.savedOffers), 2)
-	cachedOffer1, ok := cache.savedOffers["test-offer-01"]
-	assert.True(t, ok)
-	cachedOffer2, ok := cache.savedOffers["test-offer-02"]
-	assert.True(t, ok)
+	assert.Equal(t, cache.savedOffers.len(), 2)
+	cachedOffer1 := cache.savedOffers.get("test-offer-01")
+	assert.NotNil(t, cachedOffer1)
+	cachedOffer2 := cache.savedOffers.get("test-offer-02")
+	assert.NotNil(t, cachedOffer2)
 
 	assert.NotNil(t, cachedOffer1.offer)
 	assert.Equal(t, "test-offer-01", cachedOffer1.offer.Id.GetValue())
@@ -115,11 +117,30 @@ func TestSchedCacheRemoveOffer(t *testing.T) {
 	cache.putOffer(offer02, pid02)
 	cache.removeOffer(util.NewOfferID("test-offer-01"))
 
-	assert.Equal(t, 1, len(cache.savedOffers))
+	assert.Equal(t, 1, cache.savedOffers.len())
 	assert.True(t, cache.containsOffer(util.NewOfferID("test-offer-02")))
 	assert.False(t, cache.containsOffer(util.NewOfferID("test-offer-01")))
 }
 
+func TestSchedCacheExpireOffers(t *testing.T) {
+	cache := newSchedCache()
+	pid, err := upid.Parse("slave01@127.0.0.1:5050")
+	assert.NoError(t, err)
+
+	cache.putOffer(createTestOffer("01"), pid)
+	cache.offerTTL = time.Minute
+	cache.putOffer(createTestOffer("02"), pid)
+
+	assert.Empty(t, cache.expireOffers(time.Now()))
+	expired := cache.expireOffers(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, []*mesos.OfferID{util.NewOfferID("test-offer-02")}, expired)
+
+	// the offer without a deadline stays outstanding.
+	assert.True(t, cache.containsOffer(util.NewOfferID("test-offer-01")))
+	assert.False(t, cache.containsOffer(util.NewOfferID("test-offer-02")))
+	assert.True(t, cache.isRescinded(util.NewOfferID("test-offer-02")))
+}
+
 func TestSchedCachePutSlavePid(t *testing.T) {
 	cache := newSchedCache()
 
@@ -213,3 +234,190 @@ func createTestOffer(idSuffix string) *mesos.Offer {
 		"localhost."+idSuffix,
 	)
 }
+
+func TestOfferRegistryAddRemove(t *testing.T) {
+	registry := newOfferRegistry()
+	pid, err := upid.Parse("slave01@127.0.0.1:5050")
+	assert.NoError(t, err)
+
+	registry.add(createTestOffer("01"), pid, time.Now(), 0)
+	registry.add(createTestOffer("02"), pid, time.Now(), 0)
+	assert.Equal(t, 2, registry.len())
+	assert.Equal(t, 2, len(registry.list()))
+
+	entry := registry.get("test-offer-01")
+	assert.NotNil(t, entry)
+	assert.Equal(t, "test-offer-01", entry.offer.Id.GetValue())
+	assert.True(t, entry.slavePid.Equal(pid))
+	assert.True(t, entry.deadline.IsZero())
+
+	entry = registry.remove("test-offer-01")
+	assert.NotNil(t, entry)
+	assert.Nil(t, registry.remove("test-offer-01"))
+	assert.Nil(t, registry.get("test-offer-01"))
+	assert.Equal(t, 1, registry.len())
+}
+
+func TestOfferRegistryExpire(t *testing.T) {
+	registry := newOfferRegistry()
+	pid, err := upid.Parse("slave01@127.0.0.1:5050")
+	assert.NoError(t, err)
+
+	registry.add(createTestOffer("01"), pid, time.Now(), time.Millisecond)
+	registry.add(createTestOffer("02"), pid, time.Now(), time.Hour)
+	registry.add(createTestOffer("03"), pid, time.Now(), 0)
+
+	assert.Empty(t, registry.expire(time.Now().Add(-time.Second)))
+
+	expired := registry.expire(time.Now().Add(time.Second))
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "test-offer-01", expired[0].offer.Id.GetValue())
+	assert.Equal(t, 2, registry.len())
+
+	expired = registry.expire(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, "test-offer-02", expired[0].offer.Id.GetValue())
+	assert.NotNil(t, registry.get("test-offer-03"))
+}
+
+// Run with -race to verify the registry guards its state.
+func TestOfferRegistryConcurrentAccess(t *testing.T) {
+	registry := newOfferRegistry()
+	pid, err := upid.Parse("slave01@127.0.0.1:5050")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				suffix := fmt.Sprintf("%d-%d", i, j)
+				registry.add(createTestOffer(suffix), pid, time.Now(), time.Duration(j%3)*time.Millisecond)
+				registry.get("test-offer-" + suffix)
+				registry.list()
+				if j%2 == 0 {
+					registry.remove("test-offer-" + suffix)
+				}
+				registry.expire(time.Now())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	registry.expire(time.Now().Add(time.Second))
+	for _, entry := range registry.list() {
+		assert.True(t, entry.deadline.IsZero())
+	}
+}
+
+func TestCacheBudgetEntryLimitEvictsOldestTerminal(t *testing.T) {
+	order := newStatusOrder()
+	for i := 0; i < 6; i++ {
+		state := mesos.TaskState_TASK_FINISHED
+		if i%2 == 1 {
+			state = mesos.TaskState_TASK_RUNNING
+		}
+		order.accept(util.NewTaskStatus(util.NewTaskID(fmt.Sprintf("task-%d", i)), state))
+		// distinct delivery times, so the eviction order is deterministic.
+		order.delivered[fmt.Sprintf("task-%d", i)].at = time.Unix(int64(i), 0)
+	}
+
+	budget := newCacheBudget(0)
+	budget.register("task_statuses", order, 4)
+	assert.Equal(t, 2, budget.compact())
+
+	// the two oldest finished tasks are gone, running tasks are retained.
+	for _, taskId := range []string{"task-0", "task-2"} {
+		_, ok := order.delivered[taskId]
+		assert.False(t, ok, taskId)
+	}
+	for _, taskId := range []string{"task-1", "task-3", "task-4", "task-5"} {
+		_, ok := order.delivered[taskId]
+		assert.True(t, ok, taskId)
+	}
+
+	// only running tasks would remain above the limit, none are evicted.
+	budget.register("more_statuses", order, 1)
+	assert.Equal(t, 1, budget.compact())
+	entries, _ := order.usage()
+	assert.Equal(t, 3, entries)
+	assert.Equal(t, map[string]uint64{"task_statuses": 2, "more_statuses": 1}, budget.evictions())
+}
+
+func TestCacheBudgetEvictionOrdering(t *testing.T) {
+	order := newStatusOrder()
+	for i, taskId := range []string{"task-0", "task-1"} {
+		assert.True(t, order.accept(util.NewTaskStatus(util.NewTaskID(taskId), mesos.TaskState_TASK_FINISHED)))
+		order.delivered[taskId].at = time.Unix(int64(i), 0)
+	}
+	budget := newCacheBudget(0)
+	budget.register("task_statuses", order, 1)
+	assert.Equal(t, 1, budget.compact())
+
+	// a retained terminal task still suppresses stale updates.
+	assert.False(t, order.accept(util.NewTaskStatus(util.NewTaskID("task-1"), mesos.TaskState_TASK_RUNNING)))
+	// an evicted one does not, its stale update is delivered.
+	assert.True(t, order.accept(util.NewTaskStatus(util.NewTaskID("task-0"), mesos.TaskState_TASK_RUNNING)))
+	// and ordered from then on.
+	assert.False(t, order.accept(util.NewTaskStatus(util.NewTaskID("task-0"), mesos.TaskState_TASK_STAGING)))
+}
+
+func TestCacheBudgetMemoryTargetKeepsOutstandingOffers(t *testing.T) {
+	cache := newSchedCache()
+	pid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5051"}
+	for i := 0; i < 10; i++ {
+		cache.putOffer(createTestOffer(fmt.Sprintf("%02d", i)), pid)
+		cache.rescindOffer(util.NewOfferID(fmt.Sprintf("rescinded-%02d", i)))
+		cache.putSlavePid(util.NewSlaveID(fmt.Sprintf("slave-%02d", i)), pid)
+	}
+	_, offerBytes := cache.savedOffers.usage()
+
+	budget := newCacheBudget(offerBytes + 1)
+	budget.register("offers", pinnedCache{cache.savedOffers}, 0)
+	budget.register("rescinded_offers", cache.rescindedOffers, 0)
+	budget.register("slave_pids", budgetedCacheFuncs{cache.slavePidUsage, cache.evictSlavePids}, 0)
+	assert.Equal(t, 20, budget.compact())
+
+	// the outstanding offers alone exceed what is left of the target.
+	assert.Equal(t, 10, cache.savedOffers.len())
+	assert.Equal(t, 0, cache.rescindedOffers.len())
+	entries, _ := cache.slavePidUsage()
+	assert.Equal(t, 0, entries)
+	assert.Equal(t, map[string]uint64{"offers": 0, "rescinded_offers": 10, "slave_pids": 10}, budget.evictions())
+}
+
+func TestCacheBudgetMemoryTargetEvictsOldestFirst(t *testing.T) {
+	cache := newSchedCache()
+	pid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5051"}
+	for i := 0; i < 10; i++ {
+		slaveId := fmt.Sprintf("slave-%02d", i)
+		cache.putSlavePid(util.NewSlaveID(slaveId), pid)
+		cache.slavePidSeen[slaveId] = time.Unix(int64(i), 0)
+	}
+	_, bytes := cache.slavePidUsage()
+
+	budget := newCacheBudget(bytes / 2)
+	budget.register("slave_pids", budgetedCacheFuncs{cache.slavePidUsage, cache.evictSlavePids}, 0)
+	assert.Equal(t, 5, budget.compact())
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, i >= 5, cache.containsSlavePid(util.NewSlaveID(fmt.Sprintf("slave-%02d", i))))
+	}
+}
+
+func TestSchedulerDriverCompactCaches(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	driver.budget = newCacheBudget(0)
+	driver.budget.register("executor_failures", driver.failures, 1)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		status := util.NewTaskStatus(util.NewTaskID(fmt.Sprintf("task-%d", i)), mesos.TaskState_TASK_FAILED)
+		execId := util.NewExecutorID(fmt.Sprintf("executor-%d", i))
+		driver.failures.record(util.NewSlaveID("slave-1"), execId, status, now.Add(time.Duration(i)*time.Second))
+	}
+
+	assert.Equal(t, 2, driver.CompactCaches())
+	assert.Equal(t, uint64(2), driver.CacheEvictions()["executor_failures"])
+	assert.Equal(t, 1, len(driver.failures.take(util.NewSlaveID("slave-1"), util.NewExecutorID("executor-2"), now)))
+}
@@ -19,6 +19,7 @@
 package scheduler
 
 import (
+	log "github.com/golang/glog"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 )
 
@@ -28,6 +29,10 @@ import (
 // (e.g., launch tasks, kill tasks, etc.).
 // See the MesosSchedulerDriver type for a concrete
 // impl of a SchedulerDriver.
+//
+// Each method returns the status of the driver along with the error that
+// kept it from doing its job, nil on success. A message that could not be
+// sent is reported as a *SendError.
 type SchedulerDriver interface {
 	// Starts the scheduler driver. This needs to be called before any
 	// other driver calls are made.
@@ -73,28 +78,51 @@ type SchedulerDriver interface {
 	// Available resources are aggregated when mutiple offers are
 	// provided. Note that all offers must belong to the same slave.
 	// Invoking this function with an empty collection of tasks declines
-	// offers in their entirety (see Scheduler::declineOffer).
+	// offers in their entirety (see Scheduler::declineOffer). Tasks
+	// launched against an offer that was rescinded, or against offers
+	// from several slaves, are not sent to the master, they are reported
+	// as TASK_LOST instead.
 	LaunchTasks(offerIDs []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error)
 
+	// Launches the given set of tasks on the resources of several offers
+	// at once, like LaunchTasks. The offers must belong to the same slave,
+	// otherwise nothing is sent and an error is returned.
+	LaunchTasksOnOffers(offerIDs []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error)
+
 	// Kills the specified task. Note that attempting to kill a task is
 	// currently not reliable. If, for example, a scheduler fails over
 	// while it was attempting to kill a task it will need to retry in
 	// the future. Likewise, if unregistered / disconnected, the request
-	// will be dropped (these semantics may be changed in the future).
+	// is not sent and ErrNotConnected is returned: the kill is not
+	// queued, the scheduler must issue it again once Reregistered.
 	KillTask(taskID *mesos.TaskID) (mesos.Status, error)
 
+	// Kills the specified tasks, like KillTask does for each of them. The
+	// kills that could not be sent do not keep the others from being
+	// sent, they are reported by a *KillTasksError.
+	KillTasks(taskIDs []*mesos.TaskID) (mesos.Status, error)
+
 	// Declines an offer in its entirety and applies the specified
 	// filters on the resources (see mesos.proto for a description of
 	// Filters). Note that this can be done at any time, it is not
 	// necessary to do this within the Scheduler::resourceOffers
-	// callback.
+	// callback. MesosSchedulerDriver applies its RefusalPolicy if filters
+	// is nil.
 	DeclineOffer(offerID *mesos.OfferID, filters *mesos.Filters) (mesos.Status, error)
 
 	// Removes all filters previously set by the framework (via
 	// LaunchTasks()). This enables the framework to receive offers from
-	// those filtered slaves.
+	// those filtered slaves. It also undoes a previous SuppressOffers().
 	ReviveOffers() (mesos.Status, error)
 
+	// Informs Mesos that the framework does not currently want any
+	// resource offers. No further offers are sent to the framework
+	// until ReviveOffers() is called. MesosSchedulerDriver cannot tell
+	// the master so: it declines the offers it receives meanwhile with
+	// long lived filters, which persist until ReviveOffers() is called,
+	// even across a failover of the scheduler. See its SuppressOffers.
+	SuppressOffers() (mesos.Status, error)
+
 	// Sends a message from the framework to one of its executors. These
 	// messages are best effort; do not expect a framework message to be
 	// retransmitted in any reliable fashion.
@@ -107,6 +135,13 @@ type SchedulerDriver interface {
 	// then the master will send the latest status for each task
 	// currently known.
 	ReconcileTasks(statuses []*mesos.TaskStatus) (mesos.Status, error)
+
+	// Acknowledges the status update of a task delivered to StatusUpdate,
+	// when the driver runs with mesos_explicit_acknowledgements. The
+	// slave resends an update until it is acknowledged, and holds back
+	// the next updates of the task meanwhile. Otherwise the driver
+	// acknowledges the updates once StatusUpdate returns.
+	AcknowledgeStatusUpdate(status *mesos.TaskStatus) (mesos.Status, error)
 }
 
 // Scheduler a type with callback attributes to be provided by frameworks
@@ -149,6 +184,8 @@ type Scheduler interface {
 	// will have those resources rescinded (or if a framework has
 	// already launched tasks with those resources then those tasks will
 	// fail with a TASK_LOST status and a message saying as much).
+	// Schedulers that implement OfferScorer only receive the offers
+	// the driver keeps.
 	ResourceOffers(SchedulerDriver, []*mesos.Offer)
 
 	// Invoked when an offer is no longer valid (e.g., the slave was
@@ -162,7 +199,8 @@ type Scheduler interface {
 	// Invoked when the status of a task has changed (e.g., a slave is
 	// lost and so the task is lost, a task finishes and an executor
 	// sends a status update saying so, etc). Note that returning from
-	// this callback _acknowledges_ receipt of this status update! If
+	// this callback _acknowledges_ receipt of this status update, unless
+	// the driver runs with mesos_explicit_acknowledgements! If
 	// for whatever reason the scheduler aborts during this callback (or
 	// the process exits) another status update will be delivered (note,
 	// however, that this is currently not true if the slave sending the
@@ -181,11 +219,39 @@ type Scheduler interface {
 
 	// Invoked when an executor has exited/terminated. Note that any
 	// tasks running will have TASK_LOST status updates automagically
-	// generated.
+	// generated. Schedulers that implement ExecutorLostInfoHandler
+	// receive an ExecutorLostInfo instead.
 	ExecutorLost(SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, int)
 
 	// Invoked when there is an unrecoverable error in the scheduler or
-	// scheduler driver. The driver will be aborted BEFORE invoking this
-	// callback.
+	// scheduler driver, e.g. an error reported by the master or a dead
+	// messenger. The driver will be aborted AFTER this callback returns.
 	Error(SchedulerDriver, string)
 }
+
+// SchedulerBase implements the Scheduler callbacks as no-ops, except for
+// Error which logs the error. Embed it in a Scheduler to implement the
+// callbacks of interest only:
+//
+//	type MyScheduler struct {
+//		scheduler.SchedulerBase
+//	}
+//
+//	func (s *MyScheduler) ResourceOffers(driver scheduler.SchedulerDriver, offers []*mesos.Offer) {
+//		...
+//	}
+type SchedulerBase struct{}
+
+func (SchedulerBase) Registered(SchedulerDriver, *mesos.FrameworkID, *mesos.MasterInfo)           {}
+func (SchedulerBase) Reregistered(SchedulerDriver, *mesos.MasterInfo)                             {}
+func (SchedulerBase) Disconnected(SchedulerDriver)                                                {}
+func (SchedulerBase) ResourceOffers(SchedulerDriver, []*mesos.Offer)                              {}
+func (SchedulerBase) OfferRescinded(SchedulerDriver, *mesos.OfferID)                              {}
+func (SchedulerBase) StatusUpdate(SchedulerDriver, *mesos.TaskStatus)                             {}
+func (SchedulerBase) FrameworkMessage(SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, string) {}
+func (SchedulerBase) SlaveLost(SchedulerDriver, *mesos.SlaveID)                                   {}
+func (SchedulerBase) ExecutorLost(SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, int)        {}
+
+func (SchedulerBase) Error(_ SchedulerDriver, err string) {
+	log.Errorf("Scheduler received error: %v\n", err)
+}
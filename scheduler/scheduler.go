@@ -19,10 +19,17 @@
 package scheduler
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,21 +39,89 @@ import (
 	"github.com/mesos/mesos-go/auth"
 	"github.com/mesos/mesos-go/auth/sasl"
 	"github.com/mesos/mesos-go/auth/sasl/mech"
+	"github.com/mesos/mesos-go/detector"
 	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
 	"github.com/mesos/mesos-go/messenger"
 	"github.com/mesos/mesos-go/upid"
 	"golang.org/x/net/context"
 )
 
 const (
-	authTimeout = 5 * time.Second // timeout interval for an authentication attempt
+	authTimeout   = 5 * time.Second // timeout interval for an authentication attempt
+	warmupTimeout = 2 * time.Second // timeout interval for pre-connecting to the master
+
+	defaultMaxMessageSize = 1024 * 1024 // bytes, above which the master may drop a message
+
+	// how long the resources offered while offers are suppressed are
+	// refused, unless ReviveOffers is called first.
+	suppressRefuseSeconds = 365 * 24 * 60 * 60
 )
 
 var (
 	authProvider = flag.String("mesos_authentication_provider", sasl.ProviderName,
 		fmt.Sprintf("Authentication provider to use, default is SASL that supports mechanisms: %+v", mech.ListSupported()))
+	maxMessageSize = flag.Int("mesos_max_message_size", defaultMaxMessageSize,
+		"Size in bytes of a serialized message sent to the master above which the driver warns")
+	strictMessageSize = flag.Bool("mesos_strict_message_size", false,
+		"Fail instead of warning when a message sent to the master exceeds mesos_max_message_size")
+	orderedUpdates = flag.Bool("mesos_ordered_status_updates", false,
+		"Deliver status updates for a task in non-decreasing state order, suppressing stale updates. Required by the TaskCacheStore")
+	masterWarmup = flag.Bool("mesos_master_warmup", false,
+		"Pre-connect to the master before registering so that the first message reuses the connection")
+	dialTimeout = flag.Duration("mesos_dial_timeout", 10*time.Second,
+		"Time allowed to connect to the master or a slave when sending a message, 0 means no limit")
+	responseHeaderTimeout = flag.Duration("mesos_response_header_timeout", 30*time.Second,
+		"Time allowed for the master or a slave to accept a message, 0 means no limit")
+	requestTimeout = flag.Duration("mesos_request_timeout", 0,
+		"Time allowed to send a message, connecting included, 0 means no limit")
+	tcpKeepAlive = flag.Duration("mesos_tcp_keepalive", 0,
+		"Period of the TCP keepalive probes of the connections to the master and the slaves, 0 disables them")
+	idleConnTimeout = flag.Duration("mesos_idle_conn_timeout", 0,
+		"Time after which an unused connection to the master or a slave is closed instead of being reused, should be lower than the idle timeout of the firewalls on the way, 0 keeps the connections open")
+	stopDrainTimeout = flag.Duration("mesos_stop_drain_timeout", 5*time.Second,
+		"Time Stop waits for the queued messages, e.g. UnregisterFramework, to be sent before stopping the messenger, 0 does not wait")
+	offerTimeout = flag.Duration("mesos_offer_timeout", 0,
+		"Time after which an outstanding offer is treated as rescinded, should match the --offer_timeout of the master, 0 means offers do not expire")
 )
 
+// ErrNotConnected is returned by KillTask and AcknowledgeStatusUpdate, and
+// for each task by KillTasks, when the driver is not connected to a
+// master, the message was not sent.
+var ErrNotConnected = errors.New("Not connected to master")
+
+// SendError is returned by the driver methods when the messenger failed
+// to send their message, Err is the error of the messenger, e.g.
+// messenger.ErrQueueFull.
+type SendError struct {
+	Message string     // the name of the message, e.g. KillTaskMessage
+	To      *upid.UPID // the master or the slave the message was sent to
+	Err     error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("Failed to send %s to %v: %v", e.Message, e.To, e.Err)
+}
+
+// KillTasksError is returned by KillTasks when some of the kills were not
+// sent, the others were.
+type KillTasksError struct {
+	Errors map[string]error // why each kill was not sent, key:task ID
+}
+
+func (e *KillTasksError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failures := make([]string, len(ids))
+	for i, id := range ids {
+		failures[i] = fmt.Sprintf("%s: %v", id, e.Errors[id])
+	}
+	return fmt.Sprintf("Failed to kill %d tasks: %s", len(ids), strings.Join(failures, "; "))
+}
+
 // Concrete implementation of a SchedulerDriver that connects a
 // Scheduler with a Mesos master. The MesosSchedulerDriver is
 // thread-safe.
@@ -72,31 +147,144 @@ type MesosSchedulerDriver struct {
 	MasterPid     *upid.UPID
 	FrameworkInfo *mesos.FrameworkInfo
 
+	// AllowedTaskUsers lists the users tasks may run as instead of the
+	// framework user. A nil list allows any user.
+	AllowedTaskUsers []string
+
+	// TaskCacheStore, if set before Start, persists the status of the
+	// tasks across restarts of the driver, see TaskCacheStore.
+	TaskCacheStore TaskCacheStore
+
+	// Metrics, if set before Start, receives the activity of the driver
+	// and of its messenger. Metrics are discarded otherwise.
+	Metrics messenger.Metrics
+
+	// Refusal, if set before Start, sets how long the resources of the
+	// offers declined by the driver, or by DeclineOffer without filters,
+	// are not offered again.
+	Refusal RefusalPolicy
+
 	lock            sync.RWMutex
 	self            *upid.UPID
 	stopCh          chan struct{}
-	stopped         bool
-	status          mesos.Status
+	events          chan func()   // see post
+	eventsDone      chan struct{} // closed once the event goroutine returns, nil until started
+	state           *stateMachine
 	messenger       messenger.Messenger
-	connected       bool
 	connection      uuid.UUID
 	local           bool
 	checkpoint      bool
 	recoveryTimeout time.Duration
 	cache           *schedCache
-	updates         map[string]*mesos.StatusUpdate // Key is a UUID string.
-	tasks           map[string]*mesos.TaskInfo     // Key is a UUID string.
+	updates         *statusUpdateManager       // acknowledgements to resend
+	tasks           map[string]*mesos.TaskInfo // Key is a UUID string.
 	credential      *mesos.Credential
+	statusOrder     *statusOrder  // nil if status updates are delivered raw.
+	taskIDs         *taskIDs      // see checkTaskID
+	suppressLock    sync.Mutex    // guards suppressed and suppressFilters, see declineSuppressed
+	suppressed      bool          // see SuppressOffers
+	suppressFilters bool          // offers were declined for suppressRefuseSeconds since the last ReviveOffers
+	registerSent    time.Time     // when the last RegisterFramework message was sent
+	registerLatency time.Duration // RegisterFramework to FrameworkRegistered round trip
+	failures        *executorFailures
+	counters        *driverCounters // see MetricsSnapshot
+	duplicates      *duplicateDetector
+	leaderRedirects int // registrations redirected since the master was detected, see followLeader
+	budget          *cacheBudget
+	stopReason      error // what caused the driver to abort, if anything
+	shutdownReason  ShutdownReason
+	starting        bool // claimed by Start, see claimStart
+	stopping        bool // claimed by Stop or Abort, see claimStop
+	stopOnce        sync.Once
+	clock           clock
+
+	reconcileBatchSize  int
+	reconcileBatchDelay time.Duration
+	drainTimeout        time.Duration // see mesos_stop_drain_timeout
+	maxKeptOffers       int
+	restorePending      bool // the restored tasks are to be reconciled
+	restoreAll          bool // the task cache could not be restored
+
+	maxMessageSize       int
+	strictMessageSize    bool
+	masterWarmup         bool
+	authProvider         string
+	cacheCompactInterval time.Duration
+	taskCacheInterval    time.Duration
+	taskIDReuseCooldown  time.Duration
+	allowTaskIDReuse     bool
+	idLimits             IDLimitConfig
+	checkOfferResources  bool
+	callbackStopTimeout  time.Duration
+	abortOnPanic         bool
+	explicitAcks         bool
+	ackLock              sync.Mutex
+	pendingAcks          map[string]*pendingAck // delivered, not yet acknowledged, key:taskId
+	quota                *QuotaAccount          // nil without quota
+	prometheusMetrics    bool
+	detector             detector.Detector // nil unless the master is a zk:// or file:// URL, see detectMaster
+	detectTimeout        time.Duration
+	strict               *strictChecks // nil unless mesos_dev_strict
+	debug                *debugEndpoints
+	masters              *masterList // nil unless the master is a list of masters
 }
 
+var _ SchedulerDriver = (*MesosSchedulerDriver)(nil)
+
 // Create a new mesos scheduler driver with the given
 // scheduler, framework info,
 // master address, and credential(optional)
+// The master is either host:port or a zk://host1:port1,host2:port2/path
+// URL the leading master is detected from when the driver starts, or a
+// file:///path holding either, see mesos_master_file_poll. A comma
+// separated list of host:port masters is registered with in turn until
+// one accepts, see mesos_master_attempts.
+// The other options come from the command line flags, see
+// NewDriverWithConfig.
 func NewMesosSchedulerDriver(
 	sched Scheduler,
 	framework *mesos.FrameworkInfo,
 	master string,
 	credential *mesos.Credential,
+) (*MesosSchedulerDriver, error) {
+	return NewDriverWithConfig(DriverConfig{
+		Scheduler:  sched,
+		Framework:  framework,
+		Master:     master,
+		Credential: credential,
+	})
+}
+
+// NewMesosSchedulerDriverTLS is like NewMesosSchedulerDriver, but the
+// driver talks HTTPS to the master with the given TLS config. The driver
+// also serves HTTPS if the config has certificates.
+func NewMesosSchedulerDriverTLS(
+	sched Scheduler,
+	framework *mesos.FrameworkInfo,
+	master string,
+	credential *mesos.Credential,
+	tlsConfig *tls.Config,
+) (*MesosSchedulerDriver, error) {
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("TLS config required.")
+	}
+	return NewDriverWithConfig(DriverConfig{
+		Scheduler:  sched,
+		Framework:  framework,
+		Master:     master,
+		Credential: credential,
+		TLS:        tlsConfig,
+	})
+}
+
+// newConfiguredDriver creates a driver with the options of cfg, which
+// is assumed valid.
+func newConfiguredDriver(
+	sched Scheduler,
+	framework *mesos.FrameworkInfo,
+	cfg *Config,
+	credential *mesos.Credential,
+	tlsConfig *tls.Config,
 ) (*MesosSchedulerDriver, error) {
 	if sched == nil {
 		return nil, fmt.Errorf("Scheduler callbacks required.")
@@ -106,10 +294,20 @@ func NewMesosSchedulerDriver(
 		return nil, fmt.Errorf("FrameworkInfo must be provided.")
 	}
 
-	if master == "" {
+	if cfg.Master == "" {
 		return nil, fmt.Errorf("Missing master location URL.")
 	}
 
+	if framework.Role != nil {
+		if err := util.ValidateRole(framework.GetRole()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkFrameworkName(framework, cfg.IDLimits); err != nil {
+		return nil, err
+	}
+
 	// set default userid
 	if framework.GetUser() == "" {
 		user, err := user.Current()
@@ -133,21 +331,106 @@ func NewMesosSchedulerDriver(
 		Scheduler:     sched,
 		FrameworkInfo: framework,
 		stopCh:        make(chan struct{}),
-		status:        mesos.Status_DRIVER_NOT_STARTED,
-		stopped:       true,
-		connected:     false,
+		events:        make(chan func(), cfg.Dispatch.QueueSize),
+		state:         newStateMachine(),
 		cache:         newSchedCache(),
+		failures:      newExecutorFailures(),
+		taskIDs:       newTaskIDs(),
+		counters:      newDriverCounters(),
+		duplicates:    newDuplicateDetector(cfg.Duplicates),
+		debug:         newDebugEndpoints(cfg.Debug),
 		credential:    credential,
-	}
-
-	if m, err := upid.Parse("master@" + master); err != nil {
+		clock:         realClock{},
+
+		reconcileBatchSize:   cfg.Reconcile.BatchSize,
+		reconcileBatchDelay:  time.Duration(cfg.Reconcile.BatchDelay),
+		drainTimeout:         time.Duration(cfg.Timeouts.StopDrain),
+		maxKeptOffers:        cfg.MaxKeptOffers,
+		maxMessageSize:       cfg.MessageSize.Max,
+		strictMessageSize:    cfg.MessageSize.Strict,
+		masterWarmup:         cfg.MasterWarmup,
+		authProvider:         cfg.Authentication.Provider,
+		cacheCompactInterval: time.Duration(cfg.Cache.CompactInterval),
+		taskCacheInterval:    time.Duration(cfg.TaskCache.SnapshotInterval),
+		taskIDReuseCooldown:  time.Duration(cfg.TaskIDs.ReuseCooldown),
+		allowTaskIDReuse:     cfg.TaskIDs.AllowReuse,
+		explicitAcks:         cfg.ExplicitAcks,
+		pendingAcks:          make(map[string]*pendingAck),
+		prometheusMetrics:    cfg.PrometheusMetrics,
+		idLimits:             cfg.IDLimits,
+		checkOfferResources:  cfg.CheckOfferResources,
+		callbackStopTimeout:  time.Duration(cfg.Dispatch.CallbackStopTimeout),
+		abortOnPanic:         cfg.Dispatch.AbortOnPanic,
+		detectTimeout:        time.Duration(cfg.Timeouts.Detect),
+	}
+	driver.updates = newStatusUpdateManager(time.Duration(cfg.AckRetry.Backoff), time.Duration(cfg.AckRetry.MaxBackoff))
+
+	driver.cache.offerTTL = time.Duration(cfg.OfferTimeout)
+	driver.cache.clock = driver.clock
+	driver.cache.directSendFailures = cfg.DirectSend.Failures
+	driver.cache.directSendReprobe = time.Duration(cfg.DirectSend.Reprobe)
+	if cfg.OrderedStatusUpdates {
+		driver.statusOrder = newStatusOrder()
+	}
+	if cfg.DevStrict {
+		driver.strict = newStrictChecks()
+	}
+	driver.initCacheBudget(cfg.Cache.MemoryTarget, cfg.Cache.MaxEntries)
+	if q := cfg.Quota; q.Cpus > 0 || q.Mem > 0 || q.Disk > 0 {
+		driver.quota = newQuotaAccount(Resources{q.Cpus, q.Mem, q.Disk}, q.Enforce)
+	}
+
+	if isDetected(cfg.Master) {
+		d, err := masterDetector(cfg.Master, time.Duration(cfg.MasterFilePoll))
+		if err != nil {
+			return nil, err
+		}
+		driver.detector = d
+	} else if isMasterList(cfg.Master) {
+		l, err := newMasterList(cfg.Master, cfg.MasterList)
+		if err != nil {
+			return nil, err
+		}
+		driver.masters = l
+		driver.MasterPid = l.masters[0]
+	} else if m, err := upid.Parse("master@" + cfg.Master); err != nil {
 		return nil, err
 	} else {
 		driver.MasterPid = m
 	}
 
 	//TODO keep scheduler counter to for proper PID.
-	driver.messenger = messenger.NewHttp(&upid.UPID{ID: "scheduler(1)"})
+	self := &upid.UPID{ID: "scheduler(1)", Host: cfg.Bind.Address}
+	if cfg.Bind.Port != 0 {
+		self.Port = strconv.Itoa(cfg.Bind.Port)
+	}
+	// the detected master is not known yet.
+	if pid := driver.masterPid(); pid != nil && self.Host == "" {
+		if ip := net.ParseIP(pid.Host); ip != nil && ip.To4() == nil {
+			self.Host = "::" // the master can only reach us over IPv6.
+		}
+	}
+	var transporter *messenger.HTTPTransporter
+	if tlsConfig != nil {
+		transporter = messenger.NewHTTPSTransporter(self, tlsConfig)
+	} else {
+		transporter = messenger.NewHTTPTransporter(self)
+	}
+	// a hung master or slave must not block the messages queued behind.
+	transporter.SetTimeouts(messenger.HTTPTimeouts{
+		Dial:           time.Duration(cfg.Timeouts.Dial),
+		ResponseHeader: time.Duration(cfg.Timeouts.ResponseHeader),
+		Request:        time.Duration(cfg.Timeouts.Request),
+		KeepAlive:      time.Duration(cfg.Timeouts.KeepAlive),
+		IdleConn:       time.Duration(cfg.Timeouts.IdleConn),
+	})
+	driver.messenger = messenger.NewWithOptions(self, transporter, messenger.Options{
+		SendQueueSize:    cfg.Send.QueueSize,
+		SendQueueTimeout: time.Duration(cfg.Send.QueueTimeout),
+		SendMaxAttempts:  cfg.Send.MaxAttempts,
+		SendRetryBackoff: time.Duration(cfg.Send.RetryBackoff),
+		DecodeRoutines:   cfg.Send.DecodeRoutines,
+	})
 	if err := driver.init(); err != nil {
 		log.Errorf("Failed to initialize the scheduler driver: %v\n", err)
 		return nil, err
@@ -159,48 +442,96 @@ func NewMesosSchedulerDriver(
 func (driver *MesosSchedulerDriver) init() error {
 	log.Infof("Initializing mesos scheduler driver\n")
 
-	// Install handlers.
-	driver.messenger.Install(driver.frameworkRegistered, &mesos.FrameworkRegisteredMessage{})
-	driver.messenger.Install(driver.frameworkReregistered, &mesos.FrameworkReregisteredMessage{})
-	driver.messenger.Install(driver.resourcesOffered, &mesos.ResourceOffersMessage{})
-	driver.messenger.Install(driver.resourceOfferRescinded, &mesos.RescindResourceOfferMessage{})
-	driver.messenger.Install(driver.statusUpdated, &mesos.StatusUpdateMessage{})
-	driver.messenger.Install(driver.slaveLost, &mesos.LostSlaveMessage{})
-	driver.messenger.Install(driver.frameworkMessageRcvd, &mesos.ExecutorToFrameworkMessage{})
-	driver.messenger.Install(driver.frameworkErrorRcvd, &mesos.FrameworkErrorMessage{})
+	// Install handlers, they run on the event goroutine, see post.
+	driver.messenger.Install(driver.dispatch(driver.frameworkRegistered), &mesos.FrameworkRegisteredMessage{})
+	driver.messenger.Install(driver.dispatch(driver.frameworkReregistered), &mesos.FrameworkReregisteredMessage{})
+	driver.messenger.Install(driver.dispatch(driver.resourcesOffered), &mesos.ResourceOffersMessage{})
+	driver.messenger.Install(driver.dispatch(driver.resourceOfferRescinded), &mesos.RescindResourceOfferMessage{})
+	driver.messenger.Install(driver.dispatch(driver.statusUpdated), &mesos.StatusUpdateMessage{})
+	driver.messenger.Install(driver.dispatch(driver.slaveLost), &mesos.LostSlaveMessage{})
+	driver.messenger.Install(driver.dispatch(driver.frameworkMessageRcvd), &mesos.ExecutorToFrameworkMessage{})
+	driver.messenger.Install(driver.dispatch(driver.frameworkErrorRcvd), &mesos.FrameworkErrorMessage{})
+	driver.messenger.Install(driver.dispatch(driver.executorLost), &mesos.ExitedExecutorMessage{})
 	return nil
 }
 
 // ------------------------- Accessors ----------------------- //
 func (driver *MesosSchedulerDriver) Status() mesos.Status {
+	return driver.state.get().status()
+}
+
+func (driver *MesosSchedulerDriver) Stopped() bool {
+	switch driver.state.get() {
+	case StateInitialized, StateStopped, StateAborted:
+		return true
+	}
+	return false
+}
+
+func (driver *MesosSchedulerDriver) Connected() bool {
+	return driver.state.get() == StateConnected
+}
+
+// masterPid returns the MasterPid, it changes as masters fail over.
+func (driver *MesosSchedulerDriver) masterPid() *upid.UPID {
 	driver.lock.RLock()
 	defer driver.lock.RUnlock()
-	return driver.status
+	return driver.MasterPid
 }
-func (driver *MesosSchedulerDriver) setStatus(stat mesos.Status) {
+
+func (driver *MesosSchedulerDriver) setMasterPid(pid *upid.UPID) {
 	driver.lock.Lock()
-	driver.status = stat
+	driver.MasterPid = pid
 	driver.lock.Unlock()
 }
 
-func (driver *MesosSchedulerDriver) Stopped() bool {
-	return driver.stopped
+// frameworkId returns the ID of the framework, nil until it registers.
+func (driver *MesosSchedulerDriver) frameworkId() *mesos.FrameworkID {
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	return driver.FrameworkInfo.Id
 }
 
-func (driver *MesosSchedulerDriver) setStopped(val bool) {
-	driver.lock.Lock()
-	driver.stopped = val
-	driver.lock.Unlock()
+// frameworkInfo returns a copy of the FrameworkInfo, safe to send while
+// the framework registers.
+func (driver *MesosSchedulerDriver) frameworkInfo() *mesos.FrameworkInfo {
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	return proto.Clone(driver.FrameworkInfo).(*mesos.FrameworkInfo)
 }
 
-func (driver *MesosSchedulerDriver) Connected() bool {
-	return driver.connected
+// State returns the lifecycle state of the driver.
+func (driver *MesosSchedulerDriver) State() DriverState {
+	return driver.state.get()
 }
 
-func (driver *MesosSchedulerDriver) setConnected(val bool) {
-	driver.lock.Lock()
-	driver.connected = val
-	driver.lock.Unlock()
+// WatchState returns a channel receiving the state transitions of the
+// driver until ctx is done or the driver is stopped or aborted, then the
+// channel is closed. A watcher that falls behind misses the newest
+// transitions, see WatchStateWith.
+func (driver *MesosSchedulerDriver) WatchState(ctx context.Context) <-chan StateTransition {
+	return driver.state.watch(ctx, WatchOptions{})
+}
+
+// WatchStateWith is WatchState queuing the transitions for a watcher that
+// falls behind as told by opts. The first transition received after a
+// gap counts the missed ones in Dropped. The final transition is always
+// received.
+func (driver *MesosSchedulerDriver) WatchStateWith(ctx context.Context, opts WatchOptions) <-chan StateTransition {
+	return driver.state.watch(ctx, opts)
+}
+
+// transition changes the state of the driver, see stateTransitions for
+// the valid transitions.
+func (driver *MesosSchedulerDriver) transition(to DriverState) bool {
+	if !driver.state.transition(to) {
+		return false
+	}
+	if to == StateConnected {
+		// the offers cached from now on belong to the new epoch.
+		driver.cache.setEpoch(driver.Epoch())
+	}
+	return true
 }
 
 // ---------------------- Handlers for Events from Master --------------- //
@@ -208,6 +539,10 @@ func (driver *MesosSchedulerDriver) frameworkRegistered(from *upid.UPID, pbMsg p
 	log.V(2).Infoln("Handling scheduler driver framework registered event.")
 
 	msg := pbMsg.(*mesos.FrameworkRegisteredMessage)
+	if err := requireFields(msg, "FrameworkId", "MasterInfo"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
 	masterInfo := msg.GetMasterInfo()
 	masterPid := msg.GetMasterInfo().GetPid()
 	frameworkId := msg.GetFrameworkId()
@@ -217,22 +552,40 @@ func (driver *MesosSchedulerDriver) frameworkRegistered(from *upid.UPID, pbMsg p
 		return
 	}
 
-	if driver.connected {
+	if driver.Connected() {
 		log.Infoln("Ignoring FrameworkRegisteredMessage from master, driver is already connected!\n", masterPid)
+		driver.registeredWhileConnected(from, frameworkId)
 		return
 	}
 
-	if driver.stopped {
+	if driver.Stopped() {
 		log.Infof("Ignoring FrameworkRegisteredMessage from master %s, driver is stopped!\n", masterPid)
 		return
 	}
 
+	if !driver.transition(StateConnected) {
+		log.Infof("Ignoring FrameworkRegisteredMessage from master %s, driver is %v!\n", masterPid, driver.State())
+		return
+	}
+
 	log.Infof("Framework registered with ID=%s\n", frameworkId.GetValue())
+	driver.lock.Lock()
 	driver.FrameworkInfo.Id = frameworkId // generated by master.
-
-	driver.setConnected(true)
 	driver.connection = uuid.NewUUID()
+	if !driver.registerSent.IsZero() {
+		driver.registerLatency = driver.clock.Now().Sub(driver.registerSent)
+		log.V(1).Infof("Framework registration took %v\n", driver.registerLatency)
+		driver.metrics().Observe(MetricRegistrationLatency, driver.registerLatency.Seconds())
+	}
+	driver.lock.Unlock()
+	driver.metrics().Increment(MetricRegistered)
+	driver.counters.registered(driver.clock.Now(), false)
+	driver.masterRegistered()
+
+	driver.updateMasterPid(masterInfo)
 	driver.Scheduler.Registered(driver, frameworkId, masterInfo)
+	driver.resendAcks(true)
+	driver.reconcileRestoredTasks()
 }
 
 func (driver *MesosSchedulerDriver) frameworkReregistered(from *upid.UPID, pbMsg proto.Message) {
@@ -244,18 +597,190 @@ func (driver *MesosSchedulerDriver) frameworkReregistered(from *upid.UPID, pbMsg
 		return
 	}
 
-	if driver.connected {
+	if driver.Connected() {
 		log.Infoln("Ignoring FrameworkReregisteredMessage from master,driver is already connected!")
+		driver.registeredWhileConnected(from, msg.GetFrameworkId())
+		return
+	}
+
+	if !driver.transition(StateConnected) {
+		log.Infof("Ignoring FrameworkReregisteredMessage from master, driver is %v!\n", driver.State())
 		return
 	}
 
 	// TODO(vv) detect if message was from leading-master (sched.cpp)
 	log.Infof("Framework re-registered with ID [%s] ", msg.GetFrameworkId().GetValue())
-	driver.setConnected(true)
+	driver.updateMasterPid(msg.GetMasterInfo())
+	driver.lock.Lock()
 	driver.connection = uuid.NewUUID()
+	driver.lock.Unlock()
+	driver.metrics().Increment(MetricReregistered)
+	driver.counters.registered(driver.clock.Now(), true)
+	driver.masterRegistered()
+	driver.reviveFilters()
 
 	driver.Scheduler.Reregistered(driver, msg.GetMasterInfo())
+	driver.resendAcks(true)
+	driver.reconcileRestoredTasks()
+
+	if n := driver.duplicates.reregistered(driver.clock.Now()); n > 0 {
+		driver.duplicateSuspected(fmt.Sprintf("the framework re-registered %d times within %v", n, driver.duplicates.window))
+	}
+}
+
+// OnMasterChanged is notified by a detector.Detector of a new leading
+// master, info is nil if there is none. The driver disconnects from the
+// previous master and registers with the new one, re-registering if the
+// framework has an ID already.
+func (driver *MesosSchedulerDriver) OnMasterChanged(info *mesos.MasterInfo) {
+	switch driver.State() {
+	case StateDetecting, StateRegistering, StateConnected, StateDisconnected:
+	default:
+		log.V(1).Infof("Ignoring master change, driver is %v!\n", driver.State())
+		return
+	}
+
+	if driver.Connected() {
+		log.Infoln("Disconnected from master", driver.masterPid())
+		driver.transition(StateDisconnected)
+		driver.metrics().Increment(MetricDisconnected)
+		driver.Scheduler.Disconnected(driver)
+	} else if driver.State() == StateRegistering {
+		driver.transition(StateDisconnected)
+	}
+
+	if info == nil {
+		log.Infoln("No leading master detected, waiting for one")
+		if driver.State() != StateDetecting {
+			driver.transition(StateDetecting)
+		}
+		return
+	}
+
+	pid, err := masterUPID(info)
+	if err != nil {
+		log.Errorf("Ignoring new leading master: %v\n", err)
+		return
+	}
+	driver.setMasterPid(pid)
+	driver.leaderRedirects = 0
+	if !driver.transition(StateRegistering) {
+		return
+	}
+
+	var message proto.Message
+	if info := driver.frameworkInfo(); info.GetId().GetValue() == "" {
+		message = &mesos.RegisterFrameworkMessage{Framework: info}
+	} else {
+		message = &mesos.ReregisterFrameworkMessage{Framework: info, Failover: proto.Bool(false)}
+	}
+	if err := driver.checkRegistrationSize(message); err != nil {
+		driver.error(err.Error(), true, ShutdownMessageTooLarge)
+		return
+	}
+	log.V(1).Infoln("Registering with new master", pid)
+	driver.watchRegistration()
+	if err := driver.send(pid, message); err != nil {
+		log.Errorf("Failed to register with new master %v: %v\n", pid, err)
+	}
+}
+
+// sendFailed is notified by the messenger of a message it failed to
+// deliver, it is handled on the event goroutine, see post.
+func (driver *MesosSchedulerDriver) sendFailed(msg *messenger.Message, err error) {
+	driver.post(func() { driver.handleSendFailure(msg, err) })
+}
 
+// handleSendFailure handles a message that could not be delivered.
+// Failing to reach the master disconnects the driver, messages that
+// failed to reach a slave are sent through the master instead, other
+// failures are reported as errors. A registration a standby master
+// redirected is sent to the leader, see followLeader.
+func (driver *MesosSchedulerDriver) handleSendFailure(msg *messenger.Message, err error) {
+	if msg.UPID.Equal(driver.masterPid()) {
+		if redirect, ok := err.(*messenger.LeaderRedirectError); ok && driver.followLeader(msg, redirect) {
+			return
+		}
+		if driver.masterFailed(msg, err) {
+			return
+		}
+		driver.masterLost(fmt.Errorf("Failed to send message %v: %v", msg.Name, err))
+		return
+	}
+
+	var slaveId *mesos.SlaveID
+	switch m := msg.ProtoMessage.(type) {
+	case *mesos.FrameworkToExecutorMessage:
+		slaveId = m.SlaveId
+	case *mesos.StatusUpdateAcknowledgementMessage:
+		slaveId = m.SlaveId
+	default:
+		driver.error(fmt.Sprintf("Failed to send message %v: %v", msg.Name, err), true, ShutdownSendFailed)
+		return
+	}
+	log.Warningf("Failed to send message %v to slave %v, sending it through the master: %v\n", msg.Name, msg.UPID, err)
+	driver.cache.directSendFailed(slaveId, driver.clock.Now())
+	// not on the event goroutine, send may wait for room in the queue.
+	go func() {
+		if err := driver.send(driver.masterPid(), msg.ProtoMessage); err != nil {
+			log.Errorf("Failed to send message %v through the master: %v\n", msg.Name, err)
+		}
+	}()
+}
+
+// masterLost disconnects the driver from the master it is connected to,
+// the Scheduler is notified once per lost connection. The driver
+// registers again once a detector reports a leading master, see
+// OnMasterChanged.
+func (driver *MesosSchedulerDriver) masterLost(cause error) {
+	if !driver.Connected() {
+		log.V(1).Infof("Ignoring lost master, the driver is %v: %v\n", driver.State(), cause)
+		return
+	}
+	if !driver.transition(StateDisconnected) {
+		return
+	}
+	log.Errorf("Lost master %v: %v\n", driver.masterPid(), cause)
+	driver.metrics().Increment(MetricDisconnected)
+	driver.Scheduler.Disconnected(driver)
+}
+
+// updateMasterPid points the driver at the master described by info,
+// keeping the current MasterPid if info does not locate a master.
+func (driver *MesosSchedulerDriver) updateMasterPid(info *mesos.MasterInfo) {
+	pid, err := masterUPID(info)
+	if err != nil {
+		log.Warningf("Keeping master %v: %v\n", driver.masterPid(), err)
+		return
+	}
+	if !pid.Equal(driver.masterPid()) {
+		log.V(2).Infof("Master is now %v\n", pid)
+		driver.setMasterPid(pid)
+	}
+}
+
+// masterUPID builds the UPID of a master, preferring MasterInfo.pid and
+// falling back to the ip or hostname and port of the master.
+func masterUPID(info *mesos.MasterInfo) (*upid.UPID, error) {
+	if info == nil {
+		return nil, fmt.Errorf("Missing MasterInfo.")
+	}
+	if pid := info.GetPid(); pid != "" {
+		return upid.Parse(pid)
+	}
+	if info.GetPort() == 0 {
+		return nil, fmt.Errorf("MasterInfo %q has neither a pid nor a port.", info.GetId())
+	}
+	port := strconv.Itoa(int(info.GetPort()))
+	if ip := info.GetIp(); ip != 0 {
+		// MasterInfo.ip is packed in network byte order.
+		host := net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24)).String()
+		return &upid.UPID{ID: "master", Host: host, Port: port}, nil
+	}
+	if host := info.GetHostname(); host != "" {
+		return &upid.UPID{ID: "master", Host: host, Port: port}, nil
+	}
+	return nil, fmt.Errorf("MasterInfo %q has neither a pid nor an address.", info.GetId())
 }
 
 func (driver *MesosSchedulerDriver) resourcesOffered(from *upid.UPID, pbMsg proto.Message) {
@@ -267,7 +792,7 @@ func (driver *MesosSchedulerDriver) resourcesOffered(from *upid.UPID, pbMsg prot
 		return
 	}
 
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring ResourceOffersMessage, the driver is not connected!")
 		return
 	}
@@ -277,30 +802,52 @@ func (driver *MesosSchedulerDriver) resourcesOffered(from *upid.UPID, pbMsg prot
 		log.Errorln("Ignoring offers, Offer count does not match Slave PID count.")
 		return
 	}
+	driver.counters.offered(len(msg.Offers))
+
+	if driver.declineSuppressed(msg.Offers) {
+		return
+	}
 
+	scorer, scored := driver.Scheduler.(OfferScorer)
 	for i, offer := range msg.Offers {
+		driver.cache.putSlaveContext(offer)
 		if pid, err := upid.Parse(pidStrings[i]); err == nil {
-			driver.cache.putOffer(offer, pid)
+			if scored {
+				driver.cache.putScoredOffer(offer, pid, scorer.Score(offer))
+			} else {
+				driver.cache.putOffer(offer, pid)
+			}
 			log.V(1).Infof("Cached offer %s from SlavePID %s", offer.Id.GetValue(), pid)
 		} else {
-			log.V(1).Infoln("Failed to parse offer PID:", pid)
+			log.V(1).Infoln("Failed to parse offer PID:", pidStrings[i], err)
 		}
 	}
 
-	driver.Scheduler.ResourceOffers(driver, msg.Offers)
+	offers := msg.Offers
+	if scored {
+		if offers = driver.keepTopOffers(offers); len(offers) == 0 {
+			return
+		}
+	}
+	driver.offersHanded(offers)
+	driver.Scheduler.ResourceOffers(driver, offers)
 }
 
 func (driver *MesosSchedulerDriver) resourceOfferRescinded(from *upid.UPID, pbMsg proto.Message) {
 	log.V(1).Infoln("Handling resource offer rescinded.")
 
 	msg := pbMsg.(*mesos.RescindResourceOfferMessage)
+	if err := requireFields(msg, "OfferId"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
 
 	if driver.Status() == mesos.Status_DRIVER_ABORTED {
 		log.Infoln("Ignoring RescindResourceOfferMessage, the driver is aborted!")
 		return
 	}
 
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring ResourceOffersMessage, the driver is not connected!")
 		return
 	}
@@ -308,10 +855,76 @@ func (driver *MesosSchedulerDriver) resourceOfferRescinded(from *upid.UPID, pbMs
 	// TODO(vv) check for leading master (see sched.cpp)
 
 	log.V(1).Infoln("Rescinding offer ", msg.OfferId.GetValue())
-	driver.cache.removeOffer(msg.OfferId)
+	driver.cache.rescindOffer(msg.OfferId)
 	driver.Scheduler.OfferRescinded(driver, msg.OfferId)
 }
 
+// expireOffers rescinds the offers outstanding for longer than
+// mesos_offer_timeout, as the master would, and posts their
+// OfferRescinded callbacks.
+func (driver *MesosSchedulerDriver) expireOffers() {
+	for _, offerId := range driver.cache.expireOffers(driver.clock.Now()) {
+		log.V(1).Infoln("Offer expired ", offerId.GetValue())
+		offerId := offerId
+		driver.postAsync(func() { driver.Scheduler.OfferRescinded(driver, offerId) })
+	}
+}
+
+// offerExpiryInterval returns how often the outstanding offers are
+// checked for expiry given their ttl.
+func offerExpiryInterval(ttl time.Duration) time.Duration {
+	if interval := ttl / 10; interval > time.Second {
+		return time.Second
+	} else if interval > 0 {
+		return interval
+	}
+	return time.Millisecond
+}
+
+// offerExpiryLoop expires the outstanding offers every interval until
+// the driver stops.
+func (driver *MesosSchedulerDriver) offerExpiryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-driver.stopCh:
+			return
+		case <-ticker.C:
+			if driver.Connected() {
+				driver.expireOffers()
+			}
+		}
+	}
+}
+
+// checkMessageSize returns an error if the serialized message is larger
+// than limit bytes. A limit <= 0 disables the check.
+func checkMessageSize(msg proto.Message, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	if size := proto.Size(msg); size > limit {
+		return fmt.Errorf("Serialized %T is %d bytes, exceeding the limit of %d bytes", msg, size, limit)
+	}
+	return nil
+}
+
+// checkRegistrationSize warns, or fails if mesos_strict_message_size is
+// set, when a (re-)registration message exceeds mesos_max_message_size.
+func (driver *MesosSchedulerDriver) checkRegistrationSize(msg proto.Message) error {
+	err := checkMessageSize(msg, driver.maxMessageSize)
+	if err == nil {
+		return nil
+	}
+	if !driver.strictMessageSize {
+		log.Warningf("%T may be rejected by the master: %v\n", msg, err)
+		return nil
+	}
+	log.Errorf("Refusing to send %T: %v\n", msg, err)
+	return err
+}
+
 func (driver *MesosSchedulerDriver) send(upid *upid.UPID, msg proto.Message) error {
 	//TODO(jdef) should implement timeout here
 	ctx, cancel := context.WithCancel(context.TODO())
@@ -320,31 +933,68 @@ func (driver *MesosSchedulerDriver) send(upid *upid.UPID, msg proto.Message) err
 	c := make(chan error, 1)
 	go func() { c <- driver.messenger.Send(ctx, upid, msg) }()
 
+	var err error
 	select {
 	case <-ctx.Done():
 		<-c // wait for Send(...)
-		return ctx.Err()
-	case err := <-c:
-		return err
+		err = ctx.Err()
+	case err = <-c:
+	}
+	driver.counters.sent(msg, err, driver.clock.Now())
+	if err != nil {
+		return &SendError{Message: reflect.TypeOf(msg).Elem().Name(), To: upid, Err: err}
 	}
+	return nil
 }
 
 func (driver *MesosSchedulerDriver) statusUpdated(from *upid.UPID, pbMsg proto.Message) {
-	msg := pbMsg.(*mesos.StatusUpdateMessage)
+	driver.handleStatus(from, pbMsg.(*mesos.StatusUpdateMessage), true)
+}
+
+// handleStatus delivers a status update, and records the state of its
+// task unless record is false.
+func (driver *MesosSchedulerDriver) handleStatus(from *upid.UPID, msg *mesos.StatusUpdateMessage, record bool) {
+	if err := requireFields(msg, "Update.Status.TaskId"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
 
 	if driver.Status() == mesos.Status_DRIVER_ABORTED {
 		log.V(1).Infoln("Ignoring StatusUpdate message, the driver is aborted!")
 		return
 	}
 
-	if !driver.connected {
+	// updates generated by the driver, e.g. TASK_LOST while disconnected,
+	// are delivered regardless.
+	if !driver.Connected() && !from.Equal(driver.self) {
 		log.V(1).Infoln("Ignoring StatusUpdate message, the driver is not connected!")
 		return
 	}
 
 	log.V(2).Infoln("Received status update from ", from.String(), " status source:", msg.GetPid())
 
-	driver.Scheduler.StatusUpdate(driver, msg.Update.GetStatus())
+	messenger.IncrementLabeled(driver.metrics(), MetricStatusUpdates, messenger.Labels{
+		"task_state": msg.Update.GetStatus().GetState().String(),
+	})
+	driver.counters.statusUpdated(msg.Update.GetStatus().GetState(), driver.clock.Now())
+
+	if execId := msg.Update.GetExecutorId(); execId != nil {
+		driver.failures.record(msg.Update.GetSlaveId(), execId, msg.Update.GetStatus(), driver.clock.Now())
+	}
+
+	if record {
+		driver.taskIDs.update(msg.Update.GetStatus().GetTaskId(), msg.Update.GetStatus().GetState(), driver.clock.Now())
+	}
+	delivered := !record || driver.statusOrder == nil || driver.statusOrder.accept(msg.Update.GetStatus())
+	if delivered {
+		if driver.quota != nil && record {
+			driver.quota.update(msg.Update.GetStatus(), from.Equal(driver.self), driver.clock.Now())
+		}
+		driver.deliverStatus(msg.Update)
+	} else {
+		// stale updates are acknowledged all the same.
+		driver.metrics().Increment(MetricStatusUpdatesSuppressed)
+	}
 
 	if driver.Status() == mesos.Status_DRIVER_ABORTED {
 		log.V(1).Infoln("Not sending StatusUpdate ACK, the driver is aborted!")
@@ -353,21 +1003,41 @@ func (driver *MesosSchedulerDriver) statusUpdated(from *upid.UPID, pbMsg proto.M
 
 	// Send StatusUpdate Acknowledgement
 	// Only send ACK if udpate was not from this driver
-	if !from.Equal(driver.self) && msg.GetPid() != from.String() {
-		ackMsg := &mesos.StatusUpdateAcknowledgementMessage{
-			SlaveId:     msg.Update.SlaveId,
-			FrameworkId: driver.FrameworkInfo.Id,
-			TaskId:      msg.Update.Status.TaskId,
-			Uuid:        msg.Update.Uuid,
-		}
+	if from.Equal(driver.self) {
+		log.V(1).Infoln("Not sending ACK, update was generated by the driver.")
+		return
+	}
+	if len(msg.Update.GetUuid()) == 0 {
+		log.V(1).Infoln("Not sending ACK, update has no UUID.")
+		return
+	}
 
-		log.V(2).Infoln("Sending status update ACK to ", from.String())
-		if err := driver.send(driver.MasterPid, ackMsg); err != nil {
-			log.Errorf("Failed to send StatusUpdate ACK message: %v\n", err)
-			return
+	// ACK the process that sent the update, the slave, if it is known.
+	target := driver.masterPid()
+	if pid := msg.GetPid(); pid != "" && driver.cache.sendDirect(msg.Update.SlaveId, driver.clock.Now()) {
+		if slavePid, err := upid.Parse(pid); err != nil {
+			log.Warningf("Unable to parse status update pid %s, sending ACK to master: %v\n", pid, err)
+		} else {
+			target = slavePid
 		}
-	} else {
-		log.V(1).Infoln("Not sending ACK, update is not from slave:", from.String())
+	}
+
+	ackMsg := &mesos.StatusUpdateAcknowledgementMessage{
+		SlaveId:     msg.Update.SlaveId,
+		FrameworkId: driver.frameworkId(),
+		TaskId:      msg.Update.Status.TaskId,
+		Uuid:        msg.Update.Uuid,
+	}
+
+	// the stale updates the framework did not see are acknowledged all
+	// the same.
+	if driver.explicitAcks && delivered {
+		driver.awaitAck(msg.Update.Status, target, ackMsg)
+		return
+	}
+
+	if err := driver.sendAck(target, ackMsg); err != nil {
+		log.Errorf("Failed to send StatusUpdate ACK message, will retry: %v\n", err)
 	}
 }
 
@@ -375,13 +1045,17 @@ func (driver *MesosSchedulerDriver) slaveLost(from *upid.UPID, pbMsg proto.Messa
 	log.V(1).Infoln("Handling LostSlave event.")
 
 	msg := pbMsg.(*mesos.LostSlaveMessage)
+	if err := requireFields(msg, "SlaveId"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
 
 	if driver.Status() == mesos.Status_DRIVER_ABORTED {
 		log.V(1).Infoln("Ignoring LostSlave message, the driver is aborted!")
 		return
 	}
 
-	if !driver.connected {
+	if !driver.Connected() {
 		log.V(1).Infoln("Ignoring LostSlave message, the driver is not connected!")
 		return
 	}
@@ -391,6 +1065,12 @@ func (driver *MesosSchedulerDriver) slaveLost(from *upid.UPID, pbMsg proto.Messa
 	log.V(2).Infoln("Lost slave ", msg.SlaveId.GetValue())
 	driver.cache.removeSlavePid(msg.SlaveId)
 
+	// The master rescinds the offers of the slave as well, but that may
+	// race with a launch. Fail such launches locally.
+	for _, offerId := range driver.cache.rescindSlaveOffers(msg.SlaveId) {
+		log.V(2).Infoln("Rescinded offer ", offerId.GetValue(), " of lost slave ", msg.SlaveId.GetValue())
+	}
+
 	driver.Scheduler.SlaveLost(driver, msg.SlaveId)
 }
 
@@ -398,6 +1078,10 @@ func (driver *MesosSchedulerDriver) frameworkMessageRcvd(from *upid.UPID, pbMsg
 	log.V(1).Infoln("Handling framework message event.")
 
 	msg := pbMsg.(*mesos.ExecutorToFrameworkMessage)
+	if err := requireFields(msg, "ExecutorId", "SlaveId"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
 
 	if driver.Status() == mesos.Status_DRIVER_ABORTED {
 		log.V(1).Infoln("Ignoring framwork message, the driver is aborted!")
@@ -409,10 +1093,57 @@ func (driver *MesosSchedulerDriver) frameworkMessageRcvd(from *upid.UPID, pbMsg
 	driver.Scheduler.FrameworkMessage(driver, msg.ExecutorId, msg.SlaveId, string(msg.Data))
 }
 
+func (driver *MesosSchedulerDriver) executorLost(from *upid.UPID, pbMsg proto.Message) {
+	log.V(1).Infoln("Handling executor exited event.")
+
+	msg := pbMsg.(*mesos.ExitedExecutorMessage)
+	if err := requireFields(msg, "ExecutorId", "SlaveId"); err != nil {
+		log.Errorf("Ignoring message from %v: %v\n", from, err)
+		return
+	}
+
+	if driver.Status() == mesos.Status_DRIVER_ABORTED {
+		log.V(1).Infoln("Ignoring ExitedExecutor message, the driver is aborted!")
+		return
+	}
+
+	if !driver.Connected() {
+		log.V(1).Infoln("Ignoring ExitedExecutor message, the driver is not connected!")
+		return
+	}
+
+	driver.cache.removeExecutor(msg.GetSlaveId(), msg.GetExecutorId())
+	failures := driver.failures.take(msg.GetSlaveId(), msg.GetExecutorId(), driver.clock.Now())
+	info := inferExecutorLost(msg.GetExecutorId(), msg.GetSlaveId(), int(msg.GetStatus()), failures)
+	log.V(1).Infof("Executor %s on slave %s lost, cause %v, status %d\n",
+		msg.GetExecutorId().GetValue(), msg.GetSlaveId().GetValue(), info.Cause, info.Status)
+
+	if handler, ok := driver.Scheduler.(ExecutorLostInfoHandler); ok {
+		handler.ExecutorLostInfo(driver, info)
+	} else {
+		driver.Scheduler.ExecutorLost(driver, msg.GetExecutorId(), msg.GetSlaveId(), int(msg.GetStatus()))
+	}
+}
+
 func (driver *MesosSchedulerDriver) frameworkErrorRcvd(from *upid.UPID, pbMsg proto.Message) {
 	log.V(1).Infoln("Handling framework error event.")
 	msg := pbMsg.(*mesos.FrameworkErrorMessage)
-	driver.error(msg.GetMessage(), true)
+	// the messenger reports its own failures as framework errors.
+	if !from.Equal(driver.masterPid()) {
+		driver.error(msg.GetMessage(), true, ShutdownMessengerError)
+		return
+	}
+	ferr := newFrameworkError(msg.GetMessage())
+	reason := ShutdownMasterError
+	switch {
+	case msg.GetMessage() == frameworkFailedOver:
+		// another scheduler registered with the framework ID.
+		reason = ShutdownDuplicateScheduler
+	case ferr.Kind == FrameworkErrorAuthorization:
+		reason = ShutdownAuthorizationFailed
+	}
+	log.Errorf("Master %v sent a %v error: %s\n", from, ferr.Kind, ferr.Message)
+	driver.errorCause(ferr.Message, ferr, true, reason)
 }
 
 // ---------------------- Interface Methods ---------------------- //
@@ -423,17 +1154,56 @@ func (driver *MesosSchedulerDriver) Start() (mesos.Status, error) {
 	log.Infoln("Starting the scheduler driver...")
 
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_NOT_STARTED {
-		return stat, fmt.Errorf("Unable to Start, expecting driver status %s, but is %s:", mesos.Status_DRIVER_NOT_STARTED, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to Start, expecting driver status %s, but is %s:", mesos.Status_DRIVER_NOT_STARTED, stat))
+	}
+	if !driver.claimStart() {
+		return driver.Status(), fmt.Errorf("Unable to Start, the driver is already starting")
+	}
+
+	message := &mesos.RegisterFrameworkMessage{
+		Framework: driver.frameworkInfo(), // a copy, encoded while the master may set the ID
+	}
+	// checked before anything is started, the driver may be started again
+	// with a smaller FrameworkInfo.
+	if err := driver.checkRegistrationSize(message); err != nil {
+		driver.releaseStart()
+		return driver.Status(), err
 	}
 
-	driver.setStopped(true)
-	driver.setStatus(mesos.Status_DRIVER_NOT_STARTED)
+	if err := driver.startDebugEndpoints(driver.startMetrics()); err != nil {
+		log.Errorf("Scheduler failed to serve the debug endpoints: %v\n", err)
+		driver.releaseStart()
+		return driver.Status(), err
+	}
+
+	// A failed send to the master means the connection to it is lost.
+	if notifier, ok := driver.messenger.(messenger.FailureNotifier); ok {
+		notifier.OnSendFailure(driver.sendFailed)
+	}
 
 	// Start the messenger.
 	if err := driver.messenger.Start(); err != nil {
 		log.Errorf("Scheduler failed to start the messenger: %v\n", err)
+		driver.releaseStart()
 		return driver.Status(), err
 	}
+	driver.startEvents()
+
+	if driver.detector != nil {
+		if err := driver.detectMaster(); err != nil {
+			log.Errorf("Scheduler failed to detect the master: %v\n", err)
+			driver.setStopReason(err)
+			stat := mesos.Status_DRIVER_ABORTED
+			if err0 := driver.stop(stat); err0 != nil {
+				log.Errorf("Failed to stop scheduler driver %v\n", err0)
+			}
+			return stat, err
+		}
+	}
+
+	if driver.masterWarmup {
+		driver.warmup()
+	}
 
 	// authenticate?
 	//TODO(jdef) perhaps at some point in the future this will get pushed down into
@@ -445,25 +1215,34 @@ func (driver *MesosSchedulerDriver) Start() (mesos.Status, error) {
 			ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
 			defer cancel()
 			handler := &CredentialHandler{
-				pid:        driver.MasterPid,
+				pid:        driver.masterPid(),
 				client:     driver.messenger.UPID(),
 				credential: driver.credential,
 			}
-			ctx = auth.WithLoginProvider(ctx, *authProvider)
+			ctx = auth.WithLoginProvider(ctx, driver.authProvider)
 			return auth.Login(ctx, handler)
 		}(); err != nil {
 			log.Errorf("Scheduler failed to authenticate: %v\n", err)
-			return driver.Status(), err
+			driver.setStopReason(err)
+			driver.setShutdownReason(ShutdownAuthenticationFailed)
+			driver.notifyError(err.Error(), ShutdownAuthenticationFailed)
+			stat := mesos.Status_DRIVER_ABORTED
+			if err0 := driver.stop(stat); err0 != nil {
+				log.Errorf("Failed to stop scheduler driver %v\n", err0)
+			}
+			return stat, err
 		}
 	}
 
-	// register framework
-	message := &mesos.RegisterFrameworkMessage{
-		Framework: driver.FrameworkInfo,
-	}
+	driver.restoreTaskCache()
 
-	log.V(3).Infoln("Registering with master", driver.MasterPid)
-	if err := driver.send(driver.MasterPid, message); err != nil {
+	// register framework
+	log.V(3).Infoln("Registering with master", driver.masterPid())
+	driver.lock.Lock()
+	driver.registerSent = driver.clock.Now()
+	driver.lock.Unlock()
+	driver.watchRegistration()
+	if err := driver.send(driver.masterPid(), message); err != nil {
 		log.Errorf("Failed to send RegisterFramework message: %v\n", err)
 		stat := driver.Status()
 		err0 := driver.stop(stat)
@@ -475,25 +1254,124 @@ func (driver *MesosSchedulerDriver) Start() (mesos.Status, error) {
 	}
 
 	driver.self = driver.messenger.UPID()
-	driver.setStatus(mesos.Status_DRIVER_RUNNING)
-	driver.setStopped(false)
+	driver.transition(StateRegistering)
 	log.Infoln("Mesos scheduler driver started with PID=", driver.self.String())
 
+	if driver.cacheCompactInterval > 0 {
+		go driver.compactLoop(driver.cacheCompactInterval)
+	}
+	if driver.TaskCacheStore != nil && driver.taskCacheInterval > 0 {
+		go driver.taskCacheLoop(driver.taskCacheInterval)
+	}
+	if driver.cache.offerTTL > 0 {
+		go driver.offerExpiryLoop(offerExpiryInterval(driver.cache.offerTTL))
+	}
+	if driver.updates.backoff > 0 {
+		go driver.ackRetryLoop(driver.updates.backoff)
+	}
+
 	// TODO(VV) Monitor Master Connection
 
 	return driver.Status(), nil
 }
 
-//Join blocks until the driver is stopped.
-//Should follow a call to Start()
+// warmup pre-connects to the master if the messenger supports it. Errors
+// are only logged, they are early diagnostics of an unreachable master and
+// registration is attempted regardless.
+func (driver *MesosSchedulerDriver) warmup() {
+	w, ok := driver.messenger.(messenger.Warmer)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+	defer cancel()
+	if err := w.Warmup(ctx, driver.masterPid()); err != nil {
+		log.Warningf("Failed to warm up connection to master %v: %v\n", driver.masterPid(), err)
+	}
+}
+
+// RegistrationLatency returns the time between the last RegisterFramework
+// message sent and the FrameworkRegistered reply, or zero if the driver has
+// not registered yet.
+func (driver *MesosSchedulerDriver) RegistrationLatency() time.Duration {
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	return driver.registerLatency
+}
+
+// SendQueueDepth returns the number of messages waiting to be sent by the
+// messenger, or zero if it does not queue them.
+func (driver *MesosSchedulerDriver) SendQueueDepth() int {
+	if q, ok := driver.messenger.(messenger.QueueReporter); ok {
+		return q.QueueDepth()
+	}
+	return 0
+}
+
+//Join blocks until the driver is stopped, and the Scheduler callback in
+//progress returned, see mesos_callback_stop_timeout.
+//Should follow a call to Start(). See StopReason() and ShutdownReason()
+//for why it stopped.
 func (driver *MesosSchedulerDriver) Join() (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to Join, expecting driver status %s, but is %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to Join, expecting driver status %s, but is %s", mesos.Status_DRIVER_RUNNING, stat))
 	}
 	<-driver.stopCh // wait for stop signal
+	driver.awaitCallback()
 	return driver.Status(), nil
 }
 
+// StopReason returns the status of the driver and, once it is aborted,
+// the error that caused the abort. The error is nil if the driver was
+// stopped or aborted explicitly.
+func (driver *MesosSchedulerDriver) StopReason() (mesos.Status, error) {
+	stat := driver.Status() // the reason is recorded before the driver aborts
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	return stat, driver.stopReason
+}
+
+// setStopReason records the first error that causes the driver to abort.
+func (driver *MesosSchedulerDriver) setStopReason(err error) {
+	driver.lock.Lock()
+	if driver.stopReason == nil {
+		driver.stopReason = err
+	}
+	driver.lock.Unlock()
+}
+
+// claimStart returns true to the one caller that gets to start the
+// driver, Start may be called concurrently.
+func (driver *MesosSchedulerDriver) claimStart() bool {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if driver.starting {
+		return false
+	}
+	driver.starting = true
+	return true
+}
+
+// releaseStart lets the driver be started again after Start failed
+// before the driver left StateInitialized.
+func (driver *MesosSchedulerDriver) releaseStart() {
+	driver.lock.Lock()
+	driver.starting = false
+	driver.lock.Unlock()
+}
+
+// claimStop returns true to the one caller of Stop or Abort that gets to
+// stop the driver.
+func (driver *MesosSchedulerDriver) claimStop() bool {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if driver.stopping {
+		return false
+	}
+	driver.stopping = true
+	return true
+}
+
 //Run starts and joins driver process and waits to be stopped or aborted.
 func (driver *MesosSchedulerDriver) Run() (mesos.Status, error) {
 	stat, err := driver.Start()
@@ -503,45 +1381,90 @@ func (driver *MesosSchedulerDriver) Run() (mesos.Status, error) {
 	}
 
 	if stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to Run, expecting driver status %s, but is %s:", mesos.Status_DRIVER_RUNNING, driver.status)
+		return stat, fmt.Errorf("Unable to Run, expecting driver status %s, but is %s:", mesos.Status_DRIVER_RUNNING, driver.Status())
 	}
 
 	log.Infoln("Scheduler driver running.  Waiting to be stopped.")
 	return driver.Join()
 }
 
-//Stop stops the driver.
+//Stop stops the driver. Unless failover is true the framework is
+//unregistered from the master, which then kills its tasks. Otherwise the
+//master keeps the framework and its tasks for the framework's failover
+//timeout, waiting for a new scheduler to take over.
 func (driver *MesosSchedulerDriver) Stop(failover bool) (mesos.Status, error) {
 	log.Infoln("Stopping the scheduler driver")
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
 		return stat, fmt.Errorf("Unable to Stop, expected driver status %s, but is %s", mesos.Status_DRIVER_RUNNING, stat)
 	}
+	if !driver.claimStop() {
+		return driver.Status(), fmt.Errorf("Unable to Stop, the driver is already stopping")
+	}
+	driver.declineCachedOffers()
+	return driver.shutdown(failover, mesos.Status_DRIVER_STOPPED, ShutdownUserStop)
+}
 
-	if driver.connected && failover {
+// shutdown unregisters the framework unless failover is true and stops
+// the driver with the given status. reason is recorded unless the driver already
+// shuts down for another reason.
+func (driver *MesosSchedulerDriver) shutdown(failover bool, stopStatus mesos.Status, reason ShutdownReason) (mesos.Status, error) {
+	connected := driver.Connected()
+	if stopStatus == mesos.Status_DRIVER_STOPPED {
+		driver.transition(StateStopping)
+	}
+	if connected && !failover {
 		// unregister the framework
 		message := &mesos.UnregisterFrameworkMessage{
-			FrameworkId: driver.FrameworkInfo.Id,
+			FrameworkId: driver.frameworkId(),
 		}
-		if err := driver.send(driver.MasterPid, message); err != nil {
+		if err := driver.send(driver.masterPid(), message); err != nil {
 			log.Errorf("Failed to send UnregisterFramework message while stopping driver: %v\n", err)
+			driver.setStopReason(err)
+			driver.setShutdownReason(ShutdownUnregisterFailed)
 			status := mesos.Status_DRIVER_ABORTED
 			return status, driver.stop(status)
 		}
 	}
 
 	// stop messenger
-	status := mesos.Status_DRIVER_STOPPED
-	return status, driver.stop(status)
+	driver.setShutdownReason(reason)
+	driver.saveTaskCache()
+	if driver.debug.stopFirst {
+		driver.stopDebugMetrics()
+	}
+	if stopStatus == mesos.Status_DRIVER_STOPPED {
+		driver.drain()
+	}
+	return stopStatus, driver.stop(stopStatus)
+}
+
+// drain waits up to mesos_stop_drain_timeout for the messages queued so
+// far to be sent, so that stopping the messenger does not drop them.
+func (driver *MesosSchedulerDriver) drain() {
+	d, ok := driver.messenger.(messenger.Drainer)
+	if !ok || driver.drainTimeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), driver.drainTimeout)
+	defer cancel()
+	if err := d.Drain(ctx); err != nil {
+		log.Warningf("Stopping the messenger before it sent all the messages: %v\n", err)
+	}
 }
 
 func (driver *MesosSchedulerDriver) stop(stopStatus mesos.Status) error {
+	driver.stopDetector()
 	// stop messenger
 	err := driver.messenger.Stop()
-	defer close(driver.stopCh)
 
-	driver.setStatus(stopStatus)
-	driver.setStopped(true)
-	driver.connected = false
+	switch stopStatus {
+	case mesos.Status_DRIVER_STOPPED:
+		driver.state.terminate(StateStopped, driver.ShutdownReason())
+	case mesos.Status_DRIVER_ABORTED:
+		driver.state.terminate(StateAborted, driver.ShutdownReason())
+	}
+	driver.stopOnce.Do(func() { close(driver.stopCh) })
+	driver.debugStopped()
 
 	if err != nil {
 		return err
@@ -550,193 +1473,543 @@ func (driver *MesosSchedulerDriver) stop(stopStatus mesos.Status) error {
 	return nil
 }
 
+//Abort aborts the driver. When connected, the master is asked to
+//deactivate the framework so that it stops sending offers, the framework
+//stays registered. An aborted driver cannot be started again, Join
+//returns DRIVER_ABORTED.
 func (driver *MesosSchedulerDriver) Abort() (mesos.Status, error) {
-	log.Infof("Aborting framework [%s]\n", driver.FrameworkInfo.GetId().GetValue())
+	log.Infof("Aborting framework [%s]\n", driver.frameworkId().GetValue())
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
 		return stat, fmt.Errorf("Unable to Abort, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
 	}
+	if !driver.claimStop() {
+		return driver.Status(), fmt.Errorf("Unable to Abort, the driver is already stopping")
+	}
 
-	if !driver.connected {
-		log.Infoln("Ignoring Abort, master is disconnected.")
-		return driver.Status(), fmt.Errorf("Unable to Abort, driver not connected.")
+	driver.declineCachedOffers()
+	if driver.Connected() {
+		message := &mesos.DeactivateFrameworkMessage{
+			FrameworkId: driver.frameworkId(),
+		}
+		if err := driver.send(driver.masterPid(), message); err != nil {
+			log.Errorf("Failed to send DeactivateFramework message while aborting driver: %v\n", err)
+		}
+	} else {
+		log.Infoln("Not deactivating the framework, master is disconnected.")
 	}
-	_, err := driver.Stop(true)
-	stat := mesos.Status_DRIVER_ABORTED
-	driver.setStatus(stat)
-	return stat, err
+	_, err := driver.shutdown(true, mesos.Status_DRIVER_ABORTED, ShutdownUserAbort)
+	return mesos.Status_DRIVER_ABORTED, err
+}
+
+// LaunchTask launches tasks against a single offer, it is LaunchTasks
+// with one offer ID.
+func (driver *MesosSchedulerDriver) LaunchTask(offerId *mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
+	return driver.LaunchTasks([]*mesos.OfferID{offerId}, tasks, filters)
+}
+
+// LaunchTasksOnOffers launches tasks on the resources of several offers
+// from the same slave at once, it is LaunchTasks.
+func (driver *MesosSchedulerDriver) LaunchTasksOnOffers(offerIds []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
+	return driver.LaunchTasks(offerIds, tasks, filters)
 }
 
 func (driver *MesosSchedulerDriver) LaunchTasks(offerIds []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
+	return driver.LaunchTasksContext(context.Background(), offerIds, tasks, filters)
+}
+
+// LaunchTasksContext is LaunchTasks correlated by the ID carried by ctx,
+// see WithCorrelation. The ID is logged, set in the CorrelationEnv of the
+// command of a copy of each task run without an executor of its own, and
+// appended to the Message of the TASK_LOST updates the driver generates
+// for the tasks it fails to launch. The tasks are left as they are, and
+// only the launch is logged with a generated ID, if ctx carries none.
+func (driver *MesosSchedulerDriver) LaunchTasksContext(ctx context.Context, offerIds []*mesos.OfferID, tasks []*mesos.TaskInfo, filters *mesos.Filters) (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expected driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to LaunchTasks, expected driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	driver.checkOffers(offerIds)
+
+	correlation, correlated := Correlation(ctx)
+	log.V(1).Infof("Launching %d tasks on offers %v, correlation %s\n", len(tasks), offerIds, correlationOf(ctx))
+	if correlated {
+		stamped := make([]*mesos.TaskInfo, len(tasks))
+		for i, task := range tasks {
+			// an executor must be launched with the same ExecutorInfo each time.
+			if task.Executor == nil {
+				task = proto.Clone(task).(*mesos.TaskInfo)
+				util.SetTaskEnv(task, CorrelationEnv, correlation)
+			}
+			stamped[i] = task
+		}
+		tasks = stamped
 	}
 
+	// a task ID may be reused once its task is terminal, the updates of
+	// the new task are not ordered after those of the previous one. A
+	// task reusing the ID of a running task is lost, its TASK_LOST update
+	// is not taken for one of the running task, see pushLostTask.
+	var duplicate error
+	driver.taskIDs.prune(driver.clock.Now(), driver.taskIDReuseCooldown)
+	unique := make([]*mesos.TaskInfo, 0, len(tasks))
+	for _, task := range tasks {
+		if err := driver.checkTaskID(task); err != nil {
+			log.Warningf("Not launching task %s: %v\n", task.TaskId.GetValue(), err)
+			driver.pushLostTask(task, err.Error(), correlation)
+			duplicate = err
+			continue
+		}
+		if driver.statusOrder != nil {
+			driver.statusOrder.forget(task.GetTaskId())
+		}
+		unique = append(unique, task)
+	}
+	tasks = unique
+
 	// Launch tasks
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring LaunchTasks message, disconnected from master.")
 		// Send statusUpdate with status=TASK_LOST for each task.
 		// See sched.cpp L#823
 		for _, task := range tasks {
-			driver.pushLostTask(task, "Master is disconnected")
+			driver.pushLostTask(task, "Master Disconnected", correlation)
 		}
 		return driver.Status(), fmt.Errorf("Not connected to master.  Tasks marked as lost.")
 	}
 
+	// The master would reject the whole launch, don't bother sending it.
+	driver.expireOffers()
+	for _, offerId := range offerIds {
+		var why string
+		if driver.cache.isRescinded(offerId) {
+			why = "Offer " + offerId.GetValue() + " was rescinded"
+		} else if len(tasks) > 0 && !driver.cache.containsOffer(offerId) {
+			// declining an offer the driver does not know is harmless.
+			why = "Offer " + offerId.GetValue() + " is unknown"
+		} else {
+			continue
+		}
+		log.Warningf("Ignoring LaunchTasks message: %s.\n", why)
+		for _, task := range tasks {
+			driver.pushLostTask(task, why, correlation)
+		}
+		return driver.Status(), fmt.Errorf("%s.  Tasks marked as lost.", why)
+	}
+	// nor does it know the offers made before a failover.
+	for _, offerId := range offerIds {
+		if err := driver.staleOffer(offerId); err != nil {
+			log.Warningf("Ignoring LaunchTasks message: %v\n", err)
+			for _, task := range tasks {
+				driver.pushLostTask(task, err.Error(), correlation)
+			}
+			return driver.Status(), err
+		}
+	}
+	// nor would it launch tasks on offers from several slaves.
+	slaveId, err := driver.cache.offersSlave(offerIds)
+	if err != nil {
+		log.Warningf("Ignoring LaunchTasks message: %v\n", err)
+		for _, task := range tasks {
+			driver.pushLostTask(task, err.Error(), correlation)
+		}
+		return driver.Status(), fmt.Errorf("%v  Tasks marked as lost.", err)
+	}
+	// over-committed offers would only yield TASK_LOST updates later.
+	if driver.checkOfferResources {
+		if err := driver.fitOffers(offerIds, slaveId, tasks); err != nil {
+			log.Warningf("Ignoring LaunchTasks message: %v\n", err)
+			for _, task := range tasks {
+				driver.pushLostTask(task, err.Error(), correlation)
+			}
+			return driver.Status(), err
+		}
+	}
+
 	okTasks := make([]*mesos.TaskInfo, 0, len(tasks))
+	executors := make(map[string]*mesos.ExecutorInfo) // of okTasks, key:executorId
+	var invalid, exceeded error
 
-	// Set TaskInfo.executor.framework_id, if it's missing.
+	// Set TaskInfo.executor.framework_id, if it's missing, and validate the
+	// tasks. The invalid ones are lost, the others are still launched.
 	for _, task := range tasks {
 		if task.Executor != nil && task.Executor.FrameworkId == nil {
-			task.Executor.FrameworkId = driver.FrameworkInfo.Id
+			task.Executor.FrameworkId = driver.frameworkId()
+		}
+		if err := driver.validateTask(task, slaveId, executors); err != nil {
+			log.Warningf("Not launching task %s: %v\n", task.TaskId.GetValue(), err)
+			driver.pushLostTask(task, err.Error(), correlation)
+			invalid = err
+			continue
+		}
+		if err := driver.chargeQuota(task, executors); err != nil {
+			log.Warningf("Not launching task %s: %v\n", task.TaskId.GetValue(), err)
+			driver.pushLostTask(task, err.Error(), correlation)
+			exceeded = err
+			continue
+		}
+		if task.Executor != nil {
+			executors[task.Executor.ExecutorId.GetValue()] = task.Executor
 		}
 		okTasks = append(okTasks, task)
 	}
 
 	for _, offerId := range offerIds {
-		for _, task := range okTasks {
-			// Keep only the slave PIDs where we run tasks so we can send
-			// framework messages directly.
-			if driver.cache.containsOffer(offerId) {
-				if driver.cache.getOffer(offerId).offer.SlaveId.Equal(task.SlaveId) {
-					// cache the tasked slave, for future communication
-					pid := driver.cache.getOffer(offerId).slavePid
-					driver.cache.putSlavePid(task.SlaveId, pid)
-				} else {
-					log.Warningf("Attempting to launch task %s with the wrong slaveId offer %s\n", task.TaskId.GetValue(), task.SlaveId.GetValue())
-				}
-			} else {
-				log.Warningf("Attempting to launch task %s with unknown offer %s\n", task.TaskId.GetValue(), offerId.GetValue())
+		// Keep only the slave PIDs where we run tasks so we can send
+		// framework messages directly. The offer may have been rescinded
+		// meanwhile.
+		if entry := driver.cache.getOffer(offerId); entry != nil {
+			for _, task := range okTasks {
+				driver.cache.putSlavePid(task.SlaveId, entry.slavePid)
 			}
 		}
-
-		driver.cache.removeOffer(offerId) // if offer
+		driver.cache.removeOffer(offerId)
 	}
 
 	// launch tasks
 	message := &mesos.LaunchTasksMessage{
-		FrameworkId: driver.FrameworkInfo.Id,
+		FrameworkId: driver.frameworkId(),
 		OfferIds:    offerIds,
 		Tasks:       okTasks,
 		Filters:     filters,
 	}
 
-	if err := driver.send(driver.MasterPid, message); err != nil {
-		for _, task := range tasks {
-			driver.pushLostTask(task, "Unable to launch tasks: "+err.Error())
+	if err := driver.send(driver.masterPid(), message); err != nil {
+		// the invalid tasks are lost already.
+		for _, task := range okTasks {
+			driver.pushLostTask(task, "Unable to launch tasks: "+err.Error(), correlation)
 		}
 		log.Errorf("Failed to send LaunchTask message: %v\n", err)
 		return driver.Status(), err
 	}
+	for _, executor := range executors {
+		driver.cache.putExecutor(slaveId, executor)
+	}
+	for _, task := range okTasks {
+		driver.taskIDs.launched(task.TaskId, driver.clock.Now())
+	}
 
+	if invalid != nil {
+		return driver.Status(), fmt.Errorf("Invalid tasks marked as lost: %v", invalid)
+	}
+	if duplicate != nil {
+		return driver.Status(), fmt.Errorf("Tasks not launched: %v", duplicate)
+	}
+	if exceeded != nil {
+		return driver.Status(), exceeded
+	}
 	return driver.Status(), nil
 }
 
-func (driver *MesosSchedulerDriver) pushLostTask(taskInfo *mesos.TaskInfo, why string) {
+// validateTask rejects tasks the master or the slave would refuse to
+// launch, like the C++ driver does. slaveId is the slave of the offers, nil
+// if they are unknown, and executors those of the tasks already accepted
+// for the same launch, key:executorId.
+func (driver *MesosSchedulerDriver) validateTask(task *mesos.TaskInfo, slaveId *mesos.SlaveID, executors map[string]*mesos.ExecutorInfo) error {
+	if err := driver.checkTaskIDs(task); err != nil {
+		return err
+	}
+	if task.Executor != nil && task.Command != nil {
+		return fmt.Errorf("Task %s should have either CommandInfo or ExecutorInfo set, but not both.", task.TaskId.GetValue())
+	}
+	if slaveId != nil && !slaveId.Equal(task.SlaveId) {
+		return fmt.Errorf("Task %s targets slave %s, but the offers are from slave %s.",
+			task.TaskId.GetValue(), task.SlaveId.GetValue(), slaveId.GetValue())
+	}
+	if task.Executor != nil {
+		executorId := task.Executor.ExecutorId
+		known, ok := executors[executorId.GetValue()]
+		if !ok {
+			known = driver.cache.getExecutor(task.SlaveId, executorId)
+		}
+		if known != nil && !known.Equal(task.Executor) {
+			return fmt.Errorf("Task %s uses executor %s with an ExecutorInfo different from the one the executor was launched with.",
+				task.TaskId.GetValue(), executorId.GetValue())
+		}
+	}
+	return driver.validateTaskUser(task)
+}
+
+// validateTaskUser rejects tasks running as a user that is not allowed.
+func (driver *MesosSchedulerDriver) validateTaskUser(task *mesos.TaskInfo) error {
+	if driver.AllowedTaskUsers == nil {
+		return nil
+	}
+	user := task.GetCommand().GetUser()
+	if task.Executor != nil {
+		user = task.GetExecutor().GetCommand().GetUser()
+	}
+	if user == "" || user == driver.FrameworkInfo.GetUser() {
+		return nil
+	}
+	for _, allowed := range driver.AllowedTaskUsers {
+		if user == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("Task %s may not run as user %q, it is not one of the allowed task users %v.",
+		task.TaskId.GetValue(), user, driver.AllowedTaskUsers)
+}
+
+// pushLostTask posts a TASK_LOST update of a task the driver failed to
+// launch, the correlation ID of the launch, if any, is appended to why.
+// If a task that is not terminal has its ID, e.g. the task reuses it, the
+// update is only delivered: the state of that task is left as it is.
+func (driver *MesosSchedulerDriver) pushLostTask(taskInfo *mesos.TaskInfo, why, correlation string) {
+	if correlation != "" {
+		why += " (correlation " + correlation + ")"
+	}
 	msg := &mesos.StatusUpdateMessage{
 		Update: &mesos.StatusUpdate{
-			FrameworkId: driver.FrameworkInfo.Id,
+			FrameworkId: driver.frameworkId(),
 			Status: &mesos.TaskStatus{
 				TaskId:  taskInfo.TaskId,
 				State:   mesos.TaskState_TASK_LOST.Enum(),
 				Message: proto.String(why),
 			},
 			SlaveId:    taskInfo.SlaveId,
-			ExecutorId: taskInfo.Executor.ExecutorId,
-			Timestamp:  proto.Float64(float64(time.Now().Unix())),
+			ExecutorId: taskInfo.GetExecutor().GetExecutorId(),
+			Timestamp:  proto.Float64(float64(driver.clock.Now().Unix())),
 			Uuid:       []byte(uuid.NewUUID()),
 		},
 	}
 
-	// put it on internal chanel
-	// will cause handler to push to attached Scheduler
-	driver.statusUpdated(driver.self, msg)
+	// handled as if received, once the caller returned.
+	record := !driver.taskIDs.live(taskInfo.TaskId)
+	driver.postAsync(func() { driver.handleStatus(driver.self, msg, record) })
 }
 
 func (driver *MesosSchedulerDriver) KillTask(taskId *mesos.TaskID) (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to KillTask, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	return driver.Status(), driver.killTask(taskId)
+}
+
+// KillTasks kills the given tasks, see KillTask. A kill that cannot be
+// sent does not keep the others from being sent, the failed ones are
+// reported by a *KillTasksError.
+func (driver *MesosSchedulerDriver) KillTasks(taskIds []*mesos.TaskID) (mesos.Status, error) {
+	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
+		return stat, driver.misused(fmt.Errorf("Unable to KillTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
 	}
 
-	if !driver.connected {
-		log.Infoln("Ignoring kill task message, disconnected from master.")
-		return driver.Status(), fmt.Errorf("Not connected to master")
+	failed := make(map[string]error)
+	for _, taskId := range taskIds {
+		if err := driver.killTask(taskId); err != nil {
+			failed[taskId.GetValue()] = err
+		}
+	}
+	if len(failed) > 0 {
+		return driver.Status(), &KillTasksError{Errors: failed}
+	}
+	return driver.Status(), nil
+}
+
+func (driver *MesosSchedulerDriver) killTask(taskId *mesos.TaskID) error {
+	if !driver.Connected() {
+		log.Infof("Not killing task %v, disconnected from master.\n", taskId.GetValue())
+		return ErrNotConnected
 	}
 
-	message := &mesos.KillTaskMessage{TaskId: taskId}
+	message := &mesos.KillTaskMessage{
+		FrameworkId: driver.frameworkId(),
+		TaskId:      taskId,
+	}
 
-	if err := driver.send(driver.MasterPid, message); err != nil {
+	if err := driver.send(driver.masterPid(), message); err != nil {
 		log.Errorf("Failed to send KillTask message: %v\n", err)
-		return driver.Status(), err
+		return err
 	}
-
-	return driver.Status(), nil
+	return nil
 }
 
 func (driver *MesosSchedulerDriver) RequestResources(requests []*mesos.Request) (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to RequestResources, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
 	}
 
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring request resource message, disconnected from master.")
-		return driver.status, fmt.Errorf("Not connected to master")
+		return driver.Status(), fmt.Errorf("Not connected to master")
 	}
 
 	message := &mesos.ResourceRequestMessage{
-		FrameworkId: driver.FrameworkInfo.Id,
+		FrameworkId: driver.frameworkId(),
 		Requests:    requests,
 	}
 
-	if err := driver.send(driver.MasterPid, message); err != nil {
+	if err := driver.send(driver.masterPid(), message); err != nil {
 		log.Errorf("Failed to send ResourceRequest message: %v\n", err)
-		return driver.status, err
+		return driver.Status(), err
 	}
 
-	return driver.status, nil
+	return driver.Status(), nil
 }
 
 func (driver *MesosSchedulerDriver) DeclineOffer(offerId *mesos.OfferID, filters *mesos.Filters) (mesos.Status, error) {
+	if filters == nil {
+		var offer *mesos.Offer
+		if entry := driver.cache.getOffer(offerId); entry != nil {
+			offer = entry.offer
+		}
+		filters = driver.declineFilters(offer)
+	}
 	return driver.LaunchTasks([]*mesos.OfferID{offerId}, []*mesos.TaskInfo{}, filters)
 }
 
+// CachedOffers returns a copy of the outstanding offers, key:offer ID.
+// Offers leave the cache once used or declined, rescinded, expired, or
+// when their slave is lost. Tasks launched against offers missing from
+// the cache are lost locally, without reaching the master.
+func (driver *MesosSchedulerDriver) CachedOffers() map[string]*mesos.Offer {
+	return driver.cache.offersSnapshot()
+}
+
+// CachedOffer returns a copy of the outstanding offer with the given ID,
+// nil if it is not in the cache or expired, see CachedOffers.
+func (driver *MesosSchedulerDriver) CachedOffer(offerId *mesos.OfferID) *mesos.Offer {
+	entry := driver.cache.getOffer(offerId)
+	if entry == nil || (!entry.deadline.IsZero() && !driver.clock.Now().Before(entry.deadline)) {
+		return nil
+	}
+	return proto.Clone(entry.offer).(*mesos.Offer)
+}
+
 func (driver *MesosSchedulerDriver) ReviveOffers() (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to ReviveOffers, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
 	}
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring revive offers message, disconnected from master.")
 		return driver.Status(), fmt.Errorf("Not connected to master.")
 	}
 
+	driver.suppressLock.Lock()
+	defer driver.suppressLock.Unlock()
+	driver.suppressed = false
+	if err := driver.reviveOffers(); err != nil {
+		return driver.Status(), err
+	}
+	return driver.Status(), nil
+}
+
+// reviveOffers sends a ReviveOffersMessage, clearing the filters of the
+// offers declined while suppressed once it is sent. The caller holds
+// suppressLock.
+func (driver *MesosSchedulerDriver) reviveOffers() error {
 	message := &mesos.ReviveOffersMessage{
-		FrameworkId: driver.FrameworkInfo.Id,
+		FrameworkId: driver.frameworkId(),
 	}
-	if err := driver.send(driver.MasterPid, message); err != nil {
+	if err := driver.send(driver.masterPid(), message); err != nil {
 		log.Errorf("Failed to send ReviveOffers message: %v\n", err)
-		return driver.Status(), err
+		return err
+	}
+	driver.suppressFilters = false
+	return nil
+}
+
+// reviveFilters sends again, once re-registered, the ReviveOffers that
+// failed to clear the filters of the offers declined while suppressed.
+func (driver *MesosSchedulerDriver) reviveFilters() {
+	driver.suppressLock.Lock()
+	defer driver.suppressLock.Unlock()
+	if driver.suppressed || !driver.suppressFilters {
+		return
+	}
+	log.Infoln("Reviving the offers declined while offers were suppressed.")
+	driver.reviveOffers()
+}
+
+// SuppressOffers keeps the offers from reaching the Scheduler until
+// ReviveOffers is called. The masters this driver talks to cannot be told
+// to stop sending offers: the driver declines them instead, refusing their
+// resources for suppressRefuseSeconds so that the master stops offering
+// them, and the master keeps sending the offers of other resources, e.g.
+// of new slaves. These filters outlive the driver: a scheduler failing
+// over while offers are suppressed gets no offers for the declined
+// resources until it calls ReviveOffers. ReviveOffers clears them, or the
+// driver does once re-registered if sending it failed.
+func (driver *MesosSchedulerDriver) SuppressOffers() (mesos.Status, error) {
+	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
+		return stat, driver.misused(fmt.Errorf("Unable to SuppressOffers, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
+	}
+	if !driver.Connected() {
+		log.Infoln("Ignoring suppress offers, disconnected from master.")
+		return driver.Status(), fmt.Errorf("Not connected to master.")
 	}
 
+	driver.suppressLock.Lock()
+	driver.suppressed = true
+	driver.suppressLock.Unlock()
 	return driver.Status(), nil
 }
 
+// declineSuppressed declines the offers received while offers are
+// suppressed, for suppressRefuseSeconds, and tells whether it did. It
+// holds suppressLock so that no decline is sent after the ReviveOffers
+// that should clear its filter.
+func (driver *MesosSchedulerDriver) declineSuppressed(offers []*mesos.Offer) bool {
+	driver.suppressLock.Lock()
+	defer driver.suppressLock.Unlock()
+	if !driver.suppressed {
+		return false
+	}
+	log.V(1).Infof("Declining %d offers, offers are suppressed.\n", len(offers))
+	for _, offer := range offers {
+		message := &mesos.LaunchTasksMessage{
+			FrameworkId: driver.frameworkId(),
+			OfferIds:    []*mesos.OfferID{offer.Id},
+			Tasks:       []*mesos.TaskInfo{},
+			Filters:     &mesos.Filters{RefuseSeconds: proto.Float64(suppressRefuseSeconds)},
+		}
+		if err := driver.send(driver.masterPid(), message); err != nil {
+			log.Errorf("Failed to decline offer %s: %v\n", offer.Id.GetValue(), err)
+		}
+	}
+	driver.suppressFilters = true
+	return true
+}
+
+// declineCachedOffers declines the outstanding offers, so that the master
+// offers their resources to other frameworks right away instead of once
+// they time out, and clears the cache. The offers are declined even if
+// sending a decline fails.
+func (driver *MesosSchedulerDriver) declineCachedOffers() {
+	for _, entry := range driver.cache.savedOffers.list() {
+		offer := entry.offer
+		driver.cache.removeOffer(offer.Id)
+		if !driver.Connected() {
+			continue
+		}
+		message := &mesos.LaunchTasksMessage{
+			FrameworkId: driver.frameworkId(),
+			OfferIds:    []*mesos.OfferID{offer.Id},
+			Tasks:       []*mesos.TaskInfo{},
+			Filters:     driver.declineFilters(offer),
+		}
+		if err := driver.send(driver.masterPid(), message); err != nil {
+			log.Errorf("Failed to decline offer %s while stopping: %v\n", offer.Id.GetValue(), err)
+		}
+	}
+}
+
 func (driver *MesosSchedulerDriver) SendFrameworkMessage(executorId *mesos.ExecutorID, slaveId *mesos.SlaveID, data string) (mesos.Status, error) {
 	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
+		return stat, driver.misused(fmt.Errorf("Unable to SendFrameworkMessage, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat))
 	}
-	if !driver.connected {
+	if !driver.Connected() {
 		log.Infoln("Ignoring send framework message, disconnected from master.")
 		return driver.Status(), fmt.Errorf("Not connected to master")
 	}
 
 	message := &mesos.FrameworkToExecutorMessage{
 		SlaveId:     slaveId,
-		FrameworkId: driver.FrameworkInfo.Id,
+		FrameworkId: driver.frameworkId(),
 		ExecutorId:  executorId,
 		Data:        []byte(data),
 	}
 	// Use list of cached slaveIds from previous offers.
 	// Send frameworkMessage directly to cached slave, otherwise to master.
-	if driver.cache.containsSlavePid(slaveId) {
+	if driver.cache.containsSlavePid(slaveId) && driver.cache.sendDirect(slaveId, driver.clock.Now()) {
 		slavePid := driver.cache.getSlavePid(slaveId)
 		if slavePid.Equal(driver.self) {
 			return driver.Status(), nil
@@ -747,7 +2020,7 @@ func (driver *MesosSchedulerDriver) SendFrameworkMessage(executorId *mesos.Execu
 		}
 	} else {
 		// slavePid not cached, send to master.
-		if err := driver.send(driver.MasterPid, message); err != nil {
+		if err := driver.send(driver.masterPid(), message); err != nil {
 			log.Errorf("Failed to send framework to executor message: %v\n", err)
 			return driver.Status(), err
 		}
@@ -756,39 +2029,49 @@ func (driver *MesosSchedulerDriver) SendFrameworkMessage(executorId *mesos.Execu
 	return driver.Status(), nil
 }
 
+// ReconcileTasks reconciles the given tasks, see ReconcileTasksAsync.
 func (driver *MesosSchedulerDriver) ReconcileTasks(statuses []*mesos.TaskStatus) (mesos.Status, error) {
-	if stat := driver.Status(); stat != mesos.Status_DRIVER_RUNNING {
-		return stat, fmt.Errorf("Unable to LaunchTasks, expecting driver status %s, but got %s", mesos.Status_DRIVER_RUNNING, stat)
-	}
-	if !driver.connected {
-		log.Infoln("Ignoring send Reconcile Tasks message, disconnected from master.")
-		return driver.Status(), fmt.Errorf("Not connected to master.")
-	}
-
-	message := &mesos.ReconcileTasksMessage{
-		FrameworkId: driver.FrameworkInfo.Id,
-		Statuses:    statuses,
-	}
-	if err := driver.send(driver.MasterPid, message); err != nil {
-		log.Errorf("Failed to send reconcile tasks message: %v\n", err)
-		return driver.Status(), err
-	}
+	_, stat, err := driver.ReconcileTasksAsync(statuses)
+	return stat, err
+}
 
-	return driver.Status(), nil
+// error reports err to the Scheduler. Errors reported by the master and
+// fatal internal errors, e.g. a dead messenger, are unrecoverable: the
+// driver is aborted for reason once the Error callback returns.
+func (driver *MesosSchedulerDriver) error(err string, abortDriver bool, reason ShutdownReason) {
+	driver.errorCause(err, nil, abortDriver, reason)
 }
 
-func (driver *MesosSchedulerDriver) error(err string, abortDriver bool) {
+// errorCause is error, cause is the StopReason of the driver unless nil.
+// A FrameworkError is handed to a FrameworkErrorHandler.
+func (driver *MesosSchedulerDriver) errorCause(err string, cause error, abortDriver bool, reason ShutdownReason) {
 	if abortDriver {
 		if driver.Status() == mesos.Status_DRIVER_ABORTED {
 			log.V(3).Infoln("Ignoring error message, the driver is aborted!")
 			return
 		}
-
-		log.Infoln("Aborting driver, got error '", err, "'")
-
-		driver.Abort()
+		if cause == nil {
+			cause = fmt.Errorf("Aborted on error: %s", err)
+		}
+		driver.setStopReason(cause)
+		driver.setShutdownReason(reason)
 	}
 
 	log.V(3).Infoln("Sending error '", err, "'")
-	driver.Scheduler.Error(driver, err)
+	ferr, _ := cause.(*FrameworkError)
+	if handler, ok := driver.Scheduler.(FrameworkErrorHandler); ok && ferr != nil {
+		handler.FrameworkError(driver, ferr)
+	} else {
+		driver.notifyError(err, reason)
+	}
+
+	// the scheduler may have stopped the driver itself.
+	if abortDriver && driver.Status() == mesos.Status_DRIVER_RUNNING {
+		log.Infoln("Aborting driver, got error '", err, "'")
+		if driver.Connected() {
+			driver.Abort()
+		} else if err := driver.stop(mesos.Status_DRIVER_ABORTED); err != nil {
+			log.Errorf("Failed to stop scheduler driver %v\n", err)
+		}
+	}
 }
@@ -19,25 +19,45 @@
 package scheduler
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/gogo/protobuf/proto"
 	log "github.com/golang/glog"
+	"github.com/mesos/mesos-go/detector"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 	util "github.com/mesos/mesos-go/mesosutil"
 	"github.com/mesos/mesos-go/testutil"
+	"github.com/mesos/mesos-go/upid"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // testScuduler is used for testing Schduler callbacks.
 type testScheduler struct {
-	ch chan bool
-	wg *sync.WaitGroup
-	t  *testing.T
+	ch       chan bool
+	wg       *sync.WaitGroup
+	t        *testing.T
+	offers   chan []*mesos.Offer    // if set, receives offers instead of ch
+	statuses chan *mesos.TaskStatus // if set, receives status updates instead of wg
+	lost     chan *lostExecutor     // if set, receives lost executors
+	messages chan []byte            // if set, receives framework messages instead of ch
+	lostCh   chan bool              // if set, receives Disconnected calls
+}
+
+type lostExecutor struct {
+	executorId *mesos.ExecutorID
+	slaveId    *mesos.SlaveID
+	status     int
 }
 
 func (sched *testScheduler) Registered(dr SchedulerDriver, fw *mesos.FrameworkID, mi *mesos.MasterInfo) {
@@ -55,11 +75,18 @@ func (sched *testScheduler) Reregistered(dr SchedulerDriver, mi *mesos.MasterInf
 
 func (sched *testScheduler) Disconnected(dr SchedulerDriver) {
 	log.Infoln("Shed.Disconnected() called")
+	if sched.lostCh != nil {
+		sched.lostCh <- true
+	}
 }
 
 func (sched *testScheduler) ResourceOffers(dr SchedulerDriver, offers []*mesos.Offer) {
 	log.Infoln("Sched.ResourceOffers called.")
 	assert.NotNil(sched.t, offers)
+	if sched.offers != nil {
+		sched.offers <- offers
+		return
+	}
 	assert.Equal(sched.t, len(offers), 1)
 	sched.ch <- true
 }
@@ -74,9 +101,13 @@ func (sched *testScheduler) OfferRescinded(dr SchedulerDriver, oid *mesos.OfferI
 func (sched *testScheduler) StatusUpdate(dr SchedulerDriver, stat *mesos.TaskStatus) {
 	log.Infoln("Sched.StatusUpdate() called.")
 	assert.NotNil(sched.t, stat)
+	if sched.statuses != nil {
+		sched.statuses <- stat
+		return
+	}
 	assert.Equal(sched.t, "test-task-001", stat.GetTaskId().GetValue())
 	sched.wg.Done()
-	log.Infof("Status update done with waitGroup %v \n", sched.wg)
+	log.Infoln("Status update done with waitGroup")
 }
 
 func (sched *testScheduler) SlaveLost(dr SchedulerDriver, slaveId *mesos.SlaveID) {
@@ -92,12 +123,19 @@ func (sched *testScheduler) FrameworkMessage(dr SchedulerDriver, execId *mesos.E
 	assert.Equal(sched.t, slaveId.GetValue(), "test-slave-001")
 	assert.NotNil(sched.t, execId)
 	assert.NotNil(sched.t, data)
+	if sched.messages != nil {
+		sched.messages <- []byte(data)
+		return
+	}
 	assert.Equal(sched.t, "test-data-999", string(data))
 	sched.ch <- true
 }
 
-func (sched *testScheduler) ExecutorLost(SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, int) {
+func (sched *testScheduler) ExecutorLost(dr SchedulerDriver, execId *mesos.ExecutorID, slaveId *mesos.SlaveID, status int) {
 	log.Infoln("Sched.ExecutorLost	 called")
+	if sched.lost != nil {
+		sched.lost <- &lostExecutor{execId, slaveId, status}
+	}
 }
 
 func (sched *testScheduler) Error(dr SchedulerDriver, err string) {
@@ -151,8 +189,12 @@ func TestSchedulerDriverRegisterFrameworkMessage(t *testing.T) {
 
 func TestSchedulerDriverFrameworkRegisteredEvent(t *testing.T) {
 	// start mock master server to handle connection
+	registering := make(chan struct{}, 1)
 	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
 		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.RegisterFrameworkMessage") {
+			registering <- struct{}{}
+		}
 		rsp.WriteHeader(http.StatusAccepted)
 	})
 
@@ -169,6 +211,14 @@ func TestSchedulerDriverFrameworkRegisteredEvent(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 
+	// the registration must not fail once the driver follows the master
+	// it registered with.
+	select {
+	case <-registering:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for RegisterFrameworkMessage.")
+	}
+
 	// Send an event to this SchedulerDriver (via http) to test handlers.
 	pbMsg := &mesos.FrameworkRegisteredMessage{
 		FrameworkId: framework.Id,
@@ -179,6 +229,7 @@ func TestSchedulerDriverFrameworkRegisteredEvent(t *testing.T) {
 	c.SendMessage(driver.self, pbMsg) // after this driver.connced=true
 
 	assert.True(t, driver.Connected())
+	assert.True(t, driver.RegistrationLatency() > 0)
 	select {
 	case <-ch:
 	case <-time.After(time.Millisecond * 2):
@@ -186,6 +237,91 @@ func TestSchedulerDriverFrameworkRegisteredEvent(t *testing.T) {
 	}
 }
 
+func TestSchedulerDriverFrameworkRegisteredEventIPv6(t *testing.T) {
+	registering := make(chan *upid.UPID, 1)
+	server := testutil.NewMockMasterHttpServerIPv6(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.RegisterFrameworkMessage") {
+			from, err := upid.Parse(req.Header.Get("Libprocess-From"))
+			assert.NoError(t, err)
+			registering <- from
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	ch := make(chan bool)
+	sched := newTestScheduler()
+	sched.ch = ch
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "::1", driver.MasterPid.Host)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+
+	select {
+	case from := <-registering:
+		assert.Equal(t, driver.self.String(), from.String())
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for RegisterFrameworkMessage.")
+	}
+
+	pbMsg := &mesos.FrameworkRegisteredMessage{
+		FrameworkId: framework.Id,
+		MasterInfo:  util.NewMasterInfo("master", 123456, 1234),
+	}
+	pbMsg.MasterInfo.Pid = proto.String(server.PID.String())
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, pbMsg)
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+	assert.True(t, driver.Connected())
+	assert.Equal(t, server.PID.String(), driver.MasterPid.String())
+}
+
+func TestSchedulerDriverRegisterOverTLS(t *testing.T) {
+	registering := make(chan *http.Request, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.RegisterFrameworkMessage") {
+			registering <- req
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	sched := newTestScheduler()
+	sched.t = t
+
+	_, err := NewMesosSchedulerDriverTLS(sched, framework, server.Listener.Addr().String(), nil, nil)
+	assert.Error(t, err)
+	driver, err := NewMesosSchedulerDriverTLS(sched, framework, server.Listener.Addr().String(), nil, &tls.Config{RootCAs: roots})
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Stop(false)
+
+	select {
+	case req := <-registering:
+		assert.NotNil(t, req.TLS)
+		assert.Equal(t, driver.self.String(), req.Header.Get("Libprocess-From"))
+		assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for RegisterFrameworkMessage over TLS.")
+	}
+}
+
 func TestSchedulerDriverFrameworkReregisteredEvent(t *testing.T) {
 	// start mock master server to handle connection
 	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
@@ -214,12 +350,179 @@ func TestSchedulerDriverFrameworkReregisteredEvent(t *testing.T) {
 	c := testutil.NewMockMesosClient(t, server.PID)
 	c.SendMessage(driver.self, pbMsg)
 
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
 	assert.True(t, driver.Connected())
+}
 
+func TestSchedulerDriverReregisteredAfterFailover(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	ch := make(chan bool)
+	sched := newTestScheduler()
+	sched.ch = ch
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+
+	masterInfo := util.NewMasterInfo("master-1", 123456, 1234)
+	masterInfo.Pid = proto.String(server.PID.String())
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: framework.Id,
+		MasterInfo:  masterInfo,
+	})
 	select {
 	case <-ch:
-	case <-time.After(time.Millisecond * 2):
-		log.Errorf("Tired of waiting for scheduler callback.")
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for Registered callback.")
+	}
+
+	// the master fails over, the driver re-registers with its successor.
+	failover := util.NewMasterInfo("master-2", 123456, 1234)
+	failover.Pid = proto.String(server.PID.String())
+	driver.OnMasterChanged(failover)
+	assert.False(t, driver.Connected())
+
+	c.SendMessage(driver.self, &mesos.FrameworkReregisteredMessage{
+		FrameworkId: util.NewFrameworkID("not-the-framework-id"),
+		MasterInfo:  failover,
+	})
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for Reregistered callback.")
+	}
+	assert.True(t, driver.Connected())
+	assert.Equal(t, framework.Id.GetValue(), driver.FrameworkInfo.Id.GetValue())
+}
+
+func TestSchedulerDriverReregistersWithFrameworkId(t *testing.T) {
+	type received struct {
+		name string
+		body []byte
+	}
+	rcvd := make(chan received, 4)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		rcvd <- received{req.RequestURI[strings.LastIndex(req.RequestURI, "/")+1:], body}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+	nextMessage := func() received {
+		select {
+		case msg := <-rcvd:
+			return msg
+		case <-time.After(time.Second * 1):
+			t.Fatalf("Tired of waiting for the master to receive a message.")
+		}
+		return received{}
+	}
+	newMaster := func(id string) *mesos.MasterInfo {
+		info := util.NewMasterInfo(id, 123456, 1234)
+		info.Pid = proto.String(server.PID.String())
+		return info
+	}
+
+	ch := make(chan bool)
+	sched := newTestScheduler()
+	sched.ch = ch
+	sched.t = t
+
+	// the framework has no ID until the master assigns one.
+	driver, err := NewMesosSchedulerDriver(sched, util.NewFrameworkInfo("test", "test-framework-001", nil), server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Equal(t, "mesos.internal.RegisterFrameworkMessage", nextMessage().name)
+
+	// a framework that never registered registers afresh.
+	driver.OnMasterChanged(newMaster("master-1"))
+	assert.Equal(t, "mesos.internal.RegisterFrameworkMessage", nextMessage().name)
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: framework.Id,
+		MasterInfo:  newMaster("master-1"),
+	})
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for Registered callback.")
+	}
+
+	driver.OnMasterChanged(newMaster("master-2"))
+	msg := nextMessage()
+	assert.Equal(t, "mesos.internal.ReregisterFrameworkMessage", msg.name)
+	reregister := &mesos.ReregisterFrameworkMessage{}
+	assert.NoError(t, proto.Unmarshal(msg.body, reregister))
+	assert.Equal(t, framework.Id.GetValue(), reregister.GetFramework().GetId().GetValue())
+	assert.False(t, reregister.GetFailover())
+
+	driver.Stop(false)
+}
+
+func TestSchedulerDriverDisconnectedOnSendFailure(t *testing.T) {
+	registering := make(chan struct{}, 1)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.RegisterFrameworkMessage") {
+			registering <- struct{}{}
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+
+	sched := newTestScheduler()
+	sched.lostCh = make(chan bool, 2)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Stop(false)
+	select {
+	case <-registering:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for RegisterFrameworkMessage.")
+	}
+	driver.transition(StateConnected) // mock state
+
+	// the master goes away, the next message to it fails.
+	server.Close()
+	_, err = driver.KillTask(util.NewTaskID("test-task-001"))
+	assert.NoError(t, err)
+	select {
+	case <-sched.lostCh:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Tired of waiting for Disconnected callback.")
+	}
+	assert.False(t, driver.Connected())
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+
+	// calls fail fast while disconnected, without another callback.
+	stat, err = driver.KillTask(util.NewTaskID("test-task-001"))
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	select {
+	case <-sched.lostCh:
+		t.Fatalf("Disconnected called more than once.")
+	case <-time.After(time.Millisecond * 100):
 	}
 }
 
@@ -242,7 +545,7 @@ func TestSchedulerDriverResourceOffersEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
+	driver.transition(StateConnected) // mock state
 
 	// Send a event to this SchedulerDriver (via http) to test handlers.
 	offer := util.NewOffer(
@@ -266,6 +569,50 @@ func TestSchedulerDriverResourceOffersEvent(t *testing.T) {
 	}
 }
 
+func TestSchedulerDriverResourceOffersEventWithSlavePids(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.offers = make(chan []*mesos.Offer, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	pbMsg := &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{
+			util.NewOffer(util.NewOfferID("test-offer-001"), framework.Id, util.NewSlaveID("test-slave-001"), "test-host-001"),
+			util.NewOffer(util.NewOfferID("test-offer-002"), framework.Id, util.NewSlaveID("test-slave-002"), "test-host-002"),
+		},
+		Pids: []string{"slave(1)@127.0.0.1:5051", "slave(1)@127.0.0.2:5051"},
+	}
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, pbMsg)
+
+	select {
+	case offers := <-sched.offers:
+		assert.Equal(t, 2, len(offers))
+		assert.Equal(t, "test-offer-001", offers[0].Id.GetValue())
+		assert.Equal(t, "test-offer-002", offers[1].Id.GetValue())
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+
+	// offer -> slave pid bookkeeping
+	cached := driver.cache.getOffer(util.NewOfferID("test-offer-002"))
+	assert.NotNil(t, cached)
+	assert.Equal(t, "slave(1)@127.0.0.2:5051", cached.slavePid.String())
+}
+
 func TestSchedulerDriverRescindOfferEvent(t *testing.T) {
 	// start mock master server to handle connection
 	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
@@ -285,11 +632,13 @@ func TestSchedulerDriverRescindOfferEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
+	driver.transition(StateConnected) // mock state
+	offerId := util.NewOfferID("test-offer-001")
+	driver.cache.putOffer(util.NewOffer(offerId, framework.Id, util.NewSlaveID("test-slave-001"), "localhost"), server.PID)
 
 	// Send a event to this SchedulerDriver (via http) to test handlers.
 	pbMsg := &mesos.RescindResourceOfferMessage{
-		OfferId: util.NewOfferID("test-offer-001"),
+		OfferId: offerId,
 	}
 
 	c := testutil.NewMockMesosClient(t, server.PID)
@@ -297,14 +646,84 @@ func TestSchedulerDriverRescindOfferEvent(t *testing.T) {
 
 	select {
 	case <-ch:
-	case <-time.After(time.Millisecond * 2):
-		log.Errorf("Tired of waiting for scheduler callback.")
+	case <-time.After(time.Second):
+		t.Fatal("Tired of waiting for scheduler callback.")
+	}
+	assert.Nil(t, driver.CachedOffer(offerId))
+}
+
+func TestSchedulerDriverLaunchTasksOnRescindedOffer(t *testing.T) {
+	launched := make(chan struct{}, 1)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.LaunchTasksMessage") {
+			launched <- struct{}{}
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.offers = make(chan []*mesos.Offer, 1)
+	sched.statuses = make(chan *mesos.TaskStatus, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	offerId := util.NewOfferID("test-offer-001")
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{util.NewOffer(offerId, framework.Id, util.NewSlaveID("test-slave-001"), "test-host-001")},
+		Pids:   []string{"slave(1)@127.0.0.1:5051"},
+	})
+	select {
+	case <-sched.offers:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+
+	c.SendMessage(driver.self, &mesos.RescindResourceOfferMessage{OfferId: offerId})
+	select {
+	case <-sched.ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+	assert.False(t, driver.cache.containsOffer(offerId))
+
+	task := util.NewTaskInfo(
+		"simple-task",
+		util.NewTaskID("test-task-001"),
+		util.NewSlaveID("test-slave-001"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 400)},
+	)
+	task.Command = util.NewCommandInfo("pwd")
+	stat, err = driver.LaunchTasks([]*mesos.OfferID{offerId}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+
+	select {
+	case status := <-sched.statuses:
+		assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for TASK_LOST.")
+	}
+
+	select {
+	case <-launched:
+		t.Fatalf("Received unexpected LaunchTasksMessage.")
+	case <-time.After(time.Millisecond * 100):
 	}
 }
 
 func TestSchedulerDriverStatusUpdatedEvent(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(2)
+	acks := make(chan *mesos.StatusUpdateAcknowledgementMessage, 1)
 	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
 		log.Infoln("MockMaster - rcvd ", req.RequestURI)
 		if strings.Contains(req.RequestURI, "mesos.internal.StatusUpdateAcknowledgementMessage") {
@@ -312,8 +731,11 @@ func TestSchedulerDriverStatusUpdatedEvent(t *testing.T) {
 			data, _ := ioutil.ReadAll(req.Body)
 			defer req.Body.Close()
 			assert.NotNil(t, data)
+			ack := new(mesos.StatusUpdateAcknowledgementMessage)
+			assert.NoError(t, proto.Unmarshal(data, ack))
+			acks <- ack
 			wg.Done()
-			log.Infof("MockMaster - Done with wait group %v \n", wg)
+			log.Infoln("MockMaster - Done with wait group")
 		}
 		rsp.WriteHeader(http.StatusAccepted)
 	})
@@ -329,9 +751,10 @@ func TestSchedulerDriverStatusUpdatedEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
+	driver.transition(StateConnected) // mock state
 
 	// Send a event to this SchedulerDriver (via http) to test handlers.
+	// The mock server stands in for the slave that is ACKed.
 	pbMsg := &mesos.StatusUpdateMessage{
 		Update: util.NewStatusUpdate(
 			framework.Id,
@@ -339,7 +762,7 @@ func TestSchedulerDriverStatusUpdatedEvent(t *testing.T) {
 			float64(time.Now().Unix()),
 			[]byte("test-abcd-ef-3455-454-001"),
 		),
-		Pid: proto.String(driver.self.String()),
+		Pid: proto.String(server.PID.String()),
 	}
 	pbMsg.Update.SlaveId = &mesos.SlaveID{Value: proto.String("test-slave-001")}
 
@@ -348,6 +771,61 @@ func TestSchedulerDriverStatusUpdatedEvent(t *testing.T) {
 
 	<-time.After(time.Millisecond * 1)
 	wg.Wait()
+
+	ack := <-acks
+	assert.Equal(t, "test-slave-001", ack.GetSlaveId().GetValue())
+	assert.Equal(t, framework.Id.GetValue(), ack.GetFrameworkId().GetValue())
+	assert.Equal(t, "test-task-001", ack.GetTaskId().GetValue())
+	assert.Equal(t, []byte("test-abcd-ef-3455-454-001"), ack.GetUuid())
+}
+
+func TestSchedulerDriverStatusUpdatedEventWithoutUUID(t *testing.T) {
+	acked := make(chan struct{}, 1)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.StatusUpdateAcknowledgementMessage") {
+			acked <- struct{}{}
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.statuses = make(chan *mesos.TaskStatus, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	pbMsg := &mesos.StatusUpdateMessage{
+		Update: util.NewStatusUpdate(
+			framework.Id,
+			util.NewTaskStatus(util.NewTaskID("test-task-001"), mesos.TaskState_TASK_RUNNING),
+			float64(time.Now().Unix()),
+			[]byte{}, // uuid is required on the wire, but may be empty
+		),
+	}
+	pbMsg.Update.SlaveId = &mesos.SlaveID{Value: proto.String("test-slave-001")}
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, pbMsg)
+
+	select {
+	case status := <-sched.statuses:
+		assert.Equal(t, mesos.TaskState_TASK_RUNNING, status.GetState())
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+
+	select {
+	case <-acked:
+		t.Fatalf("Received unexpected StatusUpdateAcknowledgementMessage.")
+	case <-time.After(time.Millisecond * 100):
+	}
 }
 
 func TestSchedulerDriverLostSlaveEvent(t *testing.T) {
@@ -368,7 +846,7 @@ func TestSchedulerDriverLostSlaveEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
+	driver.transition(StateConnected) // mock state
 
 	// Send a event to this SchedulerDriver (via http) to test handlers.	offer := util.NewOffer(
 	pbMsg := &mesos.LostSlaveMessage{
@@ -378,11 +856,121 @@ func TestSchedulerDriverLostSlaveEvent(t *testing.T) {
 	c := testutil.NewMockMesosClient(t, server.PID)
 	c.SendMessage(driver.self, pbMsg)
 
-	<-time.After(time.Millisecond * 1)
 	select {
 	case <-ch:
-	case <-time.After(time.Millisecond * 2):
-		log.Errorf("Tired of waiting for scheduler callback.")
+	case <-time.After(time.Second):
+		t.Fatal("Tired of waiting for scheduler callback.")
+	}
+}
+
+func TestSchedulerDriverLostSlavePurgesOffers(t *testing.T) {
+	launched := make(chan struct{}, 1)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.LaunchTasksMessage") {
+			launched <- struct{}{}
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.offers = make(chan []*mesos.Offer, 1)
+	sched.statuses = make(chan *mesos.TaskStatus, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	lostOfferId := util.NewOfferID("test-offer-001")
+	otherOfferId := util.NewOfferID("test-offer-002")
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{
+			util.NewOffer(lostOfferId, framework.Id, util.NewSlaveID("test-slave-001"), "test-host-001"),
+			util.NewOffer(otherOfferId, framework.Id, util.NewSlaveID("test-slave-002"), "test-host-002"),
+		},
+		Pids: []string{"slave(1)@127.0.0.1:5051", "slave(1)@127.0.0.1:5052"},
+	})
+	select {
+	case <-sched.offers:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for scheduler callback.")
+	}
+	driver.cache.putSlavePid(util.NewSlaveID("test-slave-001"), &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5051"})
+
+	c.SendMessage(driver.self, &mesos.LostSlaveMessage{SlaveId: util.NewSlaveID("test-slave-001")})
+	select {
+	case <-sched.ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for SlaveLost callback.")
+	}
+	assert.False(t, driver.cache.containsOffer(lostOfferId))
+	assert.True(t, driver.cache.containsOffer(otherOfferId))
+	assert.False(t, driver.cache.containsSlavePid(util.NewSlaveID("test-slave-001")))
+
+	task := util.NewTaskInfo(
+		"simple-task",
+		util.NewTaskID("test-task-001"),
+		util.NewSlaveID("test-slave-001"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 400)},
+	)
+	task.Command = util.NewCommandInfo("pwd")
+	stat, err = driver.LaunchTasks([]*mesos.OfferID{lostOfferId}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+
+	select {
+	case status := <-sched.statuses:
+		assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for TASK_LOST.")
+	}
+
+	select {
+	case <-launched:
+		t.Fatalf("Received unexpected LaunchTasksMessage.")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSchedulerDriverExitedExecutorEvent(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.lost = make(chan *lostExecutor, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.ExitedExecutorMessage{
+		SlaveId:     util.NewSlaveID("test-slave-001"),
+		FrameworkId: framework.Id,
+		ExecutorId:  util.NewExecutorID("test-executor-001"),
+		Status:      proto.Int32(3 << 8),
+	})
+
+	select {
+	case lost := <-sched.lost:
+		assert.Equal(t, "test-executor-001", lost.executorId.GetValue())
+		assert.Equal(t, "test-slave-001", lost.slaveId.GetValue())
+		assert.Equal(t, 3<<8, lost.status)
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for ExecutorLost callback.")
 	}
 }
 
@@ -404,7 +992,7 @@ func TestSchedulerDriverFrameworkMessageEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
+	driver.transition(StateConnected) // mock state
 
 	// Send a event to this SchedulerDriver (via http) to test handlers.	offer := util.NewOffer(
 	pbMsg := &mesos.ExecutorToFrameworkMessage{
@@ -425,6 +1013,42 @@ func TestSchedulerDriverFrameworkMessageEvent(t *testing.T) {
 	}
 }
 
+func TestSchedulerDriverFrameworkMessageBinaryData(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := newTestScheduler()
+	sched.messages = make(chan []byte, 1)
+	sched.t = t
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	// not valid UTF-8, must arrive unchanged.
+	data := []byte{0x00, 0xff, 0xfe, 0xc3, 0x28, 0xa0, 0xa1, 0xe2, 0x28, 0xa1, 0xf0, 0x90, 0x28, 0xbc, 0x00}
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.ExecutorToFrameworkMessage{
+		SlaveId:     util.NewSlaveID("test-slave-001"),
+		FrameworkId: framework.Id,
+		ExecutorId:  util.NewExecutorID("test-executor-001"),
+		Data:        data,
+	})
+
+	select {
+	case received := <-sched.messages:
+		assert.Equal(t, data, received)
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for FrameworkMessage callback.")
+	}
+}
+
 func TestSchedulerDriverFrameworkErrorEvent(t *testing.T) {
 	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
 		log.Infoln("MockMaster - rcvd ", req.RequestURI)
@@ -443,8 +1067,7 @@ func TestSchedulerDriverFrameworkErrorEvent(t *testing.T) {
 	stat, err := driver.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
-	driver.setConnected(true) // mock state
-	driver.setStopped(false)
+	driver.transition(StateConnected) // mock state
 
 	// Send an error event to this SchedulerDriver (via http) to test handlers.	offer := util.NewOffer(
 	pbMsg := &mesos.FrameworkErrorMessage{
@@ -461,5 +1084,404 @@ func TestSchedulerDriverFrameworkErrorEvent(t *testing.T) {
 		log.Errorf("Tired of waiting for scheduler callback.")
 	}
 
+	// the driver aborts once the callback returned.
+	select {
+	case <-driver.stopCh:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for the driver to abort.")
+	}
 	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
 }
+
+func TestSchedulerDriverStopFlushesUnregister(t *testing.T) {
+	var unregistered int32
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.Contains(req.RequestURI, "mesos.internal.UnregisterFrameworkMessage") {
+			// a slow master, the message is still being sent when Stop
+			// is called.
+			time.Sleep(200 * time.Millisecond)
+			atomic.StoreInt32(&unregistered, 1)
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, server.Addr, nil)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	driver.transition(StateConnected) // mock state
+
+	stat, err = driver.Stop(false)
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&unregistered), "Stop returned before UnregisterFrameworkMessage was sent.")
+}
+
+// fakeDetector reports the leaders it is told to.
+type fakeDetector struct {
+	lock      sync.Mutex
+	obs       detector.MasterChanged
+	detecting chan struct{} // closed by Detect
+	stopped   bool
+}
+
+func newFakeDetector() *fakeDetector {
+	return &fakeDetector{detecting: make(chan struct{})}
+}
+
+func (d *fakeDetector) Detect(obs detector.MasterChanged) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.obs = obs
+	close(d.detecting)
+	return nil
+}
+
+func (d *fakeDetector) Stop() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = true
+	return nil
+}
+
+func (d *fakeDetector) appoint(info *mesos.MasterInfo) {
+	<-d.detecting
+	d.lock.Lock()
+	obs := d.obs
+	d.lock.Unlock()
+	obs.OnMasterChanged(info)
+}
+
+func (d *fakeDetector) isStopped() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.stopped
+}
+
+// useDetector makes the drivers created until the returned function is
+// called detect their master with d.
+func useDetector(t *testing.T, d detector.Detector) func() {
+	newDetector = func(spec string) (detector.Detector, error) {
+		assert.Equal(t, "zk://127.0.0.1:2181,127.0.0.2:2181/mesos", spec)
+		return d, nil
+	}
+	return func() { newDetector = detector.New }
+}
+
+// recordingMaster is a mock master reporting the names of the messages
+// it receives.
+type recordingMaster struct {
+	server   *testutil.MockMesosHttpServer
+	info     *mesos.MasterInfo
+	received chan string
+}
+
+func newRecordingMaster(t *testing.T, id string) *recordingMaster {
+	m := &recordingMaster{received: make(chan string, 8)}
+	m.server = testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		m.received <- path.Base(req.URL.Path)
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	m.info = util.NewMasterInfo(id, 123456, 1234)
+	m.info.Pid = proto.String(m.server.PID.String())
+	return m
+}
+
+func (m *recordingMaster) await(t *testing.T, expected string) {
+	select {
+	case name := <-m.received:
+		assert.Equal(t, expected, name)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Missing %s message.", expected)
+	}
+}
+
+func newDetectedDriver(t *testing.T, timeout time.Duration) (*MesosSchedulerDriver, *callsScheduler) {
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	sched.On("Disconnected").Return()
+	config := DefaultConfig()
+	config.Master = "zk://127.0.0.1:2181,127.0.0.2:2181/mesos"
+	config.Timeouts.Detect = Duration(timeout)
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	assert.Nil(t, driver.masterPid())
+	return driver, sched
+}
+
+func TestSchedulerDriverDetectsMaster(t *testing.T) {
+	masterA, masterB := newRecordingMaster(t, "master-a"), newRecordingMaster(t, "master-b")
+	defer masterA.server.Close()
+	defer masterB.server.Close()
+	d := newFakeDetector()
+	defer useDetector(t, d)()
+
+	driver, sched := newDetectedDriver(t, 5*time.Second)
+	go d.appoint(masterA.info)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Equal(t, masterA.server.PID, driver.masterPid())
+	masterA.await(t, "mesos.internal.RegisterFrameworkMessage")
+	testutil.NewMockMesosClient(t, masterA.server.PID).SendMessage(driver.self,
+		&mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterA.info})
+	sched.await(t, "Registered")
+
+	// the leader changes, the driver re-registers with the new one.
+	d.appoint(masterB.info)
+	masterB.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	assert.Equal(t, masterB.server.PID, driver.masterPid())
+	assert.False(t, driver.Connected())
+	testutil.NewMockMesosClient(t, masterB.server.PID).SendMessage(driver.self,
+		&mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterB.info})
+	sched.await(t, "Reregistered")
+	assert.True(t, driver.Connected())
+
+	driver.Abort()
+	assert.True(t, d.isStopped())
+}
+
+func TestSchedulerDriverDetectTimeout(t *testing.T) {
+	d := newFakeDetector()
+	defer useDetector(t, d)()
+
+	driver, _ := newDetectedDriver(t, 50*time.Millisecond)
+	// no leader yet.
+	go d.appoint(nil)
+	stat, err := driver.Start()
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	assert.True(t, d.isStopped())
+}
+
+func TestSchedulerDriverDetectInvalidURL(t *testing.T) {
+	config := DefaultConfig()
+	config.Master = "zk://"
+	_, err := NewMesosSchedulerDriverFromConfig(NewMockScheduler(), framework, config)
+	assert.Error(t, err)
+}
+
+func TestSchedulerDriverFileMaster(t *testing.T) {
+	masterA, masterB := newRecordingMaster(t, "master-a"), newRecordingMaster(t, "master-b")
+	defer masterA.server.Close()
+	defer masterB.server.Close()
+	dir, err := ioutil.TempDir("", "mesos-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "master")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(masterA.server.Addr+"\n"), 0644))
+
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	sched.On("Disconnected").Return()
+	config := DefaultConfig()
+	config.Master = "file://" + file
+	config.MasterFilePoll = Duration(20 * time.Millisecond)
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Equal(t, masterA.server.PID, driver.masterPid())
+	masterA.await(t, "mesos.internal.RegisterFrameworkMessage")
+	testutil.NewMockMesosClient(t, masterA.server.PID).SendMessage(driver.self,
+		&mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterA.info})
+	sched.await(t, "Registered")
+
+	// the file names another master, the driver re-registers with it.
+	assert.NoError(t, ioutil.WriteFile(file, []byte(masterB.server.Addr), 0644))
+	masterB.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	assert.Equal(t, masterB.server.PID, driver.masterPid())
+	driver.Abort()
+}
+
+func TestSchedulerDriverFileMasterInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "master")
+
+	_, err = NewMesosSchedulerDriver(NewMockScheduler(), framework, "file://"+file, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to read the master from "+file)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("127.0.0.1"), 0644))
+	_, err = NewMesosSchedulerDriver(NewMockScheduler(), framework, "file://"+file, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid master \"127.0.0.1\" in "+file)
+	}
+}
+
+func TestSchedulerDriverFollowsLeaderHint(t *testing.T) {
+	received := make(chan string, 4) // paths of the messages received by the leader
+	leader := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		received <- req.URL.Path
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer leader.Close()
+	standby := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		http.Redirect(rsp, req, "//"+leader.Addr+"/master/redirect", http.StatusTemporaryRedirect)
+	})
+	defer standby.Close()
+
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	config := DefaultConfig()
+	config.Master = standby.Addr
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	defer driver.Abort()
+
+	path := <-received
+	assert.True(t, strings.HasSuffix(path, "RegisterFrameworkMessage"), path)
+	assert.Equal(t, leader.PID, driver.masterPid())
+
+	info := util.NewMasterInfo("leader", 123456, 1234)
+	info.Pid = proto.String(leader.PID.String())
+	testutil.NewMockMesosClient(t, leader.PID).SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: info})
+	sched.await(t, "Registered")
+	assert.True(t, driver.Connected())
+}
+
+func TestSchedulerDriverLeaderHintLoop(t *testing.T) {
+	redirects := make(chan struct{}, 2*maxLeaderRedirects+2)
+	var a, b *testutil.MockMesosHttpServer
+	a = testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		redirects <- struct{}{}
+		http.Redirect(rsp, req, "//"+b.Addr, http.StatusTemporaryRedirect)
+	})
+	defer a.Close()
+	b = testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		redirects <- struct{}{}
+		http.Redirect(rsp, req, "//"+a.Addr, http.StatusTemporaryRedirect)
+	})
+	defer b.Close()
+
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	config := DefaultConfig()
+	config.Master = a.Addr
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	defer driver.Abort()
+
+	// the first attempt, then one per redirect followed.
+	for i := 0; i <= maxLeaderRedirects; i++ {
+		<-redirects
+	}
+	select {
+	case <-redirects:
+		t.Fatal("followed more than", maxLeaderRedirects, "redirects")
+	case <-time.After(200 * time.Millisecond):
+	}
+	followed := make(chan int)
+	driver.post(func() { followed <- driver.leaderRedirects })
+	assert.Equal(t, maxLeaderRedirects, <-followed)
+	assert.False(t, driver.Connected())
+}
+
+func newMasterListDriver(t *testing.T, master string, cfg MasterListConfig) (*MesosSchedulerDriver, *callsScheduler) {
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	sched.On("Disconnected").Return()
+	config := DefaultConfig()
+	config.Master = master
+	config.MasterList = cfg
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	return driver, sched
+}
+
+func TestSchedulerDriverMasterListRefused(t *testing.T) {
+	// a master refusing connections.
+	refusing := testutil.NewMockMasterHttpServer(t, func(http.ResponseWriter, *http.Request) {})
+	refusing.Close()
+	masterB := newRecordingMaster(t, "master-b")
+	defer masterB.server.Close()
+
+	driver, sched := newMasterListDriver(t, refusing.Addr+","+masterB.server.Addr, MasterListConfig{
+		Attempts:            1,
+		RegistrationTimeout: Duration(time.Minute),
+		Backoff:             Duration(10 * time.Millisecond),
+		MaxBackoff:          Duration(100 * time.Millisecond),
+	})
+	assert.Equal(t, refusing.PID, driver.Master())
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Abort()
+
+	// the framework has an ID already.
+	masterB.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	assert.Equal(t, masterB.server.PID, driver.Master())
+	testutil.NewMockMesosClient(t, masterB.server.PID).SendMessage(driver.self,
+		&mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterB.info})
+	sched.await(t, "Reregistered")
+	assert.True(t, driver.Connected())
+	assert.Equal(t, masterB.server.PID, driver.Master())
+}
+
+func TestSchedulerDriverMasterListTimeout(t *testing.T) {
+	// masters accepting the registrations but never answering them.
+	masterA, masterB := newRecordingMaster(t, "master-a"), newRecordingMaster(t, "master-b")
+	defer masterA.server.Close()
+	defer masterB.server.Close()
+
+	driver, _ := newMasterListDriver(t, masterA.server.Addr+", "+masterB.server.Addr, MasterListConfig{
+		Attempts:            2,
+		RegistrationTimeout: Duration(20 * time.Millisecond),
+		Backoff:             Duration(time.Millisecond),
+		MaxBackoff:          Duration(10 * time.Millisecond),
+	})
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Abort()
+
+	// each master is attempted twice, in turn, looping over the list.
+	masterA.await(t, "mesos.internal.RegisterFrameworkMessage")
+	masterA.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	masterB.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	masterB.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	masterA.await(t, "mesos.internal.ReregisterFrameworkMessage")
+	assert.False(t, driver.Connected())
+}
+
+func TestMasterListBackoff(t *testing.T) {
+	l, err := newMasterList("127.0.0.1:5050,127.0.0.2:5050", MasterListConfig{
+		Attempts:   1,
+		Backoff:    Duration(time.Second),
+		MaxBackoff: Duration(3 * time.Second),
+	})
+	assert.NoError(t, err)
+
+	for _, expected := range []struct {
+		master string
+		delay  time.Duration
+	}{
+		{"master@127.0.0.2:5050", time.Second},
+		{"master@127.0.0.1:5050", 2 * time.Second}, // a pass over the list
+		{"master@127.0.0.2:5050", 2 * time.Second},
+		{"master@127.0.0.1:5050", 3 * time.Second},
+	} {
+		attempt := l.started()
+		next, delay, _, ok := l.failed(attempt)
+		assert.True(t, ok)
+		assert.Equal(t, expected.master, next.String())
+		assert.Equal(t, expected.delay, delay)
+
+		// stale failures are ignored.
+		_, _, _, ok = l.failed(attempt)
+		assert.False(t, ok)
+	}
+
+	_, err = newMasterList("127.0.0.1:5050,127.0.0.2", MasterListConfig{})
+	assert.Error(t, err)
+}
@@ -19,15 +19,37 @@
 package scheduler
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gogo/protobuf/proto"
+	log "github.com/golang/glog"
+	"github.com/mesos/mesos-go/auth"
+	"github.com/mesos/mesos-go/auth/callback"
 	mesos "github.com/mesos/mesos-go/mesosproto"
 	util "github.com/mesos/mesos-go/mesosutil"
 	"github.com/mesos/mesos-go/messenger"
+	"github.com/mesos/mesos-go/testutil"
 	"github.com/mesos/mesos-go/upid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -44,6 +66,41 @@ var (
 	)
 )
 
+// newConnectedDriver returns a driver connected to the master, sending
+// through a MockedMessenger.
+func newConnectedDriver(t *testing.T, sched Scheduler) *MesosSchedulerDriver {
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Send").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	driver.self = &upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"}
+	driver.transition(StateRegistering)
+	driver.transition(StateConnected)
+	return driver
+}
+
+func sendTaskFailure(driver *MesosSchedulerDriver, taskId string, state mesos.TaskState, message string) {
+	status := util.NewTaskStatus(util.NewTaskID(taskId), state)
+	status.Message = proto.String(message)
+	update := util.NewStatusUpdate(framework.Id, status, float64(time.Now().Unix()), []byte("uuid-"+taskId))
+	update.SlaveId = util.NewSlaveID("test-slave-001")
+	update.ExecutorId = util.NewExecutorID("test-executor-001")
+	slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	driver.statusUpdated(slave, &mesos.StatusUpdateMessage{Update: update, Pid: proto.String(slave.String())})
+}
+
+func sendExecutorExited(driver *MesosSchedulerDriver, status int32) {
+	slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	driver.executorLost(slave, &mesos.ExitedExecutorMessage{
+		SlaveId:     util.NewSlaveID("test-slave-001"),
+		FrameworkId: framework.Id,
+		ExecutorId:  util.NewExecutorID("test-executor-001"),
+		Status:      proto.Int32(status),
+	})
+}
+
 func TestSchedulerDriverNew(t *testing.T) {
 	masterAddr := "localhost:5050"
 	mUpid, err := upid.Parse("master@" + masterAddr)
@@ -86,6 +143,30 @@ func TestSchedulerDriverStartOK(t *testing.T) {
 	assert.False(t, driver.Stopped())
 }
 
+func TestSchedulerDriverStartWithWarmupFailure(t *testing.T) {
+	defer func(v bool) { *masterWarmup = v }(*masterWarmup)
+	*masterWarmup = true
+
+	sched := NewMockScheduler()
+
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("Warmup").Return(fmt.Errorf("connection refused"))
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	messenger.AssertNumberOfCalls(t, "Warmup", 1)
+	messenger.AssertNumberOfCalls(t, "Send", 1)
+}
+
 func TestSchedulerDriverStartWithMessengerFailure(t *testing.T) {
 	sched := NewMockScheduler()
 	sched.On("Error").Return()
@@ -126,13 +207,143 @@ func TestSchedulerDriverStartWithRegistrationFailure(t *testing.T) {
 	assert.True(t, driver.Stopped())
 
 	stat, err := driver.Start()
-	assert.Error(t, err)
+	if assert.IsType(t, &SendError{}, err) {
+		assert.Equal(t, "RegisterFrameworkMessage", err.(*SendError).Message)
+		assert.Equal(t, driver.MasterPid, err.(*SendError).To)
+		assert.EqualError(t, err.(*SendError).Err, "messenger failed to send")
+	}
 	assert.True(t, driver.Stopped())
 	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, driver.Status())
 	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, stat)
 
 }
 
+func TestSchedulerDriverFrameworkRole(t *testing.T) {
+	info, err := util.NewFrameworkInfoWithRole("test-user", "test-framework", nil, "analytics")
+	assert.NoError(t, err)
+
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Start").Return(nil)
+	msgr.On("UPID").Return(&upid.UPID{})
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), info, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	defer driver.Stop(false)
+	if assert.NotEmpty(t, msgr.sent) {
+		data, err := proto.Marshal(msgr.sent[0])
+		assert.NoError(t, err)
+		message := new(mesos.RegisterFrameworkMessage)
+		assert.NoError(t, proto.Unmarshal(data, message))
+		assert.Equal(t, "analytics", message.GetFramework().GetRole())
+	}
+
+	// a driver is not created for an invalid role.
+	info.Role = proto.String("analytics/batch")
+	driver, err = NewMesosSchedulerDriver(NewMockScheduler(), info, master, nil)
+	assert.Nil(t, driver)
+	assert.Error(t, err)
+}
+
+func TestCheckMessageSize(t *testing.T) {
+	message := &mesos.RegisterFrameworkMessage{
+		Framework: util.NewFrameworkInfo("test-user", strings.Repeat("x", 2048), nil),
+	}
+	assert.NoError(t, checkMessageSize(message, 0))
+	assert.NoError(t, checkMessageSize(message, 4096))
+	assert.Error(t, checkMessageSize(message, 1024))
+}
+
+func TestSchedulerDriverStartWithOversizedFrameworkInfo(t *testing.T) {
+	defer func(limit int) { *maxMessageSize = limit }(*maxMessageSize)
+	*maxMessageSize = 1024
+
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	info := util.NewFrameworkInfo("test-user", strings.Repeat("x", 2048), nil)
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), info, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	// only warns by default
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	messenger.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func TestSchedulerDriverStartWithOversizedFrameworkInfoStrict(t *testing.T) {
+	defer func(limit int, strict bool) {
+		*maxMessageSize, *strictMessageSize = limit, strict
+	}(*maxMessageSize, *strictMessageSize)
+	*maxMessageSize, *strictMessageSize = 1024, true
+
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	info := util.NewFrameworkInfo("test-user", strings.Repeat("x", 2048), nil)
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), info, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	stat, err := driver.Start()
+	assert.Error(t, err)
+	assert.True(t, driver.Stopped())
+	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, stat)
+	messenger.AssertNotCalled(t, "Start")
+	messenger.AssertNotCalled(t, "Send")
+
+	// nothing was started, the driver may be started again.
+	info.Name = proto.String("test-framework")
+	stat, err = driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	stat, err = driver.Abort()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+}
+
+func TestSchedulerDriverReregisterWithOversizedFrameworkInfoStrict(t *testing.T) {
+	defer func(limit int, strict bool) {
+		*maxMessageSize, *strictMessageSize = limit, strict
+	}(*maxMessageSize, *strictMessageSize)
+	*maxMessageSize, *strictMessageSize = 1024, true
+
+	sched := &reasonScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("Disconnected").Return()
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	driver.self = &upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"}
+	driver.transition(StateRegistering)
+	driver.transition(StateConnected)
+
+	// the FrameworkInfo grew since the driver registered.
+	info := *framework
+	info.Name = proto.String(strings.Repeat("x", 2048))
+	driver.FrameworkInfo = &info
+	driver.OnMasterChanged(util.NewMasterInfo("master", 123456, 1234))
+
+	assert.Empty(t, msgr.sent)
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
+	assert.Equal(t, ShutdownMessageTooLarge, driver.ShutdownReason())
+	assert.Equal(t, []ShutdownReason{ShutdownMessageTooLarge}, sched.reasons)
+}
+
 func TestSchedulerDriverJoinUnstarted(t *testing.T) {
 	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
 	assert.NoError(t, err)
@@ -195,8 +406,7 @@ func TestSchedulerDriverRun(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
 	// close it all.
-	driver.setStatus(mesos.Status_DRIVER_STOPPED)
-	close(driver.stopCh)
+	driver.Stop(false)
 	time.Sleep(time.Millisecond * 1)
 }
 
@@ -241,6 +451,43 @@ func TestSchdulerDriverStopOK(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_STOPPED, driver.Status())
 }
 
+func TestSchedulerDriverStopFailover(t *testing.T) {
+	for _, failover := range []bool{false, true} {
+		messenger := messenger.NewMockedMessenger()
+		messenger.On("Send").Return(nil)
+		messenger.On("Stop").Return(nil)
+
+		driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = messenger
+		driver.transition(StateRegistering)
+		driver.transition(StateConnected)
+
+		joined := make(chan mesos.Status, 1)
+		go func() {
+			stat, _ := driver.Join()
+			joined <- stat
+		}()
+
+		stat, err := driver.Stop(failover)
+		assert.NoError(t, err)
+		assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+		select {
+		case stat := <-joined:
+			assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+		case <-time.After(time.Second):
+			t.Fatalf("Join did not return after Stop(%v).", failover)
+		}
+
+		// only a framework that does not fail over is unregistered.
+		if failover {
+			messenger.AssertNotCalled(t, "Send")
+		} else {
+			messenger.AssertNumberOfCalls(t, "Send", 1)
+		}
+	}
+}
+
 func TestSchdulerDriverAbort(t *testing.T) {
 	// Set expections and return values.
 	messenger := messenger.NewMockedMessenger()
@@ -260,7 +507,7 @@ func TestSchdulerDriverAbort(t *testing.T) {
 		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
 	}()
 	time.Sleep(time.Millisecond * 1)
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 
 	assert.False(t, driver.Stopped())
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
@@ -273,6 +520,245 @@ func TestSchdulerDriverAbort(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
 }
 
+// sentMessenger records the messages sent through it.
+type sentMessenger struct {
+	*messenger.MockedMessenger
+	sent []proto.Message
+	to   []*upid.UPID // of sent
+}
+
+func (m *sentMessenger) Send(ctx context.Context, to *upid.UPID, msg proto.Message) error {
+	m.sent = append(m.sent, msg)
+	m.to = append(m.to, to)
+	return m.MockedMessenger.Send(ctx, to, msg)
+}
+
+func TestSchedulerDriverShutdownDeclinesOffers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		shutdown func(*MesosSchedulerDriver) (mesos.Status, error)
+		last     proto.Message
+	}{
+		{"stop", func(d *MesosSchedulerDriver) (mesos.Status, error) { return d.Stop(false) }, &mesos.UnregisterFrameworkMessage{}},
+		{"stop failover", func(d *MesosSchedulerDriver) (mesos.Status, error) { return d.Stop(true) }, nil},
+		{"abort", func(d *MesosSchedulerDriver) (mesos.Status, error) { return d.Abort() }, &mesos.DeactivateFrameworkMessage{}},
+	} {
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		msgr.On("Stop").Return(nil)
+		driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = msgr
+		driver.transition(StateRegistering)
+		driver.transition(StateConnected)
+
+		slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+		for _, id := range []string{"offer-1", "offer-2"} {
+			driver.cache.putOffer(util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("slave-1"), "localhost"), slavePid)
+		}
+
+		_, err = tc.shutdown(driver)
+		assert.NoError(t, err, tc.name)
+		assert.Empty(t, driver.CachedOffers(), tc.name)
+
+		declined := []string{}
+		for _, msg := range msgr.sent[:2] {
+			if launch, ok := msg.(*mesos.LaunchTasksMessage); assert.True(t, ok, tc.name) {
+				assert.Empty(t, launch.Tasks, tc.name)
+				declined = append(declined, launch.OfferIds[0].GetValue())
+			}
+		}
+		sort.Strings(declined)
+		assert.Equal(t, []string{"offer-1", "offer-2"}, declined, tc.name)
+		if tc.last == nil {
+			assert.Len(t, msgr.sent, 2, tc.name)
+		} else if assert.Len(t, msgr.sent, 3, tc.name) {
+			assert.IsType(t, tc.last, msgr.sent[2], tc.name)
+		}
+	}
+
+	// a failed decline does not prevent stopping.
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(fmt.Errorf("connection refused")).Once()
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	driver.transition(StateRegistering)
+	driver.transition(StateConnected)
+	driver.cache.putOffer(util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost"),
+		&upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	stat, err := driver.Stop(false)
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+	assert.Len(t, msgr.sent, 2)
+	assert.Empty(t, driver.CachedOffers())
+}
+
+func TestSchedulerDriverAbortDeactivates(t *testing.T) {
+	for _, connected := range []bool{true, false} {
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		msgr.On("Stop").Return(nil)
+
+		driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = msgr
+		driver.transition(StateRegistering)
+		if connected {
+			driver.transition(StateConnected)
+		}
+
+		joined := make(chan mesos.Status, 1)
+		go func() {
+			stat, _ := driver.Join()
+			joined <- stat
+		}()
+
+		stat, err := driver.Abort()
+		assert.NoError(t, err)
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+		select {
+		case stat := <-joined:
+			assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+		case <-time.After(time.Second):
+			t.Fatalf("Join did not return after Abort, connected %v.", connected)
+		}
+
+		// the framework is deactivated, not unregistered.
+		if connected {
+			if assert.Equal(t, 1, len(msgr.sent)) {
+				deactivate, ok := msgr.sent[0].(*mesos.DeactivateFrameworkMessage)
+				assert.True(t, ok, "sent %T", msgr.sent[0])
+				assert.Equal(t, framework.Id, deactivate.GetFrameworkId())
+			}
+		} else {
+			assert.Empty(t, msgr.sent)
+		}
+
+		// aborted is final.
+		stat, err = driver.Start()
+		assert.Error(t, err)
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+		stat, _ = driver.Join()
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	}
+}
+
+func TestSchedulerDriverStopReasonStopped(t *testing.T) {
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	done := make(chan mesos.Status, 1)
+	go func() {
+		stat, _ := driver.Run()
+		done <- stat
+	}()
+	time.Sleep(time.Millisecond * 1)
+
+	driver.Stop(false)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, <-done)
+	stat, err := driver.StopReason()
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+	assert.NoError(t, err)
+}
+
+func TestSchedulerDriverStopReasonMasterError(t *testing.T) {
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	sched := NewMockScheduler()
+	sched.On("Error").Return()
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	done := make(chan mesos.Status, 1)
+	go func() {
+		stat, _ := driver.Run()
+		done <- stat
+	}()
+	time.Sleep(time.Millisecond * 1)
+	driver.transition(StateConnected) // simulated
+
+	driver.frameworkErrorRcvd(driver.MasterPid, &mesos.FrameworkErrorMessage{
+		Message: proto.String("Framework has been removed"),
+	})
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, <-done)
+	stat, err := driver.StopReason()
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Framework has been removed")
+	sched.AssertNumberOfCalls(t, "Error", 1)
+}
+
+// errorScheduler records the driver status seen by the Error callback.
+type errorScheduler struct {
+	*MockScheduler
+	errors   []string
+	statuses []mesos.Status
+}
+
+func (sched *errorScheduler) Error(dr SchedulerDriver, err string) {
+	sched.errors = append(sched.errors, err)
+	sched.statuses = append(sched.statuses, dr.(*MesosSchedulerDriver).Status())
+}
+
+func TestSchedulerDriverErrorAbortsAfterCallback(t *testing.T) {
+	for _, connected := range []bool{true, false} {
+		messenger := messenger.NewMockedMessenger()
+		messenger.On("Start").Return(nil)
+		messenger.On("UPID").Return(&upid.UPID{})
+		messenger.On("Send").Return(nil)
+		messenger.On("Stop").Return(nil)
+
+		sched := &errorScheduler{MockScheduler: NewMockScheduler()}
+		driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+		driver.messenger = messenger
+		assert.NoError(t, err)
+
+		done := make(chan mesos.Status, 1)
+		go func() {
+			stat, _ := driver.Run()
+			done <- stat
+		}()
+		time.Sleep(time.Millisecond * 1)
+		// a framework rejected on registration is told so before it is connected.
+		if connected {
+			driver.transition(StateConnected)
+		}
+
+		driver.frameworkErrorRcvd(driver.MasterPid, &mesos.FrameworkErrorMessage{
+			Message: proto.String("Framework failed over"),
+		})
+		select {
+		case stat := <-done:
+			assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+		case <-time.After(time.Second):
+			t.Fatalf("Join did not return after the driver aborted.")
+		}
+		assert.Equal(t, []string{"Framework failed over"}, sched.errors)
+		assert.Equal(t, []mesos.Status{mesos.Status_DRIVER_RUNNING}, sched.statuses)
+
+		// later errors are ignored.
+		driver.frameworkErrorRcvd(driver.MasterPid, &mesos.FrameworkErrorMessage{
+			Message: proto.String("Framework failed over"),
+		})
+		assert.Equal(t, 1, len(sched.errors))
+	}
+}
+
 func TestSchdulerDriverLunchTasksUnstarted(t *testing.T) {
 	sched := NewMockScheduler()
 	sched.On("Error").Return()
@@ -314,7 +800,7 @@ func TestSchdulerDriverLaunchTasksWithError(t *testing.T) {
 		driver.Run()
 	}()
 	time.Sleep(time.Millisecond * 1)
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.False(t, driver.Stopped())
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
@@ -345,8 +831,7 @@ func TestSchdulerDriverLaunchTasksWithError(t *testing.T) {
 		util.NewSlaveID("test-slave-001"),
 		[]*mesos.Resource{util.NewScalarResource("mem", 400)},
 	)
-	task.Command = util.NewCommandInfo("pwd")
-	task.Executor = util.NewExecutorInfo(util.NewExecutorID("test-exec"), task.Command)
+	task.Executor = util.NewExecutorInfo(util.NewExecutorID("test-exec"), util.NewCommandInfo("pwd"))
 	tasks := []*mesos.TaskInfo{task}
 
 	stat, err := driver.LaunchTasks(
@@ -354,7 +839,7 @@ func TestSchdulerDriverLaunchTasksWithError(t *testing.T) {
 		tasks,
 		&mesos.Filters{},
 	)
-	assert.Error(t, err)
+	assert.Equal(t, &SendError{Message: "LaunchTasksMessage", To: driver.MasterPid, Err: fmt.Errorf("Unable to send message")}, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 
 }
@@ -375,7 +860,7 @@ func TestSchdulerDriverLaunchTasks(t *testing.T) {
 		driver.Run()
 	}()
 	time.Sleep(time.Millisecond * 1)
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.False(t, driver.Stopped())
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
@@ -388,8 +873,10 @@ func TestSchdulerDriverLaunchTasks(t *testing.T) {
 	task.Command = util.NewCommandInfo("pwd")
 	tasks := []*mesos.TaskInfo{task}
 
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
 	stat, err := driver.LaunchTasks(
-		[]*mesos.OfferID{&mesos.OfferID{}},
+		[]*mesos.OfferID{offer.Id},
 		tasks,
 		&mesos.Filters{},
 	)
@@ -397,6 +884,433 @@ func TestSchdulerDriverLaunchTasks(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 }
 
+func TestSchedulerDriverLaunchTasksUserOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		user    string
+		ok      bool
+	}{
+		{"unset list", nil, "nobody", true},
+		{"allowed", []string{"nobody"}, "nobody", true},
+		{"framework user", []string{}, framework.GetUser(), true},
+		{"no override", []string{}, "", true},
+		{"disallowed", []string{"nobody"}, "root", false},
+	} {
+		sched := NewMockScheduler()
+		sched.On("StatusUpdate").Return()
+		driver := newConnectedDriver(t, sched)
+		driver.AllowedTaskUsers = tc.allowed
+
+		task := util.NewTaskInfo(
+			"simple-task",
+			util.NewTaskID("simple-task-1"),
+			util.NewSlaveID("slave-1"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 400)},
+		)
+		task.Command = util.NewCommandInfo("pwd")
+		if tc.user != "" {
+			util.SetTaskUser(task, tc.user)
+		}
+
+		offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+		driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+		stat, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+		waitEvents(driver)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat, tc.name)
+		if tc.ok {
+			assert.NoError(t, err, tc.name)
+			sched.AssertNumberOfCalls(t, "StatusUpdate", 0)
+		} else {
+			assert.Error(t, err, tc.name)
+			assert.Contains(t, err.Error(), `may not run as user "root"`, tc.name)
+			sched.AssertNumberOfCalls(t, "StatusUpdate", 1)
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTasksMultipleOffers(t *testing.T) {
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	newOffer := func(id, slave string) *mesos.Offer {
+		return util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID(slave), "localhost")
+	}
+	newTask := func(id, slave string) *mesos.TaskInfo {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID(slave),
+			[]*mesos.Resource{util.NewScalarResource("mem", 400)})
+		task.Command = util.NewCommandInfo("pwd")
+		return task
+	}
+
+	for _, tc := range []struct {
+		name   string
+		offers []*mesos.Offer
+		ok     bool
+	}{
+		{"same slave", []*mesos.Offer{newOffer("offer-1", "slave-1"), newOffer("offer-2", "slave-1")}, true},
+		{"different slaves", []*mesos.Offer{newOffer("offer-1", "slave-1"), newOffer("offer-2", "slave-2")}, false},
+	} {
+		sched := NewMockScheduler()
+		sched.On("StatusUpdate").Return()
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		driver.messenger = msgr
+
+		offerIds := []*mesos.OfferID{}
+		for _, offer := range tc.offers {
+			driver.cache.putOffer(offer, slavePid)
+			offerIds = append(offerIds, offer.Id)
+		}
+		tasks := []*mesos.TaskInfo{newTask("task-1", "slave-1"), newTask("task-2", "slave-1")}
+
+		stat, err := driver.LaunchTasks(offerIds, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat, tc.name)
+		if tc.ok {
+			assert.NoError(t, err, tc.name)
+			if assert.Equal(t, 1, len(msgr.sent), tc.name) {
+				launch := msgr.sent[0].(*mesos.LaunchTasksMessage)
+				assert.Equal(t, offerIds, launch.OfferIds, tc.name)
+				assert.Equal(t, 2, len(launch.Tasks), tc.name)
+			}
+			assert.Equal(t, 0, driver.cache.savedOffers.len(), tc.name)
+			sched.AssertNumberOfCalls(t, "StatusUpdate", 0)
+		} else {
+			assert.Error(t, err, tc.name)
+			assert.Contains(t, err.Error(), "different slaves", tc.name)
+			assert.Empty(t, msgr.sent, tc.name)
+			// the offers are still usable.
+			assert.Equal(t, 2, driver.cache.savedOffers.len(), tc.name)
+			sched.AssertNumberOfCalls(t, "StatusUpdate", 2)
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTask(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	task := util.NewTaskInfo("task-1", util.NewTaskID("task-1"), util.NewSlaveID("slave-1"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 400)})
+	task.Command = util.NewCommandInfo("pwd")
+
+	stat, err := driver.LaunchTask(offer.Id, []*mesos.TaskInfo{task}, &mesos.Filters{})
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	if assert.Equal(t, 1, len(msgr.sent)) {
+		launch := msgr.sent[0].(*mesos.LaunchTasksMessage)
+		assert.Equal(t, []*mesos.OfferID{offer.Id}, launch.OfferIds)
+		assert.Equal(t, []*mesos.TaskInfo{task}, launch.Tasks)
+	}
+}
+
+func TestSchedulerDriverLaunchTasksOnOffers(t *testing.T) {
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	for _, slaves := range [][]string{{"slave-1", "slave-1"}, {"slave-1", "slave-2"}} {
+		sched := NewMockScheduler()
+		sched.On("StatusUpdate").Return()
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		driver.messenger = msgr
+
+		offerIds := []*mesos.OfferID{}
+		for i, slave := range slaves {
+			offer := util.NewOffer(util.NewOfferID([]string{"offer-1", "offer-2"}[i]), framework.Id, util.NewSlaveID(slave), "localhost")
+			driver.cache.putOffer(offer, slavePid)
+			offerIds = append(offerIds, offer.Id)
+		}
+		task := util.NewTaskInfo("task-1", util.NewTaskID("task-1"), util.NewSlaveID("slave-1"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 400)})
+		task.Command = util.NewCommandInfo("pwd")
+
+		stat, err := driver.LaunchTasksOnOffers(offerIds, []*mesos.TaskInfo{task}, &mesos.Filters{})
+		waitEvents(driver)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+		if slaves[0] != slaves[1] {
+			assert.Error(t, err)
+			assert.Empty(t, msgr.sent)
+			sched.AssertNumberOfCalls(t, "StatusUpdate", 1)
+			continue
+		}
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(msgr.sent)) {
+			launch := msgr.sent[0].(*mesos.LaunchTasksMessage)
+			assert.Equal(t, offerIds, launch.OfferIds)
+			assert.Equal(t, []*mesos.TaskInfo{task}, launch.Tasks)
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTasksLostLocally(t *testing.T) {
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	for _, tc := range []struct {
+		name    string
+		prepare func(*MesosSchedulerDriver, *mesos.Offer)
+		why     string
+	}{
+		{"disconnected", func(driver *MesosSchedulerDriver, offer *mesos.Offer) {
+			driver.cache.putOffer(offer, slavePid)
+			driver.transition(StateDisconnected)
+		}, "Master Disconnected"},
+		{"unknown offer", func(*MesosSchedulerDriver, *mesos.Offer) {}, "Offer offer-1 is unknown"},
+		{"rescinded offer", func(driver *MesosSchedulerDriver, offer *mesos.Offer) {
+			driver.cache.putOffer(offer, slavePid)
+			driver.cache.rescindOffer(offer.Id)
+		}, "Offer offer-1 was rescinded"},
+	} {
+		sched := newTestScheduler()
+		sched.t = t
+		sched.statuses = make(chan *mesos.TaskStatus, 3)
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		driver.messenger = msgr
+
+		offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+		tc.prepare(driver, offer)
+		tasks := []*mesos.TaskInfo{}
+		for _, id := range []string{"task-1", "task-2", "task-3"} {
+			task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("slave-1"),
+				[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+			task.Command = util.NewCommandInfo("pwd")
+			tasks = append(tasks, task)
+		}
+
+		stat, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		assert.Error(t, err, tc.name)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat, tc.name)
+		assert.Empty(t, msgr.sent, tc.name)
+
+		close(sched.statuses)
+		lost := []string{}
+		for status := range sched.statuses {
+			assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState(), tc.name)
+			assert.Equal(t, tc.why, status.GetMessage(), tc.name)
+			lost = append(lost, status.TaskId.GetValue())
+		}
+		assert.Equal(t, []string{"task-1", "task-2", "task-3"}, lost, tc.name)
+	}
+}
+
+func TestSchedulerDriverCachedOffers(t *testing.T) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("ResourceOffers").Return()
+	sched.On("OfferRescinded").Return()
+	sched.On("SlaveLost").Return()
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	offer := func(id, slaveId string) *mesos.Offer {
+		return util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID(slaveId), "localhost")
+	}
+	driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{offer("offer-1", "slave-1"), offer("offer-2", "slave-1"), offer("offer-3", "slave-2")},
+		Pids:   []string{"slave(1)@127.0.0.1:5052", "slave(1)@127.0.0.1:5052", "slave(2)@127.0.0.2:5052"},
+	})
+	cachedIds := func() []string {
+		ids := []string{}
+		for id, offer := range driver.CachedOffers() {
+			assert.Equal(t, id, offer.Id.GetValue())
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	assert.Equal(t, []string{"offer-1", "offer-2", "offer-3"}, cachedIds())
+
+	// the snapshot is a copy.
+	driver.CachedOffers()["offer-1"].Hostname = proto.String("changed")
+	assert.Equal(t, "localhost", driver.CachedOffers()["offer-1"].GetHostname())
+	// and so is a single offer.
+	if cached := driver.CachedOffer(util.NewOfferID("offer-3")); assert.NotNil(t, cached) {
+		assert.Equal(t, "slave-2", cached.SlaveId.GetValue())
+		cached.Hostname = proto.String("changed")
+		assert.Equal(t, "localhost", driver.CachedOffer(util.NewOfferID("offer-3")).GetHostname())
+	}
+	assert.Nil(t, driver.CachedOffer(util.NewOfferID("offer-9")))
+
+	launch := func(offerIds ...string) error {
+		ids := []*mesos.OfferID{}
+		for _, id := range offerIds {
+			ids = append(ids, util.NewOfferID(id))
+		}
+		task := util.NewTaskInfo("task-1", util.NewTaskID("task-1"), util.NewSlaveID("slave-1"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+		task.Command = util.NewCommandInfo("pwd")
+		_, err := driver.LaunchTasks(ids, []*mesos.TaskInfo{task}, &mesos.Filters{})
+		waitEvents(driver)
+		return err
+	}
+	assertLost := func(why string) {
+		if assert.Len(t, sched.statuses, 1) {
+			assert.Equal(t, mesos.TaskState_TASK_LOST, sched.statuses[0].GetState())
+			assert.Contains(t, sched.statuses[0].GetMessage(), why)
+		}
+		assert.Empty(t, msgr.sent)
+		sched.statuses = nil
+	}
+
+	// launch after rescind.
+	driver.resourceOfferRescinded(driver.MasterPid, &mesos.RescindResourceOfferMessage{OfferId: util.NewOfferID("offer-1")})
+	assert.Equal(t, []string{"offer-2", "offer-3"}, cachedIds())
+	assert.Error(t, launch("offer-1"))
+	assertLost("Offer offer-1 was rescinded")
+
+	// a known offer along with an unknown one.
+	assert.Error(t, launch("offer-2", "offer-9"))
+	assertLost("Offer offer-9 is unknown")
+	assert.Equal(t, []string{"offer-2", "offer-3"}, cachedIds())
+
+	// offers of different slaves.
+	assert.Error(t, launch("offer-2", "offer-3"))
+	assertLost("slave")
+	assert.Equal(t, []string{"offer-2", "offer-3"}, cachedIds())
+
+	// the offers of a lost slave are dropped.
+	driver.slaveLost(driver.MasterPid, &mesos.LostSlaveMessage{SlaveId: util.NewSlaveID("slave-2")})
+	assert.Equal(t, []string{"offer-2"}, cachedIds())
+
+	// a used offer is dropped.
+	assert.NoError(t, launch("offer-2"))
+	assert.Empty(t, sched.statuses)
+	assert.Len(t, msgr.sent, 1)
+	assert.Empty(t, cachedIds())
+}
+
+func TestSchedulerDriverCachedOfferExpired(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	clock := newFakeClock()
+	clock.use(driver)
+	driver.cache.offerTTL = time.Minute
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	assert.NotNil(t, driver.CachedOffer(offer.Id))
+
+	// before the driver gets to rescind it.
+	clock.advance(2 * time.Minute)
+	assert.Nil(t, driver.CachedOffer(offer.Id))
+}
+
+func TestSchedulerDriverLaunchTasksSendFailureLosesTasksOnce(t *testing.T) {
+	sched := newTestScheduler()
+	sched.t = t
+	sched.statuses = make(chan *mesos.TaskStatus, 4)
+	driver := newConnectedDriver(t, sched)
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Send").Return(fmt.Errorf("connection refused"))
+	driver.messenger = msgr
+
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	valid := util.NewTaskInfo("valid", util.NewTaskID("valid"), util.NewSlaveID("slave-1"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+	valid.Command = util.NewCommandInfo("pwd")
+	invalid := util.NewTaskInfo("invalid", util.NewTaskID("invalid"), util.NewSlaveID("slave-2"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+	invalid.Command = util.NewCommandInfo("pwd")
+
+	_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{valid, invalid}, &mesos.Filters{})
+	waitEvents(driver)
+	assert.EqualError(t, err, "Failed to send LaunchTasksMessage to "+driver.MasterPid.String()+": connection refused")
+
+	close(sched.statuses)
+	lost := map[string]int{}
+	for status := range sched.statuses {
+		assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+		lost[status.TaskId.GetValue()]++
+	}
+	assert.Equal(t, map[string]int{"valid": 1, "invalid": 1}, lost)
+}
+
+func TestSchedulerDriverLaunchTasksValidation(t *testing.T) {
+	sched := newTestScheduler()
+	sched.t = t
+	sched.statuses = make(chan *mesos.TaskStatus, 10)
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	launch := func(offerId string, tasks ...*mesos.TaskInfo) []string {
+		offer := util.NewOffer(util.NewOfferID(offerId), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+		driver.cache.putOffer(offer, slavePid)
+		msgr.sent = nil
+		stat, _ := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+		if !assert.Equal(t, 1, len(msgr.sent)) {
+			return nil
+		}
+		launched := []string{}
+		for _, task := range msgr.sent[0].(*mesos.LaunchTasksMessage).Tasks {
+			launched = append(launched, task.TaskId.GetValue())
+		}
+		return launched
+	}
+	newTask := func(id, slave string) *mesos.TaskInfo {
+		return util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID(slave),
+			[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+	}
+	commandTask := func(id, slave string) *mesos.TaskInfo {
+		task := newTask(id, slave)
+		task.Command = util.NewCommandInfo("pwd")
+		return task
+	}
+	executorTask := func(id, executor, command string) *mesos.TaskInfo {
+		task := newTask(id, "slave-1")
+		task.Executor = util.NewExecutorInfo(util.NewExecutorID(executor), util.NewCommandInfo(command))
+		return task
+	}
+	both := executorTask("both", "executor-1", "./executor")
+	both.Command = util.NewCommandInfo("pwd")
+
+	launched := launch("offer-1",
+		commandTask("command", "slave-1"),
+		both,
+		commandTask("other-slave", "slave-2"),
+		executorTask("executor", "executor-1", "./executor"),
+		executorTask("same-executor", "executor-1", "./executor"),
+		executorTask("changed-executor", "executor-1", "./other-executor"),
+	)
+	assert.Equal(t, []string{"command", "executor", "same-executor"}, launched)
+
+	// the executor launched is remembered until it is lost.
+	launched = launch("offer-2",
+		executorTask("changed-later", "executor-1", "./other-executor"),
+		executorTask("same-later", "executor-1", "./executor"),
+	)
+	assert.Equal(t, []string{"same-later"}, launched)
+	driver.executorLost(slavePid, &mesos.ExitedExecutorMessage{
+		ExecutorId:  util.NewExecutorID("executor-1"),
+		FrameworkId: framework.Id,
+		SlaveId:     util.NewSlaveID("slave-1"),
+		Status:      proto.Int32(0),
+	})
+	launched = launch("offer-3", executorTask("changed-after-loss", "executor-1", "./other-executor"))
+	assert.Equal(t, []string{"changed-after-loss"}, launched)
+
+	close(sched.statuses)
+	lost := map[string]string{}
+	for status := range sched.statuses {
+		assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+		lost[status.TaskId.GetValue()] = status.GetMessage()
+	}
+	assert.Equal(t, 4, len(lost))
+	assert.Contains(t, lost["both"], "either CommandInfo or ExecutorInfo")
+	assert.Contains(t, lost["other-slave"], "offers are from slave slave-1")
+	assert.Contains(t, lost["changed-executor"], "different from the one the executor was launched with")
+	assert.Contains(t, lost["changed-later"], "different from the one the executor was launched with")
+}
+
 func TestSchdulerDriverKillTask(t *testing.T) {
 	messenger := messenger.NewMockedMessenger()
 	messenger.On("Start").Return(nil)
@@ -413,7 +1327,7 @@ func TestSchdulerDriverKillTask(t *testing.T) {
 		driver.Run()
 	}()
 	time.Sleep(time.Millisecond * 1)
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.False(t, driver.Stopped())
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
@@ -422,20 +1336,95 @@ func TestSchdulerDriverKillTask(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 }
 
-func TestSchdulerDriverRequestResources(t *testing.T) {
-	messenger := messenger.NewMockedMessenger()
-	messenger.On("Start").Return(nil)
-	messenger.On("UPID").Return(&upid.UPID{})
-	messenger.On("Send").Return(nil)
-	messenger.On("Stop").Return(nil)
+func TestSchedulerDriverKillTaskDelivery(t *testing.T) {
+	newDriver := func(sendErr error) (*MesosSchedulerDriver, *sentMessenger) {
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(sendErr)
+		driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = msgr
+		driver.transition(StateRegistering)
+		return driver, msgr
+	}
 
-	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
-	driver.messenger = messenger
+	// disconnected, the kill is not sent.
+	driver, msgr := newDriver(nil)
+	stat, err := driver.KillTask(util.NewTaskID("test-task-1"))
+	assert.Equal(t, ErrNotConnected, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Empty(t, msgr.sent)
+
+	// connected, the kill is sent.
+	driver.transition(StateConnected)
+	stat, err = driver.KillTask(util.NewTaskID("test-task-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	if assert.Len(t, msgr.sent, 1) {
+		kill := msgr.sent[0].(*mesos.KillTaskMessage)
+		assert.Equal(t, "test-task-1", kill.GetTaskId().GetValue())
+	}
+
+	// the kill could not be queued.
+	driver, msgr = newDriver(messenger.ErrQueueFull)
+	driver.transition(StateConnected)
+	stat, err = driver.KillTask(util.NewTaskID("test-task-1"))
+	assert.Equal(t, &SendError{Message: "KillTaskMessage", To: driver.MasterPid, Err: messenger.ErrQueueFull}, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Len(t, msgr.sent, 1)
+}
+
+func TestSchedulerDriverKillTasks(t *testing.T) {
+	driver, _, msgr := newAckDriver(t, false)
+	ids := []*mesos.TaskID{util.NewTaskID("task-1"), util.NewTaskID("task-2"), util.NewTaskID("task-3")}
+
+	stat, err := driver.KillTasks(ids)
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	killed := []string{}
+	for _, msg := range msgr.sent {
+		killed = append(killed, msg.(*mesos.KillTaskMessage).GetTaskId().GetValue())
+	}
+	assert.Equal(t, []string{"task-1", "task-2", "task-3"}, killed)
+
+	// the kills that fail do not keep the others from being sent.
+	failing := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	failing.On("Send").Return(messenger.ErrQueueFull).Once()
+	failing.On("Send").Return(nil)
+	failing.On("Stop").Return(nil)
+	driver.messenger = failing
+	stat, err = driver.KillTasks(ids)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Equal(t, &KillTasksError{Errors: map[string]error{
+		"task-1": &SendError{Message: "KillTaskMessage", To: driver.MasterPid, Err: messenger.ErrQueueFull},
+	}}, err)
+	assert.Len(t, failing.sent, 3)
+
+	driver.transition(StateDisconnected)
+	stat, err = driver.KillTasks(ids[:2])
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.EqualError(t, err, "Failed to kill 2 tasks: task-1: Not connected to master; task-2: Not connected to master")
+	assert.Len(t, failing.sent, 3)
+
+	driver.Abort()
+	stat, err = driver.KillTasks(ids)
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	assert.Error(t, err)
+}
+
+func TestSchdulerDriverRequestResources(t *testing.T) {
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	driver.messenger = messenger
 	assert.NoError(t, err)
 	assert.True(t, driver.Stopped())
 
 	driver.Start()
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
 	stat, err := driver.RequestResources(
@@ -469,7 +1458,7 @@ func TestSchdulerDriverReviveOffers(t *testing.T) {
 	assert.True(t, driver.Stopped())
 
 	driver.Start()
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
 	stat, err := driver.ReviveOffers()
@@ -477,6 +1466,124 @@ func TestSchdulerDriverReviveOffers(t *testing.T) {
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 }
 
+func TestSchdulerDriverSuppressOffers(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("ResourceOffers").Return()
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	offers := func(ids ...string) *mesos.ResourceOffersMessage {
+		msg := &mesos.ResourceOffersMessage{}
+		for _, id := range ids {
+			msg.Offers = append(msg.Offers, util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("test-slave-001"), "localhost"))
+			msg.Pids = append(msg.Pids, "slave(1)@127.0.0.1:5052")
+		}
+		return msg
+	}
+
+	stat, err := driver.SuppressOffers()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	assert.Empty(t, msgr.sent)
+
+	// the offers are declined for long, the scheduler does not see them.
+	driver.resourcesOffered(driver.MasterPid, offers("offer-1", "offer-2"))
+	sched.AssertNotCalled(t, "ResourceOffers")
+	assert.Equal(t, 0, driver.cache.savedOffers.len())
+	if assert.Equal(t, 2, len(msgr.sent)) {
+		for i, id := range []string{"offer-1", "offer-2"} {
+			decline := msgr.sent[i].(*mesos.LaunchTasksMessage)
+			assert.Equal(t, []*mesos.OfferID{util.NewOfferID(id)}, decline.OfferIds)
+			assert.Empty(t, decline.Tasks)
+			assert.Equal(t, float64(suppressRefuseSeconds), decline.Filters.GetRefuseSeconds())
+			assert.Equal(t, framework.Id, decline.FrameworkId)
+		}
+	}
+
+	// reviving clears the filters at the master and delivers offers again.
+	msgr.sent = nil
+	stat, err = driver.ReviveOffers()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	if assert.Equal(t, 1, len(msgr.sent)) {
+		assert.Equal(t, framework.Id, msgr.sent[0].(*mesos.ReviveOffersMessage).FrameworkId)
+	}
+	driver.resourcesOffered(driver.MasterPid, offers("offer-3"))
+	sched.AssertNumberOfCalls(t, "ResourceOffers", 1)
+	assert.Equal(t, 1, len(msgr.sent))
+}
+
+func TestSchdulerDriverReviveOffersFailed(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("Disconnected").Return()
+	sched.On("Reregistered").Return()
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	_, err := driver.SuppressOffers()
+	assert.NoError(t, err)
+	driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")},
+		Pids:   []string{"slave(1)@127.0.0.1:5052"},
+	})
+	assert.Equal(t, 1, len(msgr.sent))
+
+	// the filters are cleared once the driver re-registers.
+	msgr.MockedMessenger = messenger.NewMockedMessenger()
+	msgr.On("Send").Return(fmt.Errorf("connection refused")).Once()
+	msgr.On("Send").Return(nil)
+	_, err = driver.ReviveOffers()
+	assert.Error(t, err)
+	assert.False(t, driver.suppressed)
+	assert.True(t, driver.suppressFilters)
+
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(masterUpid)
+	driver.masterLost(fmt.Errorf("connection refused"))
+	driver.OnMasterChanged(masterInfo)
+	msgr.sent = nil
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	if assert.Equal(t, 1, len(msgr.sent)) {
+		assert.Equal(t, framework.Id, msgr.sent[0].(*mesos.ReviveOffersMessage).FrameworkId)
+	}
+	assert.False(t, driver.suppressFilters)
+
+	// and are not revived twice.
+	driver.masterLost(fmt.Errorf("connection refused"))
+	driver.OnMasterChanged(masterInfo)
+	msgr.sent = nil
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	assert.Empty(t, msgr.sent)
+}
+
+func TestSchdulerDriverSuppressOffersDisconnected(t *testing.T) {
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	driver.messenger = messenger
+	assert.NoError(t, err)
+
+	stat, err := driver.SuppressOffers()
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, stat)
+
+	driver.Start()
+	assert.False(t, driver.Connected())
+
+	stat, err = driver.SuppressOffers()
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	messenger.AssertNumberOfCalls(t, "Send", 1) // RegisterFrameworkMessage only
+}
+
 func TestSchdulerDriverSendFrameworkMessage(t *testing.T) {
 	messenger := messenger.NewMockedMessenger()
 	messenger.On("Start").Return(nil)
@@ -490,7 +1597,7 @@ func TestSchdulerDriverSendFrameworkMessage(t *testing.T) {
 	assert.True(t, driver.Stopped())
 
 	driver.Start()
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
 	stat, err := driver.SendFrameworkMessage(
@@ -515,7 +1622,7 @@ func TestSchdulerDriverReconcileTasks(t *testing.T) {
 	assert.True(t, driver.Stopped())
 
 	driver.Start()
-	driver.setConnected(true) // simulated
+	driver.transition(StateConnected) // simulated
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
 
 	stat, err := driver.ReconcileTasks(
@@ -526,3 +1633,3749 @@ func TestSchdulerDriverReconcileTasks(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
 }
+
+func TestMasterUPID(t *testing.T) {
+	pid, err := masterUPID(&mesos.MasterInfo{Pid: proto.String("master@127.0.0.1:5050")})
+	assert.NoError(t, err)
+	assert.Equal(t, "master@127.0.0.1:5050", pid.String())
+
+	// 16777343 is 127.0.0.1 in network byte order.
+	pid, err = masterUPID(util.NewMasterInfo("master-1", 16777343, 5051))
+	assert.NoError(t, err)
+	assert.Equal(t, "master@127.0.0.1:5051", pid.String())
+
+	pid, err = masterUPID(&mesos.MasterInfo{Hostname: proto.String("master-1"), Port: proto.Uint32(5052)})
+	assert.NoError(t, err)
+	assert.Equal(t, "master@master-1:5052", pid.String())
+
+	_, err = masterUPID(&mesos.MasterInfo{Id: proto.String("master-1")})
+	assert.Error(t, err)
+	_, err = masterUPID(&mesos.MasterInfo{Pid: proto.String("master-1")})
+	assert.Error(t, err)
+}
+
+func TestSchedulerDriverFrameworkRegisteredWithMasterPid(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("Registered").Return()
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	assert.NoError(t, err)
+	driver.transition(StateRegistering)
+
+	driver.frameworkRegistered(driver.MasterPid, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: framework.Id,
+		MasterInfo:  &mesos.MasterInfo{Pid: proto.String("master@127.0.0.2:5050")},
+	})
+	assert.True(t, driver.Connected())
+	assert.Equal(t, "master@127.0.0.2:5050", driver.MasterPid.String())
+	sched.AssertNumberOfCalls(t, "Registered", 1)
+}
+
+// offersScheduler only implements ResourceOffers, see SchedulerBase.
+type offersScheduler struct {
+	SchedulerBase
+	offers []*mesos.Offer
+}
+
+func (sched *offersScheduler) ResourceOffers(_ SchedulerDriver, offers []*mesos.Offer) {
+	sched.offers = append(sched.offers, offers...)
+}
+
+func TestSchedulerBase(t *testing.T) {
+	sched := &offersScheduler{}
+	driver := newConnectedDriver(t, sched)
+
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+	driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{offer},
+		Pids:   []string{"slave(1)@127.0.0.1:5052"},
+	})
+	assert.Equal(t, []*mesos.Offer{offer}, sched.offers)
+
+	// the other callbacks do nothing.
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FAILED, "")
+	driver.slaveLost(driver.MasterPid, &mesos.LostSlaveMessage{SlaveId: util.NewSlaveID("test-slave-001")})
+	assert.Equal(t, []*mesos.Offer{offer}, sched.offers)
+}
+
+// launchingScheduler launches a task on each offer.
+type launchingScheduler struct {
+	SchedulerBase
+}
+
+func (sched *launchingScheduler) ResourceOffers(driver SchedulerDriver, offers []*mesos.Offer) {
+	for _, offer := range offers {
+		task := util.NewTaskInfo("task", util.NewTaskID("task-"+offer.Id.GetValue()), offer.SlaveId, offer.Resources)
+		task.Command = util.NewCommandInfo("pwd")
+		driver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+	}
+}
+
+func TestMockSchedulerDriver(t *testing.T) {
+	driver := NewMockSchedulerDriver()
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+	task := util.NewTaskInfo("task", util.NewTaskID("task-offer-1"), offer.SlaveId, nil)
+	task.Command = util.NewCommandInfo("pwd")
+	driver.On("LaunchTasks", []*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{task}, mock.Anything).Return(mesos.Status_DRIVER_RUNNING, nil)
+
+	(&launchingScheduler{}).ResourceOffers(driver, []*mesos.Offer{offer})
+	driver.AssertExpectations(t)
+	driver.AssertNotCalled(t, "DeclineOffer", mock.Anything, mock.Anything)
+}
+
+// sentAcks returns the acknowledgements sent, key:task ID.
+func sentAcks(msgr *sentMessenger) map[string]*mesos.StatusUpdateAcknowledgementMessage {
+	acks := make(map[string]*mesos.StatusUpdateAcknowledgementMessage)
+	for _, msg := range msgr.sent {
+		if ack, ok := msg.(*mesos.StatusUpdateAcknowledgementMessage); ok {
+			acks[ack.GetTaskId().GetValue()] = ack
+		}
+	}
+	return acks
+}
+
+func newAckDriver(t *testing.T, explicit bool) (*MesosSchedulerDriver, *statusScheduler, *sentMessenger) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.explicitAcks = explicit
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+	return driver, sched, msgr
+}
+
+func TestSchedulerDriverAutomaticAcks(t *testing.T) {
+	driver, sched, msgr := newAckDriver(t, false)
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Len(t, sched.statuses, 1)
+
+	ack := sentAcks(msgr)["task-1"]
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, []byte("uuid-task-1"), ack.GetUuid())
+		assert.Equal(t, "test-slave-001", ack.GetSlaveId().GetValue())
+		assert.Equal(t, framework.GetId().GetValue(), ack.GetFrameworkId().GetValue())
+	}
+
+	_, err := driver.AcknowledgeStatusUpdate(sched.statuses[0])
+	assert.Error(t, err)
+	assert.Len(t, msgr.sent, 1)
+}
+
+func TestSchedulerDriverExplicitAcks(t *testing.T) {
+	driver, sched, msgr := newAckDriver(t, true)
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	sendTaskFailure(driver, "task-2", mesos.TaskState_TASK_RUNNING, "")
+	assert.Len(t, sched.statuses, 2)
+	assert.Empty(t, sentAcks(msgr), "the updates are acknowledged by the framework")
+
+	stat, err := driver.AcknowledgeStatusUpdate(sched.statuses[0])
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	acks := sentAcks(msgr)
+	assert.Len(t, acks, 1)
+	if ack := acks["task-1"]; assert.NotNil(t, ack) {
+		assert.Equal(t, []byte("uuid-task-1"), ack.GetUuid())
+		assert.Equal(t, "test-slave-001", ack.GetSlaveId().GetValue())
+		assert.Equal(t, framework.GetId().GetValue(), ack.GetFrameworkId().GetValue())
+	}
+
+	// acknowledging again, or another update of the task, does nothing.
+	_, err = driver.AcknowledgeStatusUpdate(sched.statuses[0])
+	assert.NoError(t, err)
+	other := *sched.statuses[1]
+	other.State = mesos.TaskState_TASK_FINISHED.Enum()
+	_, err = driver.AcknowledgeStatusUpdate(&other)
+	assert.NoError(t, err)
+	assert.Len(t, sentAcks(msgr), 1)
+
+	// a failed acknowledgement is kept until it is sent.
+	failing := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	failing.On("Send").Return(messenger.ErrQueueFull)
+	driver.messenger = failing
+	_, err = driver.AcknowledgeStatusUpdate(sched.statuses[1])
+	assert.IsType(t, &SendError{}, err)
+	driver.messenger = msgr
+	_, err = driver.AcknowledgeStatusUpdate(sched.statuses[1])
+	assert.NoError(t, err)
+	assert.Len(t, sentAcks(msgr), 2)
+	assert.Empty(t, driver.pendingAcks)
+
+	// not while disconnected.
+	sendTaskFailure(driver, "task-3", mesos.TaskState_TASK_RUNNING, "")
+	driver.transition(StateDisconnected)
+	_, err = driver.AcknowledgeStatusUpdate(sched.statuses[2])
+	assert.Equal(t, ErrNotConnected, err)
+}
+
+// newConcurrentDriver returns a driver, not started, whose scheduler
+// accepts every callback.
+func newConcurrentDriver(t *testing.T) *MesosSchedulerDriver {
+	sched := NewMockScheduler()
+	for _, method := range []string{"Registered", "Reregistered", "Disconnected", "ResourceOffers", "OfferRescinded",
+		"StatusUpdate", "FrameworkMessage", "SlaveLost", "ExecutorLost", "Error"} {
+		sched.On(method).Return()
+	}
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Start").Return(nil)
+	msgr.On("UPID").Return(&upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"})
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.messenger = msgr
+	return driver
+}
+
+func TestSchedulerDriverConcurrentStart(t *testing.T) {
+	driver := newConcurrentDriver(t)
+	var started int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := driver.Start(); err == nil {
+				atomic.AddInt32(&started, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), started, "the driver is started once")
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+
+	registrations := 0
+	for _, call := range driver.messenger.(*messenger.MockedMessenger).Calls {
+		if call.Method == "Send" {
+			registrations++
+		}
+	}
+	assert.Equal(t, 1, registrations)
+
+	// as is Stop.
+	var stopped int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if stat, err := driver.Stop(false); err == nil && stat == mesos.Status_DRIVER_STOPPED {
+				atomic.AddInt32(&stopped, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), stopped)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, driver.Status())
+}
+
+func TestSchedulerDriverConcurrentCalls(t *testing.T) {
+	driver := newConcurrentDriver(t)
+	_, err := driver.Start()
+	assert.NoError(t, err)
+
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(masterUpid)
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+
+	// Join returns once the driver is stopped, to every caller.
+	joined := make(chan mesos.Status, 4)
+	for i := 0; i < cap(joined); i++ {
+		go func() {
+			stat, _ := driver.Join()
+			joined <- stat
+		}()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	// the master keeps failing over.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			driver.frameworkRegistered(driver.MasterPid, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+			offerId := fmt.Sprintf("offer-%d", i)
+			driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+				Offers: []*mesos.Offer{util.NewOffer(util.NewOfferID(offerId), framework.Id, util.NewSlaveID("slave-1"), "localhost")},
+				Pids:   []string{slavePid.String()},
+			})
+			status := util.NewTaskStatus(util.NewTaskID(fmt.Sprintf("task-%d", i)), mesos.TaskState_TASK_RUNNING)
+			update := util.NewStatusUpdate(framework.Id, status, float64(time.Now().Unix()), []byte(offerId))
+			update.SlaveId = util.NewSlaveID("slave-1")
+			driver.statusUpdated(slavePid, &mesos.StatusUpdateMessage{Update: update, Pid: proto.String(slavePid.String())})
+			driver.masterLost(errors.New("connection refused"))
+			driver.OnMasterChanged(masterInfo)
+			driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+		}
+	}()
+	// while the framework uses the driver.
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				id := fmt.Sprintf("task-%d-%d", g, i)
+				task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("slave-1"),
+					[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+				task.Command = util.NewCommandInfo("pwd")
+				driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID(fmt.Sprintf("offer-%d", i))}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+				driver.KillTask(task.TaskId)
+				driver.ReviveOffers()
+				driver.DeclineOffer(util.NewOfferID("offer-0"), nil)
+				driver.ReconcileTasks(nil)
+				driver.Status()
+				driver.Connected()
+			}
+		}(g)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	// Stop and Abort race each other, one of them stops the driver.
+	var stops sync.WaitGroup
+	stops.Add(2)
+	go func() {
+		defer stops.Done()
+		driver.Stop(true)
+	}()
+	go func() {
+		defer stops.Done()
+		driver.Abort()
+	}()
+	stops.Wait()
+	close(done)
+	wg.Wait()
+
+	final := driver.Status()
+	assert.True(t, final == mesos.Status_DRIVER_STOPPED || final == mesos.Status_DRIVER_ABORTED, final.String())
+	for i := 0; i < cap(joined); i++ {
+		select {
+		case stat := <-joined:
+			assert.Equal(t, final, stat)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Join did not return")
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files of the tests")
+
+// assertGolden compares got to the golden file of name under
+// testdata/config, rewriting the file with -update.
+func assertGolden(t *testing.T, name, got string) {
+	path := filepath.Join("testdata", "config", name+".golden")
+	if *updateGolden {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(got), 0644))
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), got, path)
+}
+
+func TestLoadConfigFull(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join("testdata", "config", "full.json"))
+	assert.NoError(t, err)
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	assert.NoError(t, err)
+	assertGolden(t, "full", string(data)+"\n")
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, name := range []string{
+		"invalid_syntax",
+		"invalid_unknown",
+		"invalid_type",
+		"invalid_missing",
+		"invalid_range",
+		"invalid_conflict",
+	} {
+		cfg, err := LoadConfig(filepath.Join("testdata", "config", name+".json"))
+		assert.Nil(t, cfg, name)
+		if assert.IsType(t, &ConfigError{}, err, name) {
+			assertGolden(t, name, err.Error()+"\n")
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	// the missing fields keep the flags, the unknown ones are ignored.
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"master": "127.0.0.1:5050", "masters": ""}`), 0644))
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	want := DefaultConfig()
+	want.Master = "127.0.0.1:5050"
+	assert.Equal(t, want, cfg)
+
+	_, err = LoadConfig(filepath.Join(dir, "missing.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	err := cfg.Validate()
+	assert.Equal(t, &ConfigError{Problems: []string{"master: required"}}, err)
+	assert.Equal(t, "invalid scheduler config:\n\tmaster: required", err.Error())
+
+	cfg.Master = "127.0.0.1:5050"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestNewMesosSchedulerDriverFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("secret"), 0600))
+
+	cfg := DefaultConfig()
+	cfg.Master = "127.0.0.1:5050"
+	cfg.Authentication.Principal = "framework"
+	cfg.Authentication.SecretFile = secretFile
+	cfg.Bind = BindConfig{Address: "127.0.0.1", Port: 5052}
+	cfg.MessageSize = MessageSizeConfig{Max: 2048, Strict: true}
+	cfg.MasterWarmup = true
+	cfg.ExplicitAcks = true
+	cfg.OfferTimeout = Duration(time.Minute)
+	cfg.MaxKeptOffers = 8
+	cfg.AllowedTaskUsers = []string{"nobody"}
+	cfg.Reconcile = ReconcileConfig{BatchSize: 10, BatchDelay: Duration(time.Millisecond)}
+	cfg.Refusal = RefusalConfig{Default: Duration(time.Second), Roles: map[string]Duration{"*": Duration(time.Hour)}}
+	cfg.DirectSend = DirectSendConfig{Failures: 7, Reprobe: Duration(time.Second)}
+	cfg.OrderedStatusUpdates = true
+	cfg.TaskCache = TaskCacheConfig{File: filepath.Join(dir, "tasks.json"), SnapshotInterval: Duration(time.Second)}
+
+	framework := util.NewFrameworkInfo("test-user", "test-framework", nil)
+	driver, err := NewMesosSchedulerDriverFromConfig(NewMockScheduler(), framework, cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "framework", driver.credential.GetPrincipal())
+	assert.Equal(t, []byte("secret"), driver.credential.GetSecret())
+	assert.Equal(t, "framework", framework.GetPrincipal())
+	assert.Equal(t, "127.0.0.1", driver.messenger.UPID().Host)
+	assert.Equal(t, "5052", driver.messenger.UPID().Port)
+	assert.Equal(t, 2048, driver.maxMessageSize)
+	assert.True(t, driver.strictMessageSize)
+	assert.True(t, driver.masterWarmup)
+	assert.True(t, driver.explicitAcks)
+	assert.Equal(t, time.Minute, driver.cache.offerTTL)
+	assert.Equal(t, 8, driver.maxKeptOffers)
+	assert.Equal(t, []string{"nobody"}, driver.AllowedTaskUsers)
+	assert.Equal(t, 10, driver.reconcileBatchSize)
+	assert.Equal(t, time.Millisecond, driver.reconcileBatchDelay)
+	assert.Equal(t, RefusalPolicy{Default: time.Second, Roles: map[string]time.Duration{"*": time.Hour}}, driver.Refusal)
+	assert.Equal(t, 7, driver.cache.route("test-slave-001").breaker.threshold)
+	assert.NotNil(t, driver.statusOrder)
+	assert.Equal(t, NewFileTaskCacheStore(cfg.TaskCache.File), driver.TaskCacheStore)
+	assert.Equal(t, time.Second, driver.taskCacheInterval)
+
+	// an invalid config creates no driver.
+	cfg.Send.QueueSize = 0
+	driver, err = NewMesosSchedulerDriverFromConfig(NewMockScheduler(), framework, cfg)
+	assert.Nil(t, driver)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "send.queue_size"), err.Error())
+	}
+}
+
+// statusScheduler records the status updates it receives.
+type statusScheduler struct {
+	*MockScheduler
+	statuses []*mesos.TaskStatus
+}
+
+func (sched *statusScheduler) StatusUpdate(_ SchedulerDriver, status *mesos.TaskStatus) {
+	sched.statuses = append(sched.statuses, status)
+}
+
+func correlationEnv(task *mesos.TaskInfo) string {
+	for _, v := range task.GetCommand().GetEnvironment().GetVariables() {
+		if v.GetName() == CorrelationEnv {
+			return v.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestCorrelation(t *testing.T) {
+	_, ok := Correlation(context.Background())
+	assert.False(t, ok)
+	id, ok := Correlation(WithCorrelation(context.Background(), "trace-1"))
+	assert.True(t, ok)
+	assert.Equal(t, "trace-1", id)
+
+	generated := correlationOf(context.Background())
+	assert.NotEmpty(t, generated)
+	assert.NotEqual(t, generated, correlationOf(context.Background()))
+}
+
+func TestSchedulerDriverLaunchTasksCorrelated(t *testing.T) {
+	for _, sendErr := range []error{nil, errors.New("connection refused")} {
+		sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(sendErr)
+		driver.messenger = msgr
+
+		offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+		driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+		tasks := []*mesos.TaskInfo{}
+		for _, id := range []string{"task-1", "task-2"} {
+			task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("slave-1"),
+				[]*mesos.Resource{util.NewScalarResource("mem", 400)})
+			task.Command = util.NewCommandInfo("pwd")
+			tasks = append(tasks, task)
+		}
+
+		ctx := WithCorrelation(context.Background(), "trace-1")
+		_, err := driver.LaunchTasksContext(ctx, []*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		if assert.Equal(t, 1, len(msgr.sent)) {
+			for _, task := range msgr.sent[0].(*mesos.LaunchTasksMessage).Tasks {
+				assert.Equal(t, "trace-1", correlationEnv(task))
+			}
+		}
+		// the tasks of the caller are not stamped.
+		for _, task := range tasks {
+			assert.Nil(t, task.Command.Environment)
+		}
+		if sendErr == nil {
+			assert.NoError(t, err)
+			assert.Empty(t, sched.statuses)
+			continue
+		}
+		assert.Error(t, err)
+		if assert.Equal(t, 2, len(sched.statuses)) {
+			for _, status := range sched.statuses {
+				assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+				assert.Equal(t, "Unable to launch tasks: "+err.Error()+" (correlation trace-1)", status.GetMessage())
+				assert.Empty(t, status.GetData())
+			}
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTasksUncorrelated(t *testing.T) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.transition(StateDisconnected)
+
+	tasks := []*mesos.TaskInfo{}
+	for _, id := range []string{"task-1", "task-2"} {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("slave-1"), nil)
+		task.Command = util.NewCommandInfo("pwd")
+		tasks = append(tasks, task)
+	}
+	_, err := driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, tasks, nil)
+	waitEvents(driver)
+	assert.Error(t, err)
+
+	// without an ID in the context, neither the tasks nor their updates
+	// carry one.
+	for _, task := range tasks {
+		assert.Nil(t, task.Command.Environment)
+	}
+	if assert.Equal(t, 2, len(sched.statuses)) {
+		for _, status := range sched.statuses {
+			assert.Equal(t, "Master Disconnected", status.GetMessage())
+			assert.Empty(t, status.GetData())
+		}
+	}
+}
+
+// callsScheduler reports the callbacks of interest on calls.
+type callsScheduler struct {
+	*MockScheduler
+	calls chan string
+}
+
+func (sched *callsScheduler) Registered(SchedulerDriver, *mesos.FrameworkID, *mesos.MasterInfo) {
+	sched.calls <- "Registered"
+}
+
+func (sched *callsScheduler) Reregistered(SchedulerDriver, *mesos.MasterInfo) {
+	sched.calls <- "Reregistered"
+}
+
+func (sched *callsScheduler) ResourceOffers(SchedulerDriver, []*mesos.Offer) {
+	sched.calls <- "ResourceOffers"
+}
+
+func (sched *callsScheduler) StatusUpdate(SchedulerDriver, *mesos.TaskStatus) {
+	sched.calls <- "StatusUpdate"
+}
+
+func (sched *callsScheduler) await(t *testing.T, expected string) {
+	select {
+	case call := <-sched.calls:
+		assert.Equal(t, expected, call)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Missing %s callback.", expected)
+	}
+}
+
+func TestSchedulerDriverMetricsSnapshot(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := &callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}
+	sched.On("Disconnected").Return()
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DriverMetricsSnapshot{StatusUpdates: map[mesos.TaskState]uint64{}}, driver.MetricsSnapshot())
+
+	start := time.Now()
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	defer driver.Abort()
+
+	masterInfo := util.NewMasterInfo("master-1", 123456, 1234)
+	masterInfo.Pid = proto.String(server.PID.String())
+	c := testutil.NewMockMesosClient(t, server.PID)
+	c.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	sched.await(t, "Registered")
+
+	var offers []*mesos.Offer
+	var pids []string
+	for _, id := range []string{"offer-1", "offer-2", "offer-3"} {
+		offers = append(offers, util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("test-slave-001"), "localhost"))
+		pids = append(pids, server.PID.String())
+	}
+	c.SendMessage(driver.self, &mesos.ResourceOffersMessage{Offers: offers, Pids: pids})
+	sched.await(t, "ResourceOffers")
+
+	var tasks []*mesos.TaskInfo
+	for _, id := range []string{"task-1", "task-2"} {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("test-slave-001"), nil)
+		task.Command = util.NewCommandInfo("pwd")
+		tasks = append(tasks, task)
+	}
+	_, err = driver.LaunchTasks([]*mesos.OfferID{offers[0].Id}, tasks, &mesos.Filters{})
+	assert.NoError(t, err)
+	_, err = driver.DeclineOffer(offers[1].Id, nil)
+	assert.NoError(t, err)
+	_, err = driver.DeclineOffer(offers[2].Id, nil)
+	assert.NoError(t, err)
+
+	for i, state := range []mesos.TaskState{mesos.TaskState_TASK_RUNNING, mesos.TaskState_TASK_RUNNING, mesos.TaskState_TASK_FINISHED} {
+		update := util.NewStatusUpdate(framework.Id, util.NewTaskStatus(tasks[i%2].TaskId, state),
+			float64(time.Now().Unix()), []byte("uuid-"+tasks[i%2].TaskId.GetValue()+"-"+state.String()))
+		update.SlaveId = util.NewSlaveID("test-slave-001")
+		c.SendMessage(driver.self, &mesos.StatusUpdateMessage{Update: update, Pid: proto.String(server.PID.String())})
+		sched.await(t, "StatusUpdate")
+	}
+
+	// the master fails over.
+	driver.OnMasterChanged(masterInfo)
+	c.SendMessage(driver.self, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	sched.await(t, "Reregistered")
+
+	snapshot := driver.MetricsSnapshot()
+	assert.Equal(t, uint64(3), snapshot.OffersReceived)
+	assert.Equal(t, uint64(2), snapshot.OffersDeclined)
+	assert.Equal(t, uint64(2), snapshot.TasksLaunched)
+	assert.Equal(t, uint64(1), snapshot.Reconnects)
+	assert.Equal(t, map[mesos.TaskState]uint64{
+		mesos.TaskState_TASK_RUNNING:  2,
+		mesos.TaskState_TASK_FINISHED: 1,
+	}, snapshot.StatusUpdates)
+	// registration, re-registration, launch, declines and acknowledgements.
+	assert.True(t, snapshot.MessagesSent >= 8, "%d messages sent", snapshot.MessagesSent)
+	assert.Equal(t, uint64(0), snapshot.MessagesFailed)
+	assert.False(t, snapshot.LastRegistered.Before(start))
+	assert.False(t, snapshot.LastStatusUpdate.Before(start))
+	assert.False(t, snapshot.LastMessageSent.Before(start))
+	assert.False(t, snapshot.LastMessageReceived.Before(start))
+	assert.True(t, snapshot.LastRegistered.After(snapshot.LastStatusUpdate), "re-registered last")
+
+	// the snapshot is a copy.
+	snapshot.StatusUpdates[mesos.TaskState_TASK_LOST] = 1
+	assert.NotContains(t, driver.MetricsSnapshot().StatusUpdates, mesos.TaskState_TASK_LOST)
+}
+
+func TestSchedulerDriverMetricsSnapshotSendFailure(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("Disconnected").Return()
+	driver := newConnectedDriver(t, sched)
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Send").Return(errors.New("connection refused"))
+	driver.messenger = msgr
+
+	_, err := driver.ReviveOffers()
+	assert.IsType(t, &SendError{}, err)
+	snapshot := driver.MetricsSnapshot()
+	assert.Equal(t, uint64(0), snapshot.MessagesSent)
+	assert.Equal(t, uint64(1), snapshot.MessagesFailed)
+}
+
+// drainingMessenger blocks Drain until released, and serves the
+// handlers it is given.
+type drainingMessenger struct {
+	*messenger.MockedMessenger
+	draining chan struct{}
+	release  chan struct{}
+	mux      *http.ServeMux
+}
+
+func newDrainingMessenger() *drainingMessenger {
+	msgr := &drainingMessenger{
+		MockedMessenger: messenger.NewMockedMessenger(),
+		draining:        make(chan struct{}),
+		release:         make(chan struct{}),
+		mux:             http.NewServeMux(),
+	}
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+	return msgr
+}
+
+func (m *drainingMessenger) Drain(ctx context.Context) error {
+	close(m.draining)
+	<-m.release
+	return nil
+}
+
+func (m *drainingMessenger) Handle(pattern string, handler http.Handler) error {
+	m.mux.Handle(pattern, handler)
+	return nil
+}
+
+func newDebugDriver(t *testing.T, cfg DebugConfig) (*MesosSchedulerDriver, *drainingMessenger, *fakeClock) {
+	driver := newConnectedDriver(t, &offersScheduler{})
+	msgr := newDrainingMessenger()
+	clock := newFakeClock()
+	driver.messenger = msgr
+	clock.use(driver)
+	driver.drainTimeout = time.Minute
+	driver.prometheusMetrics = true
+	driver.debug = newDebugEndpoints(cfg)
+	assert.NoError(t, driver.startDebugEndpoints(driver.startMetrics()))
+	return driver, msgr, clock
+}
+
+// scrape returns the status code and body of url, 0 if it is not served.
+func scrape(t *testing.T, url string) (int, string) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	rsp, err := client.Get(url)
+	if err != nil {
+		return 0, ""
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	return rsp.StatusCode, string(body)
+}
+
+func stopDriver(driver *MesosSchedulerDriver) chan mesos.Status {
+	stopped := make(chan mesos.Status, 1)
+	go func() {
+		stat, _ := driver.Stop(false)
+		stopped <- stat
+	}()
+	return stopped
+}
+
+func TestSchedulerDriverDebugEndpointsStopFirst(t *testing.T) {
+	driver, msgr, clock := newDebugDriver(t, DebugConfig{Address: "127.0.0.1:0", HealthGrace: Duration(time.Minute), StopFirst: true})
+	url := "http://" + driver.debug.listener.Addr().String()
+
+	code, body := scrape(t, url+"/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "mesos_connected 1\n")
+	code, body = scrape(t, url+"/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"state":"CONNECTED"`)
+
+	// draining: no more scrapes, /health reports the driver stopping.
+	stopped := stopDriver(driver)
+	<-msgr.draining
+	code, _ = scrape(t, url+"/metrics")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, body = scrape(t, url+"/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, `"state":"STOPPING"`)
+	close(msgr.release)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, <-stopped)
+
+	// stopped: /health reports the final state during the grace window.
+	code, body = scrape(t, url+"/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, `"state":"STOPPED"`)
+	assert.Contains(t, body, `"shutdown_reason":"`+ShutdownUserStop.String()+`"`)
+	code, _ = scrape(t, url+"/metrics")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// nothing is served after the grace window.
+	clock.tick(t)
+	for i := 0; ; i++ {
+		if code, _ = scrape(t, url+"/health"); code == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("/health is still served after the grace window.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulerDriverDebugEndpointsStopLast(t *testing.T) {
+	driver, msgr, _ := newDebugDriver(t, DebugConfig{Address: "127.0.0.1:0"})
+	url := "http://" + driver.debug.listener.Addr().String()
+
+	// draining: the metrics are still scraped.
+	stopped := stopDriver(driver)
+	<-msgr.draining
+	code, body := scrape(t, url+"/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "mesos_connected 0\n")
+	close(msgr.release)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, <-stopped)
+
+	// stopped without a grace window: nothing is served.
+	code, _ = scrape(t, url+"/health")
+	assert.Equal(t, 0, code)
+	code, _ = scrape(t, url+"/metrics")
+	assert.Equal(t, 0, code)
+}
+
+func TestSchedulerDriverStopDebugEndpoints(t *testing.T) {
+	driver, _, _ := newDebugDriver(t, DebugConfig{Address: "127.0.0.1:0"})
+	url := "http://" + driver.debug.listener.Addr().String()
+
+	driver.StopDebugEndpoints()
+	code, _ := scrape(t, url+"/metrics")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+	driver.StopDebugEndpoints()
+}
+
+func TestSchedulerDriverDebugEndpointsOfMessenger(t *testing.T) {
+	driver, msgr, _ := newDebugDriver(t, DebugConfig{})
+	assert.Nil(t, driver.debug.listener)
+	server := httptest.NewServer(msgr.mux)
+	defer server.Close()
+
+	code, _ := scrape(t, server.URL+"/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = scrape(t, server.URL+"/health")
+	assert.Equal(t, http.StatusOK, code)
+
+	// the messenger still serves, the endpoints do not.
+	driver.StopDebugEndpoints()
+	code, _ = scrape(t, server.URL+"/metrics")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = scrape(t, server.URL+"/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestNewDriverWithConfigProblems(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Bind.Port = 70000
+	_, err := NewDriverWithConfig(DriverConfig{Options: cfg})
+	if cfgErr, ok := err.(*ConfigError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, []string{
+			"scheduler: required",
+			"framework: required",
+			"master: required",
+			"bind.port: must be between 0 and 65535, got 70000",
+		}, cfgErr.Problems)
+	}
+
+	// the old constructor fails the same way.
+	_, err = NewMesosSchedulerDriver(nil, util.NewFrameworkInfo("test-user", "test-name", nil), "", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "scheduler: required")
+		assert.Contains(t, err.Error(), "master: required")
+	}
+}
+
+func TestNewDriverWithConfigDefaults(t *testing.T) {
+	info := &mesos.FrameworkInfo{Name: proto.String("test-name")}
+	driver, err := NewDriverWithConfig(DriverConfig{Scheduler: NewMockScheduler(), Framework: info, Master: master})
+	assert.NoError(t, err)
+
+	if u, err := user.Current(); err == nil {
+		assert.Equal(t, u.Username, driver.FrameworkInfo.GetUser())
+	}
+	host, err := os.Hostname()
+	assert.NoError(t, err)
+	assert.Equal(t, host, driver.FrameworkInfo.GetHostname())
+	assert.Equal(t, master, driver.MasterPid.Host+":"+driver.MasterPid.Port)
+	assert.Nil(t, driver.credential)
+	assert.Equal(t, *explicitAcks, driver.explicitAcks, "the options are those of the flags")
+}
+
+func TestNewDriverWithConfigOverrides(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Master = "127.0.0.1:6060"
+	cfg.Bind = BindConfig{Address: "127.0.0.2", Port: 6061}
+	cfg.Authentication = AuthConfig{Principal: "options", SecretFile: "/does/not/exist", Provider: "SASL"}
+	cfg.ExplicitAcks = true
+	saved := *cfg
+
+	info := util.NewFrameworkInfo("test-user", "test-name", nil)
+	info.Hostname = proto.String("framework-host")
+	credential := &mesos.Credential{Principal: proto.String("test-principal"), Secret: []byte("secret")}
+	driver, err := NewDriverWithConfig(DriverConfig{
+		Scheduler:        NewMockScheduler(),
+		Framework:        info,
+		Master:           master,
+		Credential:       credential,
+		BindingAddress:   "127.0.0.1",
+		BindingPort:      6062,
+		HostnameOverride: "override-host",
+		Options:          cfg,
+	})
+	assert.NoError(t, err, "the credential is not read from the options")
+
+	assert.Equal(t, master, driver.MasterPid.Host+":"+driver.MasterPid.Port)
+	assert.Equal(t, credential, driver.credential)
+	assert.Equal(t, "test-principal", driver.FrameworkInfo.GetPrincipal())
+	assert.Equal(t, "override-host", driver.FrameworkInfo.GetHostname())
+	assert.Equal(t, "test-user", driver.FrameworkInfo.GetUser())
+	self := driver.messenger.UPID()
+	assert.Equal(t, "127.0.0.1", self.Host)
+	assert.Equal(t, "6062", self.Port)
+	assert.True(t, driver.explicitAcks)
+	assert.Equal(t, saved, *cfg, "the options are not modified")
+
+	// without overrides, the options apply.
+	opts := *cfg
+	opts.Authentication = AuthConfig{Provider: "SASL"}
+	driver, err = NewDriverWithConfig(DriverConfig{
+		Scheduler: NewMockScheduler(),
+		Framework: util.NewFrameworkInfo("test-user", "test-name", nil),
+		Options:   &opts,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.1:6060", driver.MasterPid.Host+":"+driver.MasterPid.Port)
+		self = driver.messenger.UPID()
+		assert.Equal(t, "127.0.0.2", self.Host)
+		assert.Equal(t, "6061", self.Port)
+	}
+}
+
+// duplicateScheduler reports the reasons of the errors on calls too.
+type duplicateScheduler struct {
+	*callsScheduler
+}
+
+func (sched *duplicateScheduler) ErrorReason(_ SchedulerDriver, _ string, reason ShutdownReason) {
+	sched.calls <- "ErrorReason " + reason.String()
+}
+
+// fakeMaster is a mock master the driver may register with.
+type fakeMaster struct {
+	server *testutil.MockMesosHttpServer
+	client *testutil.MockMesosClient
+	info   *mesos.MasterInfo
+}
+
+func newFakeMaster(t *testing.T, id string) *fakeMaster {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	info := util.NewMasterInfo(id, 123456, 1234)
+	info.Pid = proto.String(server.PID.String())
+	return &fakeMaster{server: server, client: testutil.NewMockMesosClient(t, server.PID), info: info}
+}
+
+func newDuplicateDriver(t *testing.T, master *fakeMaster, cfg DuplicateConfig) (*MesosSchedulerDriver, *duplicateScheduler) {
+	sched := &duplicateScheduler{&callsScheduler{MockScheduler: NewMockScheduler(), calls: make(chan string, 8)}}
+	sched.On("Disconnected").Return()
+	config := DefaultConfig()
+	config.Master = master.server.Addr
+	config.Duplicates = cfg
+	driver, err := NewMesosSchedulerDriverFromConfig(sched, framework, config)
+	assert.NoError(t, err)
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	master.client.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: master.info})
+	sched.await(t, "Registered")
+	return driver, sched
+}
+
+func TestDuplicateDetector(t *testing.T) {
+	d := newDuplicateDetector(DuplicateConfig{Reregistrations: 3, Window: Duration(time.Minute)})
+	now := time.Now()
+	assert.Equal(t, 0, d.reregistered(now))
+	assert.Equal(t, 0, d.reregistered(now.Add(30*time.Second)))
+	// the first one is out of the window.
+	assert.Equal(t, 0, d.reregistered(now.Add(80*time.Second)))
+	assert.Equal(t, 3, d.reregistered(now.Add(85*time.Second)))
+	// the count starts over.
+	assert.Equal(t, 0, d.reregistered(now.Add(86*time.Second)))
+
+	never := newDuplicateDetector(DuplicateConfig{})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 0, never.reregistered(now))
+	}
+}
+
+func TestSchedulerDriverDuplicateRegistration(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		masterA, masterB := newFakeMaster(t, "master-a"), newFakeMaster(t, "master-b")
+		driver, sched := newDuplicateDriver(t, masterA, DuplicateConfig{Reregistrations: 5, Window: Duration(time.Minute), Abort: abort})
+
+		// a late answer of the master the driver registered with.
+		masterA.client.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterA.info})
+		waitEvents(driver)
+		assert.Empty(t, sched.calls)
+
+		// another master registered the framework, for another scheduler.
+		masterB.client.SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterB.info})
+		sched.await(t, "ErrorReason DUPLICATE_SCHEDULER")
+		if abort {
+			assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
+			assert.Equal(t, ShutdownDuplicateScheduler, driver.ShutdownReason())
+		} else {
+			assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+			assert.True(t, driver.Connected())
+			driver.Abort()
+		}
+		masterA.server.Close()
+		masterB.server.Close()
+	}
+}
+
+func TestSchedulerDriverDuplicateFlipFlop(t *testing.T) {
+	masterA, masterB := newFakeMaster(t, "master-a"), newFakeMaster(t, "master-b")
+	defer masterA.server.Close()
+	defer masterB.server.Close()
+	driver, sched := newDuplicateDriver(t, masterA, DuplicateConfig{Reregistrations: 3, Window: Duration(time.Minute), Abort: true})
+
+	// the two schedulers take the framework over from each other.
+	for i, master := range []*fakeMaster{masterB, masterA, masterB} {
+		driver.OnMasterChanged(master.info)
+		master.client.SendMessage(driver.self, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: master.info})
+		sched.await(t, "Reregistered")
+		if i < 2 {
+			assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+		}
+	}
+	sched.await(t, "ErrorReason DUPLICATE_SCHEDULER")
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
+	assert.Equal(t, ShutdownDuplicateScheduler, driver.ShutdownReason())
+}
+
+func TestSchedulerDriverFrameworkFailedOver(t *testing.T) {
+	master := newFakeMaster(t, "master-a")
+	defer master.server.Close()
+	driver, sched := newDuplicateDriver(t, master, DuplicateConfig{})
+
+	master.client.SendMessage(driver.self, &mesos.FrameworkErrorMessage{Message: proto.String(frameworkFailedOver)})
+	sched.await(t, "ErrorReason DUPLICATE_SCHEDULER")
+	assert.Equal(t, ShutdownDuplicateScheduler, driver.ShutdownReason())
+}
+
+func TestSchedulerDriverEpochs(t *testing.T) {
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Start").Return(nil)
+	msgr.On("UPID").Return(&upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"})
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("Registered").Return()
+	sched.On("Disconnected").Return()
+	sched.On("Reregistered").Return()
+	sched.On("ResourceOffers").Return()
+
+	driver, err := NewMesosSchedulerDriver(sched, util.NewFrameworkInfo("test-user", "test-name", nil), master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	assert.Equal(t, uint64(0), driver.Epoch())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transitions := driver.WatchState(ctx)
+
+	offer := func(id string) {
+		driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+			Offers: []*mesos.Offer{util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("slave-1"), "localhost")},
+			Pids:   []string{"slave(1)@127.0.0.1:5052"},
+		})
+	}
+	task := func(id string) *mesos.TaskInfo {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("slave-1"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+		task.Command = util.NewCommandInfo("pwd")
+		return task
+	}
+
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	driver.frameworkRegistered(driver.MasterPid, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: util.NewFrameworkID("test-framework-1"),
+		MasterInfo:  util.NewMasterInfo("master-1", 123456, 5050),
+	})
+	assert.Equal(t, uint64(1), driver.Epoch())
+	offer("offer-1")
+	offer("offer-2")
+
+	// the leading master fails over.
+	driver.OnMasterChanged(&mesos.MasterInfo{
+		Id:   proto.String("master-2"),
+		Ip:   proto.Uint32(123456),
+		Port: proto.Uint32(5050),
+		Pid:  proto.String("master@127.0.0.2:5050"),
+	})
+	assert.Equal(t, uint64(1), driver.Epoch(), "the epoch changes once the framework re-registers")
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{
+		FrameworkId: util.NewFrameworkID("test-framework-1"),
+		MasterInfo:  util.NewMasterInfo("master-2", 123456, 5050),
+	})
+	assert.Equal(t, uint64(2), driver.Epoch())
+	offer("offer-3")
+
+	// an offer from before the failover cannot be launched on.
+	stat, err := driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, []*mesos.TaskInfo{task("task-1")}, &mesos.Filters{})
+	waitEvents(driver)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	if stale, ok := err.(*StaleOfferError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "offer-1", stale.OfferId)
+		assert.Equal(t, uint64(1), stale.Epoch)
+		assert.Equal(t, uint64(2), stale.Current)
+	}
+	if assert.Len(t, sched.statuses, 1) {
+		assert.Equal(t, "task-1", sched.statuses[0].TaskId.GetValue())
+		assert.Equal(t, mesos.TaskState_TASK_LOST, sched.statuses[0].GetState())
+		assert.Equal(t, err.Error(), sched.statuses[0].GetMessage())
+	}
+	// nor along with a current one.
+	_, err = driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-3"), util.NewOfferID("offer-2")}, []*mesos.TaskInfo{task("task-2")}, &mesos.Filters{})
+	waitEvents(driver)
+	assert.IsType(t, &StaleOfferError{}, err)
+	assert.True(t, driver.cache.containsOffer(util.NewOfferID("offer-3")))
+
+	_, err = driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-3")}, []*mesos.TaskInfo{task("task-3")}, &mesos.Filters{})
+	waitEvents(driver)
+	assert.NoError(t, err)
+	assert.Len(t, sched.statuses, 2)
+
+	_, err = driver.Stop(false)
+	assert.NoError(t, err)
+
+	var seen []StateTransition
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case tr, ok := <-transitions:
+			if !ok {
+				done = true
+				break
+			}
+			seen = append(seen, tr)
+		case <-timeout:
+			t.Fatalf("Transitions channel was not closed.")
+		}
+	}
+	expected := []uint64{0, 1, 1, 1, 2, 2, 2}
+	if assert.Equal(t, len(expected), len(seen), "%v", seen) {
+		for i, epoch := range expected {
+			assert.Equal(t, epoch, seen[i].Epoch, "transition %v", seen[i])
+		}
+	}
+}
+
+// waitEvents waits for the events posted so far to be handled, or for
+// the driver to stop. They are handled by the caller if the event
+// goroutine is not started.
+func waitEvents(driver *MesosSchedulerDriver) {
+	driver.lock.RLock()
+	started := driver.eventsDone != nil
+	driver.lock.RUnlock()
+	for !started {
+		select {
+		case fn := <-driver.events:
+			driver.handle(fn)
+		default:
+			return
+		}
+	}
+	done := make(chan struct{})
+	driver.post(func() { close(done) })
+	select {
+	case <-done:
+	case <-driver.stopCh:
+	}
+}
+
+func TestSchedulerDriverSendFailedOnEventGoroutine(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("Disconnected").Return()
+	driver := newConnectedDriver(t, sched)
+
+	// the messenger's goroutine is not held by the callback.
+	driver.sendFailed(&messenger.Message{UPID: driver.MasterPid, Name: "mesos.internal.KillTaskMessage"}, errors.New("connection refused"))
+	sched.AssertNotCalled(t, "Disconnected")
+	assert.True(t, driver.Connected())
+
+	driver.startEvents()
+	waitEvents(driver)
+	sched.AssertNumberOfCalls(t, "Disconnected", 1)
+	assert.False(t, driver.Connected())
+}
+
+func TestSchedulerDriverDirectSendFailedOnEventGoroutine(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	defer close(driver.stopCh)
+	slaveId := util.NewSlaveID("test-slave-001")
+
+	driver.sendFailed(&messenger.Message{
+		UPID:         &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"},
+		Name:         "mesos.internal.FrameworkToExecutorMessage",
+		ProtoMessage: &mesos.FrameworkToExecutorMessage{SlaveId: slaveId, ExecutorId: util.NewExecutorID("test-executor-001")},
+	}, errors.New("connection refused"))
+	assert.Empty(t, driver.SlaveRoutes())
+
+	driver.startEvents()
+	waitEvents(driver)
+	assert.Equal(t, SlaveRoute{Mode: SlaveRouteDirect, Failures: 1, Fallbacks: 1}, driver.SlaveRoutes()["test-slave-001"])
+}
+
+// blockingScheduler records the callbacks, ResourceOffers blocks until
+// released.
+type blockingScheduler struct {
+	*MockScheduler
+	calls   chan string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (sched *blockingScheduler) ResourceOffers(SchedulerDriver, []*mesos.Offer) {
+	sched.calls <- "ResourceOffers"
+	close(sched.entered)
+	<-sched.release
+}
+
+func (sched *blockingScheduler) StatusUpdate(_ SchedulerDriver, status *mesos.TaskStatus) {
+	sched.calls <- "StatusUpdate " + status.GetTaskId().GetValue()
+}
+
+func TestSchedulerDriverCallbacksInOrder(t *testing.T) {
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	sched := &blockingScheduler{
+		MockScheduler: NewMockScheduler(),
+		calls:         make(chan string, 2),
+		entered:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	defer driver.Abort()
+	driver.transition(StateConnected) // mock state
+
+	c := testutil.NewMockMesosClient(t, server.PID)
+	offer := util.NewOffer(util.NewOfferID("test-offer-001"), framework.Id, util.NewSlaveID("test-slave-001"), "test-localhost")
+	c.SendMessage(driver.self, &mesos.ResourceOffersMessage{Offers: []*mesos.Offer{offer}, Pids: []string{server.PID.String()}})
+	select {
+	case <-sched.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ResourceOffers was not called.")
+	}
+
+	// the update is received while the offers callback sleeps.
+	update := util.NewStatusUpdate(framework.Id, util.NewTaskStatus(util.NewTaskID("test-task-001"), mesos.TaskState_TASK_RUNNING),
+		float64(time.Now().Unix()), []byte("test-abcd-ef-3455-454-001"))
+	update.SlaveId = util.NewSlaveID("test-slave-001")
+	c.SendMessage(driver.self, &mesos.StatusUpdateMessage{Update: update, Pid: proto.String(server.PID.String())})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(driver.events) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(driver.events), "the update is queued")
+	assert.Equal(t, 1, len(sched.calls))
+
+	close(sched.release)
+	for _, expected := range []string{"ResourceOffers", "StatusUpdate test-task-001"} {
+		select {
+		case call := <-sched.calls:
+			assert.Equal(t, expected, call)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Missing %s callback.", expected)
+		}
+	}
+}
+
+func TestSchedulerDriverJoinWaitsForCallback(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		release bool // the callback
+		waits   bool // Join for it
+	}{
+		{"callback returns", 5 * time.Second, true, true},
+		{"callback hangs", 50 * time.Millisecond, false, false},
+		{"no timeout", 0, false, false},
+	} {
+		driver := newConnectedDriver(t, NewMockScheduler())
+		driver.messenger.(*messenger.MockedMessenger).On("Stop").Return(nil)
+		driver.callbackStopTimeout = tc.timeout
+		driver.startEvents()
+
+		entered, release := make(chan struct{}), make(chan struct{})
+		driver.post(func() {
+			close(entered)
+			<-release
+		})
+		<-entered
+		stopped := make(chan struct{})
+		go func() {
+			driver.Join()
+			close(stopped)
+		}()
+		time.Sleep(10 * time.Millisecond) // Join is waiting
+		stat, _ := driver.Stop(true)
+		assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat, tc.name)
+		select {
+		case <-stopped:
+			assert.False(t, tc.waits, "%s: Join did not wait for the callback", tc.name)
+		case <-time.After(200 * time.Millisecond):
+			assert.True(t, tc.waits, "%s: Join waited for the callback", tc.name)
+		}
+		close(release)
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Join did not return.", tc.name)
+		}
+		assert.Equal(t, mesos.Status_DRIVER_STOPPED, driver.Status(), tc.name)
+	}
+}
+
+func TestSchedulerDriverStopFromCallback(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	driver.messenger.(*messenger.MockedMessenger).On("Stop").Return(nil)
+	driver.callbackStopTimeout = time.Minute
+	driver.startEvents()
+
+	aborted := make(chan mesos.Status, 1)
+	driver.post(func() {
+		stat, _ := driver.Abort()
+		aborted <- stat
+	})
+	select {
+	case stat := <-aborted:
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Abort waited for the callback it was called by.")
+	}
+}
+
+// panickingScheduler panics in StatusUpdate.
+type panickingScheduler struct {
+	*MockScheduler
+	errors chan string
+}
+
+func (sched *panickingScheduler) StatusUpdate(SchedulerDriver, *mesos.TaskStatus) {
+	panic("status update bug")
+}
+
+func (sched *panickingScheduler) Error(_ SchedulerDriver, err string) {
+	sched.errors <- err
+}
+
+func TestSchedulerDriverCallbackPanic(t *testing.T) {
+	for _, abort := range []bool{true, false} {
+		before := runtime.NumGoroutine()
+		sched := &panickingScheduler{MockScheduler: NewMockScheduler(), errors: make(chan string, 1)}
+		sched.On("Disconnected").Return()
+		msgr := messenger.NewMockedMessenger()
+		msgr.On("Start").Return(nil)
+		msgr.On("UPID").Return(&upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"})
+		msgr.On("Send").Return(nil)
+		msgr.On("Stop").Return(nil)
+		driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = msgr
+		driver.abortOnPanic = abort
+		_, err = driver.Start()
+		assert.NoError(t, err)
+		driver.transition(StateConnected) // mock state
+
+		// the update is received by the messenger.
+		joined := make(chan mesos.Status, 1)
+		go func() {
+			stat, _ := driver.Join()
+			joined <- stat
+		}()
+		update := util.NewStatusUpdate(framework.Id, util.NewTaskStatus(util.NewTaskID("task-1"), mesos.TaskState_TASK_RUNNING),
+			float64(time.Now().Unix()), []byte("uuid-task-1"))
+		update.SlaveId = util.NewSlaveID("test-slave-001")
+		slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+		driver.dispatch(driver.statusUpdated)(slave, &mesos.StatusUpdateMessage{Update: update, Pid: proto.String(slave.String())})
+
+		if !abort {
+			waitEvents(driver)
+			assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+			assert.Empty(t, sched.errors)
+			_, err = driver.Stop(false)
+			assert.NoError(t, err)
+		} else {
+			select {
+			case err := <-sched.errors:
+				assert.Contains(t, err, "Scheduler callback panicked: status update bug")
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Error was not called.")
+			}
+		}
+		select {
+		case stat := <-joined:
+			if abort {
+				assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+				assert.Equal(t, ShutdownCallbackPanic, driver.ShutdownReason())
+			} else {
+				assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Join did not return.")
+		}
+
+		// the goroutines of the driver are gone.
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines, %d before", runtime.NumGoroutine(), before)
+	}
+}
+
+func TestSchedulerDriverLostTaskOnEventGoroutine(t *testing.T) {
+	sched := &panickingScheduler{MockScheduler: NewMockScheduler(), errors: make(chan string, 1)}
+	driver := newConnectedDriver(t, sched)
+	driver.messenger.(*messenger.MockedMessenger).On("Stop").Return(nil)
+	driver.transition(StateDisconnected)
+
+	// the TASK_LOST update is handled once LaunchTasks returned, its
+	// callback panicking aborts the driver as any other.
+	task := util.NewTaskInfo("task-1", util.NewTaskID("task-1"), util.NewSlaveID("test-slave-001"), nil)
+	task.Command = util.NewCommandInfo("pwd")
+	assert.NotPanics(t, func() {
+		_, err := driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, []*mesos.TaskInfo{task}, nil)
+		assert.Error(t, err)
+	})
+	assert.Equal(t, 1, len(driver.events))
+	waitEvents(driver)
+	assert.Contains(t, <-sched.errors, "Scheduler callback panicked: status update bug")
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
+}
+
+// lostInfoScheduler receives ExecutorLostInfo instead of ExecutorLost.
+type lostInfoScheduler struct {
+	*MockScheduler
+	infos []*ExecutorLostInfo
+}
+
+func (sched *lostInfoScheduler) ExecutorLostInfo(dr SchedulerDriver, info *ExecutorLostInfo) {
+	sched.infos = append(sched.infos, info)
+}
+
+func TestExecutorLostInference(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		state    mesos.TaskState
+		message  string // empty if no task failed
+		status   int32
+		cause    ExecutorLostCause
+		exitCode int
+		signal   int
+	}{
+		{"oom", mesos.TaskState_TASK_FAILED, "Memory limit exceeded: Requested: 64MB Used: 64MB", 9, ExecutorLostOOM, 0, 9},
+		{"launch", mesos.TaskState_TASK_FAILED, "Failed to fetch URIs for container 'abc'", 1 << 8, ExecutorLostLaunchFailed, 1, 0},
+		{"restart", mesos.TaskState_TASK_LOST, "Slave restarted", 15, ExecutorLostSlaveRestarted, 0, 15},
+		{"signaled", 0, "", 15, ExecutorLostSignaled, 0, 15},
+		{"exited", 0, "", 3 << 8, ExecutorLostExited, 3, 0},
+	} {
+		sched := &lostInfoScheduler{MockScheduler: NewMockScheduler()}
+		sched.On("StatusUpdate").Return()
+		driver := newConnectedDriver(t, sched)
+
+		if tc.message != "" {
+			sendTaskFailure(driver, "test-task-001", tc.state, tc.message)
+		}
+		sendExecutorExited(driver, tc.status)
+
+		if !assert.Equal(t, 1, len(sched.infos), tc.name) {
+			continue
+		}
+		info := sched.infos[0]
+		assert.Equal(t, tc.cause, info.Cause, tc.name)
+		assert.Equal(t, tc.exitCode, info.ExitCode, tc.name)
+		assert.Equal(t, tc.signal, info.Signal, tc.name)
+		assert.Equal(t, "test-executor-001", info.ExecutorId.GetValue(), tc.name)
+		assert.Equal(t, "test-slave-001", info.SlaveId.GetValue(), tc.name)
+		if tc.message != "" {
+			assert.Equal(t, 1, len(info.TaskIds), tc.name)
+			assert.Equal(t, "test-task-001", info.TaskIds[0].GetValue(), tc.name)
+		} else {
+			assert.Equal(t, 0, len(info.TaskIds), tc.name)
+		}
+	}
+}
+
+func TestExecutorLostIgnoresStaleFailures(t *testing.T) {
+	failures := newExecutorFailures()
+	slaveId, execId := util.NewSlaveID("test-slave-001"), util.NewExecutorID("test-executor-001")
+	status := util.NewTaskStatus(util.NewTaskID("test-task-001"), mesos.TaskState_TASK_FAILED)
+	status.Message = proto.String("Memory limit exceeded")
+
+	now := time.Now()
+	failures.record(slaveId, execId, status, now.Add(-2*executorFailureWindow))
+	info := inferExecutorLost(execId, slaveId, 9, failures.take(slaveId, execId, now))
+	assert.Equal(t, ExecutorLostSignaled, info.Cause)
+	assert.Equal(t, 0, len(info.TaskIds))
+
+	// a running task does not count as a failure.
+	failures.record(slaveId, execId, util.NewTaskStatus(util.NewTaskID("test-task-002"), mesos.TaskState_TASK_RUNNING), now)
+	assert.Equal(t, 0, len(failures.take(slaveId, execId, now)))
+}
+
+func TestExecutorLostLegacyCallback(t *testing.T) {
+	sched := NewMockScheduler()
+	sched.On("ExecutorLost").Return()
+	driver := newConnectedDriver(t, sched)
+
+	sendExecutorExited(driver, 1<<8)
+	sched.AssertNumberOfCalls(t, "ExecutorLost", 1)
+}
+
+func TestFrameworkErrorKind(t *testing.T) {
+	for message, kind := range map[string]FrameworkErrorKind{
+		"Not authorized to use role 'prod'":                            FrameworkErrorAuthorization,
+		"Framework is not authorized to register as 'root'":            FrameworkErrorAuthorization,
+		"Framework 'x' at scheduler(1)@1.2.3.4:5 is not authenticated": FrameworkErrorAuthorization,
+		"Framework has been removed":                                   FrameworkErrorRegistration,
+		"Framework failed over":                                        FrameworkErrorRegistration,
+		"Completed framework attempted to re-register":                 FrameworkErrorRegistration,
+		"Master is shutting down":                                      FrameworkErrorGeneric,
+		"":                                                             FrameworkErrorGeneric,
+	} {
+		err := newFrameworkError(message)
+		assert.Equal(t, kind, err.Kind, message)
+		assert.Equal(t, message, err.Error())
+	}
+}
+
+// frameworkErrorScheduler records the errors passed to FrameworkError
+// and to Error.
+type frameworkErrorScheduler struct {
+	*MockScheduler
+	frameworkErrors []*FrameworkError
+	errors          []string
+}
+
+func (sched *frameworkErrorScheduler) FrameworkError(_ SchedulerDriver, err *FrameworkError) {
+	sched.frameworkErrors = append(sched.frameworkErrors, err)
+}
+
+func (sched *frameworkErrorScheduler) Error(_ SchedulerDriver, err string) {
+	sched.errors = append(sched.errors, err)
+}
+
+func TestSchedulerDriverAuthorizationErrorAborts(t *testing.T) {
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Start").Return(nil)
+	msgr.On("UPID").Return(&upid.UPID{})
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	sched := &frameworkErrorScheduler{MockScheduler: NewMockScheduler()}
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+
+	done := make(chan mesos.Status, 1)
+	go func() {
+		stat, _ := driver.Run()
+		done <- stat
+	}()
+	time.Sleep(time.Millisecond * 1)
+	driver.transition(StateConnected) // simulated
+
+	driver.frameworkErrorRcvd(driver.MasterPid, &mesos.FrameworkErrorMessage{
+		Message: proto.String("Not authorized to use role 'prod'"),
+	})
+	select {
+	case stat := <-done:
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	case <-time.After(time.Second):
+		t.Fatalf("The driver still runs after an authorization error.")
+	}
+
+	if assert.Len(t, sched.frameworkErrors, 1) {
+		assert.Equal(t, FrameworkErrorAuthorization, sched.frameworkErrors[0].Kind)
+		assert.Equal(t, "Not authorized to use role 'prod'", sched.frameworkErrors[0].Message)
+	}
+	assert.Empty(t, sched.errors)
+	assert.Equal(t, ShutdownAuthorizationFailed, driver.ShutdownReason())
+	_, err = driver.StopReason()
+	ferr, ok := err.(*FrameworkError)
+	if assert.True(t, ok) {
+		assert.Equal(t, FrameworkErrorAuthorization, ferr.Kind)
+	}
+}
+
+func TestSchedulerDriverFrameworkErrorCallback(t *testing.T) {
+	// a Scheduler that is not a FrameworkErrorHandler gets the text.
+	sched := &errorScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.messenger.(*messenger.MockedMessenger).On("Stop").Return(nil)
+	driver.frameworkErrorRcvd(driver.MasterPid, &mesos.FrameworkErrorMessage{
+		Message: proto.String("Framework has been removed"),
+	})
+	assert.Equal(t, []string{"Framework has been removed"}, sched.errors)
+	assert.Equal(t, ShutdownMasterError, driver.ShutdownReason())
+	_, err := driver.StopReason()
+	if ferr, ok := err.(*FrameworkError); assert.True(t, ok) {
+		assert.Equal(t, FrameworkErrorRegistration, ferr.Kind)
+	}
+}
+
+func TestSchedulerDriverJoinWithHeartbeat(t *testing.T) {
+	driver, _, clock := newReconcileDriver(t, 0)
+	driver.cache.putOffer(util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost"), driver.masterPid())
+
+	beats := make(chan HealthSnapshot, 4)
+	n := 0
+	joined := make(chan mesos.Status, 1)
+	go func() {
+		stat, err := driver.JoinWithHeartbeat(time.Minute, func(h HealthSnapshot) {
+			n++
+			beats <- h
+			if n == 2 {
+				panic("heartbeat failed")
+			}
+		})
+		assert.NoError(t, err)
+		joined <- stat
+	}()
+
+	// a heartbeat per interval, the panic of the second one does not
+	// stop the third.
+	for i := 0; i < 3; i++ {
+		clock.advance(time.Minute)
+		clock.tick(t)
+		h := <-beats
+		assert.Equal(t, clock.Now(), h.Time)
+		assert.Equal(t, StateConnected, h.State)
+		assert.Equal(t, mesos.Status_DRIVER_RUNNING, h.Status)
+		assert.True(t, h.Connected)
+		assert.Equal(t, driver.masterPid(), h.Master)
+		assert.Equal(t, 1, h.OutstandingOffers)
+		assert.Equal(t, 0, h.PendingAcks)
+	}
+
+	// no more heartbeats once the driver stops.
+	driver.Abort()
+	select {
+	case stat := <-joined:
+		assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	case <-time.After(time.Second):
+		t.Fatal("JoinWithHeartbeat did not return once the driver stopped.")
+	}
+	for len(clock.afters) > 0 {
+		<-clock.afters <- clock.Now()
+	}
+	assert.Empty(t, beats)
+}
+
+func TestSchedulerDriverJoinWithHeartbeatNotRunning(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+	stat, err := driver.JoinWithHeartbeat(time.Minute, func(HealthSnapshot) {})
+	assert.Error(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, stat)
+
+	driver, _, _ = newReconcileDriver(t, 0)
+	_, err = driver.JoinWithHeartbeat(0, func(HealthSnapshot) {})
+	assert.Error(t, err)
+}
+
+func TestCheckPathID(t *testing.T) {
+	for _, tc := range []struct {
+		id  string
+		max int
+		err string
+	}{
+		{"task-1", 255, ""},
+		{strings.Repeat("x", 255), 255, ""},
+		{strings.Repeat("x", 256), 255, "256 bytes long, longer than 255"},
+		{"täsk", 4, "5 bytes long"},
+		{"", 255, "empty"},
+		{"web/1", 255, "slash"},
+		{"/web", 255, "slash"},
+		{"web\x001", 255, "NUL"},
+		{".", 255, "dot"},
+		{"..", 255, "dot"},
+		{".hidden", 255, "dot"},
+		{"web.1", 255, ""},
+		{"web..1", 255, ""},
+	} {
+		err := checkPathID("Task ID", tc.id, tc.max)
+		if tc.err == "" {
+			assert.NoError(t, err, "%q", tc.id)
+		} else if assert.Error(t, err, "%q", tc.id) {
+			assert.Contains(t, err.Error(), tc.err, "%q", tc.id)
+		}
+	}
+}
+
+func TestSchedulerDriverFrameworkNameLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		strict bool
+		ok     bool
+	}{
+		{strings.Repeat("n", 16), true, true},
+		{strings.Repeat("n", 17), false, true},
+		{strings.Repeat("n", 17), true, false},
+	} {
+		cfg := DefaultConfig()
+		cfg.Master = master
+		cfg.IDLimits = IDLimitConfig{FrameworkName: 16, ExecutorID: 255, TaskID: 255, Strict: tc.strict}
+		info := util.NewFrameworkInfo("test-user", tc.name, nil)
+		driver, err := NewMesosSchedulerDriverFromConfig(NewMockScheduler(), info, cfg)
+		if tc.ok {
+			assert.NoError(t, err, "%d bytes, strict %v", len(tc.name), tc.strict)
+			assert.NotNil(t, driver)
+		} else if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "Framework name is 17 bytes long")
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTaskIDLimits(t *testing.T) {
+	long := strings.Repeat("x", 33)
+	for _, tc := range []struct {
+		name       string
+		taskId     string
+		executorId string // no executor if empty
+		strict     bool
+		err        string
+	}{
+		{"short", "task-1", "", true, ""},
+		{"long task ID", long, "", true, "Task ID is 33 bytes long"},
+		{"long task ID, not strict", long, "", false, ""},
+		{"hostile task ID", "../task", "", true, "slash"},
+		{"hostile task ID, not strict", "../task", "", false, ""},
+		{"long executor ID", "task-1", long, true, "Executor ID is 33 bytes long"},
+		{"hidden executor ID", "task-1", ".executor", true, "starts with a dot"},
+		{"executor ID", "task-1", "executor-1", true, ""},
+	} {
+		sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		driver.messenger = msgr
+		driver.idLimits = IDLimitConfig{FrameworkName: 1024, ExecutorID: 32, TaskID: 32, Strict: tc.strict}
+
+		offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+		driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+		task := util.NewTaskInfo("task", util.NewTaskID(tc.taskId), util.NewSlaveID("test-slave-001"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+		if tc.executorId == "" {
+			task.Command = util.NewCommandInfo("pwd")
+		} else {
+			task.Executor = util.NewExecutorInfo(util.NewExecutorID(tc.executorId), util.NewCommandInfo("pwd"))
+			task.Executor.FrameworkId = framework.Id
+		}
+
+		_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+		waitEvents(driver)
+		launch := msgr.sent[0].(*mesos.LaunchTasksMessage)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.name)
+			assert.Len(t, launch.Tasks, 1, tc.name)
+			assert.Empty(t, sched.statuses, tc.name)
+			continue
+		}
+		if assert.Error(t, err, tc.name) {
+			assert.Contains(t, err.Error(), tc.err, tc.name)
+		}
+		assert.Empty(t, launch.Tasks, tc.name)
+		if assert.Len(t, sched.statuses, 1, tc.name) {
+			assert.Equal(t, mesos.TaskState_TASK_LOST, sched.statuses[0].GetState(), tc.name)
+			assert.Contains(t, sched.statuses[0].GetMessage(), tc.err, tc.name)
+		}
+	}
+}
+
+// countingMetrics counts increments and observations by name.
+type countingMetrics struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingMetrics) Increment(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[name]++
+}
+
+func (c *countingMetrics) Observe(name string, value float64) {
+	c.Increment(name)
+}
+
+func TestSchedulerDriverMetrics(t *testing.T) {
+	driver, _ := newDispatchDriver(t, false)
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	driver.Metrics = metrics
+
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(masterUpid)
+	driver.frameworkRegistered(driver.MasterPid, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	driver.masterLost(errors.New("connection refused"))
+	driver.OnMasterChanged(masterInfo)
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+	driver.OnMasterChanged(nil)
+
+	assert.Equal(t, map[string]int{
+		MetricRegistered:   1,
+		MetricDisconnected: 2,
+		MetricReregistered: 1,
+	}, metrics.counts)
+}
+
+// metricsMessenger records the metrics it reports to.
+type metricsMessenger struct {
+	*messenger.MockedMessenger
+	metrics messenger.Metrics
+}
+
+func (m *metricsMessenger) SetMetrics(metrics messenger.Metrics) {
+	m.metrics = metrics
+}
+
+func TestSchedulerDriverMessengerMetrics(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+	msgr := &metricsMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	driver.messenger = msgr
+
+	driver.startMetrics()
+	assert.Nil(t, msgr.metrics)
+
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	driver.Metrics = metrics
+	driver.startMetrics()
+	assert.Equal(t, metrics, msgr.metrics)
+}
+
+func TestSchedulerDriverPrometheusMetrics(t *testing.T) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.prometheusMetrics = true
+	driver.startMetrics()
+	metrics, ok := driver.Metrics.(*messenger.PrometheusMetrics)
+	if !assert.True(t, ok) {
+		return
+	}
+
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	sendTaskFailure(driver, "task-2", mesos.TaskState_TASK_RUNNING, "")
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FAILED, "")
+	driver.metrics().Observe(MetricDeclineRefuseSeconds, 5)
+
+	var text bytes.Buffer
+	_, err := metrics.WriteTo(&text)
+	assert.NoError(t, err)
+	for _, line := range []string{
+		"# TYPE mesos_status_updates_total counter",
+		`mesos_status_updates_total{task_state="TASK_FAILED"} 1`,
+		`mesos_status_updates_total{task_state="TASK_RUNNING"} 2`,
+		"# TYPE mesos_decline_refuse_seconds histogram",
+		`mesos_decline_refuse_seconds_bucket{le="1"} 0`,
+		`mesos_decline_refuse_seconds_bucket{le="5"} 1`,
+		"# TYPE mesos_connected gauge",
+		"mesos_connected 1",
+		"mesos_cached_offers 0",
+		"mesos_unsent_acks 0",
+	} {
+		assert.Contains(t, text.String(), line+"\n")
+	}
+
+	// the metrics set by the framework are kept.
+	driver = newConnectedDriver(t, sched)
+	driver.prometheusMetrics = true
+	driver.Metrics = &countingMetrics{counts: make(map[string]int)}
+	driver.startMetrics()
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Equal(t, 1, driver.Metrics.(*countingMetrics).counts[MetricStatusUpdates])
+}
+
+func ports(begin, end uint64) *mesos.Resource {
+	return util.NewRangesResource("ports", []*mesos.Value_Range{util.NewValueRange(begin, end)})
+}
+
+func TestFitResources(t *testing.T) {
+	roleMem := util.NewScalarResource("mem", 512)
+	roleMem.Role = &[]string{"analytics"}[0]
+	offered := []*mesos.Resource{
+		util.NewScalarResource("cpus", 2),
+		util.NewScalarResource("mem", 1024),
+		roleMem,
+		ports(31000, 31009),
+		ports(31010, 31019),
+		ports(32000, 32000),
+	}
+	for _, tc := range []struct {
+		name   string
+		needed []*mesos.Resource
+		err    string
+	}{
+		{"nothing", nil, ""},
+		{"all of it", []*mesos.Resource{util.NewScalarResource("cpus", 1.5), util.NewScalarResource("cpus", 0.5),
+			util.NewScalarResource("mem", 1024), roleMem, ports(31000, 31019), ports(32000, 32000)}, ""},
+		{"rounding", []*mesos.Resource{util.NewScalarResource("cpus", 0.1), util.NewScalarResource("cpus", 0.2),
+			util.NewScalarResource("cpus", 1.7)}, ""},
+		{"too many cpus", []*mesos.Resource{util.NewScalarResource("cpus", 1.5), util.NewScalarResource("cpus", 1)},
+			"Tasks need cpus 2.5, the offers hold 2."},
+		{"not offered", []*mesos.Resource{util.NewScalarResource("disk", 1)},
+			"Tasks need disk 1, the offers hold 0."},
+		{"role", []*mesos.Resource{util.NewScalarResource("mem", 1024), roleMem, roleMem},
+			"Tasks need mem(analytics) 1024, the offers hold 512."},
+		{"ports across offered ranges", []*mesos.Resource{ports(31005, 31015)}, ""},
+		{"ports out of range", []*mesos.Resource{ports(31015, 31025)},
+			"Tasks need ports [31015-31025], the offers hold [31000-31019, 32000-32000]."},
+		{"ports taken twice", []*mesos.Resource{ports(31000, 31004), ports(31004, 31004)},
+			"Tasks need ports [31004-31004], the offers hold [31005-31019, 32000-32000]."},
+	} {
+		err := fitResources(tc.needed, offered)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.name)
+		} else if assert.IsType(t, &OfferResourcesError{}, err, tc.name) {
+			assert.Equal(t, tc.err, err.Error(), tc.name)
+		}
+	}
+}
+
+func TestSchedulerDriverLaunchTasksOfferResources(t *testing.T) {
+	for _, check := range []bool{false, true} {
+		sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+		driver := newConnectedDriver(t, sched)
+		msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+		msgr.On("Send").Return(nil)
+		driver.messenger = msgr
+		driver.checkOfferResources = check
+
+		slaveId := util.NewSlaveID("test-slave-001")
+		offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, slaveId, "localhost")
+		offer.Resources = []*mesos.Resource{util.NewScalarResource("cpus", 1), util.NewScalarResource("mem", 128), ports(31000, 31001)}
+		driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+
+		executor := util.NewExecutorInfo(util.NewExecutorID("executor-1"), util.NewCommandInfo("pwd"))
+		executor.FrameworkId = framework.Id
+		executor.Resources = []*mesos.Resource{util.NewScalarResource("mem", 32)}
+		var tasks []*mesos.TaskInfo
+		for _, id := range []string{"task-1", "task-2"} {
+			task := util.NewTaskInfo(id, util.NewTaskID(id), slaveId,
+				[]*mesos.Resource{util.NewScalarResource("cpus", 0.5), util.NewScalarResource("mem", 64), ports(31000, 31000)})
+			task.Executor = executor
+			tasks = append(tasks, task)
+		}
+
+		// the executor is launched once, but both tasks want port 31000.
+		_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		if !check {
+			assert.NoError(t, err)
+			assert.Len(t, msgr.sent, 1)
+			continue
+		}
+		if assert.IsType(t, &OfferResourcesError{}, err) {
+			assert.Equal(t, "Tasks need ports [31000-31000], the offers hold [31001-31001].", err.Error())
+		}
+		assert.Empty(t, msgr.sent, "nothing is sent")
+		assert.True(t, driver.cache.containsOffer(offer.Id))
+		if assert.Len(t, sched.statuses, 2) {
+			assert.Equal(t, mesos.TaskState_TASK_LOST, sched.statuses[0].GetState())
+			assert.Equal(t, err.Error(), sched.statuses[0].GetMessage())
+		}
+
+		// the executor counts, unless it runs on the slave already.
+		tasks[1].Resources = []*mesos.Resource{util.NewScalarResource("mem", 64), ports(31001, 31001)}
+		_, err = driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		if assert.Error(t, err) {
+			assert.Equal(t, "Tasks need mem 160, the offers hold 128.", err.Error())
+		}
+		driver.cache.putExecutor(slaveId, executor)
+		_, err = driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		assert.NoError(t, err)
+		if assert.Len(t, msgr.sent, 1) {
+			assert.Len(t, msgr.sent[0].(*mesos.LaunchTasksMessage).Tasks, 2)
+		}
+	}
+}
+
+// scoringScheduler scores offers by their cpus.
+type scoringScheduler struct {
+	*MockScheduler
+	offered   []string
+	rescinded []string
+}
+
+func (sched *scoringScheduler) Score(offer *mesos.Offer) float64 {
+	return offer.Resources[0].GetScalar().GetValue()
+}
+
+func (sched *scoringScheduler) ResourceOffers(_ SchedulerDriver, offers []*mesos.Offer) {
+	for _, offer := range offers {
+		sched.offered = append(sched.offered, offer.Id.GetValue())
+	}
+}
+
+func (sched *scoringScheduler) OfferRescinded(_ SchedulerDriver, offerId *mesos.OfferID) {
+	sched.rescinded = append(sched.rescinded, offerId.GetValue())
+}
+
+// topOffers returns the IDs of the keep highest-scored offers, ties are
+// broken by offer ID.
+func topOffers(scores map[string]float64, keep int) map[string]float64 {
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	top := make(map[string]float64)
+	for i := 0; i < len(ids) && i < keep; i++ {
+		top[ids[i]] = scores[ids[i]]
+	}
+	return top
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSchedulerDriverKeepsTopScoredOffers(t *testing.T) {
+	const keep = 3
+	sched := &scoringScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.maxKeptOffers = keep
+
+	rng := rand.New(rand.NewSource(1))
+	kept := make(map[string]float64) // the offers expected to be outstanding
+	next := 0
+	for step := 0; step < 500; step++ {
+		switch op := rng.Intn(4); {
+		case op < 2 || len(kept) == 0:
+			msg := &mesos.ResourceOffersMessage{}
+			all := make(map[string]float64, len(kept))
+			for id, score := range kept {
+				all[id] = score
+			}
+			for i := rng.Intn(4) + 1; i > 0; i-- {
+				id := fmt.Sprintf("offer-%04d", next)
+				next++
+				score := float64(rng.Intn(20))
+				offer := util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+				offer.Resources = []*mesos.Resource{util.NewScalarResource("cpus", score)}
+				msg.Offers = append(msg.Offers, offer)
+				msg.Pids = append(msg.Pids, "slave(1)@127.0.0.1:5052")
+				all[id] = score
+			}
+			top := topOffers(all, keep)
+
+			var offered, rescinded []string
+			for _, offer := range msg.Offers {
+				if _, ok := top[offer.Id.GetValue()]; ok {
+					offered = append(offered, offer.Id.GetValue())
+				}
+			}
+			for _, id := range sortedKeys(kept) {
+				if _, ok := top[id]; !ok {
+					rescinded = append(rescinded, id)
+				}
+			}
+			sched.offered, sched.rescinded = nil, nil
+			driver.resourcesOffered(driver.MasterPid, msg)
+			sort.Strings(sched.rescinded)
+			assert.Equal(t, offered, sched.offered, "step %d", step)
+			assert.Equal(t, rescinded, sched.rescinded, "step %d", step)
+			for _, id := range rescinded {
+				assert.True(t, driver.cache.isRescinded(util.NewOfferID(id)), "step %d", step)
+			}
+			kept = top
+		case op == 2:
+			id := sortedKeys(kept)[rng.Intn(len(kept))]
+			driver.resourceOfferRescinded(driver.MasterPid, &mesos.RescindResourceOfferMessage{OfferId: util.NewOfferID(id)})
+			delete(kept, id)
+		default:
+			id := sortedKeys(kept)[rng.Intn(len(kept))]
+			_, err := driver.DeclineOffer(util.NewOfferID(id), nil)
+			assert.NoError(t, err)
+			delete(kept, id)
+		}
+
+		outstanding := []string{}
+		for _, entry := range driver.cache.savedOffers.list() {
+			outstanding = append(outstanding, entry.offer.Id.GetValue())
+		}
+		sort.Strings(outstanding)
+		assert.Equal(t, sortedKeys(kept), outstanding, "step %d", step)
+		assert.True(t, len(outstanding) <= keep, "step %d", step)
+	}
+}
+
+func TestSchedulerDriverKeepsAllOffersUnlimited(t *testing.T) {
+	sched := &scoringScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+
+	msg := &mesos.ResourceOffersMessage{}
+	for i := 0; i < 5; i++ {
+		offer := util.NewOffer(util.NewOfferID(fmt.Sprintf("offer-%d", i)), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+		offer.Resources = []*mesos.Resource{util.NewScalarResource("cpus", float64(i))}
+		msg.Offers = append(msg.Offers, offer)
+		msg.Pids = append(msg.Pids, "slave(1)@127.0.0.1:5052")
+	}
+	driver.resourcesOffered(driver.MasterPid, msg)
+
+	assert.Equal(t, 5, len(sched.offered))
+	assert.Equal(t, 5, driver.cache.savedOffers.len())
+	assert.Empty(t, sched.rescinded)
+}
+
+func TestSchedulerDriverOffersExpire(t *testing.T) {
+	defer func(v time.Duration) { *offerTimeout = v }(*offerTimeout)
+	*offerTimeout = time.Minute
+
+	sched := &scoringScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("StatusUpdate").Return()
+	driver := newConnectedDriver(t, sched)
+	clock := newFakeClock()
+	clock.use(driver)
+
+	msg := &mesos.ResourceOffersMessage{}
+	for _, id := range []string{"offer-1", "offer-2"} {
+		offer := util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+		offer.Resources = []*mesos.Resource{util.NewScalarResource("cpus", 1)}
+		msg.Offers = append(msg.Offers, offer)
+		msg.Pids = append(msg.Pids, "slave(1)@127.0.0.1:5052")
+	}
+	driver.resourcesOffered(driver.MasterPid, msg)
+
+	driver.expireOffers()
+	waitEvents(driver)
+	assert.Empty(t, sched.rescinded)
+	assert.Equal(t, 2, driver.cache.savedOffers.len())
+
+	clock.advance(2 * time.Minute)
+	task := util.NewTaskInfo("simple-task", util.NewTaskID("simple-task-1"), util.NewSlaveID("test-slave-001"), nil)
+	_, err := driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, []*mesos.TaskInfo{task}, nil)
+	waitEvents(driver)
+	assert.Error(t, err)
+
+	// expired offers are rescinded, the scheduler is told once.
+	sort.Strings(sched.rescinded)
+	assert.Equal(t, []string{"offer-1", "offer-2"}, sched.rescinded)
+	assert.Equal(t, 0, driver.cache.savedOffers.len())
+	assert.True(t, driver.cache.isRescinded(util.NewOfferID("offer-1")))
+	sched.AssertNumberOfCalls(t, "StatusUpdate", 1)
+}
+
+// installMessenger records the handlers installed by the driver.
+type installMessenger struct {
+	*messenger.MockedMessenger
+	types    map[string]reflect.Type
+	handlers map[string]messenger.MessageHandler
+}
+
+func (m *installMessenger) Install(handler messenger.MessageHandler, msg proto.Message) error {
+	name := reflect.TypeOf(msg).Elem().Name()
+	m.types[name] = reflect.TypeOf(msg).Elem()
+	m.handlers[name] = handler
+	return nil
+}
+
+// newDispatchDriver returns a driver whose handlers are installed on the
+// returned messenger.
+func newDispatchDriver(t *testing.T, connected bool) (*MesosSchedulerDriver, *installMessenger) {
+	sched := NewMockScheduler()
+	for _, method := range []string{"Registered", "Reregistered", "Disconnected", "ResourceOffers", "OfferRescinded",
+		"StatusUpdate", "FrameworkMessage", "SlaveLost", "ExecutorLost", "Error"} {
+		sched.On(method).Return()
+	}
+	msgr := &installMessenger{
+		MockedMessenger: messenger.NewMockedMessenger(),
+		types:           make(map[string]reflect.Type),
+		handlers:        make(map[string]messenger.MessageHandler),
+	}
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.messenger = msgr
+	driver.self = &upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"}
+	assert.NoError(t, driver.init())
+	driver.transition(StateRegistering)
+	if connected {
+		driver.transition(StateConnected)
+	}
+	return driver, msgr
+}
+
+// dispatchSeeds returns a valid message of each type the driver handles.
+func dispatchSeeds() []proto.Message {
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(masterUpid)
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	offer.Resources = []*mesos.Resource{util.NewScalarResource("cpus", 1)}
+	status := util.NewTaskStatus(util.NewTaskID("task-1"), mesos.TaskState_TASK_RUNNING)
+	update := util.NewStatusUpdate(framework.Id, status, float64(time.Now().Unix()), []byte("uuid-1"))
+	update.SlaveId = util.NewSlaveID("slave-1")
+	update.ExecutorId = util.NewExecutorID("executor-1")
+	return []proto.Message{
+		&mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo},
+		&mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo},
+		&mesos.ResourceOffersMessage{Offers: []*mesos.Offer{offer}, Pids: []string{"slave(1)@127.0.0.1:5052"}},
+		&mesos.RescindResourceOfferMessage{OfferId: util.NewOfferID("offer-1")},
+		&mesos.StatusUpdateMessage{Update: update, Pid: proto.String("slave(1)@127.0.0.1:5052")},
+		&mesos.LostSlaveMessage{SlaveId: util.NewSlaveID("slave-1")},
+		&mesos.ExecutorToFrameworkMessage{
+			SlaveId:     util.NewSlaveID("slave-1"),
+			FrameworkId: framework.Id,
+			ExecutorId:  util.NewExecutorID("executor-1"),
+			Data:        []byte("hello"),
+		},
+		&mesos.FrameworkErrorMessage{Message: proto.String("error")},
+		&mesos.ExitedExecutorMessage{
+			ExecutorId:  util.NewExecutorID("executor-1"),
+			FrameworkId: framework.Id,
+			SlaveId:     util.NewSlaveID("slave-1"),
+			Status:      proto.Int32(1),
+		},
+	}
+}
+
+// FuzzSchedulerDriverDispatch decodes the payload as a messenger would
+// and hands it to the driver's handler for the message, which must not
+// panic.
+func FuzzSchedulerDriverDispatch(f *testing.F) {
+	for _, msg := range dispatchSeeds() {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		name := reflect.TypeOf(msg).Elem().Name()
+		f.Add(name, data, true)
+		f.Add(name, data, false)
+	}
+
+	f.Fuzz(func(t *testing.T, name string, data []byte, connected bool) {
+		_, msgr := newDispatchDriver(t, connected)
+		names := make([]string, 0, len(msgr.types))
+		for n := range msgr.types {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		mtype, ok := msgr.types[name]
+		if !ok {
+			// route unknown names to a handler anyway.
+			name = names[len(name)%len(names)]
+			mtype = msgr.types[name]
+		}
+
+		msg := reflect.New(mtype).Interface().(proto.Message)
+		if err := messenger.Unmarshal(data, msg); err != nil {
+			return // rejected by the messenger
+		}
+		slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+		msgr.handlers[name](slave, msg)
+	})
+}
+
+func TestRequireFields(t *testing.T) {
+	update := &mesos.StatusUpdateMessage{Update: &mesos.StatusUpdate{}}
+	assert.NoError(t, requireFields(update, "Update"))
+
+	err := requireFields(update, "Update", "Update.Status.TaskId")
+	if assert.IsType(t, &ProtocolError{}, err) {
+		assert.Equal(t, "Update.Status.TaskId", err.(*ProtocolError).Field)
+		assert.Equal(t, "StatusUpdateMessage is missing required field Update.Status.TaskId.", err.Error())
+	}
+	err = requireFields(&mesos.StatusUpdateMessage{}, "Update.Status")
+	if assert.IsType(t, &ProtocolError{}, err) {
+		assert.Equal(t, "Update.Status", err.(*ProtocolError).Field)
+	}
+}
+
+func TestSchedulerDriverIgnoresIncompleteMessages(t *testing.T) {
+	messages := []proto.Message{
+		&mesos.RescindResourceOfferMessage{},
+		&mesos.StatusUpdateMessage{Update: &mesos.StatusUpdate{}},
+		&mesos.LostSlaveMessage{},
+		&mesos.ExecutorToFrameworkMessage{SlaveId: util.NewSlaveID("slave-1")},
+		&mesos.ExitedExecutorMessage{ExecutorId: util.NewExecutorID("executor-1")},
+	}
+	slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	for _, msg := range messages {
+		driver, msgr := newDispatchDriver(t, true)
+		msgr.handlers[reflect.TypeOf(msg).Elem().Name()](slave, msg)
+		driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "OfferRescinded")
+		driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "StatusUpdate")
+		driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "SlaveLost")
+		driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "FrameworkMessage")
+		driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "ExecutorLost")
+		msgr.AssertNotCalled(t, "Send")
+	}
+
+	driver, msgr := newDispatchDriver(t, false)
+	msgr.handlers["FrameworkRegisteredMessage"](slave, &mesos.FrameworkRegisteredMessage{FrameworkId: framework.Id})
+	assert.False(t, driver.Connected())
+	driver.Scheduler.(*MockScheduler).AssertNotCalled(t, "Registered")
+}
+
+func TestSchedulerDriverQuota(t *testing.T) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+	driver.quota = newQuotaAccount(Resources{Cpus: 4, Mem: 1024}, true)
+
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	launch := func(offerId string, tasks ...*mesos.TaskInfo) error {
+		offer := util.NewOffer(util.NewOfferID(offerId), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+		driver.cache.putOffer(offer, slavePid)
+		sched.statuses = nil
+		_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+		waitEvents(driver)
+		return err
+	}
+	newTask := func(id string, cpus, mem float64) *mesos.TaskInfo {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("test-slave-001"), []*mesos.Resource{
+			util.NewScalarResource("cpus", cpus),
+			util.NewScalarResource("mem", mem),
+		})
+		task.Command = util.NewCommandInfo("pwd")
+		return task
+	}
+	quota := driver.Quota()
+
+	assert.NoError(t, launch("offer-1", newTask("task-1", 2, 512)))
+	assert.Equal(t, Resources{Cpus: 2, Mem: 512}, quota.Used())
+	assert.Equal(t, Resources{Cpus: 2, Mem: 512, Disk: math.Inf(1)}, quota.Remaining())
+
+	// a task exceeding the quota is lost, the others are launched.
+	err := launch("offer-2", newTask("task-2", 3, 64), newTask("task-3", 2, 64))
+	if assert.IsType(t, &QuotaExceededError{}, err) {
+		exceeded := err.(*QuotaExceededError)
+		assert.Equal(t, "task-2", exceeded.TaskId)
+		assert.Equal(t, Resources{Cpus: 3, Mem: 64}, exceeded.Needed)
+	}
+	if assert.Len(t, sched.statuses, 1) {
+		assert.Equal(t, "task-2", sched.statuses[0].GetTaskId().GetValue())
+		assert.Equal(t, mesos.TaskState_TASK_LOST, sched.statuses[0].GetState())
+	}
+	assert.Len(t, msgr.sent[len(msgr.sent)-1].(*mesos.LaunchTasksMessage).Tasks, 1)
+	assert.Equal(t, Resources{Cpus: 4, Mem: 576}, quota.Used())
+
+	// terminal updates release the resources of their tasks.
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Equal(t, Resources{Cpus: 4, Mem: 576}, quota.Used())
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FINISHED, "")
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FINISHED, "")
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+
+	// a lost task found running by reconciliation is charged again.
+	sendTaskFailure(driver, "task-3", mesos.TaskState_TASK_LOST, "")
+	assert.Equal(t, Resources{}, quota.Used())
+	sendTaskFailure(driver, "task-3", mesos.TaskState_TASK_RUNNING, "")
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+
+	// tasks lost by the driver are not.
+	msgr.sent = nil
+	failing := messenger.NewMockedMessenger()
+	failing.On("Send").Return(messenger.ErrQueueFull)
+	driver.messenger = failing
+	assert.Error(t, launch("offer-3", newTask("task-4", 1, 64)))
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+	sendTaskFailure(driver, "task-4", mesos.TaskState_TASK_RUNNING, "")
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+	driver.messenger = msgr
+
+	// tasks launched by a previous instance of the framework.
+	quota.Charge(util.NewTaskID("task-0"), Resources{Cpus: 1})
+	assert.Equal(t, Resources{Cpus: 3, Mem: 64}, quota.Used())
+	sendTaskFailure(driver, "task-0", mesos.TaskState_TASK_KILLED, "")
+	assert.Equal(t, Resources{Cpus: 2, Mem: 64}, quota.Used())
+}
+
+func TestSchedulerDriverQuotaExecutor(t *testing.T) {
+	sched := &statusScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	driver.quota = newQuotaAccount(Resources{Mem: 1024}, false)
+	driver.cache.putOffer(util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost"),
+		&upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+
+	executor := util.NewExecutorInfo(util.NewExecutorID("executor-1"), util.NewCommandInfo("./executor"))
+	executor.Resources = []*mesos.Resource{util.NewScalarResource("mem", 128)}
+	var tasks []*mesos.TaskInfo
+	for _, id := range []string{"task-1", "task-2"} {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("test-slave-001"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 512)})
+		task.Executor = executor
+		tasks = append(tasks, task)
+	}
+
+	// the executor is charged once, with its first task, and the quota
+	// is not enforced.
+	_, err := driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, tasks, &mesos.Filters{})
+	assert.NoError(t, err)
+	assert.Empty(t, sched.statuses)
+	assert.Equal(t, Resources{Mem: 1152}, driver.Quota().Used())
+	assert.Equal(t, -128.0, driver.Quota().Remaining().Mem)
+}
+
+func TestSchedulerDriverWithoutQuota(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	assert.Nil(t, driver.Quota())
+}
+
+// fakeClock fires the channels returned by After only when told to.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	afters chan chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), afters: make(chan chan time.Time, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by d.
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// use makes the driver, and its cache, tell the time with the clock.
+func (c *fakeClock) use(driver *MesosSchedulerDriver) {
+	driver.clock = c
+	driver.cache.clock = c
+}
+
+func (c *fakeClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.afters <- ch
+	return ch
+}
+
+// tick waits for the next call to After and fires it.
+func (c *fakeClock) tick(t *testing.T) {
+	select {
+	case ch := <-c.afters:
+		ch <- c.Now()
+	case <-time.After(time.Second):
+		t.Fatalf("Tired of waiting for the clock to be used.")
+	}
+}
+
+func newReconcileDriver(t *testing.T, batchSize int) (*MesosSchedulerDriver, *messenger.MockedMessenger, *fakeClock) {
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	driver.self = &upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"}
+	driver.transition(StateRegistering)
+	driver.transition(StateConnected)
+	clock := newFakeClock()
+	clock.use(driver)
+	driver.reconcileBatchSize = batchSize
+	return driver, msgr, clock
+}
+
+func taskStatuses(n int) []*mesos.TaskStatus {
+	statuses := make([]*mesos.TaskStatus, n)
+	for i := range statuses {
+		statuses[i] = util.NewTaskStatus(util.NewTaskID(fmt.Sprintf("task-%d", i)), mesos.TaskState_TASK_RUNNING)
+	}
+	return statuses
+}
+
+func waitDone(t *testing.T, r *Reconciliation) {
+	select {
+	case <-r.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Tired of waiting for the reconciliation to finish.")
+	}
+}
+
+func TestReconcileBatches(t *testing.T) {
+	statuses := taskStatuses(5)
+	batches := reconcileBatches(statuses, 2)
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, statuses[4:], batches[2])
+	assert.Equal(t, 1, len(reconcileBatches(statuses, 0)))
+	assert.Equal(t, 1, len(reconcileBatches(statuses, 5)))
+	assert.Equal(t, [][]*mesos.TaskStatus{nil}, reconcileBatches(nil, 2))
+}
+
+func TestReconcileTasksAsyncSendsAllBatches(t *testing.T) {
+	driver, msgr, clock := newReconcileDriver(t, 2)
+
+	r, stat, err := driver.ReconcileTasksAsync(taskStatuses(5))
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	clock.tick(t)
+	clock.tick(t)
+	waitDone(t, r)
+
+	assert.NoError(t, r.Err())
+	assert.Equal(t, 3, r.Sent())
+	msgr.AssertNumberOfCalls(t, "Send", 3)
+}
+
+func TestReconcileTasksAsyncCancel(t *testing.T) {
+	driver, msgr, clock := newReconcileDriver(t, 2)
+
+	r, _, err := driver.ReconcileTasksAsync(taskStatuses(6))
+	assert.NoError(t, err)
+	r.Cancel()
+	r.Cancel() // idempotent
+	// even an expired delay does not send another batch.
+	clock.tick(t)
+	waitDone(t, r)
+
+	assert.Error(t, r.Err())
+	assert.Equal(t, 1, r.Sent())
+	msgr.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func TestReconcileTasksAsyncDriverStopped(t *testing.T) {
+	driver, _, _ := newReconcileDriver(t, 2)
+
+	r, _, err := driver.ReconcileTasksAsync(taskStatuses(6))
+	assert.NoError(t, err)
+	driver.Abort()
+	waitDone(t, r)
+
+	assert.Error(t, r.Err())
+	assert.Equal(t, 1, r.Sent())
+}
+
+// roleResource returns a scalar resource reserved for role.
+func roleResource(name string, value float64, role string) *mesos.Resource {
+	r := util.NewScalarResource(name, value)
+	r.Role = proto.String(role)
+	return r
+}
+
+func roleOffer(id string, resources ...*mesos.Resource) *mesos.Offer {
+	offer := util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("slave-1"), "localhost")
+	offer.Resources = resources
+	return offer
+}
+
+func TestDominantRole(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		offer *mesos.Offer
+		role  string
+	}{
+		{"no resources", roleOffer("offer"), "*"},
+		{"unreserved", roleOffer("offer", util.NewScalarResource("cpus", 2)), "*"},
+		{"reserved", roleOffer("offer", roleResource("cpus", 2, "prod")), "prod"},
+		{"larger share", roleOffer("offer",
+			roleResource("cpus", 1, "*"), roleResource("cpus", 3, "prod")), "prod"},
+		{"largest share of any resource", roleOffer("offer",
+			roleResource("cpus", 3, "*"), roleResource("cpus", 1, "prod"),
+			roleResource("mem", 100, "*"), roleResource("mem", 900, "prod")), "prod"},
+		{"tie", roleOffer("offer", roleResource("cpus", 1, "prod"), roleResource("cpus", 1, "*")), "*"},
+	} {
+		assert.Equal(t, tc.role, dominantRole(tc.offer), tc.name)
+	}
+}
+
+func TestSchedulerDriverDeclineRefusal(t *testing.T) {
+	sched := &scoringScheduler{MockScheduler: NewMockScheduler()}
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	driver.Metrics = metrics
+	driver.Refusal = RefusalPolicy{
+		Roles:   map[string]time.Duration{"*": time.Second, "prod": time.Hour},
+		Default: 10 * time.Minute,
+	}
+	slave := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+
+	refused := func() *mesos.Filters {
+		launch := msgr.sent[len(msgr.sent)-1].(*mesos.LaunchTasksMessage)
+		return launch.Filters
+	}
+	for _, tc := range []struct {
+		name    string
+		offer   *mesos.Offer
+		filters *mesos.Filters
+		seconds float64
+	}{
+		{"unreserved", roleOffer("offer-1", util.NewScalarResource("cpus", 4)), nil, 1},
+		{"reserved", roleOffer("offer-2", roleResource("cpus", 4, "prod")), nil, 3600},
+		{"mostly reserved", roleOffer("offer-3",
+			roleResource("cpus", 1, "*"), roleResource("cpus", 3, "prod")), nil, 3600},
+		{"other role", roleOffer("offer-4", roleResource("cpus", 4, "dev")), nil, 600},
+		{"caller filters", roleOffer("offer-5", roleResource("cpus", 4, "prod")),
+			&mesos.Filters{RefuseSeconds: proto.Float64(7)}, 7},
+	} {
+		driver.cache.putOffer(tc.offer, slave)
+		_, err := driver.DeclineOffer(tc.offer.Id, tc.filters)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.seconds, refused().GetRefuseSeconds(), tc.name)
+	}
+
+	// an offer the driver does not know gets the default.
+	_, err := driver.DeclineOffer(util.NewOfferID("offer-unknown"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(600), refused().GetRefuseSeconds())
+
+	// offers declined by the driver follow the policy too.
+	driver.maxKeptOffers = 1
+	msg := &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{
+			roleOffer("offer-6", roleResource("cpus", 4, "prod")),
+			roleOffer("offer-7", util.NewScalarResource("cpus", 8)),
+		},
+		Pids: []string{slave.String(), slave.String()},
+	}
+	driver.resourcesOffered(driver.MasterPid, msg)
+	assert.Equal(t, []string{"offer-7"}, sched.offered)
+	launch := msgr.sent[len(msgr.sent)-1].(*mesos.LaunchTasksMessage)
+	assert.Equal(t, "offer-6", launch.OfferIds[0].GetValue())
+	assert.Equal(t, float64(3600), launch.Filters.GetRefuseSeconds())
+
+	// caller filters are not reported.
+	assert.Equal(t, 6, metrics.counts[MetricDeclineRefuseSeconds])
+}
+
+const failingAuthProvider = "test-failing"
+
+func init() {
+	auth.RegisterAuthenticateeProvider(failingAuthProvider, auth.AuthenticateeFunc(
+		func(context.Context, callback.Handler) error { return auth.AuthenticationFailed }))
+}
+
+// reasonScheduler records the reasons passed to ErrorReason.
+type reasonScheduler struct {
+	*MockScheduler
+	reasons []ShutdownReason
+}
+
+func (sched *reasonScheduler) ErrorReason(_ SchedulerDriver, _ string, reason ShutdownReason) {
+	sched.reasons = append(sched.reasons, reason)
+}
+
+// lastTransition returns the final transition delivered to a watcher.
+func lastTransition(t *testing.T, transitions <-chan StateTransition) (last StateTransition) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case tr, ok := <-transitions:
+			if !ok {
+				return
+			}
+			last = tr
+		case <-timeout:
+			t.Fatalf("Transitions channel was not closed.")
+		}
+	}
+}
+
+func TestSchedulerDriverShutdownReason(t *testing.T) {
+	errorMessage := func(from func(*MesosSchedulerDriver) *upid.UPID) func(*MesosSchedulerDriver) {
+		return func(driver *MesosSchedulerDriver) {
+			driver.frameworkErrorRcvd(from(driver), &mesos.FrameworkErrorMessage{Message: proto.String("error")})
+		}
+	}
+	tests := []struct {
+		name     string
+		sendErr  error
+		shutdown func(*MesosSchedulerDriver)
+		status   mesos.Status
+		reason   ShutdownReason
+		reported bool
+	}{
+		{"stop", nil, func(driver *MesosSchedulerDriver) { driver.Stop(false) },
+			mesos.Status_DRIVER_STOPPED, ShutdownUserStop, false},
+		{"abort", nil, func(driver *MesosSchedulerDriver) { driver.Abort() },
+			mesos.Status_DRIVER_ABORTED, ShutdownUserAbort, false},
+		{"unregister failed", errors.New("connection refused"), func(driver *MesosSchedulerDriver) { driver.Stop(false) },
+			mesos.Status_DRIVER_ABORTED, ShutdownUnregisterFailed, false},
+		{"master error", nil, errorMessage(func(driver *MesosSchedulerDriver) *upid.UPID { return driver.MasterPid }),
+			mesos.Status_DRIVER_ABORTED, ShutdownMasterError, true},
+		{"messenger error", nil, errorMessage(func(driver *MesosSchedulerDriver) *upid.UPID { return driver.self }),
+			mesos.Status_DRIVER_ABORTED, ShutdownMessengerError, true},
+		{"send failed", nil, func(driver *MesosSchedulerDriver) {
+			driver.sendFailed(&messenger.Message{
+				UPID:         &upid.UPID{ID: "other(1)", Host: "127.0.0.1", Port: "5053"},
+				Name:         "mesos.internal.KillTaskMessage",
+				ProtoMessage: &mesos.KillTaskMessage{FrameworkId: framework.Id, TaskId: util.NewTaskID("task-1")},
+			}, errors.New("connection refused"))
+			waitEvents(driver)
+		}, mesos.Status_DRIVER_ABORTED, ShutdownSendFailed, true},
+	}
+
+	for _, test := range tests {
+		msgr := messenger.NewMockedMessenger()
+		msgr.On("Send").Return(test.sendErr)
+		msgr.On("Stop").Return(nil)
+
+		sched := &reasonScheduler{MockScheduler: NewMockScheduler()}
+		driver, err := NewMesosSchedulerDriver(sched, framework, master, nil)
+		assert.NoError(t, err)
+		driver.messenger = msgr
+		driver.self = &upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"}
+		driver.transition(StateRegistering)
+		driver.transition(StateConnected)
+		driver.startEvents()
+		transitions := driver.WatchState(context.Background())
+
+		assert.Equal(t, ShutdownNone, driver.ShutdownReason(), test.name)
+		test.shutdown(driver)
+
+		assert.Equal(t, test.status, driver.Status(), test.name)
+		assert.Equal(t, test.reason, driver.ShutdownReason(), test.name)
+		last := lastTransition(t, transitions)
+		assert.Equal(t, test.status, last.To.status(), test.name)
+		assert.Equal(t, test.reason, last.Reason, test.name)
+		if test.reported {
+			assert.Equal(t, []ShutdownReason{test.reason}, sched.reasons, test.name)
+		} else {
+			assert.Empty(t, sched.reasons, test.name)
+		}
+	}
+}
+
+func TestSchedulerDriverShutdownReasonAuthenticationFailed(t *testing.T) {
+	defer func(v string) { *authProvider = v }(*authProvider)
+	*authProvider = failingAuthProvider
+
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Start").Return(nil)
+	msgr.On("UPID").Return(&upid.UPID{ID: "scheduler(1)", Host: "127.0.0.1", Port: "5051"})
+	msgr.On("Stop").Return(nil)
+
+	sched := &reasonScheduler{MockScheduler: NewMockScheduler()}
+	credential := &mesos.Credential{Principal: proto.String("principal"), Secret: []byte("secret")}
+	driver, err := NewMesosSchedulerDriver(sched, framework, master, credential)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+
+	stat, err := driver.Start()
+	assert.Equal(t, auth.AuthenticationFailed, err)
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, stat)
+	assert.Equal(t, ShutdownAuthenticationFailed, driver.ShutdownReason())
+	assert.Equal(t, []ShutdownReason{ShutdownAuthenticationFailed}, sched.reasons)
+	msgr.AssertNumberOfCalls(t, "Send", 0)
+	msgr.AssertNumberOfCalls(t, "Stop", 1)
+}
+
+// contextScheduler records the slave contexts of the status updates.
+type contextScheduler struct {
+	*MockScheduler
+	contexts []SlaveContext
+}
+
+func (sched *contextScheduler) StatusUpdateContext(_ SchedulerDriver, _ *mesos.TaskStatus, sc SlaveContext) {
+	sched.contexts = append(sched.contexts, sc)
+}
+
+func TestSchedulerDriverSlaveContext(t *testing.T) {
+	sched := &contextScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("ResourceOffers").Return()
+	sched.On("SlaveLost").Return()
+	driver := newConnectedDriver(t, sched)
+
+	rack := &mesos.Attribute{
+		Name: proto.String("rack"),
+		Type: mesos.Value_TEXT.Enum(),
+		Text: &mesos.Value_Text{Value: proto.String("r1")},
+	}
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "slave1.example.com")
+	offer.Attributes = []*mesos.Attribute{rack}
+	driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+		Offers: []*mesos.Offer{offer},
+		Pids:   []string{"slave(1)@127.0.0.1:5052"},
+	})
+
+	// the updates of a known slave carry its hostname and attributes.
+	sc := driver.ResolveSlave(util.NewSlaveID("test-slave-001"))
+	assert.Equal(t, "slave1.example.com", sc.Hostname)
+	assert.Equal(t, "r1", sc.Attribute("rack").GetText().GetValue())
+	assert.Nil(t, sc.Attribute("zone"))
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FAILED, "")
+	assert.Equal(t, uint64(0), sc.Epoch)
+	sc.Epoch = driver.Epoch()
+	assert.Equal(t, []SlaveContext{sc}, sched.contexts)
+	sched.AssertNotCalled(t, "StatusUpdate")
+
+	// the context is a copy of the offered attributes.
+	rack.Text.Value = proto.String("r2")
+	assert.Equal(t, "r1", driver.ResolveSlave(util.NewSlaveID("test-slave-001")).Attribute("rack").GetText().GetValue())
+
+	// an unknown slave has an empty context.
+	assert.Equal(t, SlaveContext{}, driver.ResolveSlave(util.NewSlaveID("test-slave-002")))
+	assert.Equal(t, SlaveContext{}, driver.ResolveSlave(nil))
+
+	// so has a lost slave.
+	driver.slaveLost(driver.MasterPid, &mesos.LostSlaveMessage{SlaveId: util.NewSlaveID("test-slave-001")})
+	sendTaskFailure(driver, "task-2", mesos.TaskState_TASK_LOST, "")
+	assert.Equal(t, []SlaveContext{sc, {Epoch: driver.Epoch()}}, sched.contexts)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	now := time.Unix(0, 0)
+
+	assert.True(t, b.allow(now))
+	b.failure(now)
+	assert.Equal(t, breakerClosed, b.state)
+	b.failure(now)
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow(now.Add(time.Second)))
+
+	// a failed probe opens the breaker at once.
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(now))
+	assert.Equal(t, breakerHalfOpen, b.state)
+	b.failure(now)
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow(now))
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.Equal(t, breakerClosed, b.state)
+	assert.Equal(t, 0, b.failures)
+}
+
+func TestSchedulerDriverSlaveRouteFlapping(t *testing.T) {
+	driver := newConnectedDriver(t, NewMockScheduler())
+	clock := newFakeClock()
+	clock.use(driver)
+	driver.startEvents()
+	defer close(driver.stopCh)
+
+	slaveId := util.NewSlaveID("test-slave-001")
+	execId := util.NewExecutorID("test-executor-001")
+	slavePid := &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"}
+	driver.cache.putSlavePid(slaveId, slavePid)
+
+	sendMessage := func() {
+		_, err := driver.SendFrameworkMessage(execId, slaveId, "hello")
+		assert.NoError(t, err)
+	}
+	slaveDown := func() {
+		driver.sendFailed(&messenger.Message{
+			UPID:         slavePid,
+			Name:         "mesos.internal.FrameworkToExecutorMessage",
+			ProtoMessage: &mesos.FrameworkToExecutorMessage{SlaveId: slaveId, ExecutorId: execId},
+		}, errors.New("connection refused"))
+		waitEvents(driver)
+	}
+	assertRoute := func(mode SlaveRouteMode, failures, fallbacks uint64) {
+		route := driver.SlaveRoutes()["test-slave-001"]
+		assert.Equal(t, SlaveRoute{Mode: mode, Failures: failures, Fallbacks: fallbacks}, route)
+	}
+
+	sendMessage()
+	assertRoute(SlaveRouteDirect, 0, 0)
+
+	for i := 0; i < *directSendFailures; i++ {
+		slaveDown()
+	}
+	assertRoute(SlaveRouteMaster, 3, 3)
+	sendMessage()
+	assertRoute(SlaveRouteMaster, 3, 4)
+
+	// the probe fails, the slave is still down.
+	clock.advance(*directSendReprobe)
+	sendMessage()
+	assertRoute(SlaveRouteProbing, 3, 4)
+	slaveDown()
+	assertRoute(SlaveRouteMaster, 4, 5)
+
+	// the slave is back.
+	clock.advance(*directSendReprobe)
+	sendMessage()
+	assertRoute(SlaveRouteProbing, 4, 5)
+	sendMessage()
+	assertRoute(SlaveRouteDirect, 4, 5)
+
+	// a lost slave is forgotten.
+	driver.cache.removeSlavePid(slaveId)
+	assert.Empty(t, driver.SlaveRoutes())
+}
+
+func TestSchedulerDriverStateTransitions(t *testing.T) {
+	messenger := messenger.NewMockedMessenger()
+	messenger.On("Start").Return(nil)
+	messenger.On("UPID").Return(&upid.UPID{})
+	messenger.On("Send").Return(nil)
+	messenger.On("Stop").Return(nil)
+
+	sched := NewMockScheduler()
+	sched.On("Registered").Return()
+	sched.On("Disconnected").Return()
+	sched.On("Reregistered").Return()
+
+	driver, err := NewMesosSchedulerDriver(sched, util.NewFrameworkInfo("test-user", "test-name", nil), master, nil)
+	assert.NoError(t, err)
+	driver.messenger = messenger
+	assert.Equal(t, StateInitialized, driver.State())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transitions := driver.WatchState(ctx)
+
+	_, err = driver.Start()
+	assert.NoError(t, err)
+	driver.frameworkRegistered(driver.MasterPid, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: util.NewFrameworkID("test-framework-1"),
+		MasterInfo:  util.NewMasterInfo("master-1", 123456, 5050),
+	})
+
+	// the leading master fails over.
+	driver.OnMasterChanged(&mesos.MasterInfo{
+		Id:   proto.String("master-2"),
+		Ip:   proto.Uint32(123456),
+		Port: proto.Uint32(5050),
+		Pid:  proto.String("master@127.0.0.2:5050"),
+	})
+	assert.Equal(t, StateRegistering, driver.State())
+	assert.Equal(t, "master@127.0.0.2:5050", driver.MasterPid.String())
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{
+		FrameworkId: util.NewFrameworkID("test-framework-1"),
+		MasterInfo:  util.NewMasterInfo("master-2", 123456, 5050),
+	})
+
+	stat, err := driver.Stop(false)
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_STOPPED, stat)
+
+	var seen []StateTransition
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case tr, ok := <-transitions:
+			if !ok {
+				done = true
+				break
+			}
+			seen = append(seen, tr)
+		case <-timeout:
+			t.Fatalf("Transitions channel was not closed.")
+		}
+	}
+
+	expected := []StateTransition{
+		{From: StateInitialized, To: StateRegistering},
+		{From: StateRegistering, To: StateConnected},
+		{From: StateConnected, To: StateDisconnected},
+		{From: StateDisconnected, To: StateRegistering},
+		{From: StateRegistering, To: StateConnected},
+		{From: StateConnected, To: StateStopping},
+		{From: StateStopping, To: StateStopped},
+	}
+	if assert.Equal(t, len(expected), len(seen), "%v", seen) {
+		for i := range expected {
+			assert.Equal(t, expected[i].From, seen[i].From, "transition %d", i)
+			assert.Equal(t, expected[i].To, seen[i].To, "transition %d", i)
+			if i > 0 {
+				assert.False(t, seen[i].At.Before(seen[i-1].At), "transition %d", i)
+			}
+		}
+		assert.Equal(t, ShutdownUserStop, seen[len(seen)-1].Reason)
+	}
+	sched.AssertNumberOfCalls(t, "Registered", 1)
+	sched.AssertNumberOfCalls(t, "Disconnected", 1)
+	sched.AssertNumberOfCalls(t, "Reregistered", 1)
+}
+
+func TestSchedulerDriverInvalidStateTransition(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+
+	assert.False(t, driver.transition(StateConnected))
+	assert.True(t, driver.transition(StateRegistering))
+	assert.True(t, driver.transition(StateConnected))
+	// a connected driver must lose the master before registering again.
+	assert.False(t, driver.transition(StateRegistering))
+	assert.Equal(t, StateConnected, driver.State())
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, driver.Status())
+
+	assert.True(t, driver.transition(StateAborted))
+	assert.False(t, driver.transition(StateRegistering))
+	assert.Equal(t, mesos.Status_DRIVER_ABORTED, driver.Status())
+}
+
+func TestSchedulerDriverWatchStateCancelled(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transitions := driver.WatchState(ctx)
+	cancel()
+	select {
+	case _, ok := <-transitions:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatalf("Transitions channel was not closed.")
+	}
+	// transitions after the watch ended are not delivered.
+	assert.True(t, driver.transition(StateRegistering))
+}
+
+// pushTransitions pushes the transitions numbered, in Epoch, from first
+// to last, the last one is terminal if final.
+func pushTransitions(w *stateWatcher, first, last int, final bool) {
+	for i := first; i <= last; i++ {
+		t := StateTransition{From: StateRegistering, To: StateConnected, Epoch: uint64(i)}
+		if final && i == last {
+			t.To = StateStopped
+		}
+		w.push(t)
+	}
+}
+
+// received returns the epochs and the dropped counts of the transitions
+// received until the channel is closed.
+func received(t *testing.T, ch <-chan StateTransition) (epochs []uint64, dropped []int) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case tr, ok := <-ch:
+			if !ok {
+				return
+			}
+			epochs = append(epochs, tr.Epoch)
+			dropped = append(dropped, tr.Dropped)
+		case <-timeout:
+			t.Fatalf("Transitions channel was not closed.")
+		}
+	}
+}
+
+func TestStateWatcherDropNewest(t *testing.T) {
+	w := newStateWatcher(WatchOptions{Policy: WatchDropNewest, Buffer: 3})
+	pushTransitions(w, 1, 7, true)
+	w.finish()
+	go w.pump(context.Background())
+
+	epochs, dropped := received(t, w.out)
+	// the final transition takes the place of the newest queued one.
+	assert.Equal(t, []uint64{1, 2, 7}, epochs)
+	assert.Equal(t, []int{0, 0, 4}, dropped)
+}
+
+func TestStateWatcherDropOldest(t *testing.T) {
+	w := newStateWatcher(WatchOptions{Policy: WatchDropOldest, Buffer: 3})
+	pushTransitions(w, 1, 7, true)
+	w.finish()
+	go w.pump(context.Background())
+
+	epochs, dropped := received(t, w.out)
+	assert.Equal(t, []uint64{5, 6, 7}, epochs)
+	assert.Equal(t, []int{4, 0, 0}, dropped)
+}
+
+func TestStateWatcherBlock(t *testing.T) {
+	w := newStateWatcher(WatchOptions{Policy: WatchBlock, Buffer: 2, BlockTimeout: 50 * time.Millisecond})
+	pushTransitions(w, 1, 2, false)
+
+	// nobody takes the transitions, the push gives up.
+	start := time.Now()
+	pushTransitions(w, 3, 3, false)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	go w.pump(context.Background())
+	done := make(chan struct{})
+	var epochs []uint64
+	var dropped []int
+	go func() {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		epochs, dropped = received(t, w.out)
+	}()
+	// the slow consumer catches up before the deadline.
+	pushTransitions(w, 4, 6, true)
+	w.finish()
+	<-done
+	assert.Equal(t, []uint64{1, 2, 4, 5, 6}, epochs)
+	assert.Equal(t, []int{0, 0, 1, 0, 0}, dropped)
+}
+
+func TestStateWatcherBlockCancelled(t *testing.T) {
+	w := newStateWatcher(WatchOptions{Policy: WatchBlock, Buffer: 1, BlockTimeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.pump(ctx)
+	pushTransitions(w, 1, 2, false)
+
+	pushed := make(chan struct{})
+	go func() {
+		pushTransitions(w, 3, 3, false)
+		close(pushed)
+	}()
+	cancel()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatalf("Push still blocked after the watch ended.")
+	}
+}
+
+func TestSchedulerDriverWatchStateWith(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := driver.WatchState(ctx)
+	latest := driver.WatchStateWith(ctx, WatchOptions{Policy: WatchDropOldest, Buffer: 1})
+
+	assert.True(t, driver.transition(StateRegistering))
+	for i := 0; i < 10; i++ {
+		assert.True(t, driver.transition(StateConnected))
+		assert.True(t, driver.transition(StateDisconnected))
+		assert.True(t, driver.transition(StateRegistering))
+	}
+	assert.True(t, driver.transition(StateAborted))
+
+	epochs, _ := received(t, all)
+	if assert.Len(t, epochs, 32) {
+		assert.Equal(t, uint64(10), epochs[31])
+	}
+
+	var seen []StateTransition
+	for tr := range latest {
+		seen = append(seen, tr)
+	}
+	// at most the first transition made it to the channel, the rest but
+	// the final one was dropped.
+	if assert.True(t, len(seen) == 1 || len(seen) == 2, "%v", seen) {
+		final := seen[len(seen)-1]
+		assert.Equal(t, StateAborted, final.To)
+		assert.Equal(t, 32-len(seen), final.Dropped)
+	}
+}
+
+func TestStatusOrderAcceptInOrder(t *testing.T) {
+	order := newStatusOrder()
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_STAGING, 1)))
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_STARTING, 2)))
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_RUNNING, 3)))
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_RUNNING, 4)))
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_FINISHED, 5)))
+	assert.Equal(t, uint64(0), order.suppressedCount())
+}
+
+func TestStatusOrderSuppressesRegression(t *testing.T) {
+	order := newStatusOrder()
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_RUNNING, 2)))
+	assert.False(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_STAGING, 1)))
+	assert.False(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_RUNNING, 1)))
+	assert.Equal(t, uint64(2), order.suppressedCount())
+
+	// other tasks are unaffected.
+	assert.True(t, order.accept(createTestStatus("02", mesos.TaskState_TASK_STAGING, 1)))
+}
+
+func TestStatusOrderTerminalIsFinal(t *testing.T) {
+	order := newStatusOrder()
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_KILLED, 2)))
+	assert.False(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_RUNNING, 3)))
+	assert.False(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_KILLED, 2)))
+	assert.False(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_LOST, 4)))
+	assert.Equal(t, uint64(3), order.suppressedCount())
+}
+
+func TestStatusOrderForget(t *testing.T) {
+	order := newStatusOrder()
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_LOST, 2)))
+	order.forget(util.NewTaskID("test-task-01"))
+	assert.True(t, order.accept(createTestStatus("01", mesos.TaskState_TASK_STAGING, 1)))
+	assert.Equal(t, uint64(0), order.suppressedCount())
+}
+
+// orderStatusUpdates enables mesos_ordered_status_updates, call the
+// returned func to restore it.
+func orderStatusUpdates() func() {
+	v := *orderedUpdates
+	*orderedUpdates = true
+	return func() { *orderedUpdates = v }
+}
+
+func TestSchedulerDriverOrderedUpdatesTaskRelaunched(t *testing.T) {
+	defer orderStatusUpdates()()
+
+	sched := newTestScheduler()
+	sched.t = t
+	sched.statuses = make(chan *mesos.TaskStatus, 4)
+	driver := newConnectedDriver(t, sched)
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	driver.Metrics = metrics
+
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_LOST, "lost")
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "stale")
+	assert.Equal(t, 1, metrics.counts[MetricStatusUpdatesSuppressed])
+	// the stale update is acknowledged, or the slave would resend it.
+	if assert.Equal(t, 2, len(msgr.sent)) {
+		for _, msg := range msgr.sent {
+			assert.IsType(t, &mesos.StatusUpdateAcknowledgementMessage{}, msg)
+		}
+	}
+
+	// the updates of a task relaunched with the same ID are delivered.
+	offer := util.NewOffer(util.NewOfferID("offer-1"), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	task := util.NewTaskInfo("task-1", util.NewTaskID("task-1"), util.NewSlaveID("test-slave-001"),
+		[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+	task.Command = util.NewCommandInfo("pwd")
+	_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{task}, &mesos.Filters{})
+	assert.NoError(t, err)
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "relaunched")
+
+	close(sched.statuses)
+	states := []mesos.TaskState{}
+	for status := range sched.statuses {
+		states = append(states, status.GetState())
+	}
+	assert.Equal(t, []mesos.TaskState{mesos.TaskState_TASK_LOST, mesos.TaskState_TASK_RUNNING}, states)
+	assert.Equal(t, 1, metrics.counts[MetricStatusUpdatesSuppressed])
+}
+
+func TestStatusOrderAdversarialReplay(t *testing.T) {
+	states := []mesos.TaskState{
+		mesos.TaskState_TASK_STAGING,
+		mesos.TaskState_TASK_STARTING,
+		mesos.TaskState_TASK_RUNNING,
+		mesos.TaskState_TASK_KILLED,
+	}
+	// every permutation of the lifecycle must be delivered without regression.
+	permute(len(states), func(perm []int) {
+		order := newStatusOrder()
+		var delivered []*mesos.TaskStatus
+		for _, i := range perm {
+			status := createTestStatus("01", states[i], float64(i))
+			if order.accept(status) {
+				delivered = append(delivered, status)
+			}
+		}
+		assert.NotEmpty(t, delivered)
+		for i := 1; i < len(delivered); i++ {
+			prev, next := delivered[i-1], delivered[i]
+			assert.False(t, isTerminalState(prev.GetState()), "delivered %s after terminal %s", next.GetState(), prev.GetState())
+			assert.True(t, statePrecedence(prev.GetState()) <= statePrecedence(next.GetState()))
+		}
+		assert.Equal(t, uint64(len(perm)-len(delivered)), order.suppressedCount())
+	})
+}
+
+func permute(n int, f func([]int)) {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	var gen func(int)
+	gen = func(k int) {
+		if k == n {
+			f(perm)
+			return
+		}
+		for i := k; i < n; i++ {
+			perm[k], perm[i] = perm[i], perm[k]
+			gen(k + 1)
+			perm[k], perm[i] = perm[i], perm[k]
+		}
+	}
+	gen(0)
+}
+
+func createTestStatus(idSuffix string, state mesos.TaskState, timestamp float64) *mesos.TaskStatus {
+	status := util.NewTaskStatus(util.NewTaskID("test-task-"+idSuffix), state)
+	status.Timestamp = proto.Float64(timestamp)
+	return status
+}
+
+// disconnectingScheduler loses the master while it handles an update.
+type disconnectingScheduler struct {
+	*MockScheduler
+	driver *MesosSchedulerDriver
+}
+
+func (sched *disconnectingScheduler) StatusUpdate(SchedulerDriver, *mesos.TaskStatus) {
+	sched.driver.transition(StateDisconnected)
+}
+
+func TestSchedulerDriverAckResentOnReregistration(t *testing.T) {
+	sched := &disconnectingScheduler{MockScheduler: NewMockScheduler()}
+	sched.On("Reregistered").Return()
+	driver := newConnectedDriver(t, sched)
+	sched.driver = driver
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Empty(t, msgr.sent)
+	assert.Equal(t, 1, driver.updates.size())
+
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(masterUpid)
+	driver.transition(StateRegistering)
+	driver.frameworkReregistered(driver.MasterPid, &mesos.FrameworkReregisteredMessage{FrameworkId: framework.Id, MasterInfo: masterInfo})
+
+	ack := sentAcks(msgr)["task-1"]
+	if assert.NotNil(t, ack) {
+		assert.Equal(t, []byte("uuid-task-1"), ack.GetUuid())
+		assert.Equal(t, "test-slave-001", ack.GetSlaveId().GetValue())
+	}
+	assert.Equal(t, driver.MasterPid.String(), msgr.to[len(msgr.to)-1].String())
+	assert.Equal(t, 0, driver.updates.size())
+}
+
+func TestSchedulerDriverAckRetryBackoff(t *testing.T) {
+	driver, _, msgr := newAckDriver(t, false)
+	clock := newFakeClock()
+	clock.use(driver)
+	driver.updates = newStatusUpdateManager(time.Second, 3*time.Second)
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	driver.Metrics = metrics
+
+	failing := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	failing.On("Send").Return(messenger.ErrQueueFull)
+	driver.messenger = failing
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Equal(t, 1, driver.updates.size())
+
+	// resent after 1s, 2s, then every 3s.
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		attempts := len(failing.sent)
+		clock.advance(delay - time.Millisecond)
+		driver.resendAcks(false)
+		assert.Len(t, failing.sent, attempts)
+		clock.advance(time.Millisecond)
+		driver.resendAcks(false)
+		assert.Len(t, failing.sent, attempts+1)
+	}
+	assert.Equal(t, 4, metrics.counts[MetricAcksResent])
+
+	// the slave resends the update meanwhile.
+	driver.messenger = msgr
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+	assert.Len(t, sentAcks(msgr), 1)
+	assert.Equal(t, 0, driver.updates.size())
+	clock.advance(time.Hour)
+	driver.resendAcks(false)
+	assert.Len(t, msgr.sent, 1)
+}
+
+// strictPanic returns what f panics with, "" if it does not.
+func strictPanic(f func()) (diagnostic string) {
+	defer func() {
+		if r := recover(); r != nil {
+			diagnostic, _ = r.(string)
+		}
+	}()
+	f()
+	return ""
+}
+
+func TestSchedulerDriverStrictModifiedOffer(t *testing.T) {
+	sched := &offersScheduler{}
+	driver := newConnectedDriver(t, sched)
+	driver.strict = newStrictChecks()
+
+	offer := func(id string) {
+		driver.resourcesOffered(driver.MasterPid, &mesos.ResourceOffersMessage{
+			Offers: []*mesos.Offer{util.NewOffer(util.NewOfferID(id), framework.Id, util.NewSlaveID("slave-1"), "localhost")},
+			Pids:   []string{"slave(1)@127.0.0.1:5052"},
+		})
+	}
+	offer("offer-1")
+	offer("offer-2")
+	assert.Len(t, sched.offers, 2)
+
+	// an offer left alone.
+	assert.Equal(t, "", strictPanic(func() {
+		driver.DeclineOffer(util.NewOfferID("offer-1"), nil)
+	}))
+
+	// an offer modified once ResourceOffers returned.
+	sched.offers[1].Hostname = proto.String("elsewhere")
+	assert.Equal(t, "mesos_dev_strict: offer offer-2 was modified after it was handed to ResourceOffers", strictPanic(func() {
+		driver.DeclineOffer(util.NewOfferID("offer-2"), nil)
+	}))
+
+	// offers are not checked otherwise.
+	driver.strict = nil
+	assert.Equal(t, "", strictPanic(func() {
+		driver.DeclineOffer(util.NewOfferID("offer-2"), nil)
+	}))
+}
+
+func TestSchedulerDriverStrictInvalidState(t *testing.T) {
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+
+	// a status is returned, unless strict.
+	stat, err := driver.KillTask(util.NewTaskID("task-1"))
+	assert.Equal(t, mesos.Status_DRIVER_NOT_STARTED, stat)
+	assert.Error(t, err)
+
+	driver.strict = newStrictChecks()
+	assert.Equal(t, "mesos_dev_strict: Unable to KillTask, expecting driver status DRIVER_RUNNING, but got DRIVER_NOT_STARTED", strictPanic(func() {
+		driver.KillTask(util.NewTaskID("task-1"))
+	}))
+	assert.Contains(t, strictPanic(func() {
+		driver.LaunchTasks([]*mesos.OfferID{util.NewOfferID("offer-1")}, nil, nil)
+	}), "mesos_dev_strict: Unable to LaunchTasks")
+	assert.Contains(t, strictPanic(func() {
+		driver.ReconcileTasks(nil)
+	}), "mesos_dev_strict: Unable to ReconcileTasks")
+}
+
+func TestSchedulerDriverStrictDoubleAck(t *testing.T) {
+	driver, sched, msgr := newAckDriver(t, true)
+	driver.strict = newStrictChecks()
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_RUNNING, "")
+
+	assert.Equal(t, "", strictPanic(func() {
+		_, err := driver.AcknowledgeStatusUpdate(sched.statuses[0])
+		assert.NoError(t, err)
+	}))
+	assert.Len(t, msgr.sent, 1)
+	assert.Equal(t, "mesos_dev_strict: the TASK_RUNNING update of task task-1 is acknowledged twice", strictPanic(func() {
+		driver.AcknowledgeStatusUpdate(sched.statuses[0])
+	}))
+	assert.Len(t, msgr.sent, 1)
+
+	// the next update of the task is a new one.
+	sendTaskFailure(driver, "task-1", mesos.TaskState_TASK_FINISHED, "")
+	assert.Equal(t, "", strictPanic(func() {
+		_, err := driver.AcknowledgeStatusUpdate(sched.statuses[1])
+		assert.NoError(t, err)
+	}))
+}
+
+func tempTaskCacheStore(t *testing.T) (*FileTaskCacheStore, func()) {
+	dir, err := ioutil.TempDir("", "taskcache")
+	assert.NoError(t, err)
+	return NewFileTaskCacheStore(filepath.Join(dir, "tasks.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestFileTaskCacheStore(t *testing.T) {
+	store, cleanup := tempTaskCacheStore(t)
+	defer cleanup()
+
+	statuses, err := store.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, statuses)
+
+	saved := taskStatuses(3)
+	saved[0].Data = []byte{0xff, 0x00}
+	assert.NoError(t, store.Save(saved))
+	statuses, err = store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, saved, statuses)
+
+	assert.NoError(t, ioutil.WriteFile(store.path, []byte("{corrupt"), 0644))
+	_, err = store.Load()
+	assert.Error(t, err)
+}
+
+// runTaskCacheDriver saves the cache of a driver that delivered the given
+// statuses and stops failing over.
+func runTaskCacheDriver(t *testing.T, store TaskCacheStore, statuses []*mesos.TaskStatus) {
+	defer orderStatusUpdates()()
+	msgr := messenger.NewMockedMessenger()
+	msgr.On("Send").Return(nil)
+	msgr.On("Stop").Return(nil)
+
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+	driver.messenger = msgr
+	driver.TaskCacheStore = store
+	driver.transition(StateRegistering)
+	driver.transition(StateConnected)
+	for _, status := range statuses {
+		assert.True(t, driver.statusOrder.accept(status))
+	}
+	_, err = driver.Stop(true)
+	assert.NoError(t, err)
+}
+
+// restartTaskCacheDriver registers a driver restored from store with a
+// mock master and returns the tasks the driver reconciles.
+func restartTaskCacheDriver(t *testing.T, store TaskCacheStore) []string {
+	defer orderStatusUpdates()()
+	reconciled := make(chan []byte, 1)
+	server := testutil.NewMockMasterHttpServer(t, func(rsp http.ResponseWriter, req *http.Request) {
+		log.Infoln("MockMaster - rcvd ", req.RequestURI)
+		if strings.HasSuffix(req.RequestURI, "mesos.internal.ReconcileTasksMessage") {
+			body, err := ioutil.ReadAll(req.Body)
+			assert.NoError(t, err)
+			reconciled <- body
+		}
+		rsp.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	ch := make(chan bool)
+	sched := newTestScheduler()
+	sched.ch = ch
+	sched.t = t
+	driver, err := NewMesosSchedulerDriver(sched, framework, server.Addr, nil)
+	assert.NoError(t, err)
+	driver.TaskCacheStore = store
+	stat, err := driver.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, mesos.Status_DRIVER_RUNNING, stat)
+	defer driver.Stop(true)
+
+	masterInfo := util.NewMasterInfo("master", 123456, 1234)
+	masterInfo.Pid = proto.String(server.PID.String())
+	testutil.NewMockMesosClient(t, server.PID).SendMessage(driver.self, &mesos.FrameworkRegisteredMessage{
+		FrameworkId: framework.Id,
+		MasterInfo:  masterInfo,
+	})
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for Registered callback.")
+	}
+
+	var body []byte
+	select {
+	case body = <-reconciled:
+	case <-time.After(time.Second * 1):
+		t.Fatalf("Tired of waiting for the master to receive ReconcileTasksMessage.")
+	}
+	msg := &mesos.ReconcileTasksMessage{}
+	assert.NoError(t, proto.Unmarshal(body, msg))
+	taskIds := []string{}
+	for _, status := range msg.Statuses {
+		taskIds = append(taskIds, status.GetTaskId().GetValue())
+	}
+	sort.Strings(taskIds)
+	return taskIds
+}
+
+func TestSchedulerDriverReconcilesRestoredTasks(t *testing.T) {
+	store, cleanup := tempTaskCacheStore(t)
+	defer cleanup()
+
+	statuses := taskStatuses(3)
+	statuses[2].State = mesos.TaskState_TASK_FINISHED.Enum()
+	runTaskCacheDriver(t, store, statuses)
+	saved, err := store.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(saved))
+
+	// only the tasks that were not terminal are reconciled.
+	assert.Equal(t, []string{"task-0", "task-1"}, restartTaskCacheDriver(t, store))
+}
+
+func TestSchedulerDriverReconcilesAllTasksOnCorruptTaskCache(t *testing.T) {
+	store, cleanup := tempTaskCacheStore(t)
+	defer cleanup()
+	assert.NoError(t, ioutil.WriteFile(store.path, []byte("{corrupt"), 0644))
+
+	assert.Empty(t, restartTaskCacheDriver(t, store))
+}
+
+func TestSchedulerDriverTaskCacheVerified(t *testing.T) {
+	defer orderStatusUpdates()()
+	driver, err := NewMesosSchedulerDriver(NewMockScheduler(), framework, master, nil)
+	assert.NoError(t, err)
+
+	driver.statusOrder.preload(taskStatuses(2))
+	assert.Equal(t, 2, len(driver.statusOrder.unverified()))
+	update := util.NewTaskStatus(util.NewTaskID("task-0"), mesos.TaskState_TASK_FINISHED)
+	assert.True(t, driver.statusOrder.accept(update))
+	unverified := driver.statusOrder.unverified()
+	if assert.Equal(t, 1, len(unverified)) {
+		assert.Equal(t, "task-1", unverified[0].GetTaskId().GetValue())
+	}
+}
+
+// launchTaskIDs launches a task for each ID against a new offer and
+// returns the IDs of the tasks sent to the master.
+func launchTaskIDs(t *testing.T, driver *MesosSchedulerDriver, offerId string, taskIds ...string) ([]string, error) {
+	msgr := &sentMessenger{MockedMessenger: messenger.NewMockedMessenger()}
+	msgr.On("Send").Return(nil)
+	driver.messenger = msgr
+
+	offer := util.NewOffer(util.NewOfferID(offerId), framework.Id, util.NewSlaveID("test-slave-001"), "localhost")
+	driver.cache.putOffer(offer, &upid.UPID{ID: "slave(1)", Host: "127.0.0.1", Port: "5052"})
+	tasks := make([]*mesos.TaskInfo, 0, len(taskIds))
+	for _, id := range taskIds {
+		task := util.NewTaskInfo(id, util.NewTaskID(id), util.NewSlaveID("test-slave-001"),
+			[]*mesos.Resource{util.NewScalarResource("mem", 64)})
+		task.Command = util.NewCommandInfo("pwd")
+		tasks = append(tasks, task)
+	}
+	_, err := driver.LaunchTasks([]*mesos.OfferID{offer.Id}, tasks, &mesos.Filters{})
+
+	launched := []string{}
+	for _, msg := range msgr.sent {
+		if launch, ok := msg.(*mesos.LaunchTasksMessage); ok {
+			for _, task := range launch.Tasks {
+				launched = append(launched, task.GetTaskId().GetValue())
+			}
+		}
+	}
+	return launched, err
+}
+
+func TestSchedulerDriverTaskIDReuse(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		testTaskIDReuse(t, ordered)
+	}
+}
+
+func testTaskIDReuse(t *testing.T, ordered bool) {
+	defer func(v bool) { *orderedUpdates = v }(*orderedUpdates)
+	*orderedUpdates = ordered
+
+	newDriver := func() (*MesosSchedulerDriver, *testScheduler, *countingMetrics, *fakeClock) {
+		sched := newTestScheduler()
+		sched.t = t
+		sched.statuses = make(chan *mesos.TaskStatus, 4)
+		driver := newConnectedDriver(t, sched)
+		clock := newFakeClock()
+		clock.use(driver)
+		metrics := &countingMetrics{counts: make(map[string]int)}
+		driver.Metrics = metrics
+		sendTaskFailure(driver, "task-running", mesos.TaskState_TASK_RUNNING, "")
+		sendTaskFailure(driver, "task-finished", mesos.TaskState_TASK_FINISHED, "")
+		<-sched.statuses
+		<-sched.statuses
+		return driver, sched, metrics, clock
+	}
+
+	// the ID of a running task is refused and reported lost, the other
+	// tasks are launched.
+	driver, sched, metrics, clock := newDriver()
+	launched, err := launchTaskIDs(t, driver, "offer-1", "task-running", "task-new")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Task ID task-running is in use by a task in state TASK_RUNNING")
+	}
+	assert.Equal(t, []string{"task-new"}, launched)
+	waitEvents(driver)
+	if assert.Equal(t, 1, len(sched.statuses)) {
+		status := <-sched.statuses
+		assert.Equal(t, "task-running", status.TaskId.GetValue())
+		assert.Equal(t, mesos.TaskState_TASK_LOST, status.GetState())
+	}
+	assert.True(t, driver.taskIDs.live(util.NewTaskID("task-running")), "the running task is still running")
+	if ordered {
+		status, _, _ := driver.statusOrder.last(util.NewTaskID("task-running"))
+		assert.Equal(t, mesos.TaskState_TASK_RUNNING, status.GetState())
+	}
+	assert.Equal(t, 0, metrics.counts[MetricTaskIDReused])
+
+	// the ID of a task just launched is in use too.
+	_, err = launchTaskIDs(t, driver, "offer-2", "task-new")
+	assert.Error(t, err)
+	waitEvents(driver)
+	<-sched.statuses
+
+	// the ID of a task that just finished is reused with a warning.
+	launched, err = launchTaskIDs(t, driver, "offer-3", "task-finished")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"task-finished"}, launched)
+	assert.Equal(t, 1, metrics.counts[MetricTaskIDReused])
+
+	// once the cooldown elapsed, the ID is reused silently.
+	driver, _, metrics, clock = newDriver()
+	clock.advance(driver.taskIDReuseCooldown)
+	launched, err = launchTaskIDs(t, driver, "offer-1", "task-finished")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"task-finished"}, launched)
+	assert.Equal(t, 0, metrics.counts[MetricTaskIDReused])
+
+	// frameworks reusing IDs on purpose only get a warning.
+	defer func(v bool) { *allowTaskIDReuse = v }(*allowTaskIDReuse)
+	*allowTaskIDReuse = true
+	driver, sched, metrics, _ = newDriver()
+	launched, err = launchTaskIDs(t, driver, "offer-1", "task-running")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"task-running"}, launched)
+	assert.Equal(t, 1, metrics.counts[MetricTaskIDReused])
+	waitEvents(driver)
+	assert.Equal(t, 0, len(sched.statuses))
+}
+
+func TestTaskIDsPrune(t *testing.T) {
+	ids := newTaskIDs()
+	now := time.Now()
+	ids.update(util.NewTaskID("task-running"), mesos.TaskState_TASK_RUNNING, now)
+	ids.update(util.NewTaskID("task-finished"), mesos.TaskState_TASK_FINISHED, now)
+	ids.update(util.NewTaskID("task-finished"), mesos.TaskState_TASK_RUNNING, now) // retried
+	assert.False(t, ids.live(util.NewTaskID("task-finished")))
+
+	ids.prune(now.Add(time.Minute), time.Minute)
+	_, _, ok := ids.get(util.NewTaskID("task-finished"))
+	assert.False(t, ok)
+	assert.True(t, ids.live(util.NewTaskID("task-running")))
+
+	ids.launched(util.NewTaskID("task-finished"), now)
+	assert.True(t, ids.live(util.NewTaskID("task-finished")))
+}
@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"fmt"
+)
+
+// ShutdownReason tells why the driver stopped or aborted.
+type ShutdownReason int
+
+const (
+	ShutdownNone                 ShutdownReason = iota // the driver is not stopped
+	ShutdownUserStop                                   // Stop was called
+	ShutdownUserAbort                                  // Abort was called
+	ShutdownUnregisterFailed                           // Stop failed to unregister the framework
+	ShutdownMasterError                                // the master reported an error, e.g. the framework was removed
+	ShutdownMessengerError                             // the messenger died or failed to encode a message
+	ShutdownSendFailed                                 // a message could not be delivered
+	ShutdownAuthenticationFailed                       // the framework failed to authenticate with the master
+	ShutdownMessageTooLarge                            // a registration message exceeded mesos_max_message_size, see mesos_strict_message_size
+	ShutdownCallbackPanic                              // a Scheduler callback panicked, see mesos_abort_on_callback_panic
+	ShutdownDuplicateScheduler                         // another scheduler seems to run with the framework ID, see mesos_abort_on_duplicate_scheduler
+	ShutdownAuthorizationFailed                        // the master sent a FrameworkError of kind FrameworkErrorAuthorization
+)
+
+func (r ShutdownReason) String() string {
+	switch r {
+	case ShutdownNone:
+		return "NONE"
+	case ShutdownUserStop:
+		return "USER_STOP"
+	case ShutdownUserAbort:
+		return "USER_ABORT"
+	case ShutdownUnregisterFailed:
+		return "UNREGISTER_FAILED"
+	case ShutdownMasterError:
+		return "MASTER_ERROR"
+	case ShutdownMessengerError:
+		return "MESSENGER_ERROR"
+	case ShutdownSendFailed:
+		return "SEND_FAILED"
+	case ShutdownAuthenticationFailed:
+		return "AUTHENTICATION_FAILED"
+	case ShutdownMessageTooLarge:
+		return "MESSAGE_TOO_LARGE"
+	case ShutdownCallbackPanic:
+		return "CALLBACK_PANIC"
+	case ShutdownDuplicateScheduler:
+		return "DUPLICATE_SCHEDULER"
+	case ShutdownAuthorizationFailed:
+		return "AUTHORIZATION_FAILED"
+	default:
+		return fmt.Sprintf("ShutdownReason(%d)", int(r))
+	}
+}
+
+// ErrorReasonHandler may be implemented by a Scheduler to receive the
+// reason the driver is shutting down along with the error, instead of
+// the Error callback.
+type ErrorReasonHandler interface {
+	ErrorReason(SchedulerDriver, string, ShutdownReason)
+}
+
+// ShutdownReason returns why the driver stopped or aborted, ShutdownNone
+// while it runs. It is final once Run or Join returned.
+func (driver *MesosSchedulerDriver) ShutdownReason() ShutdownReason {
+	driver.lock.RLock()
+	defer driver.lock.RUnlock()
+	return driver.shutdownReason
+}
+
+// setShutdownReason records the first reason the driver shuts down for,
+// e.g. an error aborting the driver through Abort is not a user abort.
+func (driver *MesosSchedulerDriver) setShutdownReason(reason ShutdownReason) {
+	driver.lock.Lock()
+	if driver.shutdownReason == ShutdownNone {
+		driver.shutdownReason = reason
+	}
+	driver.lock.Unlock()
+}
+
+// notifyError passes err to the Scheduler, along with reason if the
+// scheduler is an ErrorReasonHandler.
+func (driver *MesosSchedulerDriver) notifyError(err string, reason ShutdownReason) {
+	if handler, ok := driver.Scheduler.(ErrorReasonHandler); ok {
+		handler.ErrorReason(driver, err, reason)
+		return
+	}
+	driver.Scheduler.Error(driver, err)
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// SlaveContext describes a slave as it was last offered to the framework.
+// The zero value describes a slave the driver knows nothing about, e.g.
+// one that made no offer since the driver started or that was lost.
+type SlaveContext struct {
+	Hostname   string
+	Attributes []*mesos.Attribute // must not be modified
+	Epoch      uint64             // the status update was received on, 0 from ResolveSlave
+}
+
+// Attribute returns the attribute of the slave of the given name, nil if
+// there is none.
+func (sc SlaveContext) Attribute(name string) *mesos.Attribute {
+	for _, attr := range sc.Attributes {
+		if attr.GetName() == name {
+			return attr
+		}
+	}
+	return nil
+}
+
+// ContextStatusUpdater may be implemented by a Scheduler to be told the
+// slave of the task along with each status update, e.g. to log the host
+// a task failed on. The driver then calls StatusUpdateContext instead of
+// StatusUpdate. The context of a slave the driver does not know is empty.
+type ContextStatusUpdater interface {
+	StatusUpdateContext(SchedulerDriver, *mesos.TaskStatus, SlaveContext)
+}
+
+// ResolveSlave returns the hostname and the attributes of the slave, as
+// it was last offered to the framework. It returns an empty context for
+// an unknown slave.
+func (driver *MesosSchedulerDriver) ResolveSlave(slaveId *mesos.SlaveID) SlaveContext {
+	if slaveId == nil {
+		return SlaveContext{}
+	}
+	driver.cache.lock.RLock()
+	defer driver.cache.lock.RUnlock()
+	return driver.cache.slaveContexts[slaveId.GetValue()]
+}
+
+// putSlaveContext remembers the slave of the offer.
+func (cache *schedCache) putSlaveContext(offer *mesos.Offer) {
+	sc := SlaveContext{Hostname: offer.GetHostname()}
+	for _, attr := range offer.Attributes {
+		sc.Attributes = append(sc.Attributes, proto.Clone(attr).(*mesos.Attribute))
+	}
+	cache.lock.Lock()
+	cache.slaveContexts[offer.GetSlaveId().GetValue()] = sc
+	cache.lock.Unlock()
+}
+
+// deliverStatus passes the status of the update to the scheduler, along
+// with the context of its slave if the scheduler wants it.
+func (driver *MesosSchedulerDriver) deliverStatus(update *mesos.StatusUpdate) {
+	status := update.GetStatus()
+	sched, ok := driver.Scheduler.(ContextStatusUpdater)
+	if !ok {
+		driver.Scheduler.StatusUpdate(driver, status)
+		return
+	}
+	slaveId := status.GetSlaveId()
+	if slaveId == nil {
+		slaveId = update.GetSlaveId()
+	}
+	sc := driver.ResolveSlave(slaveId)
+	sc.Epoch = driver.Epoch()
+	sched.StatusUpdateContext(driver, status, sc)
+}
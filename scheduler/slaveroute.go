@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var (
+	directSendFailures = flag.Int("mesos_direct_send_failures", 3,
+		"Consecutive failures of messages sent directly to a slave after which they are routed through the master")
+	directSendReprobe = flag.Duration("mesos_direct_send_reprobe", time.Minute,
+		"Interval after which messages are sent directly to a slave again once they were routed through the master")
+)
+
+// SlaveRouteMode tells how messages meant for a slave, i.e. framework
+// messages and status update acknowledgements, are routed.
+type SlaveRouteMode int
+
+const (
+	SlaveRouteDirect  SlaveRouteMode = iota // sent to the slave
+	SlaveRouteMaster                        // sent through the master, direct sends failed
+	SlaveRouteProbing                       // the next message probes the slave again
+)
+
+func (m SlaveRouteMode) String() string {
+	switch m {
+	case SlaveRouteDirect:
+		return "DIRECT"
+	case SlaveRouteMaster:
+		return "MASTER"
+	case SlaveRouteProbing:
+		return "PROBING"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// SlaveRoute is the routing of the messages meant for a slave.
+type SlaveRoute struct {
+	Mode      SlaveRouteMode
+	Failures  uint64 // messages that could not be sent to the slave
+	Fallbacks uint64 // messages sent through the master instead
+}
+
+type slaveRoute struct {
+	breaker   *circuitBreaker
+	failures  uint64
+	fallbacks uint64
+}
+
+func (r *slaveRoute) mode() SlaveRouteMode {
+	switch r.breaker.state {
+	case breakerOpen:
+		return SlaveRouteMaster
+	case breakerHalfOpen:
+		return SlaveRouteProbing
+	default:
+		return SlaveRouteDirect
+	}
+}
+
+// route returns the route of the slave, creating it if needed. The caller
+// must hold the lock.
+func (cache *schedCache) route(slaveId string) *slaveRoute {
+	r, ok := cache.slaveRoutes[slaveId]
+	if !ok {
+		r = &slaveRoute{breaker: newCircuitBreaker(cache.directSendFailures, cache.directSendReprobe)}
+		cache.slaveRoutes[slaveId] = r
+	}
+	return r
+}
+
+// sendDirect returns true if a message may be sent directly to the slave
+// at now, otherwise it is counted as a fallback to the master.
+func (cache *schedCache) sendDirect(slaveId *mesos.SlaveID, now time.Time) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	r := cache.route(slaveId.GetValue())
+	if r.breaker.allow(now) {
+		return true
+	}
+	r.fallbacks++
+	return false
+}
+
+// directSendFailed records a message that could not be sent directly to
+// the slave at now and is sent through the master instead.
+func (cache *schedCache) directSendFailed(slaveId *mesos.SlaveID, now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	r := cache.route(slaveId.GetValue())
+	wasDirect := r.mode() != SlaveRouteMaster
+	r.breaker.failure(now)
+	r.failures++
+	r.fallbacks++
+	if wasDirect && r.mode() == SlaveRouteMaster {
+		log.Warningf("Routing messages for slave %s through the master after %d failures\n", slaveId.GetValue(), r.breaker.failures)
+	}
+}
+
+// slaveRoutesSnapshot returns the routes of the slaves, key:slaveId.
+func (cache *schedCache) slaveRoutesSnapshot() map[string]SlaveRoute {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	routes := make(map[string]SlaveRoute, len(cache.slaveRoutes))
+	for slaveId, r := range cache.slaveRoutes {
+		routes[slaveId] = SlaveRoute{Mode: r.mode(), Failures: r.failures, Fallbacks: r.fallbacks}
+	}
+	return routes
+}
+
+// SlaveRoutes returns how the messages meant for each slave are routed,
+// key:slave ID. Messages are sent directly to a slave unless that failed
+// mesos_direct_send_failures times in a row, they are then sent through
+// the master until the slave is probed again after
+// mesos_direct_send_reprobe.
+func (driver *MesosSchedulerDriver) SlaveRoutes() map[string]SlaveRoute {
+	return driver.cache.slaveRoutesSnapshot()
+}
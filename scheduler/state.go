@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"golang.org/x/net/context"
+)
+
+// number of transitions queued for a watcher by default, see WatchOptions.
+const stateWatchBuffer = 64
+
+// DriverState is the lifecycle state of a MesosSchedulerDriver. It is
+// finer grained than the mesos.Status returned by the driver methods.
+type DriverState int
+
+const (
+	StateInitialized  DriverState = iota // created, not started yet
+	StateDetecting                       // waiting for a leading master
+	StateRegistering                     // (re)registering with the master
+	StateConnected                       // registered with the master
+	StateDisconnected                    // lost the master
+	StateStopping                        // stopping, e.g. unregistering
+	StateStopped                         // stopped, see Stop
+	StateAborted                         // aborted, see Abort and StopReason
+)
+
+func (s DriverState) String() string {
+	switch s {
+	case StateInitialized:
+		return "INITIALIZED"
+	case StateDetecting:
+		return "DETECTING"
+	case StateRegistering:
+		return "REGISTERING"
+	case StateConnected:
+		return "CONNECTED"
+	case StateDisconnected:
+		return "DISCONNECTED"
+	case StateStopping:
+		return "STOPPING"
+	case StateStopped:
+		return "STOPPED"
+	case StateAborted:
+		return "ABORTED"
+	default:
+		return fmt.Sprintf("DriverState(%d)", int(s))
+	}
+}
+
+// status maps the state to the mesos.Status reported by the driver.
+func (s DriverState) status() mesos.Status {
+	switch s {
+	case StateInitialized:
+		return mesos.Status_DRIVER_NOT_STARTED
+	case StateStopped:
+		return mesos.Status_DRIVER_STOPPED
+	case StateAborted:
+		return mesos.Status_DRIVER_ABORTED
+	default:
+		return mesos.Status_DRIVER_RUNNING
+	}
+}
+
+func (s DriverState) terminal() bool {
+	return s == StateStopped || s == StateAborted
+}
+
+// valid transitions of the driver, key:from state.
+var stateTransitions = map[DriverState][]DriverState{
+	StateInitialized:  {StateDetecting, StateRegistering, StateAborted},
+	StateDetecting:    {StateRegistering, StateStopping, StateAborted},
+	StateRegistering:  {StateConnected, StateDisconnected, StateStopping, StateAborted},
+	StateConnected:    {StateDisconnected, StateStopping, StateAborted},
+	StateDisconnected: {StateDetecting, StateRegistering, StateStopping, StateAborted},
+	StateStopping:     {StateStopped, StateAborted},
+}
+
+// StateTransition is a change of the driver state. Reason is set on the
+// final transition into StateStopped or StateAborted. Dropped counts the
+// transitions the watcher missed right before this one, because it did
+// not keep up, see WatchOptions.
+type StateTransition struct {
+	From, To DriverState
+	At       time.Time
+	Reason   ShutdownReason
+	Epoch    uint64 // of the connection once the state changed, see Epoch
+	Dropped  int
+}
+
+func (t StateTransition) String() string {
+	if t.To.terminal() {
+		return fmt.Sprintf("%v -> %v (%v)", t.From, t.To, t.Reason)
+	}
+	return fmt.Sprintf("%v -> %v", t.From, t.To)
+}
+
+// stateMachine guards the state of the driver, every change of state
+// goes through transition.
+type stateMachine struct {
+	lock     sync.RWMutex
+	state    DriverState
+	epoch    uint64 // incremented on every transition into StateConnected
+	watchers map[*stateWatcher]struct{}
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		state:    StateInitialized,
+		watchers: make(map[*stateWatcher]struct{}),
+	}
+}
+
+func (m *stateMachine) get() DriverState {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.state
+}
+
+func (m *stateMachine) currentEpoch() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.epoch
+}
+
+// transition changes the state to the given one and notifies the
+// watchers. It returns false, leaving the state unchanged, if the
+// transition is not valid.
+func (m *stateMachine) transition(to DriverState) bool {
+	return m.terminate(to, ShutdownNone)
+}
+
+// terminate is transition recording why the driver stopped, the reason
+// is ignored unless to is terminal.
+func (m *stateMachine) terminate(to DriverState, reason ShutdownReason) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	from := m.state
+	valid := false
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		log.Warningf("Ignoring invalid driver state transition %v -> %v\n", from, to)
+		return false
+	}
+
+	m.state = to
+	if to == StateConnected {
+		m.epoch++
+	}
+	t := StateTransition{From: from, To: to, At: time.Now(), Epoch: m.epoch}
+	if to.terminal() {
+		t.Reason = reason
+	}
+	log.V(1).Infof("Driver state %v\n", t)
+	for w := range m.watchers {
+		w.push(t)
+		if to.terminal() {
+			delete(m.watchers, w)
+			w.finish()
+		}
+	}
+	return true
+}
+
+// watch returns a channel receiving the transitions from now on. The
+// channel is closed once ctx is done or the state is terminal.
+func (m *stateMachine) watch(ctx context.Context, opts WatchOptions) <-chan StateTransition {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.state.terminal() {
+		ch := make(chan StateTransition)
+		close(ch)
+		return ch
+	}
+	w := newStateWatcher(opts)
+	m.watchers[w] = struct{}{}
+
+	go func() {
+		w.pump(ctx)
+		m.lock.Lock()
+		delete(m.watchers, w)
+		m.lock.Unlock()
+	}()
+	return w.out
+}
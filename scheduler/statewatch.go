@@ -0,0 +1,200 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// how long a WatchBlock watcher holds up the driver by default.
+const stateWatchBlockTimeout = time.Second
+
+// WatchPolicy tells what happens to a transition of the driver state
+// when the queue of a watcher is full.
+type WatchPolicy int
+
+const (
+	WatchDropNewest WatchPolicy = iota // drop the new transition
+	WatchDropOldest                    // drop the oldest queued transition
+	WatchBlock                         // wait up to BlockTimeout for room, then drop the new transition
+)
+
+func (p WatchPolicy) String() string {
+	switch p {
+	case WatchDropNewest:
+		return "DROP_NEWEST"
+	case WatchDropOldest:
+		return "DROP_OLDEST"
+	case WatchBlock:
+		return "BLOCK"
+	default:
+		return fmt.Sprintf("WatchPolicy(%d)", int(p))
+	}
+}
+
+// WatchOptions configures a watch of the driver state, see WatchStateWith.
+type WatchOptions struct {
+	Policy WatchPolicy
+	// Buffer is the number of transitions queued for the watcher,
+	// stateWatchBuffer if 0.
+	Buffer int
+	// BlockTimeout is how long a WatchBlock watcher may hold up a
+	// transition, a second if 0. The driver state, and the callers
+	// changing it, wait meanwhile.
+	BlockTimeout time.Duration
+}
+
+// stateWatcher queues the transitions for one watcher in a ring buffer,
+// a pump goroutine hands them over to the channel of the watcher.
+type stateWatcher struct {
+	policy       WatchPolicy
+	blockTimeout time.Duration
+
+	lock     sync.Mutex
+	queue    []StateTransition // ring buffer
+	head, n  int
+	dropped  int  // dropped transitions not accounted for in the queue yet
+	finished bool // no transitions follow, see finish
+
+	ready chan struct{} // signals the pump of a transition or of finish
+	room  chan struct{} // signals a blocked push that the pump took a transition
+	out   chan StateTransition
+	done  chan struct{} // closed when the pump returns
+}
+
+func newStateWatcher(opts WatchOptions) *stateWatcher {
+	if opts.Buffer <= 0 {
+		opts.Buffer = stateWatchBuffer
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = stateWatchBlockTimeout
+	}
+	return &stateWatcher{
+		policy:       opts.Policy,
+		blockTimeout: opts.BlockTimeout,
+		queue:        make([]StateTransition, opts.Buffer),
+		ready:        make(chan struct{}, 1),
+		room:         make(chan struct{}, 1),
+		out:          make(chan StateTransition),
+		done:         make(chan struct{}),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues t according to the policy of the watcher. The final
+// transition of the driver is never dropped, the newest queued one makes
+// room for it instead.
+func (w *stateWatcher) push(t StateTransition) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.n == len(w.queue) && w.policy == WatchBlock {
+		timer := time.NewTimer(w.blockTimeout)
+		defer timer.Stop()
+		for expired := false; w.n == len(w.queue) && !expired && !isDone(w.done); {
+			w.lock.Unlock()
+			select {
+			case <-w.room:
+			case <-w.done:
+			case <-timer.C:
+				expired = true
+			}
+			w.lock.Lock()
+		}
+	}
+	if isDone(w.done) {
+		return
+	}
+
+	if w.n == len(w.queue) {
+		switch {
+		case w.policy == WatchDropOldest:
+			evicted := w.queue[w.head]
+			w.head = (w.head + 1) % len(w.queue)
+			w.n--
+			w.dropped += evicted.Dropped + 1
+			if w.n > 0 {
+				w.queue[w.head].Dropped += w.dropped
+				w.dropped = 0
+			}
+			log.Warningf("Dropping driver state transition %v, watcher is not keeping up\n", evicted)
+		case t.To.terminal():
+			tail := (w.head + w.n - 1) % len(w.queue)
+			w.dropped += w.queue[tail].Dropped + 1
+			log.Warningf("Dropping driver state transition %v, watcher is not keeping up\n", w.queue[tail])
+			w.n--
+		default:
+			w.dropped++
+			log.Warningf("Dropping driver state transition %v, watcher is not keeping up\n", t)
+			return
+		}
+	}
+
+	t.Dropped += w.dropped
+	w.dropped = 0
+	w.queue[(w.head+w.n)%len(w.queue)] = t
+	w.n++
+	signal(w.ready)
+}
+
+// isDone reports whether ch is closed.
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish tells the pump to close the channel once the queue is drained.
+func (w *stateWatcher) finish() {
+	w.lock.Lock()
+	w.finished = true
+	w.lock.Unlock()
+	signal(w.ready)
+}
+
+// pump hands the queued transitions over in order until the watch is
+// finished and the queue drained, or until ctx is done.
+func (w *stateWatcher) pump(ctx context.Context) {
+	defer close(w.out)
+	defer close(w.done)
+	for {
+		w.lock.Lock()
+		if w.n == 0 {
+			finished := w.finished
+			w.lock.Unlock()
+			if finished {
+				return
+			}
+			select {
+			case <-w.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		t := w.queue[w.head]
+		w.queue[w.head] = StateTransition{}
+		w.head = (w.head + 1) % len(w.queue)
+		w.n--
+		w.lock.Unlock()
+		signal(w.room)
+
+		select {
+		case w.out <- t:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// statusOrder enforces per-task ordering of status updates delivered
+// to the Scheduler. Updates for a task are only delivered in
+// non-decreasing state precedence; once a terminal state has been
+// delivered every later update for that task is considered stale, until
+// a task with the same ID is launched again.
+// Updates with the same precedence are ordered by timestamp.
+type statusOrder struct {
+	lock       sync.Mutex
+	delivered  map[string]*deliveredStatus // last delivered status, key:TaskID
+	suppressed uint64
+}
+
+type deliveredStatus struct {
+	status     *mesos.TaskStatus
+	at         time.Time
+	unverified bool // restored from a TaskCacheStore, see preload
+}
+
+func newStatusOrder() *statusOrder {
+	return &statusOrder{
+		delivered: make(map[string]*deliveredStatus),
+	}
+}
+
+// statePrecedence ranks task states, terminal states rank highest.
+func statePrecedence(state mesos.TaskState) int {
+	switch state {
+	case mesos.TaskState_TASK_STAGING:
+		return 0
+	case mesos.TaskState_TASK_STARTING:
+		return 1
+	case mesos.TaskState_TASK_RUNNING:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func isTerminalState(state mesos.TaskState) bool {
+	switch state {
+	case mesos.TaskState_TASK_FINISHED,
+		mesos.TaskState_TASK_FAILED,
+		mesos.TaskState_TASK_KILLED,
+		mesos.TaskState_TASK_LOST:
+		return true
+	}
+	return false
+}
+
+// accept records the status and returns true if it may be delivered,
+// false if it is stale with respect to a previously delivered status.
+func (o *statusOrder) accept(status *mesos.TaskStatus) bool {
+	if status == nil || status.TaskId == nil {
+		return true
+	}
+	taskId := status.TaskId.GetValue()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if entry, ok := o.delivered[taskId]; ok {
+		last := entry.status
+		stale := false
+		prev, next := statePrecedence(last.GetState()), statePrecedence(status.GetState())
+		switch {
+		case isTerminalState(last.GetState()):
+			stale = true
+		case next < prev:
+			stale = true
+		case next == prev:
+			stale = status.GetTimestamp() < last.GetTimestamp()
+		}
+		if stale {
+			o.suppressed++
+			log.V(1).Infof("Suppressing stale status update %s for task %s, already delivered %s\n",
+				status.GetState(), taskId, last.GetState())
+			return false
+		}
+	}
+	o.delivered[taskId] = &deliveredStatus{status: status, at: time.Now()}
+	return true
+}
+
+// last returns the last status delivered for a task and when it was.
+func (o *statusOrder) last(taskId *mesos.TaskID) (*mesos.TaskStatus, time.Time, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	entry, ok := o.delivered[taskId.GetValue()]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return entry.status, entry.at, true
+}
+
+// forget drops the status delivered for a task, so that the updates of a
+// new task launched with the same ID are delivered.
+func (o *statusOrder) forget(taskId *mesos.TaskID) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.delivered, taskId.GetValue())
+}
+
+// suppressedCount returns the number of stale updates suppressed so far.
+func (o *statusOrder) suppressedCount() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.suppressed
+}
+
+// usage returns the number of tasks tracked and their estimated size.
+func (o *statusOrder) usage() (entries, bytes int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, entry := range o.delivered {
+		bytes += estimateSize(entry.status)
+	}
+	return len(o.delivered), bytes
+}
+
+// evict forgets up to n tasks whose terminal status was delivered, oldest
+// first. Tasks that are not terminal yet are never evicted, their last
+// status is needed to order the updates still to come.
+//
+// The cache is bounded rather than terminal being final forever: a stale
+// update arriving for an evicted task, e.g. one retried by a slave long
+// after the task finished, is delivered as if the task were new. Raise
+// mesos_cache_max_entries to keep terminal tasks longer.
+func (o *statusOrder) evict(n int) (entries, bytes int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var keys []agedKey
+	for taskId, entry := range o.delivered {
+		if isTerminalState(entry.status.GetState()) {
+			keys = append(keys, agedKey{taskId, entry.at})
+		}
+	}
+	for _, k := range oldest(keys, n) {
+		bytes += estimateSize(o.delivered[k.key].status)
+		delete(o.delivered, k.key)
+		entries++
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var (
+	ackRetryBackoff = flag.Duration("mesos_ack_retry_backoff", time.Second,
+		"Delay before resending a status update acknowledgement that could not be sent, doubled after each failure")
+	ackRetryMaxBackoff = flag.Duration("mesos_ack_retry_max_backoff", time.Minute,
+		"Maximum delay between the attempts to send a status update acknowledgement")
+)
+
+// unackedUpdate is the acknowledgement of a status update that could not
+// be sent.
+type unackedUpdate struct {
+	message  *mesos.StatusUpdateAcknowledgementMessage
+	attempts int       // failed so far
+	next     time.Time // when to resend it
+}
+
+// statusUpdateManager keeps the acknowledgements of the status updates
+// that could not be sent, e.g. because the driver was disconnected from
+// the master while the scheduler handled the update, and resends them
+// with an exponential backoff until they are sent. The slave resends an
+// update until it is acknowledged, the same update is acknowledged once.
+type statusUpdateManager struct {
+	lock       sync.Mutex
+	backoff    time.Duration
+	maxBackoff time.Duration
+	pending    map[string]*unackedUpdate // key:update UUID
+}
+
+func newStatusUpdateManager(backoff, maxBackoff time.Duration) *statusUpdateManager {
+	return &statusUpdateManager{
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		pending:    make(map[string]*unackedUpdate),
+	}
+}
+
+// failed records an attempt to send the acknowledgement that failed.
+func (m *statusUpdateManager) failed(ack *mesos.StatusUpdateAcknowledgementMessage, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := string(ack.GetUuid())
+	u, ok := m.pending[key]
+	if !ok {
+		u = &unackedUpdate{message: ack}
+		m.pending[key] = u
+	}
+	delay := m.backoff << uint(u.attempts)
+	if delay > m.maxBackoff || delay <= 0 {
+		delay = m.maxBackoff
+	}
+	u.attempts++
+	u.next = now.Add(delay)
+}
+
+// acked forgets the acknowledgement of the update once it is sent.
+func (m *statusUpdateManager) acked(uuid []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.pending, string(uuid))
+}
+
+// due returns the acknowledgements to resend at now, all of them if all
+// is true.
+func (m *statusUpdateManager) due(now time.Time, all bool) []*mesos.StatusUpdateAcknowledgementMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var acks []*mesos.StatusUpdateAcknowledgementMessage
+	for _, u := range m.pending {
+		if all || !now.Before(u.next) {
+			acks = append(acks, u.message)
+		}
+	}
+	return acks
+}
+
+// size returns the number of acknowledgements not sent yet.
+func (m *statusUpdateManager) size() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.pending)
+}
+
+// sendAck sends the acknowledgement of a status update to target, it is
+// resent to the master later if it cannot be sent now.
+func (driver *MesosSchedulerDriver) sendAck(target *upid.UPID, ack *mesos.StatusUpdateAcknowledgementMessage) error {
+	if !driver.Connected() {
+		log.Infof("Not acknowledging the update of task %v now, disconnected from master.\n", ack.GetTaskId().GetValue())
+		driver.updates.failed(ack, driver.clock.Now())
+		return ErrNotConnected
+	}
+	log.V(2).Infoln("Sending status update ACK to ", target.String())
+	if err := driver.send(target, ack); err != nil {
+		driver.updates.failed(ack, driver.clock.Now())
+		return err
+	}
+	driver.updates.acked(ack.GetUuid())
+	return nil
+}
+
+// resendAcks resends the acknowledgements that are due, all of them if
+// all is true, e.g. once the driver registered again. They are sent to
+// the master, the slave they were meant to may be unreachable.
+func (driver *MesosSchedulerDriver) resendAcks(all bool) {
+	for _, ack := range driver.updates.due(driver.clock.Now(), all) {
+		if !driver.Connected() {
+			return
+		}
+		driver.metrics().Increment(MetricAcksResent)
+		if err := driver.sendAck(driver.masterPid(), ack); err != nil {
+			log.Warningf("Failed to resend StatusUpdate ACK message: %v\n", err)
+		}
+	}
+}
+
+// ackRetryLoop resends the acknowledgements that are due every interval
+// until the driver stops.
+func (driver *MesosSchedulerDriver) ackRetryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-driver.stopCh:
+			return
+		case <-ticker.C:
+			if driver.Connected() {
+				driver.resendAcks(false)
+			}
+		}
+	}
+}
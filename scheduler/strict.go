@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var devStrict = flag.Bool("mesos_dev_strict", false,
+	"Panic on misuses of the driver instead of returning a status, for development: offers modified after ResourceOffers, calls while the driver is not running and status updates acknowledged twice")
+
+// strictChecks is what the calls of the framework are checked against
+// with mesos_dev_strict, the driver has none otherwise.
+type strictChecks struct {
+	lock   sync.Mutex
+	offers map[string]uint64            // digests of the offers handed to ResourceOffers, key:OfferID
+	acked  map[string]*mesos.TaskStatus // last update acknowledged, key:TaskID
+}
+
+func newStrictChecks() *strictChecks {
+	return &strictChecks{
+		offers: make(map[string]uint64),
+		acked:  make(map[string]*mesos.TaskStatus),
+	}
+}
+
+func offerDigest(offer *mesos.Offer) uint64 {
+	b, _ := proto.Marshal(offer)
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// misused returns err, the failure of a call made while the driver is not
+// in a state to handle it, unless mesos_dev_strict, which panics with it.
+func (driver *MesosSchedulerDriver) misused(err error) error {
+	if driver.strict != nil {
+		panic("mesos_dev_strict: " + err.Error())
+	}
+	return err
+}
+
+// offersHanded records the digests of the offers about to be handed to
+// ResourceOffers, those of the offers no longer cached are forgotten.
+func (driver *MesosSchedulerDriver) offersHanded(offers []*mesos.Offer) {
+	if driver.strict == nil {
+		return
+	}
+	s := driver.strict
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for offerId := range s.offers {
+		if driver.cache.savedOffers.get(offerId) == nil {
+			delete(s.offers, offerId)
+		}
+	}
+	for _, offer := range offers {
+		s.offers[offer.GetId().GetValue()] = offerDigest(offer)
+	}
+}
+
+// checkOffers panics if one of the cached offers was modified since it
+// was handed to ResourceOffers.
+func (driver *MesosSchedulerDriver) checkOffers(offerIds []*mesos.OfferID) {
+	if driver.strict == nil {
+		return
+	}
+	s := driver.strict
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, offerId := range offerIds {
+		digest, ok := s.offers[offerId.GetValue()]
+		entry := driver.cache.getOffer(offerId)
+		if !ok || entry == nil {
+			continue
+		}
+		if offerDigest(entry.offer) != digest {
+			panic(fmt.Sprintf("mesos_dev_strict: offer %s was modified after it was handed to ResourceOffers", offerId.GetValue()))
+		}
+		delete(s.offers, offerId.GetValue())
+	}
+}
+
+// acknowledged records the update the framework acknowledged.
+func (driver *MesosSchedulerDriver) acknowledged(status *mesos.TaskStatus) {
+	if driver.strict == nil {
+		return
+	}
+	driver.strict.lock.Lock()
+	driver.strict.acked[status.GetTaskId().GetValue()] = status
+	driver.strict.lock.Unlock()
+}
+
+// checkAcknowledged panics if status, which awaits no acknowledgement,
+// is the last update of its task acknowledged by the framework.
+func (driver *MesosSchedulerDriver) checkAcknowledged(status *mesos.TaskStatus) {
+	if driver.strict == nil {
+		return
+	}
+	driver.strict.lock.Lock()
+	acked, ok := driver.strict.acked[status.GetTaskId().GetValue()]
+	driver.strict.lock.Unlock()
+	if ok && (&pendingAck{status: acked}).matches(status) {
+		panic(fmt.Sprintf("mesos_dev_strict: the %v update of task %v is acknowledged twice", status.GetState(), status.GetTaskId().GetValue()))
+	}
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var taskCacheSnapshotInterval = flag.Duration("mesos_task_cache_snapshot_interval", time.Minute,
+	"Interval at which the scheduler driver saves its task cache to the TaskCacheStore, 0 to only save it on shutdown")
+
+// TaskCacheStore persists the last status of the tasks that are not
+// terminal, so that a driver restarted with the framework ID of its
+// predecessor only reconciles those tasks with the master. The task cache
+// is kept along the ordering of the status updates, it requires
+// mesos_ordered_status_updates.
+type TaskCacheStore interface {
+	// Load returns the saved statuses, nil if none were saved.
+	Load() ([]*mesos.TaskStatus, error)
+	Save(statuses []*mesos.TaskStatus) error
+}
+
+// FileTaskCacheStore is a TaskCacheStore keeping the statuses in a file.
+type FileTaskCacheStore struct {
+	path string
+}
+
+func NewFileTaskCacheStore(path string) *FileTaskCacheStore {
+	return &FileTaskCacheStore{path: path}
+}
+
+func (s *FileTaskCacheStore) Load() ([]*mesos.TaskStatus, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var statuses []*mesos.TaskStatus
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// Save replaces the file at once, a crash while saving leaves the
+// previous statuses in place.
+func (s *FileTaskCacheStore) Save(statuses []*mesos.TaskStatus) error {
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err0 := f.Close(); err == nil {
+		err = err0
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// snapshot returns the last status delivered for the tasks that are not
+// terminal.
+func (o *statusOrder) snapshot() []*mesos.TaskStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var statuses []*mesos.TaskStatus
+	for _, entry := range o.delivered {
+		if !isTerminalState(entry.status.GetState()) {
+			statuses = append(statuses, entry.status)
+		}
+	}
+	return statuses
+}
+
+// preload records statuses saved by a previous driver as unverified,
+// until an update for their task is accepted.
+func (o *statusOrder) preload(statuses []*mesos.TaskStatus) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, status := range statuses {
+		taskId := status.GetTaskId().GetValue()
+		if _, ok := o.delivered[taskId]; taskId == "" || ok {
+			continue
+		}
+		o.delivered[taskId] = &deliveredStatus{status: status, at: time.Now(), unverified: true}
+	}
+}
+
+// unverified returns the preloaded statuses no update was accepted for.
+func (o *statusOrder) unverified() []*mesos.TaskStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var statuses []*mesos.TaskStatus
+	for _, entry := range o.delivered {
+		if entry.unverified {
+			statuses = append(statuses, entry.status)
+		}
+	}
+	return statuses
+}
+
+// restoreTaskCache preloads the task cache saved by a previous driver of
+// the framework. The restored tasks are reconciled once registered, all
+// tasks are if the saved cache cannot be loaded.
+func (driver *MesosSchedulerDriver) restoreTaskCache() {
+	if driver.TaskCacheStore == nil || driver.statusOrder == nil || driver.frameworkId().GetValue() == "" {
+		return
+	}
+	statuses, err := driver.TaskCacheStore.Load()
+	driver.lock.Lock()
+	driver.restorePending = true
+	driver.restoreAll = err != nil
+	driver.lock.Unlock()
+	if err != nil {
+		log.Errorf("Failed to load the task cache, reconciling all tasks: %v\n", err)
+		return
+	}
+	log.Infof("Restored the status of %d tasks\n", len(statuses))
+	driver.statusOrder.preload(statuses)
+}
+
+// reconcileRestoredTasks reconciles the tasks restored by
+// restoreTaskCache, once.
+func (driver *MesosSchedulerDriver) reconcileRestoredTasks() {
+	driver.lock.Lock()
+	pending, all := driver.restorePending, driver.restoreAll
+	driver.restorePending = false
+	driver.lock.Unlock()
+	if !pending {
+		return
+	}
+
+	var statuses []*mesos.TaskStatus
+	if !all {
+		if statuses = driver.statusOrder.unverified(); len(statuses) == 0 {
+			return
+		}
+	}
+	// no statuses asks the master for all the tasks.
+	if _, _, err := driver.ReconcileTasksAsync(statuses); err != nil {
+		log.Errorf("Failed to reconcile the restored tasks: %v\n", err)
+	}
+}
+
+// saveTaskCache saves the status of the tasks that are not terminal.
+func (driver *MesosSchedulerDriver) saveTaskCache() {
+	if driver.TaskCacheStore == nil || driver.statusOrder == nil {
+		return
+	}
+	if err := driver.TaskCacheStore.Save(driver.statusOrder.snapshot()); err != nil {
+		log.Errorf("Failed to save the task cache: %v\n", err)
+	}
+}
+
+// taskCacheLoop saves the task cache every interval until the driver
+// stops.
+func (driver *MesosSchedulerDriver) taskCacheLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-driver.stopCh:
+			return
+		case <-ticker.C:
+			driver.saveTaskCache()
+		}
+	}
+}
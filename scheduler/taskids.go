@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+var (
+	taskIDReuseCooldown = flag.Duration("mesos_task_id_reuse_cooldown", 5*time.Minute,
+		"Time after a task became terminal during which launching another task with its ID logs a warning, 0 never warns")
+	allowTaskIDReuse = flag.Bool("mesos_allow_task_id_reuse", false,
+		"Only warn, instead of refusing to launch it, when a task reuses the ID of a task that is not terminal")
+)
+
+// taskIDs tracks the state of the tasks of the framework by ID, from
+// their launch or their first status update on, whether or not the
+// updates are ordered. A terminal task is forgotten once
+// mesos_task_id_reuse_cooldown passed.
+type taskIDs struct {
+	lock   sync.Mutex
+	tasks  map[string]taskIDState // key:TaskID
+	pruned time.Time
+}
+
+type taskIDState struct {
+	state mesos.TaskState
+	at    time.Time // of the last update, or of the launch
+}
+
+func newTaskIDs() *taskIDs {
+	return &taskIDs{tasks: make(map[string]taskIDState)}
+}
+
+// update records the state of a task reported by a status update. A
+// terminal task stays terminal: a retried update from before may be
+// received after the last one.
+func (ids *taskIDs) update(taskId *mesos.TaskID, state mesos.TaskState, at time.Time) {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	if last, ok := ids.tasks[taskId.GetValue()]; ok && isTerminalState(last.state) && !isTerminalState(state) {
+		return
+	}
+	ids.tasks[taskId.GetValue()] = taskIDState{state: state, at: at}
+}
+
+// launched records a task launched by the driver.
+func (ids *taskIDs) launched(taskId *mesos.TaskID, at time.Time) {
+	ids.lock.Lock()
+	ids.tasks[taskId.GetValue()] = taskIDState{state: mesos.TaskState_TASK_STAGING, at: at}
+	ids.lock.Unlock()
+}
+
+// get returns the last state of a task, ok is false if it is unknown.
+func (ids *taskIDs) get(taskId *mesos.TaskID) (state mesos.TaskState, at time.Time, ok bool) {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	s, ok := ids.tasks[taskId.GetValue()]
+	return s.state, s.at, ok
+}
+
+// live tells whether a task is known and not terminal.
+func (ids *taskIDs) live(taskId *mesos.TaskID) bool {
+	state, _, ok := ids.get(taskId)
+	return ok && !isTerminalState(state)
+}
+
+// prune forgets the tasks terminal for cooldown, at most once a cooldown.
+func (ids *taskIDs) prune(now time.Time, cooldown time.Duration) {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	if now.Sub(ids.pruned) < cooldown {
+		return
+	}
+	ids.pruned = now
+	for id, s := range ids.tasks {
+		if isTerminalState(s.state) && now.Sub(s.at) >= cooldown {
+			delete(ids.tasks, id)
+		}
+	}
+}
+
+// checkTaskID checks that the ID of a task to launch is not the one of
+// another task of the framework, see taskIDs.
+//
+// Reusing the ID of a task that is not terminal fails, unless
+// mesos_allow_task_id_reuse is set. Reusing it shortly after the task
+// became terminal only warns: the updates of the previous task may still
+// be retried by its slave.
+func (driver *MesosSchedulerDriver) checkTaskID(task *mesos.TaskInfo) error {
+	state, at, ok := driver.taskIDs.get(task.GetTaskId())
+	if !ok {
+		return nil
+	}
+	if !isTerminalState(state) {
+		err := fmt.Errorf("Task ID %s is in use by a task in state %s.", task.TaskId.GetValue(), state)
+		if !driver.allowTaskIDReuse {
+			return err
+		}
+		log.Warningf("Launching task anyway: %v\n", err)
+		driver.metrics().Increment(MetricTaskIDReused)
+		return nil
+	}
+	if since := driver.clock.Now().Sub(at); since < driver.taskIDReuseCooldown {
+		log.Warningf("Task ID %s is reused %v after its previous task became %s.\n",
+			task.TaskId.GetValue(), since, state)
+		driver.metrics().Increment(MetricTaskIDReused)
+	}
+	return nil
+}
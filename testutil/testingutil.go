@@ -53,6 +53,25 @@ func NewMockMasterHttpServer(t *testing.T, handler func(rsp http.ResponseWriter,
 	return &MockMesosHttpServer{PID: pid, Addr: addr, server: server, t: t}
 }
 
+// NewMockMasterHttpServerIPv6 is like NewMockMasterHttpServer, but the
+// server listens on the IPv6 loopback address.
+func NewMockMasterHttpServerIPv6(t *testing.T, handler func(rsp http.ResponseWriter, req *http.Request)) *MockMesosHttpServer {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	server.Listener.Close()
+	server.Listener = ln
+	server.Start()
+	addr := server.Listener.Addr().String()
+	pid, err := upid.Parse("master@" + addr)
+	assert.NoError(t, err)
+	assert.NotNil(t, pid)
+	log.Infoln("Created test Master http server with PID", pid.String())
+	return &MockMesosHttpServer{PID: pid, Addr: addr, server: server, t: t}
+}
+
 func NewMockSlaveHttpServer(t *testing.T, handler func(rsp http.ResponseWriter, req *http.Request)) *MockMesosHttpServer {
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	assert.NotNil(t, server)
@@ -19,9 +19,21 @@
 package upid
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strings"
+	"time"
+)
+
+// probeTimeout bounds the attempt to connect to each address of a host
+// in Resolve.
+const probeTimeout = time.Second
+
+// replaced by tests.
+var (
+	lookupHost  = net.LookupHost
+	dialTimeout = net.DialTimeout
 )
 
 // UPID is a equivalent of the UPID in libprocess.
@@ -41,19 +53,20 @@ func Parse(input string) (*UPID, error) {
 	}
 	upid.ID = splits[0]
 
-	if _, err := net.ResolveTCPAddr("tcp4", splits[1]); err != nil {
+	if _, err := net.ResolveTCPAddr("tcp", splits[1]); err != nil {
 		return nil, err
 	}
 	upid.Host, upid.Port, _ = net.SplitHostPort(splits[1])
 	return upid, nil
 }
 
-// String returns the string representation.
+// String returns the string representation, IPv6 hosts are enclosed
+// in square brackets.
 func (u *UPID) String() string {
 	if u == nil {
 		return ""
 	}
-	return fmt.Sprintf("%s@%s:%s", u.ID, u.Host, u.Port)
+	return fmt.Sprintf("%s@%s", u.ID, net.JoinHostPort(u.Host, u.Port))
 }
 
 // Equal returns true if two upid is equal
@@ -64,3 +77,61 @@ func (u *UPID) Equal(upid *UPID) bool {
 		return upid != nil && u.ID == upid.ID && u.Host == upid.Host && u.Port == upid.Port
 	}
 }
+
+// MarshalJSON encodes the UPID as its string form, id@host:port. The
+// zero UPID is encoded as an empty string.
+func (u UPID) MarshalJSON() ([]byte, error) {
+	if u == (UPID{}) {
+		return json.Marshal("")
+	}
+	return json.Marshal(u.String())
+}
+
+// UnmarshalJSON decodes a UPID encoded by MarshalJSON, see Parse.
+func (u *UPID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("UPID must be a string, got %s", data)
+	}
+	if s == "" {
+		*u = UPID{}
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return fmt.Errorf("Invalid UPID %q: %v", s, err)
+	}
+	*u = *parsed
+	return nil
+}
+
+// Resolve returns a copy of the UPID whose Host is an IP address, the
+// Host is looked up in the DNS unless it already is one. When the host
+// has several addresses, the first one, in the order of the resolver,
+// that accepts a TCP connection on Port is selected, or the first one if
+// none does.
+func (u *UPID) Resolve() (*UPID, error) {
+	resolved := *u
+	if net.ParseIP(u.Host) != nil {
+		return &resolved, nil
+	}
+	addrs, err := lookupHost(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No address found for host %s", u.Host)
+	}
+	resolved.Host = addrs[0]
+	if len(addrs) > 1 {
+		for _, addr := range addrs {
+			conn, err := dialTimeout("tcp", net.JoinHostPort(addr, u.Port), probeTimeout)
+			if err == nil {
+				conn.Close()
+				resolved.Host = addr
+				break
+			}
+		}
+	}
+	return &resolved, nil
+}
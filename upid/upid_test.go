@@ -1,9 +1,13 @@
 package upid
 
 import (
+	"encoding/json"
+	"errors"
 	"math/rand"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -49,6 +53,43 @@ func TestUPIDString(t *testing.T) {
 	assert.Equal(t, "mesos@localhost:5050", u.String())
 }
 
+func TestUPIDParseIPv6(t *testing.T) {
+	u, err := Parse("master@[::1]:5050")
+	assert.NoError(t, err)
+	assert.Equal(t, "master", u.ID)
+	assert.Equal(t, "::1", u.Host)
+	assert.Equal(t, "5050", u.Port)
+	assert.Equal(t, "master@[::1]:5050", u.String())
+
+	u, err = Parse("master@::1:5050")
+	assert.Nil(t, u)
+	assert.Error(t, err)
+}
+
+func TestUPIDRoundTripIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		host  string
+	}{
+		{"master@[::1]:5050", "::1"},
+		{"master@[0:0:0:0:0:0:0:1]:5050", "0:0:0:0:0:0:0:1"},
+		{"slave(1)@[2001:db8::10]:5051", "2001:db8::10"},
+		{"scheduler(1)@[::ffff:127.0.0.1]:5052", "::ffff:127.0.0.1"},
+		{"master@127.0.0.1:5050", "127.0.0.1"},
+	} {
+		u, err := Parse(tc.input)
+		if !assert.NoError(t, err, tc.input) {
+			continue
+		}
+		assert.Equal(t, tc.host, u.Host, tc.input)
+		assert.Equal(t, tc.input, u.String(), tc.input)
+
+		again, err := Parse(u.String())
+		assert.NoError(t, err, tc.input)
+		assert.True(t, u.Equal(again), tc.input)
+	}
+}
+
 func TestUPIDEqual(t *testing.T) {
 	u1, err := Parse("mesos@localhost:5050")
 	u2, err := Parse("mesos@localhost:5050")
@@ -65,3 +106,120 @@ func TestUPIDEqual(t *testing.T) {
 	assert.False(t, (*UPID)(nil).Equal(u5))
 	assert.True(t, (*UPID)(nil).Equal(nil))
 }
+
+func TestUPIDResolve(t *testing.T) {
+	defer func(lookup func(string) ([]string, error)) { lookupHost = lookup }(lookupHost)
+
+	// an IP is not looked up.
+	lookupHost = func(string) ([]string, error) {
+		t.Fatal("unexpected lookup")
+		return nil, nil
+	}
+	u := &UPID{ID: "master", Host: "127.0.0.1", Port: "5050"}
+	r, err := u.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, u, r)
+
+	// the first address accepting connections is selected.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	lookupHost = func(host string) ([]string, error) {
+		assert.Equal(t, "mesos.example.com", host)
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+	var dialed []string
+	defer func(dial func(string, string, time.Duration) (net.Conn, error)) { dialTimeout = dial }(dialTimeout)
+	dialTimeout = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if strings.HasPrefix(addr, "127.0.0.2:") {
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout(network, addr, timeout)
+	}
+	u = &UPID{ID: "master", Host: "mesos.example.com", Port: port}
+	r, err = u.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, &UPID{ID: "master", Host: "127.0.0.1", Port: port}, r)
+	assert.Equal(t, "mesos.example.com", u.Host)
+	assert.Equal(t, []string{"127.0.0.2:" + port, "127.0.0.1:" + port}, dialed)
+
+	// none is reachable, the first one is selected.
+	dialTimeout = func(string, string, time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	r, err = u.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.2", r.Host)
+
+	// a single address is not probed.
+	dialed = nil
+	dialTimeout = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("connection refused")
+	}
+	lookupHost = func(string) ([]string, error) { return []string{"127.0.0.3"}, nil }
+	r, err = u.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.3", r.Host)
+	assert.Empty(t, dialed)
+
+	lookupHost = func(string) ([]string, error) { return nil, errors.New("no such host") }
+	r, err = u.Resolve()
+	assert.Nil(t, r)
+	assert.Error(t, err)
+}
+
+func TestUPIDJSON(t *testing.T) {
+	u := &UPID{ID: "master", Host: "127.0.0.1", Port: "5050"}
+	data, err := json.Marshal(u)
+	assert.NoError(t, err)
+	assert.Equal(t, `"master@127.0.0.1:5050"`, string(data))
+
+	var v UPID
+	assert.NoError(t, json.Unmarshal(data, &v))
+	assert.True(t, u.Equal(&v))
+
+	data, err = json.Marshal(&UPID{ID: "master", Host: "::1", Port: "5050"})
+	assert.NoError(t, err)
+	assert.Equal(t, `"master@[::1]:5050"`, string(data))
+	assert.NoError(t, json.Unmarshal(data, &v))
+	assert.Equal(t, UPID{ID: "master", Host: "::1", Port: "5050"}, v)
+
+	// the zero UPID round-trips.
+	data, err = json.Marshal(UPID{})
+	assert.NoError(t, err)
+	assert.Equal(t, `""`, string(data))
+	assert.NoError(t, json.Unmarshal(data, &v))
+	assert.Equal(t, UPID{}, v)
+
+	for _, bad := range []string{`"mesos@foo:bar"`, `"master"`, `5050`, `{}`} {
+		err = json.Unmarshal([]byte(bad), &v)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestUPIDJSONField(t *testing.T) {
+	type state struct {
+		Master   *UPID `json:"master"`
+		Previous UPID  `json:"previous"`
+		Missing  *UPID `json:"missing"`
+	}
+	in := state{
+		Master:   &UPID{ID: "master", Host: "127.0.0.1", Port: "5050"},
+		Previous: UPID{ID: "master", Host: "127.0.0.2", Port: "5050"},
+	}
+	data, err := json.Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"master":"master@127.0.0.1:5050","previous":"master@127.0.0.2:5050","missing":null}`, string(data))
+
+	var out state
+	assert.NoError(t, json.Unmarshal(data, &out))
+	assert.Equal(t, in, out)
+
+	err = json.Unmarshal([]byte(`{"master":"master@127.0.0.1"}`), &out)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `Invalid UPID "master@127.0.0.1"`)
+	}
+}